@@ -59,7 +59,8 @@ func main() {
 	uart.LineBuffered = true
 	bus := sim.NewBus(ram, uart)
 	cpu := sim.NewCPU(bus)
-	cpu.Trace = true // show disassembly
+	cpu.Trace = true      // show disassembly
+	cpu.HaltOnTrap = true // the final ECALL ends the program
 
 	// Place message bytes at 0x200
 	msg := []byte("Hello, RV32!\n\x00")
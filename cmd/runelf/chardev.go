@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"rv32sim/sim"
+)
+
+// portFlags collects repeated -vcon flags.
+type portFlags []string
+
+func (p *portFlags) String() string     { return strings.Join(*p, ",") }
+func (p *portFlags) Set(s string) error { *p = append(*p, s); return nil }
+
+// openPort parses a -vcon spec, [NAME=]KIND[:PATH], and opens the host side
+// of the port:
+//
+//	stdio      the simulator's stdin and stdout; only one port may use it,
+//	           and not together with -stdin or -raw
+//	file:PATH  guest output goes to PATH (created or truncated); no input
+//	pipe:PATH  named pipes PATH.in (input) and PATH.out (output), as QEMU
+//	           uses them; opening waits until the other ends are opened
+//	unix:PATH  a connection to the Unix-domain socket PATH
+func openPort(spec string) (sim.ConsolePort, error) {
+	var port sim.ConsolePort
+	port.Name, spec = splitPortName(spec)
+	kind, path, _ := strings.Cut(spec, ":")
+	if kind != "stdio" && path == "" {
+		return port, fmt.Errorf("%q needs a path", kind)
+	}
+	switch kind {
+	case "stdio":
+		port.RW = struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout}
+	case "file":
+		f, err := os.Create(path)
+		if err != nil {
+			return port, err
+		}
+		port.RW = struct {
+			io.Reader
+			io.Writer
+		}{strings.NewReader(""), f}
+	case "pipe":
+		in, err := os.Open(path + ".in")
+		if err != nil {
+			return port, err
+		}
+		out, err := os.OpenFile(path+".out", os.O_WRONLY, 0)
+		if err != nil {
+			in.Close()
+			return port, err
+		}
+		port.RW = struct {
+			io.Reader
+			io.Writer
+		}{in, out}
+	case "unix":
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			return port, err
+		}
+		port.RW = conn
+	default:
+		return port, fmt.Errorf("unknown port kind %q (want stdio, file, pipe or unix)", kind)
+	}
+	return port, nil
+}
+
+// splitPortName splits the optional NAME= prefix off a -vcon spec.
+func splitPortName(spec string) (name, rest string) {
+	if eq := strings.IndexByte(spec, '='); eq >= 0 && !strings.Contains(spec[:eq], ":") {
+		return spec[:eq], spec[eq+1:]
+	}
+	return "", spec
+}
+
+// readsStdin reports whether a -vcon spec takes its input from stdin.
+func readsStdin(spec string) bool {
+	_, rest := splitPortName(spec)
+	return rest == "stdio"
+}
@@ -2,8 +2,20 @@
 //
 // Tiny ELF runner for the teaching RV32 simulator.
 // - Loads an ELF (built by user/hello) into RAM via sim.LoadELF32
-// - Runs the CPU until it halts (ECALL) or a step limit is reached
+// - Runs the CPU until it halts (ECALL, or any trap with -halt-on-trap),
+//   the program writes the test finisher at 0x1010_0000, or a step limit
+//   is reached
+// - A Goldfish RTC at 0x1010_1000 counts virtual time from -rtc-epoch
+//   (or reads host time with -rtc host)
+// - Entropy devices (-virtio-rng and the RNG register at 0x1010_2000) are
+//   fed from a PRNG seeded by -seed unless -host-entropy is given
 // - Prints the UART output *after* execution to avoid interleaving
+// - Exit status: 0 on an ECALL halt or a finisher pass, the low 8 bits of
+//   the finisher's fail code (1 if those are 0), 2 if the step limit was
+//   hit, 3 for a finisher reset, which is not simulated, 16 + mcause (or
+//   scause) for a halt on any other trap, e.g. 18 for an illegal
+//   instruction, 4 if the hart stopped otherwise (a WFI nothing can
+//   wake), and 5 if an otherwise clean run could not write its -pcap file
 //
 // NOTE: The import path "rv32sim/sim" assumes your go.mod has:  module rv32sim
 //       If your module is named differently, change the import below accordingly.
@@ -11,34 +23,284 @@
 package main
 
 import (
+	crand "crypto/rand"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"os/signal"
+	"time"
 
 	"rv32sim/sim"
 )
 
-func main() {
+// console is what the runner needs from either UART model.
+type console interface {
+	sim.Device
+	sim.Clocked
+	SetInput(r io.Reader)
+	String() string
+}
+
+func main() { os.Exit(run()) }
+
+// run is the runner itself; it returns the exit status so that deferred
+// cleanup happens before the process exits.
+func run() (status int) {
 	elfPath := flag.String("elf", "build/hello/hello.elf", "path to ELF file to run")
 	ramKB := flag.Uint("ramkb", 64, "RAM size in KiB")
 	steps := flag.Int("steps", 500000, "max instructions to execute before giving up")
 	trace := flag.Bool("trace", false, "enable CPU trace (disassembly) to stderr")
+	isaStr := flag.String("isa", "rv32i", "ISA string to emulate, e.g. rv32i, rv32gc or rv32im_zba_zbb")
+	lenient := flag.Bool("lenient", false, "warn about and skip illegal instructions instead of trapping")
+	haltOnTrap := flag.Bool("halt-on-trap", true, "stop on any trap (including the final ECALL) instead of entering the mtvec handler")
+	pmpEntries := flag.Int("pmp-entries", 16, "number of PMP entries to implement, 0 to 64")
+	cpuHz := flag.Uint64("cpu-hz", 0, "virtual hart clock in Hz for the CLINT timer (0: mtime counts hart cycles)")
+	timebaseHz := flag.Uint64("timebase-hz", 10_000_000, "CLINT mtime frequency in Hz when -cpu-hz is set")
+	stdin := flag.Bool("stdin", false, "feed the UART receiver from stdin and print UART output as it is produced")
+	raw := flag.Bool("raw", false, "put the terminal in raw mode (implies -stdin)")
+	tlbStats := flag.Bool("tlbstats", false, "print TLB hit/miss statistics to stderr after the run")
+	disk := flag.String("disk", "", "disk image file for a virtio-blk device")
+	diskMode := flag.String("disk-mode", "rw", "how -disk handles writes: rw, ro (read-only device) or cow (kept in memory)")
+	netMode := flag.String("net", "", "add a virtio-net NIC: loopback (frames come back) or none (no peer)")
+	macStr := flag.String("mac", "52:54:00:12:34:56", "MAC address of the -net NIC")
+	pcapPath := flag.String("pcap", "", "record the NIC's frames to this pcap file (implies -net none if -net is not given)")
+	var vconPorts portFlags
+	flag.Var(&vconPorts, "vcon", "add a virtio-console port, [NAME=]stdio|file:PATH|pipe:PATH|unix:PATH (repeatable; the first is the console)")
+	rtcMode := flag.String("rtc", "virtual", "Goldfish RTC time source: virtual (from -rtc-epoch, advanced with -cpu-hz) or host")
+	rtcEpoch := flag.String("rtc-epoch", "2000-01-01T00:00:00Z", "RFC 3339 start time of the virtual RTC")
+	virtioRNG := flag.Bool("virtio-rng", false, "add a virtio-rng entropy device")
+	seed := flag.Uint64("seed", 1, "seed for the entropy devices, so runs are reproducible")
+	hostEntropy := flag.Bool("host-entropy", false, "feed the entropy devices from the host's random source instead of -seed")
+	uartModel := flag.String("uart", "simple", "console UART at 0x1000_0000: simple (teaching UART) or ns16550")
 	flag.Parse()
 
+	isa, err := sim.ParseISA(*isaStr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad -isa: %v\n", err)
+		return 1
+	}
+	if *pmpEntries < 0 || *pmpEntries > 64 {
+		fmt.Fprintf(os.Stderr, "bad -pmp-entries: %d (want 0 to 64)\n", *pmpEntries)
+		return 1
+	}
+
 	ram := sim.NewRAM(uint64(*ramKB) * 1024)
 
 	// Buffer UART output during execution to avoid mixing with trace.
 	// After the run, we print uart.String() in one go.
-	uart := sim.NewUART(nil)
+	// Interactive programs need their output live, not after the run.
+	interactive := *stdin || *raw
+	var uartOut io.Writer
+	if interactive {
+		uartOut = os.Stdout
+	}
+
+	bus := sim.NewBus(ram, nil)
+	cpu := sim.NewCPU(bus, isa)
+	cpu.Lenient = *lenient
+	cpu.HaltOnTrap = *haltOnTrap
+	cpu.PMPEntries = *pmpEntries
+
+	// CLINT at 0x0200_0000: mtime/mtimecmp timer and msip.
+	clint := sim.NewCLINT(cpu)
+	clint.CPUHz, clint.TimebaseHz = *cpuHz, *timebaseHz
+	if err := bus.Map("clint", sim.CLINTBase, sim.CLINTSize, clint); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// PLIC at 0x0C00_0000 with the UART on source 10.
+	plic := sim.NewPLIC(31, cpu)
+	if err := bus.Map("plic", sim.PLICBase, sim.PLICSize, plic); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// Test finisher at 0x1010_0000.
+	finisher := sim.NewTestFinisher(cpu)
+	if err := bus.Map("finisher", sim.FinisherBase, sim.FinisherSize, finisher); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// Goldfish RTC at 0x1010_1000 on PLIC source 11.
+	epoch, err := time.Parse(time.RFC3339, *rtcEpoch)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bad -rtc-epoch: %v\n", err)
+		return 1
+	}
+	rtc := sim.NewGoldfishRTC(epoch)
+	switch *rtcMode {
+	case "virtual":
+		rtc.CPUHz = *cpuHz
+	case "host":
+		rtc.Clock = time.Now
+	default:
+		fmt.Fprintf(os.Stderr, "bad -rtc: %q (want virtual or host)\n", *rtcMode)
+		return 1
+	}
+	rtc.IRQ = plic.Line(sim.GoldfishRTCIRQ)
+	if err := bus.Map("rtc", sim.GoldfishRTCBase, sim.GoldfishRTCSize, rtc); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cpu.AddClocked(rtc)
+
+	// Entropy devices share one source: seeded, or the host's on request.
+	entropy := sim.NewSeededEntropy(*seed)
+	if *hostEntropy {
+		entropy = crand.Reader
+	}
+
+	// RNG register at 0x1010_2000.
+	if err := bus.Map("rng", sim.RNGBase, sim.RNGSize, sim.NewRNG(entropy)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	// virtio-mmio devices take the slots at 0x1000_1000 + n*0x1000, on PLIC
+	// sources 1 + n, in the order below.
+	slot := 0
+	attachVirtio := func(name string, dev *sim.VirtioMMIO) {
+		if slot == sim.VirtioSlots {
+			fmt.Fprintf(os.Stderr, "%s: all %d virtio slots are in use\n", name, sim.VirtioSlots)
+			os.Exit(1)
+		}
+		dev.IRQ = plic.Line(sim.VirtioIRQ + slot)
+		if err := bus.Map(name, sim.VirtioBase+uint32(slot)*sim.VirtioSize, sim.VirtioSize, dev); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		slot++
+	}
+
+	if *disk != "" {
+		mode, ok := map[string]sim.DiskMode{
+			"rw": sim.DiskReadWrite, "ro": sim.DiskReadOnly, "cow": sim.DiskCopyOnWrite,
+		}[*diskMode]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "bad -disk-mode: %q (want rw, ro or cow)\n", *diskMode)
+			return 1
+		}
+		blk, err := sim.OpenVirtioBlk(*disk, mode)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "disk: %v\n", err)
+			return 1
+		}
+		attachVirtio("virtio-blk", sim.NewVirtioMMIO(bus, blk))
+	}
 
-	bus := sim.NewBus(ram, uart)
-	cpu := sim.NewCPU(bus)
+	if *netMode != "" || *pcapPath != "" {
+		var backend sim.NetBackend
+		switch *netMode {
+		case "loopback":
+			backend = &sim.NetLoopback{}
+		case "", "none":
+		default:
+			fmt.Fprintf(os.Stderr, "bad -net: %q (want loopback or none)\n", *netMode)
+			return 1
+		}
+		hw, err := net.ParseMAC(*macStr)
+		if err != nil || len(hw) != 6 {
+			fmt.Fprintf(os.Stderr, "bad -mac: %q\n", *macStr)
+			return 1
+		}
+		if *pcapPath != "" {
+			f, err := os.Create(*pcapPath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "pcap: %v\n", err)
+				return 1
+			}
+			pcap, err := sim.NewNetPcap(f, backend)
+			// A capture that was cut short fails an otherwise clean run.
+			defer func() {
+				if err == nil {
+					err = pcap.Err()
+				}
+				if cerr := f.Close(); err == nil {
+					err = cerr
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "pcap: %v\n", err)
+					if status == 0 {
+						status = 5
+					}
+				}
+			}()
+			if err != nil {
+				return 1
+			}
+			backend = pcap
+		}
+		nic := sim.NewVirtioNet([6]byte(hw), backend)
+		attachVirtio("virtio-net", sim.NewVirtioMMIO(bus, nic))
+		cpu.AddClocked(nic)
+	}
+
+	if len(vconPorts) > 0 {
+		// Only one device may read stdin, or keystrokes are split between
+		// them at random.
+		stdinUsed := interactive
+		for _, spec := range vconPorts {
+			if !readsStdin(spec) {
+				continue
+			}
+			if stdinUsed {
+				fmt.Fprintf(os.Stderr, "bad -vcon %q: stdin is already read by -stdin, -raw or another stdio port\n", spec)
+				return 1
+			}
+			stdinUsed = true
+		}
+		var ports []sim.ConsolePort
+		for _, spec := range vconPorts {
+			port, err := openPort(spec)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "bad -vcon %q: %v\n", spec, err)
+				return 1
+			}
+			ports = append(ports, port)
+		}
+		vcon := sim.NewVirtioConsole(ports...)
+		attachVirtio("virtio-console", sim.NewVirtioMMIO(bus, vcon))
+		cpu.AddClocked(vcon)
+	}
+
+	if *virtioRNG {
+		attachVirtio("virtio-rng", sim.NewVirtioMMIO(bus, sim.NewVirtioRNG(entropy)))
+	}
+
+	// Console UART at 0x1000_0000.
+	var uart console
+	var uartSize uint32
+	switch *uartModel {
+	case "simple":
+		u := sim.NewUART(uartOut)
+		u.IRQ = plic.Line(sim.UARTIRQ)
+		uart, uartSize = u, sim.UARTSize
+	case "ns16550":
+		u := sim.NewNS16550(uartOut)
+		u.IRQ = plic.Line(sim.UARTIRQ)
+		uart, uartSize = u, sim.NS16550Size
+	default:
+		fmt.Fprintf(os.Stderr, "bad -uart: %q (want simple or ns16550)\n", *uartModel)
+		return 1
+	}
+	if err := bus.Map("uart", sim.UARTBase, uartSize, uart); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if interactive {
+		uart.SetInput(os.Stdin)
+	}
+	cpu.AddClocked(uart)
 
 	// Load ELF → copy PT_LOAD segments to RAM, zero bss, return entry PC.
 	entry, err := sim.LoadELF32(*elfPath, ram)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "ELF load error: %v\n", err)
-		os.Exit(1)
+		return 1
 	}
 	cpu.PC = entry
 
@@ -49,6 +311,23 @@ func main() {
 		// cpu.TraceOut = os.Stderr
 	}
 
+	restoreTerm := func() {}
+	if *raw {
+		restore, err := rawTerminal()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "raw terminal: %v\n", err)
+			return 1
+		}
+		restoreTerm = restore
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt)
+		go func() {
+			<-sigs
+			restore()
+			os.Exit(130)
+		}()
+	}
+
 	// Run until ECALL (Step returns false) or we hit the step limit.
 	halted := false
 	for i := 0; i < *steps; i++ {
@@ -58,17 +337,53 @@ func main() {
 		}
 	}
 
+	restoreTerm()
+
+	if *tlbStats {
+		s := cpu.TLBStats()
+		fmt.Fprintf(os.Stderr, "tlb: %d hits, %d misses, %d flushes, %d page faults\n",
+			s.Hits, s.Misses, s.Flushes, s.PageFaults)
+	}
+
 	if !halted {
 		fmt.Fprintf(os.Stderr, "program did not halt within %d steps\n", *steps)
-		os.Exit(2)
+		return 2
+	}
+
+	// Interactive output was printed as it happened.
+	if !interactive {
+		// Print UART output cleanly after the run.
+		// This avoids interleaving with trace lines.
+		out := uart.String()
+		if len(out) > 0 && out[len(out)-1] != '\n' {
+			// be nice: end with a newline for terminal readability
+			out += "\n"
+		}
+		fmt.Print(out)
+	}
+
+	switch r := finisher.Result(); r.Kind {
+	case sim.FinishFail:
+		code := int(r.Code & 0xFF)
+		if code == 0 {
+			code = 1 // still a failure
+		}
+		return code
+	case sim.FinishReset:
+		fmt.Fprintln(os.Stderr, "reset requested; not supported")
+		return 3
+	case sim.FinishPass:
+		return 0
 	}
 
-	// Print UART output cleanly after the run.
-	// This avoids interleaving with trace lines.
-	out := uart.String()
-	if len(out) > 0 && out[len(out)-1] != '\n' {
-		// be nice: end with a newline for terminal readability
-		out += "\n"
+	// Without a finisher result only an ECALL counts as success.
+	cause, trapped := cpu.HaltCause()
+	switch {
+	case !trapped:
+		return 4
+	case cause == sim.CauseEcallU || cause == sim.CauseEcallS || cause == sim.CauseEcallM:
+		return 0
+	default:
+		return 16 + int(cause)
 	}
-	fmt.Print(out)
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// rawTerminal switches the terminal on stdin to character-at-a-time input
+// without echo, so the simulated UART sees every key press as it happens.
+// Ctrl-C still interrupts. It returns a function restoring the previous
+// settings. stty keeps this free of platform-specific ioctls.
+func rawTerminal() (restore func(), err error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return nil, err
+	}
+	return func() { _, _ = stty(strings.TrimSpace(saved)) }, nil
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return string(out), err
+}
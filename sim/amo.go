@@ -0,0 +1,122 @@
+package sim
+
+// execAMO executes one RV32A instruction (LR.W, SC.W, AMO*.W).
+// The simulator runs harts one instruction at a time, so every AMO is
+// trivially atomic and the aq/rl ordering bits need no extra work.
+//
+// It returns false if the instruction raised an exception.
+func (c *CPU) execAMO(inst uint32) bool {
+	rd := (inst >> 7) & 0x1F
+	f3 := (inst >> 12) & 0x7
+	rs1 := (inst >> 15) & 0x1F
+	rs2 := (inst >> 20) & 0x1F
+	f5 := inst >> 27
+
+	if f3 != f3AMOW || (f5 == f5LR && rs2 != 0) || amoName(f5) == "" {
+		return c.illegal()
+	}
+
+	addr := c.readReg(rs1)
+	acc := accStore // SC and AMOs raise store/AMO exceptions
+	if f5 == f5LR {
+		acc = accLoad
+	}
+	if addr&3 != 0 {
+		return c.exception(misalignedCause[acc], addr)
+	}
+
+	// Reservations are tracked on physical addresses, and an AMO translates
+	// once for both its read and its write.
+	pa, ok := c.translate(addr, acc)
+	if !ok {
+		return false
+	}
+
+	switch f5 {
+	case f5LR:
+		v, ok := c.physRead(pa, addr, 4, acc)
+		if !ok {
+			return false
+		}
+		c.Bus.Reserve(c.HartID, pa)
+		c.writeReg(rd, uint32(v))
+		return true
+	case f5SC:
+		ok := c.Bus.Reserved(c.HartID, pa)
+		c.Bus.ClearReservation(c.HartID)
+		if !ok {
+			c.writeReg(rd, 1) // failure
+			return true
+		}
+		if !c.physWrite(pa, addr, 4, uint64(c.readReg(rs2))) {
+			return false
+		}
+		c.writeReg(rd, 0) // success
+		return true
+	}
+
+	v, ok := c.physRead(pa, addr, 4, acc)
+	if !ok {
+		return false
+	}
+	old := uint32(v)
+	if !c.physWrite(pa, addr, 4, uint64(amoOp(f5, old, c.readReg(rs2)))) {
+		return false
+	}
+	c.writeReg(rd, old)
+	return true
+}
+
+// amoOp returns the value an AMO stores, given the loaded word a and rs2 b.
+func amoOp(f5, a, b uint32) uint32 {
+	switch f5 {
+	case f5AMOSWAP:
+		return b
+	case f5AMOADD:
+		return a + b
+	case f5AMOXOR:
+		return a ^ b
+	case f5AMOAND:
+		return a & b
+	case f5AMOOR:
+		return a | b
+	case f5AMOMIN:
+		return uint32(min(int32(a), int32(b)))
+	case f5AMOMAX:
+		return uint32(max(int32(a), int32(b)))
+	case f5AMOMINU:
+		return min(a, b)
+	default: // f5AMOMAXU
+		return max(a, b)
+	}
+}
+
+// amoName returns the mnemonic (without ordering suffix) for funct5, or ""
+// for a reserved encoding.
+func amoName(f5 uint32) string {
+	switch f5 {
+	case f5LR:
+		return "lr.w"
+	case f5SC:
+		return "sc.w"
+	case f5AMOSWAP:
+		return "amoswap.w"
+	case f5AMOADD:
+		return "amoadd.w"
+	case f5AMOXOR:
+		return "amoxor.w"
+	case f5AMOAND:
+		return "amoand.w"
+	case f5AMOOR:
+		return "amoor.w"
+	case f5AMOMIN:
+		return "amomin.w"
+	case f5AMOMAX:
+		return "amomax.w"
+	case f5AMOMINU:
+		return "amominu.w"
+	case f5AMOMAXU:
+		return "amomaxu.w"
+	}
+	return ""
+}
@@ -0,0 +1,123 @@
+package sim
+
+import "testing"
+
+func encAMO(f5, aqrl, rd, rs1, rs2 uint32) uint32 {
+	return f5<<27 | aqrl<<25 | rs2<<20 | rs1<<15 | f3AMOW<<12 | rd<<7 | opAMO
+}
+
+func TestAMO_LRSC(t *testing.T) {
+	cpu, ram := newTestCPU(t,
+		encI(OpOPIMM, 1, F3ADDI, x0, 0x300),
+		encI(OpOPIMM, 2, F3ADDI, x0, 99),
+		encAMO(f5LR, 0, 3, 1, 0), // lr.w x3, (x1)
+		encAMO(f5SC, 0, 4, 1, 2), // sc.w x4, x2, (x1)  -> success
+		encAMO(f5SC, 0, 5, 1, 2), // sc.w x5, x2, (x1)  -> fails, no reservation
+		instECALL,
+	)
+	cpu.ISA = ExtA
+	ram.WriteBytes(0x300, []byte{42, 0, 0, 0})
+	runToHalt(cpu, 100)
+
+	if cpu.Reg[3] != 42 {
+		t.Errorf("lr.w = %d, want 42", cpu.Reg[3])
+	}
+	if cpu.Reg[4] != 0 || cpu.Reg[5] != 1 {
+		t.Errorf("sc.w results = %d,%d want 0,1", cpu.Reg[4], cpu.Reg[5])
+	}
+	if v, _ := cpu.Bus.Read32(0x300); v != 99 {
+		t.Errorf("memory = %d, want 99", v)
+	}
+}
+
+func TestAMO_StoreInvalidatesReservation(t *testing.T) {
+	cpu, _ := newTestCPU(t,
+		encI(OpOPIMM, 1, F3ADDI, x0, 0x300),
+		encAMO(f5LR, 2, 3, 1, 0), // lr.w.aq x3, (x1)
+		encAMO(f5SC, 1, 4, 1, 1), // sc.w.rl x4, x1, (x1)
+		instECALL,
+	)
+	cpu.ISA = ExtA
+	cpu.Step()
+	cpu.Step()
+	// Another hart (or DMA) stores a byte into the reserved word.
+	cpu.Bus.Write8(0x302, 7)
+	runToHalt(cpu, 10)
+	if cpu.Reg[4] != 1 {
+		t.Fatalf("sc.w after conflicting store = %d, want 1 (fail)", cpu.Reg[4])
+	}
+	if v, _ := cpu.Bus.Read32(0x300); v != 0x00070000 {
+		t.Fatalf("memory = 0x%x, SC must not have written", v)
+	}
+
+	// Reservations are per hart.
+	bus := cpu.Bus
+	bus.Reserve(0, 0x400)
+	bus.Reserve(1, 0x404)
+	bus.Write32(0x404, 1)
+	if !bus.Reserved(0, 0x400) || bus.Reserved(1, 0x404) {
+		t.Fatalf("store to 0x404 must only invalidate hart 1")
+	}
+}
+
+func TestAMO_Ops(t *testing.T) {
+	neg := func(v int32) uint32 { return uint32(v) }
+	cases := []struct {
+		f5       uint32
+		mem, rs2 uint32
+		wantMem  uint32
+	}{
+		{f5AMOSWAP, 1, 2, 2},
+		{f5AMOADD, 1, 2, 3},
+		{f5AMOXOR, 0b1100, 0b1010, 0b0110},
+		{f5AMOAND, 0b1100, 0b1010, 0b1000},
+		{f5AMOOR, 0b1100, 0b1010, 0b1110},
+		{f5AMOMIN, neg(-5), 3, neg(-5)},
+		{f5AMOMAX, neg(-5), 3, 3},
+		{f5AMOMINU, neg(-5), 3, 3},
+		{f5AMOMAXU, neg(-5), 3, neg(-5)},
+	}
+	for _, tc := range cases {
+		cpu, _ := newTestCPU(t,
+			encI(OpOPIMM, 1, F3ADDI, x0, 0x300),
+			encAMO(tc.f5, 0, 3, 1, 2),
+			instECALL,
+		)
+		cpu.ISA = ExtA
+		cpu.Reg[2] = tc.rs2
+		cpu.Bus.Write32(0x300, tc.mem)
+		runToHalt(cpu, 10)
+		if cpu.Reg[3] != tc.mem {
+			t.Errorf("%s: rd = 0x%x, want old value 0x%x", amoName(tc.f5), cpu.Reg[3], tc.mem)
+		}
+		if v, _ := cpu.Bus.Read32(0x300); v != tc.wantMem {
+			t.Errorf("%s: mem = 0x%x, want 0x%x", amoName(tc.f5), v, tc.wantMem)
+		}
+	}
+}
+
+func TestAMO_MisalignedHalts(t *testing.T) {
+	cpu, _ := newTestCPU(t,
+		encI(OpOPIMM, 1, F3ADDI, x0, 0x302),
+		encAMO(f5AMOADD, 0, 3, 1, 1),
+	)
+	cpu.ISA = ExtA
+	cpu.Step()
+	if cpu.Step() {
+		t.Fatalf("misaligned amoadd.w should stop the hart")
+	}
+}
+
+func TestDisasm_AMO(t *testing.T) {
+	cases := map[uint32]string{
+		encAMO(f5LR, 2, a0, a1, 0):       "lr.w.aq a0, (a1)",
+		encAMO(f5SC, 1, a0, a1, t0):      "sc.w.rl a0, t0, (a1)",
+		encAMO(f5AMOMAXU, 3, a0, a1, t0): "amomaxu.w.aqrl a0, t0, (a1)",
+		encAMO(f5AMOADD, 0, x0, a1, t0):  "amoadd.w zero, t0, (a1)",
+	}
+	for inst, want := range cases {
+		if got := Disasm(0, inst); got != want {
+			t.Errorf("Disasm(0x%08x) = %q, want %q", inst, got, want)
+		}
+	}
+}
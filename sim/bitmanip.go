@@ -0,0 +1,142 @@
+package sim
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// Bit-manipulation extensions Zba, Zbb, Zbc and Zbs. All of them live in the
+// OP and OP-IMM opcodes and are told apart from the base instructions by
+// funct7 (imm[11:5] for the immediate forms) and, for the unary Zbb ops,
+// the rs2 field.
+
+// bitForm is the operand shape of a bit-manipulation instruction.
+type bitForm uint8
+
+const (
+	bitReg   bitForm = iota // rd, rs1, rs2
+	bitImm                  // rd, rs1, shamt
+	bitUnary                // rd, rs1
+)
+
+// bitOp describes one instruction: fn computes rd from rs1 and either rs2
+// or the 5-bit shift amount (unused by unary forms).
+type bitOp struct {
+	name string
+	ext  ISA
+	form bitForm
+	fn   func(a, b uint32) uint32
+}
+
+// bitKey selects an entry in bitOps. rs2 is anyRS2 unless the rs2 field is
+// part of the encoding.
+type bitKey struct{ op, f7, f3, rs2 uint32 }
+
+const anyRS2 = 0xFF
+
+var bitOps = map[bitKey]bitOp{
+	// Zba: address generation.
+	{opOP, 0x10, 2, anyRS2}: {"sh1add", ExtZba, bitReg, func(a, b uint32) uint32 { return a<<1 + b }},
+	{opOP, 0x10, 4, anyRS2}: {"sh2add", ExtZba, bitReg, func(a, b uint32) uint32 { return a<<2 + b }},
+	{opOP, 0x10, 6, anyRS2}: {"sh3add", ExtZba, bitReg, func(a, b uint32) uint32 { return a<<3 + b }},
+
+	// Zbb: basic bit manipulation.
+	{opOP, 0x20, 7, anyRS2}: {"andn", ExtZbb, bitReg, func(a, b uint32) uint32 { return a &^ b }},
+	{opOP, 0x20, 6, anyRS2}: {"orn", ExtZbb, bitReg, func(a, b uint32) uint32 { return a | ^b }},
+	{opOP, 0x20, 4, anyRS2}: {"xnor", ExtZbb, bitReg, func(a, b uint32) uint32 { return ^(a ^ b) }},
+	{opOP, 0x05, 4, anyRS2}: {"min", ExtZbb, bitReg, func(a, b uint32) uint32 { return uint32(min(int32(a), int32(b))) }},
+	{opOP, 0x05, 5, anyRS2}: {"minu", ExtZbb, bitReg, func(a, b uint32) uint32 { return min(a, b) }},
+	{opOP, 0x05, 6, anyRS2}: {"max", ExtZbb, bitReg, func(a, b uint32) uint32 { return uint32(max(int32(a), int32(b))) }},
+	{opOP, 0x05, 7, anyRS2}: {"maxu", ExtZbb, bitReg, func(a, b uint32) uint32 { return max(a, b) }},
+	{opOP, 0x30, 1, anyRS2}: {"rol", ExtZbb, bitReg, rol},
+	{opOP, 0x30, 5, anyRS2}: {"ror", ExtZbb, bitReg, ror},
+	{opOP, 0x04, 4, 0}:      {"zext.h", ExtZbb, bitUnary, func(a, _ uint32) uint32 { return a & 0xFFFF }},
+
+	{OpOPIMM, 0x30, 1, 0}:      {"clz", ExtZbb, bitUnary, func(a, _ uint32) uint32 { return uint32(bits.LeadingZeros32(a)) }},
+	{OpOPIMM, 0x30, 1, 1}:      {"ctz", ExtZbb, bitUnary, func(a, _ uint32) uint32 { return uint32(bits.TrailingZeros32(a)) }},
+	{OpOPIMM, 0x30, 1, 2}:      {"cpop", ExtZbb, bitUnary, func(a, _ uint32) uint32 { return uint32(bits.OnesCount32(a)) }},
+	{OpOPIMM, 0x30, 1, 4}:      {"sext.b", ExtZbb, bitUnary, func(a, _ uint32) uint32 { return uint32(int32(int8(a))) }},
+	{OpOPIMM, 0x30, 1, 5}:      {"sext.h", ExtZbb, bitUnary, func(a, _ uint32) uint32 { return uint32(int32(int16(a))) }},
+	{OpOPIMM, 0x30, 5, anyRS2}: {"rori", ExtZbb, bitImm, ror},
+	{OpOPIMM, 0x14, 5, 7}:      {"orc.b", ExtZbb, bitUnary, orcB},
+	{OpOPIMM, 0x34, 5, 0x18}:   {"rev8", ExtZbb, bitUnary, func(a, _ uint32) uint32 { return bits.ReverseBytes32(a) }},
+
+	// Zbc: carry-less multiplication.
+	{opOP, 0x05, 1, anyRS2}: {"clmul", ExtZbc, bitReg, func(a, b uint32) uint32 { return uint32(clmul(a, b)) }},
+	{opOP, 0x05, 3, anyRS2}: {"clmulh", ExtZbc, bitReg, func(a, b uint32) uint32 { return uint32(clmul(a, b) >> 32) }},
+	{opOP, 0x05, 2, anyRS2}: {"clmulr", ExtZbc, bitReg, func(a, b uint32) uint32 { return uint32(clmul(a, b) >> 31) }},
+
+	// Zbs: single-bit operations.
+	{opOP, 0x14, 1, anyRS2}:    {"bset", ExtZbs, bitReg, bset},
+	{opOP, 0x24, 1, anyRS2}:    {"bclr", ExtZbs, bitReg, bclr},
+	{opOP, 0x34, 1, anyRS2}:    {"binv", ExtZbs, bitReg, binv},
+	{opOP, 0x24, 5, anyRS2}:    {"bext", ExtZbs, bitReg, bext},
+	{OpOPIMM, 0x14, 1, anyRS2}: {"bseti", ExtZbs, bitImm, bset},
+	{OpOPIMM, 0x24, 1, anyRS2}: {"bclri", ExtZbs, bitImm, bclr},
+	{OpOPIMM, 0x34, 1, anyRS2}: {"binvi", ExtZbs, bitImm, binv},
+	{OpOPIMM, 0x24, 5, anyRS2}: {"bexti", ExtZbs, bitImm, bext},
+}
+
+// decodeBitmanip looks up inst in bitOps. ok is false for anything that is
+// not a Zba/Zbb/Zbc/Zbs encoding, whether or not the extension is enabled.
+func decodeBitmanip(inst uint32) (bitOp, bool) {
+	k := bitKey{inst & 0x7F, inst >> 25, inst >> 12 & 7, inst >> 20 & 0x1F}
+	if op, ok := bitOps[k]; ok {
+		return op, true
+	}
+	k.rs2 = anyRS2
+	op, ok := bitOps[k]
+	return op, ok
+}
+
+// execBitmanip writes op(a, b) to rd if op's extension is enabled; otherwise
+// the instruction is illegal. It returns false if it raised an exception.
+func (c *CPU) execBitmanip(inst uint32, op bitOp, a, b uint32) bool {
+	if !c.ISA.Has(op.ext) {
+		return c.illegal()
+	}
+	c.writeReg(inst>>7&0x1F, op.fn(a, b))
+	return true
+}
+
+// disasmBitmanip formats op according to its operand shape.
+func disasmBitmanip(inst uint32, op bitOp) string {
+	rd, rs1, rs2 := inst>>7&0x1F, inst>>15&0x1F, inst>>20&0x1F
+	switch op.form {
+	case bitReg:
+		return fmt.Sprintf("%-5s %s, %s, %s", op.name, rn(rd), rn(rs1), rn(rs2))
+	case bitImm:
+		return fmt.Sprintf("%-5s %s, %s, %d", op.name, rn(rd), rn(rs1), rs2)
+	}
+	return fmt.Sprintf("%-5s %s, %s", op.name, rn(rd), rn(rs1))
+}
+
+func rol(a, b uint32) uint32 { return bits.RotateLeft32(a, int(b&31)) }
+func ror(a, b uint32) uint32 { return bits.RotateLeft32(a, -int(b&31)) }
+
+func bset(a, b uint32) uint32 { return a | 1<<(b&31) }
+func bclr(a, b uint32) uint32 { return a &^ (1 << (b & 31)) }
+func binv(a, b uint32) uint32 { return a ^ 1<<(b&31) }
+func bext(a, b uint32) uint32 { return a >> (b & 31) & 1 }
+
+// orcB sets each byte to 0xFF if it is nonzero, 0x00 otherwise.
+func orcB(a, _ uint32) uint32 {
+	var r uint32
+	for i := 0; i < 32; i += 8 {
+		if a>>i&0xFF != 0 {
+			r |= 0xFF << i
+		}
+	}
+	return r
+}
+
+// clmul returns the full 64-bit carry-less product of a and b.
+func clmul(a, b uint32) uint64 {
+	var r uint64
+	for i := 0; i < 32; i++ {
+		if b>>i&1 != 0 {
+			r ^= uint64(a) << i
+		}
+	}
+	return r
+}
@@ -0,0 +1,108 @@
+package sim
+
+import "testing"
+
+func TestBitmanip_Results(t *testing.T) {
+	const zb = ExtZba | ExtZbb | ExtZbc | ExtZbs
+	neg := func(v int32) uint32 { return uint32(v) }
+	cases := []struct {
+		inst uint32
+		a, b uint32
+		want uint32
+	}{
+		{encR(3, 2, 1, 2, 0x10), 3, 100, 106},                                   // sh1add
+		{encR(3, 6, 1, 2, 0x10), 3, 100, 124},                                   // sh3add
+		{encR(3, 7, 1, 2, 0x20), 0xFF, 0x0F, 0xF0},                              // andn
+		{encR(3, 6, 1, 2, 0x20), 0, 0xFFFF0000, 0x0000FFFF},                     // orn
+		{encR(3, 4, 1, 2, 0x20), 0xF0F0F0F0, 0xFF00FF00, 0xF00FF00F},            // xnor
+		{encR(3, 4, 1, 2, 0x05), neg(-5), 3, neg(-5)},                           // min
+		{encR(3, 5, 1, 2, 0x05), neg(-5), 3, 3},                                 // minu
+		{encR(3, 6, 1, 2, 0x05), neg(-5), 3, 3},                                 // max
+		{encR(3, 7, 1, 2, 0x05), neg(-5), 3, neg(-5)},                           // maxu
+		{encR(3, 1, 1, 2, 0x30), 0x80000001, 33, 0x00000003},                    // rol (shift mod 32)
+		{encR(3, 5, 1, 2, 0x30), 0x00000003, 1, 0x80000001},                     // ror
+		{encR(3, 4, 1, 0, 0x04), 0x12345678, 0, 0x5678},                         // zext.h
+		{encI(OpOPIMM, 3, 1, 1, 0x600), 0x00010000, 0, 15},                      // clz
+		{encI(OpOPIMM, 3, 1, 1, 0x600), 0, 0, 32},                               // clz 0
+		{encI(OpOPIMM, 3, 1, 1, 0x601), 0x00010000, 0, 16},                      // ctz
+		{encI(OpOPIMM, 3, 1, 1, 0x602), 0xF00F0001, 0, 9},                       // cpop
+		{encI(OpOPIMM, 3, 1, 1, 0x604), 0x00000080, 0, 0xFFFFFF80},              // sext.b
+		{encI(OpOPIMM, 3, 1, 1, 0x605), 0x00008000, 0, 0xFFFF8000},              // sext.h
+		{encI(OpOPIMM, 3, 5, 1, 4, 0x30), 0x0000001F, 0, 0xF0000001},            // rori
+		{encI(OpOPIMM, 3, 5, 1, 0x287), 0x00120300, 0, 0x00FFFF00},              // orc.b
+		{encI(OpOPIMM, 3, 5, 1, 0x698), 0x12345678, 0, 0x78563412},              // rev8
+		{encR(3, 1, 1, 2, 0x05), 0x80000001, 3, 0x80000003},                     // clmul
+		{encR(3, 3, 1, 2, 0x05), 0x80000000, 0x80000000, 0x40000000},            // clmulh
+		{encR(3, 2, 1, 2, 0x05), 0x80000000, 0x80000000, 0x80000000},            // clmulr
+		{encR(3, 1, 1, 2, 0x14), 0, 31, 0x80000000},                             // bset
+		{encR(3, 1, 1, 2, 0x24), 0xFF, 3, 0xF7},                                 // bclr
+		{encR(3, 1, 1, 2, 0x34), 0xFF, 8, 0x1FF},                                // binv
+		{encR(3, 5, 1, 2, 0x24), 0x10, 4, 1},                                    // bext
+		{encI(OpOPIMM, 3, 1, 1, 5, 0x14), 0, 0, 0x20},                           // bseti
+		{encI(OpOPIMM, 3, 1, 1, 0, 0x24), 0xFF, 0, 0xFE},                        // bclri
+		{encI(OpOPIMM, 3, 1, 1, 31, 0x34), 0, 0, 0x80000000},                    // binvi
+		{encI(OpOPIMM, 3, 5, 1, 31, 0x24), 0x80000000, 0, 1},                    // bexti
+		{encR(3, 1, 1, 2, 0), 1, 4, 16},                                         // base sll still works
+		{encI(OpOPIMM, 3, 5, 1, 4, funct7SUBSRA), 0x80000000, 0, neg(-1 << 27)}, // base srai
+	}
+	for _, tc := range cases {
+		cpu, _ := newTestCPU(t, tc.inst, instECALL)
+		cpu.ISA = zb
+		cpu.Reg[1], cpu.Reg[2] = tc.a, tc.b
+		runToHalt(cpu, 10)
+		if cpu.Reg[3] != tc.want {
+			t.Errorf("%s with (0x%x, 0x%x) = 0x%08x, want 0x%08x", Disasm(0, tc.inst), tc.a, tc.b, cpu.Reg[3], tc.want)
+		}
+	}
+}
+
+func TestBitmanip_PerExtension(t *testing.T) {
+	sh1add := encR(3, 2, 1, 2, 0x10)
+	cpu, _ := newTestCPU(t, sh1add, instECALL)
+	cpu.ISA = ExtZbb | ExtZbc | ExtZbs
+	cpu.Reg[1], cpu.Reg[2] = 1, 1
+	runToHalt(cpu, 10)
+	if cpu.Reg[3] != 0 {
+		t.Fatalf("sh1add executed without Zba: x3 = %d", cpu.Reg[3])
+	}
+
+	cpu, _ = newTestCPU(t, sh1add, instECALL)
+	cpu.ISA = ExtZba
+	cpu.Reg[1], cpu.Reg[2] = 1, 1
+	runToHalt(cpu, 10)
+	if cpu.Reg[3] != 3 {
+		t.Fatalf("sh1add with Zba = %d, want 3", cpu.Reg[3])
+	}
+
+	isa, err := ParseISA("rv32imc_zba_zbs")
+	if err != nil || isa != ExtM|ExtC|ExtZba|ExtZbs {
+		t.Fatalf("ParseISA = (%v, %v)", isa, err)
+	}
+	if s := isa.String(); s != "rv32imc_zba_zbs" {
+		t.Fatalf("String() = %q", s)
+	}
+	if isa, err := ParseISA("rv32i_zicsr_zbb"); err != nil || isa != ExtZbb {
+		t.Fatalf("ParseISA(rv32i_zicsr_zbb) = (%v, %v)", isa, err)
+	}
+	if _, err := ParseISA("rv32i_zbx"); err == nil {
+		t.Fatalf("unknown multi-letter extension should be rejected")
+	}
+}
+
+func TestDisasm_Bitmanip(t *testing.T) {
+	cases := map[uint32]string{
+		encR(a0, 2, a1, a0, 0x10):          "sh1add a0, a1, a0",
+		encR(a0, 7, a0, a1, 0x20):          "andn  a0, a0, a1",
+		encI(OpOPIMM, a0, 1, a1, 0x600):    "clz   a0, a1",
+		encI(OpOPIMM, a0, 5, a0, 0x698):    "rev8  a0, a0",
+		encI(OpOPIMM, a0, 1, a0, 0x604):    "sext.b a0, a0",
+		encI(OpOPIMM, a0, 1, a0, 7, 0x14):  "bseti a0, a0, 7",
+		encI(OpOPIMM, t0, 5, t0, 12, 0x30): "rori  t0, t0, 12",
+		encR(a0, 4, a0, 0, 0x04):           "zext.h a0, a0",
+	}
+	for inst, want := range cases {
+		if got := Disasm(0, inst); got != want {
+			t.Errorf("Disasm(0x%08x) = %q, want %q", inst, got, want)
+		}
+	}
+}
@@ -1,64 +1,172 @@
 package sim
 
-// Memory map (teaching-simple)
+import (
+	"fmt"
+	"sort"
+)
+
+// Memory map (teaching-simple). NewBus maps RAM at 0 and the UART at
+// UARTBase; the test finisher (FinisherBase), RTC (GoldfishRTCBase), RNG
+// register (RNGBase), CLINT (CLINTBase) and PLIC (PLICBase) are attached
+// with Map when a platform needs them.
 const (
 	UARTBase uint32 = 0x1000_0000
 )
 
-// Bus routes byte/word requests to RAM or UART.
-//   - Read32/Write32 are little-endian, alignment required for 32-bit.
+// Bus routes byte/halfword/word/doubleword requests through an address map
+// of Devices.
+//   - Read16/Write16, Read32/Write32 and Read64/Write64 are little-endian
+//     and require natural alignment (2, 4 and 8 bytes respectively).
+//   - An access must fall entirely inside one mapped region; anything else
+//     fails (an access fault for the CPU).
+//   - The bus also holds the LR/SC reservation of each hart: any store
+//     that goes through the bus to a reserved word invalidates it.
 type Bus struct {
 	RAM  *RAM
 	UART *UART
+
+	regions []region          // sorted by base, non-overlapping
+	resv    map[uint32]uint32 // hart ID -> reserved word address
 }
 
-func NewBus(ram *RAM, uart *UART) *Bus { return &Bus{RAM: ram, UART: uart} }
+// region is one entry of the address map.
+type region struct {
+	name string
+	base uint32
+	size uint32
+	dev  Device
+}
 
-func (b *Bus) Read8(addr uint32) (uint8, bool) {
-	// RAM: 0 .. RAM.Size()-1
-	if addr < b.RAM.Size() {
-		return b.RAM.Read8(addr)
+func (r *region) end() uint64 { return uint64(r.base) + uint64(r.size) }
+
+// NewBus returns a bus with ram mapped at 0 and uart at UARTBase. uart may
+// be nil for machines that map another console there, e.g. an NS16550.
+// RAM that would reach the UART is mapped only up to UARTBase; the rest
+// is not addressable.
+func NewBus(ram *RAM, uart *UART) *Bus {
+	b := &Bus{RAM: ram, UART: uart}
+	size := ram.Size()
+	if uart != nil {
+		size = min(size, UARTBase)
+		b.Map("uart", UARTBase, UARTSize, uart)
 	}
-	// UART region
-	if addr >= UARTBase && addr < UARTBase+UARTSize {
-		return b.UART.Read8(addr - UARTBase)
+	if size > 0 {
+		b.Map("ram", 0, size, ram) // cannot overlap the UART now
 	}
-	return 0, false
+	return b
 }
 
-func (b *Bus) Write8(addr uint32, v uint8) bool {
-	if addr < b.RAM.Size() {
-		return b.RAM.Write8(addr, v)
+// Map attaches d to the address range [base, base+size). It fails if the
+// range is empty, wraps past 4 GiB or overlaps a region already mapped.
+func (b *Bus) Map(name string, base, size uint32, d Device) error {
+	r := region{name: name, base: base, size: size, dev: d}
+	if size == 0 || r.end() > 1<<32 {
+		return fmt.Errorf("bus: %s: bad region 0x%08x+0x%x", name, base, size)
+	}
+	i := sort.Search(len(b.regions), func(i int) bool { return b.regions[i].base >= base })
+	if i > 0 && b.regions[i-1].end() > uint64(base) {
+		o := b.regions[i-1]
+		return fmt.Errorf("bus: %s at 0x%08x overlaps %s at 0x%08x", name, base, o.name, o.base)
 	}
-	if addr >= UARTBase && addr < UARTBase+UARTSize {
-		return b.UART.Write8(addr-UARTBase, v)
+	if i < len(b.regions) && r.end() > uint64(b.regions[i].base) {
+		o := b.regions[i]
+		return fmt.Errorf("bus: %s at 0x%08x overlaps %s at 0x%08x", name, base, o.name, o.base)
 	}
-	return false
+	b.regions = append(b.regions, region{})
+	copy(b.regions[i+1:], b.regions[i:])
+	b.regions[i] = r
+	return nil
 }
 
-func (b *Bus) Read32(addr uint32) (uint32, bool) {
-	if addr&3 != 0 {
+// find returns the region holding [addr, addr+size), or nil.
+func (b *Bus) find(addr, size uint32) *region {
+	i := sort.Search(len(b.regions), func(i int) bool { return b.regions[i].end() > uint64(addr) })
+	if i == len(b.regions) {
+		return nil
+	}
+	r := &b.regions[i]
+	if addr < r.base || uint64(addr)+uint64(size) > r.end() {
+		return nil
+	}
+	return r
+}
+
+// read performs a naturally aligned access of size bytes.
+func (b *Bus) read(addr, size uint32) (uint64, bool) {
+	if addr&(size-1) != 0 {
 		return 0, false // require alignment
 	}
-	var v uint32
-	for i := 0; i < 4; i++ {
-		bb, ok := b.Read8(addr + uint32(i))
-		if !ok {
-			return 0, false
-		}
-		v |= uint32(bb) << (8 * i) // little-endian
+	r := b.find(addr, size)
+	if r == nil {
+		return 0, false
 	}
-	return v, true
+	return r.dev.Read(addr-r.base, size)
 }
 
-func (b *Bus) Write32(addr uint32, v uint32) bool {
-	if addr&3 != 0 {
+func (b *Bus) write(addr, size uint32, v uint64) bool {
+	if addr&(size-1) != 0 {
+		return false
+	}
+	r := b.find(addr, size)
+	if r == nil {
 		return false
 	}
-	for i := 0; i < 4; i++ {
-		if !b.Write8(addr+uint32(i), uint8(v>>(8*i))) {
-			return false
+	b.invalidate(addr)
+	if size == 8 {
+		b.invalidate(addr + 4)
+	}
+	return r.dev.Write(addr-r.base, size, v)
+}
+
+func (b *Bus) Read8(addr uint32) (uint8, bool) {
+	v, ok := b.read(addr, 1)
+	return uint8(v), ok
+}
+
+func (b *Bus) Write8(addr uint32, v uint8) bool { return b.write(addr, 1, uint64(v)) }
+
+func (b *Bus) Read16(addr uint32) (uint16, bool) {
+	v, ok := b.read(addr, 2)
+	return uint16(v), ok
+}
+
+func (b *Bus) Write16(addr uint32, v uint16) bool { return b.write(addr, 2, uint64(v)) }
+
+func (b *Bus) Read32(addr uint32) (uint32, bool) {
+	v, ok := b.read(addr, 4)
+	return uint32(v), ok
+}
+
+func (b *Bus) Write32(addr uint32, v uint32) bool { return b.write(addr, 4, uint64(v)) }
+
+func (b *Bus) Read64(addr uint32) (uint64, bool) { return b.read(addr, 8) }
+
+func (b *Bus) Write64(addr uint32, v uint64) bool { return b.write(addr, 8, v) }
+
+// Reserve registers an LR reservation for hart on the word containing addr,
+// replacing any reservation the hart held before.
+func (b *Bus) Reserve(hart, addr uint32) {
+	if b.resv == nil {
+		b.resv = make(map[uint32]uint32)
+	}
+	b.resv[hart] = addr &^ 3
+}
+
+// Reserved reports whether hart still holds a reservation on the word
+// containing addr.
+func (b *Bus) Reserved(hart, addr uint32) bool {
+	r, ok := b.resv[hart]
+	return ok && r == addr&^3
+}
+
+// ClearReservation drops hart's reservation (SC always does this).
+func (b *Bus) ClearReservation(hart uint32) { delete(b.resv, hart) }
+
+// invalidate drops every reservation covering the word that contains addr.
+func (b *Bus) invalidate(addr uint32) {
+	for h, r := range b.resv {
+		if r == addr&^3 {
+			delete(b.resv, h)
 		}
 	}
-	return true
 }
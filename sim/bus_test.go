@@ -0,0 +1,125 @@
+package sim
+
+import "testing"
+
+func TestBus_Read16Write16(t *testing.T) {
+	ram := NewRAM(16)
+	bus := NewBus(ram, NewUART(nil))
+
+	if !bus.Write16(4, 0xBEEF) {
+		t.Fatalf("Write16 aligned failed")
+	}
+	// Little-endian byte order.
+	if b, _ := ram.Read8(4); b != 0xEF {
+		t.Fatalf("low byte = 0x%02x, want 0xef", b)
+	}
+	if b, _ := ram.Read8(5); b != 0xBE {
+		t.Fatalf("high byte = 0x%02x, want 0xbe", b)
+	}
+	if h, ok := bus.Read16(4); !ok || h != 0xBEEF {
+		t.Fatalf("Read16 = (0x%04x,%v), want (0xbeef,true)", h, ok)
+	}
+
+	// Misaligned and out-of-bounds accesses fail.
+	if _, ok := bus.Read16(5); ok {
+		t.Fatalf("Read16 unaligned should fail")
+	}
+	if bus.Write16(5, 1) {
+		t.Fatalf("Write16 unaligned should fail")
+	}
+	if _, ok := bus.Read16(16); ok {
+		t.Fatalf("Read16 out-of-bounds should fail")
+	}
+}
+
+func TestBus_Read64Write64(t *testing.T) {
+	ram := NewRAM(16)
+	bus := NewBus(ram, NewUART(nil))
+
+	if !bus.Write64(8, 0x0123456789ABCDEF) {
+		t.Fatalf("Write64 aligned failed")
+	}
+	if w, _ := bus.Read32(8); w != 0x89ABCDEF {
+		t.Fatalf("low word = 0x%08x, want 0x89abcdef", w)
+	}
+	if d, ok := bus.Read64(8); !ok || d != 0x0123456789ABCDEF {
+		t.Fatalf("Read64 = (0x%016x,%v)", d, ok)
+	}
+	if _, ok := bus.Read64(4); ok {
+		t.Fatalf("Read64 unaligned should fail")
+	}
+	if bus.Write64(16, 1) {
+		t.Fatalf("Write64 out-of-bounds should fail")
+	}
+}
+
+// regDev records the last access it saw.
+type regDev struct {
+	off, size uint32
+	val       uint64
+}
+
+func (d *regDev) Read(off, size uint32) (uint64, bool) {
+	d.off, d.size = off, size
+	return d.val, off < 0x10
+}
+
+func (d *regDev) Write(off, size uint32, v uint64) bool {
+	d.off, d.size, d.val = off, size, v
+	return off < 0x10
+}
+
+func TestBus_LargeRAMStopsAtUART(t *testing.T) {
+	uart := NewUART(nil)
+	bus := NewBus(NewRAM(uint64(UARTBase)+0x1000), uart)
+	if !bus.Write8(UARTBase-1, 0x5A) {
+		t.Errorf("RAM below the UART not mapped")
+	}
+	if !bus.Write8(UARTBase+UARTData, 'u') || uart.String() != "u" {
+		t.Errorf("store to UARTBase did not reach the UART")
+	}
+	if _, ok := bus.Read8(UARTBase + UARTSize); ok {
+		t.Errorf("RAM past the UART is addressable")
+	}
+}
+
+func TestBus_MapDevices(t *testing.T) {
+	bus := NewBus(NewRAM(0x1000), NewUART(nil))
+	dev := &regDev{}
+	if err := bus.Map("regs", 0x4000_0000, 0x100, dev); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		base, size uint32
+	}{
+		{0x4000_00F0, 0x20},      // overlaps the end of regs
+		{0x3FFF_FF00, 0x101},     // overlaps its start
+		{0x0000_0800, 0x10},      // inside RAM
+		{UARTBase - 0x10, 0x100}, // covers the UART
+		{0xFFFF_FF00, 0x200},     // wraps
+		{0x5000_0000, 0},         // empty
+	} {
+		if err := bus.Map("bad", tc.base, tc.size, dev); err == nil {
+			t.Errorf("Map(0x%08x, 0x%x) accepted", tc.base, tc.size)
+		}
+	}
+	if err := bus.Map("next", 0x4000_0100, 0x100, &regDev{}); err != nil {
+		t.Errorf("adjacent region rejected: %v", err)
+	}
+
+	// Accesses reach the device with their size and relative offset.
+	if !bus.Write32(0x4000_0008, 0xDEADBEEF) || dev.off != 8 || dev.size != 4 || dev.val != 0xDEADBEEF {
+		t.Errorf("Write32 reached device as off=%d size=%d val=0x%x", dev.off, dev.size, dev.val)
+	}
+	if v, ok := bus.Read16(0x4000_0002); !ok || dev.size != 2 || v != 0xDEADBEEF&0xFFFF {
+		t.Errorf("Read16 = 0x%x size=%d", v, dev.size)
+	}
+	if _, ok := bus.Read8(0x4000_0010); ok {
+		t.Errorf("device access fault not reported")
+	}
+	// Accesses running past the end of a region fail.
+	bus.Map("short", 0x6000_0000, 6, dev)
+	if _, ok := bus.Read64(0x6000_0000); ok {
+		t.Errorf("8-byte read of a 6-byte region succeeded")
+	}
+}
@@ -0,0 +1,163 @@
+package sim
+
+import "math/bits"
+
+// CLINT register layout (SiFive-compatible).
+const (
+	CLINTBase uint32 = 0x0200_0000
+	CLINTSize        = 0x10000
+
+	clintMsip     = 0x0000 // 4 bytes per hart; bit 0 drives MSIP
+	clintMtimecmp = 0x4000 // 8 bytes per hart
+	clintMtime    = 0xBFF8 // 8 bytes, shared
+)
+
+// CLINT is the core-local interruptor: a shared 64-bit mtime counter plus
+// a per-hart mtimecmp (MTIP is raised while mtime >= mtimecmp) and msip
+// (bit 0 is the hart's MSIP line).
+//
+// Time is driven by the first hart's cycle counter (the CLINT registers
+// itself with it as a Clocked device). By default mtime ticks once per
+// hart cycle, i.e. it counts retired instructions plus trap and WFI idle
+// cycles. Set CPUHz and TimebaseHz to run mtime at a virtual frequency
+// instead: TimebaseHz ticks per CPUHz cycles.
+//
+// All registers are byte-addressable, so 32-bit harts update the 64-bit
+// ones one word at a time.
+type CLINT struct {
+	CPUHz      uint64
+	TimebaseHz uint64
+
+	harts    []*CPU
+	msip     []uint32
+	mtimecmp []uint64
+
+	base   uint64 // mtime at the last write to mtime
+	cycles uint64 // hart cycles since then
+}
+
+// NewCLINT returns a CLINT for the given harts; hart i of the CLINT is
+// harts[i]. Every mtimecmp resets to the maximum value (no timer).
+func NewCLINT(harts ...*CPU) *CLINT {
+	k := &CLINT{
+		harts:    harts,
+		msip:     make([]uint32, len(harts)),
+		mtimecmp: make([]uint64, len(harts)),
+	}
+	for i := range k.mtimecmp {
+		k.mtimecmp[i] = ^uint64(0)
+	}
+	if len(harts) > 0 {
+		harts[0].AddClocked(k)
+	}
+	return k
+}
+
+// Mtime returns the current value of mtime.
+func (k *CLINT) Mtime() uint64 {
+	if k.CPUHz == 0 || k.TimebaseHz == 0 {
+		return k.base + k.cycles
+	}
+	hi, lo := bits.Mul64(k.cycles, k.TimebaseHz)
+	q, _ := bits.Div64(hi%k.CPUHz, lo, k.CPUHz)
+	return k.base + q
+}
+
+// cyclesFor returns how many hart cycles it takes mtime to advance by ticks.
+func (k *CLINT) cyclesFor(ticks uint64) uint64 {
+	if k.CPUHz == 0 || k.TimebaseHz == 0 {
+		return ticks
+	}
+	// Target tick count since base, converted back and rounded up.
+	target := k.Mtime() - k.base + ticks
+	hi, lo := bits.Mul64(target, k.CPUHz)
+	lo, carry := bits.Add64(lo, k.TimebaseHz-1, 0)
+	hi += carry
+	if hi >= k.TimebaseHz {
+		return ^uint64(0)
+	}
+	q, _ := bits.Div64(hi, lo, k.TimebaseHz)
+	return q - k.cycles
+}
+
+// Advance implements Clocked.
+func (k *CLINT) Advance(n uint64) {
+	k.cycles += n
+	k.update()
+}
+
+// NextEvent implements Clocked: the cycles until the nearest mtimecmp that
+// mtime has not reached yet.
+func (k *CLINT) NextEvent() (uint64, bool) {
+	now := k.Mtime()
+	var next uint64
+	found := false
+	for _, cmp := range k.mtimecmp {
+		if cmp <= now || cmp == ^uint64(0) {
+			continue
+		}
+		if n := k.cyclesFor(cmp - now); !found || n < next {
+			next, found = n, true
+		}
+	}
+	return next, found
+}
+
+// update drives every hart's MTIP and MSIP lines.
+func (k *CLINT) update() {
+	now := k.Mtime()
+	for i, c := range k.harts {
+		c.SetInterrupt(IRQMTimer, now >= k.mtimecmp[i])
+		c.SetInterrupt(IRQMSoft, k.msip[i]&1 != 0)
+	}
+}
+
+// reg locates the register containing byte off: an msip word, an mtimecmp,
+// or mtime. shift is the byte's bit position within that register.
+func (k *CLINT) reg(off uint32) (msip *uint32, cmp *uint64, mtime bool, shift uint32) {
+	switch {
+	case off < clintMsip+4*uint32(len(k.harts)):
+		return &k.msip[off/4], nil, false, 8 * (off % 4)
+	case off >= clintMtimecmp && off < clintMtimecmp+8*uint32(len(k.harts)):
+		return nil, &k.mtimecmp[(off-clintMtimecmp)/8], false, 8 * (off % 8)
+	case off >= clintMtime && off < clintMtime+8:
+		return nil, nil, true, 8 * (off % 8)
+	}
+	return nil, nil, false, 0
+}
+
+func (k *CLINT) Read8(off uint32) (uint8, bool) {
+	if off >= CLINTSize {
+		return 0, false
+	}
+	msip, cmp, mtime, sh := k.reg(off)
+	switch {
+	case msip != nil:
+		return uint8(*msip >> sh), true
+	case cmp != nil:
+		return uint8(*cmp >> sh), true
+	case mtime:
+		return uint8(k.Mtime() >> sh), true
+	}
+	return 0, true // reserved: reads as zero
+}
+
+func (k *CLINT) Write8(off uint32, v uint8) bool {
+	if off >= CLINTSize {
+		return false
+	}
+	msip, cmp, mtime, sh := k.reg(off)
+	switch {
+	case msip != nil:
+		if sh == 0 {
+			*msip = uint32(v & 1) // only bit 0 is implemented
+		}
+	case cmp != nil:
+		*cmp = *cmp&^(0xFF<<sh) | uint64(v)<<sh
+	case mtime:
+		t := k.Mtime()
+		k.base, k.cycles = t&^(0xFF<<sh)|uint64(v)<<sh, 0
+	}
+	k.update()
+	return true
+}
@@ -0,0 +1,156 @@
+package sim
+
+import "testing"
+
+func TestCLINT_Registers(t *testing.T) {
+	ram := NewRAM(4096)
+	bus := NewBus(ram, NewUART(nil))
+	h0, h1 := NewCPU(bus), NewCPU(bus)
+	h1.HartID = 1
+	clint := NewCLINT(h0, h1)
+	if err := bus.Map("clint", CLINTBase, CLINTSize, clint); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := bus.Read64(CLINTBase + clintMtimecmp + 8); v != ^uint64(0) {
+		t.Errorf("mtimecmp1 reset = 0x%x", v)
+	}
+
+	// msip: only bit 0, per hart.
+	bus.Write32(CLINTBase+4, 0xFFFFFFFF)
+	if v, _ := bus.Read32(CLINTBase + 4); v != 1 {
+		t.Errorf("msip1 = 0x%x, want 1", v)
+	}
+	if csr(t, h1, CSRMip)&mipMSIP == 0 || csr(t, h0, CSRMip)&mipMSIP != 0 {
+		t.Errorf("msip1 drove the wrong hart's MSIP")
+	}
+	bus.Write32(CLINTBase+4, 0)
+	if csr(t, h1, CSRMip)&mipMSIP != 0 {
+		t.Errorf("MSIP not cleared")
+	}
+
+	// mtime is writable word by word and advances with hart 0's cycles.
+	bus.Write32(CLINTBase+clintMtime, 0xFFFFFFF0)
+	bus.Write32(CLINTBase+clintMtime+4, 1)
+	h0.advance(0x20)
+	if v, _ := bus.Read64(CLINTBase + clintMtime); v != 0x2_0000_0010 {
+		t.Errorf("mtime = 0x%x, want 0x200000010", v)
+	}
+
+	// MTIP follows mtime >= mtimecmp.
+	bus.Write32(CLINTBase+clintMtimecmp+4, 2)
+	bus.Write32(CLINTBase+clintMtimecmp, 0x18)
+	if csr(t, h0, CSRMip)&mipMTIP != 0 {
+		t.Errorf("MTIP raised before mtimecmp")
+	}
+	h0.advance(8)
+	if csr(t, h0, CSRMip)&mipMTIP == 0 || csr(t, h1, CSRMip)&mipMTIP != 0 {
+		t.Errorf("MTIP not raised at mtimecmp (or raised on hart 1)")
+	}
+	bus.Write32(CLINTBase+clintMtimecmp+4, 0xFFFFFFFF)
+	if csr(t, h0, CSRMip)&mipMTIP != 0 {
+		t.Errorf("MTIP not cleared by a later mtimecmp")
+	}
+
+	if _, ok := bus.Read8(CLINTBase + CLINTSize); ok {
+		t.Errorf("access past the CLINT succeeded")
+	}
+	if v, ok := bus.Read32(CLINTBase + 0x8000); !ok || v != 0 {
+		t.Errorf("reserved CLINT word = (0x%x, %v)", v, ok)
+	}
+}
+
+func TestCLINT_VirtualFrequency(t *testing.T) {
+	cpu, _ := newTestCPU(t)
+	clint := NewCLINT(cpu)
+	clint.CPUHz, clint.TimebaseHz = 100_000_000, 10_000_000 // 10 cycles per tick
+	cpu.advance(95)
+	if v := clint.Mtime(); v != 9 {
+		t.Errorf("mtime after 95 cycles = %d, want 9", v)
+	}
+	clint.mtimecmp[0] = 20
+	if n, ok := clint.NextEvent(); !ok || n != 105 {
+		t.Errorf("NextEvent = %d, %v; want 105 cycles", n, ok)
+	}
+	cpu.advance(105)
+	if csr(t, cpu, CSRMip)&mipMTIP == 0 {
+		t.Errorf("MTIP not raised after NextEvent cycles")
+	}
+	if _, ok := clint.NextEvent(); ok {
+		t.Errorf("event reported for an expired mtimecmp")
+	}
+}
+
+// A timer-interrupt handler program: arm mtimecmp, sleep in WFI, count the
+// interrupt and disarm the timer from the handler.
+func TestCLINT_TimerInterruptWithWFI(t *testing.T) {
+	const (
+		t1 = 6
+		s0 = 8
+	)
+	cpu, ram := newTestCPU(t,
+		encU(OpLUI, s0, CLINTBase),                   // s0 = CLINT
+		encI(OpOPIMM, t0, F3ADDI, x0, 0x100),         //
+		encCSR(f3CSRRW, x0, t0, CSRMtvec),            // mtvec = handler
+		encI(OpOPIMM, t0, F3ADDI, x0, 500),           //
+		encU(OpLUI, t1, clintMtimecmp),               //
+		encR(t1, f3ADD_SUB, t1, s0, 0),               // t1 = &mtimecmp0
+		encS(f3SW, t1, t0, 0),                        // mtimecmp = 500
+		encS(f3SW, t1, x0, 4),                        //
+		encI(OpOPIMM, t0, F3ADDI, x0, mipMTIP),       //
+		encCSR(f3CSRRW, x0, t0, CSRMie),              // mie.MTIE
+		encCSR(f3CSRRSI, x0, mstatusMIE, CSRMstatus), // MIE
+		instWFI,   // 0x2c; PC moves on to 0x30 while waiting
+		instECALL, // 0x30
+	)
+	for i, ins := range []uint32{
+		encI(OpOPIMM, a0, F3ADDI, a0, 1),
+		encI(OpOPIMM, t0, F3ADDI, x0, -1),
+		encS(f3SW, t1, t0, 4), // mtimecmp = far future
+		instMRET,
+	} {
+		writeInst(t, ram, 0x100+uint32(i*4), ins)
+	}
+	cpu.HaltOnTrap = false
+	clint := NewCLINT(cpu)
+	if err := cpu.Bus.Map("clint", CLINTBase, CLINTSize, clint); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := 0
+	for (cpu.PC != 0x30 || cpu.Reg[a0] == 0) && steps < 100 {
+		if !cpu.Step() {
+			t.Fatalf("hart stopped at pc=0x%x", cpu.PC)
+		}
+		steps++
+	}
+	if cpu.Reg[a0] != 1 || steps > 25 {
+		t.Fatalf("a0=%d after %d steps", cpu.Reg[a0], steps)
+	}
+	if m := clint.Mtime(); m < 500 || m > 520 {
+		t.Errorf("mtime = %d, want just past 500", m)
+	}
+}
+
+// mcycle is the program's to write; mtime must not follow it.
+func TestCLINT_MtimeIgnoresMcycleWrites(t *testing.T) {
+	cpu, _ := newTestCPU(t,
+		encI(OpOPIMM, 1, F3ADDI, x0, -1),
+		encCSR(f3CSRRW, x0, x0, CSRMcycle), // mcycle = 0
+		encCSR(f3CSRRW, x0, 1, CSRMcycleh), // mcycleh = 0xFFFF_FFFF
+		encI(OpOPIMM, 2, F3ADDI, x0, 0),
+		instECALL,
+	)
+	clint := NewCLINT(cpu)
+	var last uint64
+	for i := range 4 {
+		if !cpu.Step() {
+			t.Fatalf("stopped at step %d", i)
+		}
+		now := clint.Mtime()
+		if now != last+1 {
+			t.Fatalf("mtime after step %d = %d, want %d", i, now, last+1)
+		}
+		last = now
+	}
+}
@@ -4,19 +4,71 @@ import (
 	"fmt"
 )
 
-// CPU: minimal RV32I subset with LB/LBU/LW and SB/SW.
-// Any ECALL halts (returns false from Step()).
+// CPU: RV32I base (all loads/stores: LB/LH/LW/LBU/LHU, SB/SH/SW)
+// plus Zicsr (CSRRW/CSRRS/CSRRC and immediate forms, see csr.go) and the
+// optional extensions enabled in ISA (see ext.go).
+// Exceptions (ECALL, EBREAK, illegal instructions, misaligned or faulting
+// accesses) trap to the M-mode handler at mtvec, see trap.go. Set
+// HaltOnTrap to stop the hart instead (Step returns false), which is how
+// bare-metal programs without a handler end with ECALL.
+// S- and U-mode addresses go through the Sv32 MMU when satp enables it,
+// see mmu.go, and physical accesses are checked by PMP, see pmp.go.
+// Interrupts are taken between instructions, see irq.go.
 //
 // Tip for teaching: set Trace=true to see human-readable instructions
 // via the Disasm() helper below.
 type CPU struct {
-	Reg   [32]uint32
-	PC    uint32
-	Bus   *Bus
-	Trace bool
+	Reg    [32]uint32
+	F      [32]uint64 // FP registers (F extension); singles are NaN-boxed
+	PC     uint32
+	Bus    *Bus
+	Trace  bool
+	HartID uint32    // value of mhartid
+	ISA    ISA       // enabled extensions; RV32I-only when zero (set via NewCPU)
+	Priv   PrivLevel // current privilege mode; M after NewCPU
+
+	// Lenient restores the old teaching behaviour for undefined encodings:
+	// print a warning and skip the instruction instead of raising an
+	// illegal-instruction exception.
+	Lenient bool
+
+	// HaltOnTrap stops the hart on any exception instead of entering the
+	// trap handler. mepc/mcause/mtval are still recorded and PC is left on
+	// the faulting instruction.
+	HaltOnTrap bool
+
+	// PMPEntries is the number of implemented PMP entries (0..64), see
+	// pmp.go. NewCPU sets 16.
+	PMPEntries int
+
+	csr     csrFile
+	tlb     tlb
+	clocked []Clocked // devices advanced with the cycle counter (irq.go)
+	ticks   uint64    // cycles run, unlike mcycle never written by the program
+	wfi     bool      // parked in WFI until an interrupt is pending
+	stopped bool      // see Stop
+
+	haltCause    uint32 // cause of the trap that stopped the hart, see HaltCause
+	haltedOnTrap bool
+
+	ir   uint32 // raw bits of the instruction being executed (for mtval)
+	ilen uint32 // its length in bytes
 }
 
-func NewCPU(bus *Bus) *CPU { return &CPU{Bus: bus} }
+// NewCPU returns a hart attached to bus implementing RV32I plus the given
+// extensions, e.g. NewCPU(bus, ExtM).
+func NewCPU(bus *Bus, exts ...ISA) *CPU {
+	c := &CPU{Bus: bus, Priv: PrivM, PMPEntries: 16}
+	c.csr.mstatus = uint32(PrivM) << mstatusMPPShift // MRET without setup stays in M
+	for _, e := range exts {
+		c.ISA |= e
+	}
+	if c.ISA.Has(ExtF) {
+		// Reset with the FPU usable so bare-metal code need not enable it.
+		c.csr.mstatus |= mstatusFSInitial
+	}
+	return c
+}
 
 func (c *CPU) readReg(i uint32) uint32 {
 	if i == 0 {
@@ -31,25 +83,124 @@ func (c *CPU) writeReg(i, v uint32) {
 	}
 }
 
-func (c *CPU) fetch() (uint32, bool) { return c.Bus.Read32(c.PC) }
+// ialign is the instruction alignment in bytes: 2 with the C extension, else 4.
+func (c *CPU) ialign() uint32 {
+	if c.ISA.Has(ExtC) {
+		return 2
+	}
+	return 4
+}
 
-func (c *CPU) trap(msg string) bool {
-	fmt.Printf("\n[trap] %s\n", msg)
-	return false
+// fetch returns the raw instruction at PC and its length in bytes.
+// With C enabled it reads 16-bit parcels, so a 32-bit instruction may
+// straddle a word boundary; otherwise it reads one aligned word.
+// A failed fetch raises the exception and returns ok=false.
+func (c *CPU) fetch() (inst, n uint32, ok bool) {
+	if !c.ISA.Has(ExtC) {
+		w, ok := c.memRead(c.PC, 4, accFetch)
+		return uint32(w), 4, ok
+	}
+	lo, ok := c.memRead(c.PC, 2, accFetch)
+	if !ok {
+		return 0, 0, false
+	}
+	if lo&3 != 3 {
+		return uint32(lo), 2, true
+	}
+	hi, ok := c.memRead(c.PC+2, 2, accFetch)
+	if !ok {
+		return 0, 0, false
+	}
+	return uint32(lo | hi<<16), 4, true
 }
 
 func (c *CPU) trace(inst uint32) {
 	if c.Trace {
+		if InstLen(inst) == 2 {
+			fmt.Printf("%08x: %04x      %s\n", c.PC, inst, Disasm(c.PC, inst))
+			return
+		}
 		fmt.Printf("%08x: %08x  %s\n", c.PC, inst, Disasm(c.PC, inst))
 	}
 }
 
+// tick advances the cycle counter and the device clock by n cycles.
+// mcycle is writable by the program, so devices follow ticks instead.
+func (c *CPU) tick(n uint64) {
+	c.csr.cycle += n
+	c.ticks += n
+}
+
+// retire advances the cycle and instret counters for one completed instruction.
+func (c *CPU) retire() {
+	c.tick(1)
+	if c.csr.instretWritten {
+		c.csr.instretWritten = false
+		return
+	}
+	c.csr.instret++
+}
+
 func addPC(pc uint32, off int32) uint32 { return uint32(int32(pc) + off) }
 
+// Step executes one instruction, first taking any pending interrupt (see
+// irq.go). It returns false when the hart stops, i.e. on a trap with
+// HaltOnTrap set, in a WFI that nothing can wake or after Stop.
 func (c *CPU) Step() bool {
-	inst, ok := c.fetch()
+	if c.stopped {
+		return false
+	}
+	start := c.ticks
+	ok := c.step()
+	c.advance(c.ticks - start)
+	return ok && !c.stopped
+}
+
+// Stop halts the hart once the current instruction completes: Step
+// returns false from then on. Devices such as the test finisher use it to
+// end a run.
+func (c *CPU) Stop() { c.stopped = true }
+
+func (c *CPU) step() bool {
+	if c.interrupt() {
+		c.tick(1)
+		return true
+	}
+	if c.wfi {
+		if c.pendingIRQs()&c.csr.mie == 0 {
+			return c.idle()
+		}
+		c.wfi = false // wake even if the interrupt is globally disabled
+	}
+	if c.execute() {
+		return true
+	}
+	// The instruction trapped: it does not retire but still takes a cycle.
+	c.tick(1)
+	return !c.HaltOnTrap
+}
+
+// execute runs the instruction at PC. It returns false if it raised an
+// exception instead of completing.
+func (c *CPU) execute() bool {
+	raw, ilen, ok := c.fetch()
 	if !ok {
-		return c.trap("fetch OOB or unaligned")
+		return false
+	}
+	c.trace(raw)
+	c.ir, c.ilen = raw, ilen
+
+	inst := raw
+	if ilen == 2 {
+		var name string
+		if inst, name = expandC(uint16(raw)); name == "" {
+			if !c.illegal() {
+				return false
+			}
+			c.PC += 2
+			c.retire()
+			return true
+		}
 	}
 
 	op := inst & 0x7F
@@ -59,8 +210,7 @@ func (c *CPU) Step() bool {
 	rs2 := (inst >> 20) & 0x1F
 	f7 := (inst >> 25) & 0x7F
 
-	nextPC := c.PC + 4
-	c.trace(inst)
+	nextPC := c.PC + ilen
 
 	switch op {
 
@@ -71,45 +221,55 @@ func (c *CPU) Step() bool {
 		c.writeReg(rd, addPC(c.PC, immU(inst)))
 
 	case opJAL:
-		c.writeReg(rd, c.PC+4)
-		nextPC = addPC(c.PC, immJ(inst))
+		tgt := addPC(c.PC, immJ(inst))
+		if tgt&(c.ialign()-1) != 0 {
+			return c.exception(CauseInstMisaligned, tgt)
+		}
+		c.writeReg(rd, nextPC)
+		nextPC = tgt
 
 	case opJALR:
+		if f3 != 0 {
+			if !c.illegal() {
+				return false
+			}
+			break
+		}
 		tgt := (c.readReg(rs1) + uint32(immI(inst))) &^ 1
-		c.writeReg(rd, c.PC+4)
+		if tgt&(c.ialign()-1) != 0 {
+			return c.exception(CauseInstMisaligned, tgt)
+		}
+		c.writeReg(rd, nextPC)
 		nextPC = tgt
 
 	case opBRANCH:
 		a := c.readReg(rs1)
 		b := c.readReg(rs2)
-		off := uint32(immB(inst))
+		var taken bool
 		switch f3 {
 		case F3BEQ:
-			if a == b {
-				nextPC = c.PC + off
-			}
+			taken = a == b
 		case f3BNE:
-			if a != b {
-				nextPC = c.PC + off
-			}
+			taken = a != b
 		case f3BLT:
-			if int32(a) < int32(b) {
-				nextPC = c.PC + off
-			}
+			taken = int32(a) < int32(b)
 		case f3BGE:
-			if int32(a) >= int32(b) {
-				nextPC = c.PC + off
-			}
+			taken = int32(a) >= int32(b)
 		case f3BLTU:
-			if a < b {
-				nextPC = c.PC + off
-			}
+			taken = a < b
 		case f3BGEU:
-			if a >= b {
-				nextPC = c.PC + off
-			}
+			taken = a >= b
 		default:
-			fmt.Printf("[warn] BRANCH f3=%d\n", f3)
+			if !c.illegal() {
+				return false
+			}
+		}
+		if taken {
+			tgt := addPC(c.PC, immB(inst))
+			if tgt&(c.ialign()-1) != 0 {
+				return c.exception(CauseInstMisaligned, tgt)
+			}
+			nextPC = tgt
 		}
 
 	case OpLOAD:
@@ -117,25 +277,39 @@ func (c *CPU) Step() bool {
 		addr := base + uint32(immI(inst))
 		switch f3 {
 		case f3LB:
-			b, ok := c.Bus.Read8(addr)
+			b, ok := c.memRead(addr, 1, accLoad)
 			if !ok {
-				return c.trap("LB OOB")
+				return false
 			}
 			c.writeReg(rd, uint32(int32(int8(b))))
 		case F3LBU:
-			b, ok := c.Bus.Read8(addr)
+			b, ok := c.memRead(addr, 1, accLoad)
 			if !ok {
-				return c.trap("LBU OOB")
+				return false
 			}
 			c.writeReg(rd, uint32(b))
+		case f3LH:
+			h, ok := c.memRead(addr, 2, accLoad)
+			if !ok {
+				return false
+			}
+			c.writeReg(rd, uint32(int32(int16(h))))
+		case f3LHU:
+			h, ok := c.memRead(addr, 2, accLoad)
+			if !ok {
+				return false
+			}
+			c.writeReg(rd, uint32(h))
 		case f3LW:
-			w, ok := c.Bus.Read32(addr)
+			w, ok := c.memRead(addr, 4, accLoad)
 			if !ok {
-				return c.trap("LW OOB or unaligned")
+				return false
 			}
-			c.writeReg(rd, w)
+			c.writeReg(rd, uint32(w))
 		default:
-			fmt.Printf("[warn] LOAD f3=%d\n", f3)
+			if !c.illegal() {
+				return false
+			}
 		}
 
 	case opSTORE:
@@ -144,21 +318,34 @@ func (c *CPU) Step() bool {
 		switch f3 {
 		case F3SB:
 			v := uint8(c.readReg(rs2))
-			if !c.Bus.Write8(addr, v) {
-				return c.trap("SB OOB")
+			if !c.memWrite(addr, 1, uint64(v)) {
+				return false
+			}
+		case f3SH:
+			v := uint16(c.readReg(rs2))
+			if !c.memWrite(addr, 2, uint64(v)) {
+				return false
 			}
 		case f3SW:
 			v := c.readReg(rs2)
-			if !c.Bus.Write32(addr, v) {
-				return c.trap("SW OOB or unaligned")
+			if !c.memWrite(addr, 4, uint64(v)) {
+				return false
 			}
 		default:
-			fmt.Printf("[warn] STORE f3=%d\n", f3)
+			if !c.illegal() {
+				return false
+			}
 		}
 
 	case OpOPIMM:
 		a := c.readReg(rs1)
 		imm := uint32(immI(inst))
+		if op, ok := decodeBitmanip(inst); ok {
+			if !c.execBitmanip(inst, op, a, imm&0x1F) {
+				return false
+			}
+			break
+		}
 		switch f3 {
 		case F3ADDI:
 			c.writeReg(rd, a+uint32(int32(imm)))
@@ -168,23 +355,67 @@ func (c *CPU) Step() bool {
 			c.writeReg(rd, a|imm)
 		case f3ANDI:
 			c.writeReg(rd, a&imm)
+		case f3SLTI:
+			if int32(a) < int32(imm) {
+				c.writeReg(rd, 1)
+			} else {
+				c.writeReg(rd, 0)
+			}
+		case f3SLTIU:
+			if a < imm {
+				c.writeReg(rd, 1)
+			} else {
+				c.writeReg(rd, 0)
+			}
 		case f3SLLI:
+			if f7 != 0 { // includes shamt[5]=1, reserved on RV32
+				if !c.illegal() {
+					return false
+				}
+				break
+			}
 			sh := (imm & 0x1F)
 			c.writeReg(rd, a<<sh)
 		case f3SRxI:
 			sh := (imm & 0x1F)
-			if f7 == funct7SUBSRA { // SRAI
+			switch f7 {
+			case funct7SUBSRA: // SRAI
 				c.writeReg(rd, uint32(int32(a)>>sh))
-			} else { // SRLI
+			case 0: // SRLI
 				c.writeReg(rd, a>>sh)
+			default:
+				if !c.illegal() {
+					return false
+				}
 			}
-		default:
-			fmt.Printf("[warn] OP-IMM f3=%d\n", f3)
 		}
 
 	case opOP:
 		a := c.readReg(rs1)
 		b := c.readReg(rs2)
+		if f7 == funct7MULDIV {
+			if !c.ISA.Has(ExtM) {
+				if !c.illegal() {
+					return false
+				}
+				break
+			}
+			c.writeReg(rd, mulDiv(f3, a, b))
+			break
+		}
+		if op, ok := decodeBitmanip(inst); ok {
+			if !c.execBitmanip(inst, op, a, b) {
+				return false
+			}
+			break
+		}
+		// Only ADD/SUB and SRL/SRA have a second encoding (funct7=0x20).
+		if f7 != 0 && !(f7 == funct7SUBSRA && (f3 == f3ADD_SUB || f3 == f3SRx)) {
+			if !c.illegal() {
+				return false
+			}
+			break
+		}
 		switch f3 {
 		case f3ADD_SUB:
 			if f7 == funct7SUBSRA { // SUB
@@ -218,20 +449,97 @@ func (c *CPU) Step() bool {
 			} else {
 				c.writeReg(rd, 0)
 			}
-		default:
-			fmt.Printf("[warn] OP f3=%d f7=0x%x\n", f3, f7)
+		}
+
+	case opMISCMEM:
+		// FENCE orders memory and FENCE.I synchronises instruction fetch;
+		// harts execute one instruction at a time over a cache-less bus,
+		// so both are no-ops.
+		if f3 != f3FENCE && f3 != f3FENCEI && !c.illegal() {
+			return false
+		}
+
+	case opAMO:
+		if !c.ISA.Has(ExtA) {
+			if !c.illegal() {
+				return false
+			}
+			break
+		}
+		if !c.execAMO(inst) {
+			return false
+		}
+
+	case opLOADFP, opSTOREFP, opMADD, opMSUB, opNMSUB, opNMADD, opOPFP:
+		if !c.ISA.Has(ExtF) {
+			if !c.illegal() {
+				return false
+			}
+			break
+		}
+		if !c.execFP(inst) {
+			return false
 		}
 
 	case opSYSTEM:
-		// ECALL: halt
-		fmt.Println("\n[halt] ECALL")
-		return false
+		if f3 == f3PRIV {
+			switch inst {
+			case instECALL:
+				return c.exception(CauseEcallU+uint32(c.Priv), 0)
+			case instEBREAK:
+				return c.exception(CauseBreakpoint, c.PC)
+			case instMRET:
+				if c.Priv != PrivM {
+					if !c.illegal() {
+						return false
+					}
+					break
+				}
+				nextPC = c.mret()
+			case instSRET:
+				// TSR makes SRET trap in S-mode so M can emulate it.
+				if c.Priv == PrivU || c.Priv == PrivS && c.csr.mstatus&mstatusTSR != 0 {
+					if !c.illegal() {
+						return false
+					}
+					break
+				}
+				nextPC = c.sret()
+			case instWFI:
+				// With TW set, WFI below M-mode traps at once rather than
+				// after a time limit; U-mode may never wait.
+				if c.Priv == PrivU || c.Priv == PrivS && c.csr.mstatus&mstatusTW != 0 {
+					if !c.illegal() {
+						return false
+					}
+					break
+				}
+				c.wfi = true
+			default:
+				// SFENCE.VMA is S-mode only, and TVM traps it like satp.
+				if inst&maskSFENCEVMA != instSFENCEVMA || c.Priv == PrivU ||
+					c.Priv == PrivS && c.csr.mstatus&mstatusTVM != 0 {
+					if !c.illegal() {
+						return false
+					}
+					break
+				}
+				c.sfenceVMA(rs1, rs2)
+			}
+			break
+		}
+		if !c.execCSR(inst) && !c.illegal() {
+			return false
+		}
 
 	default:
-		fmt.Printf("\n[warn] unsupported opcode 0x%x at pc=%08x\n", op, c.PC)
+		if !c.illegal() {
+			return false
+		}
 	}
 
 	c.PC = nextPC
 	c.Reg[0] = 0 // x0 is hardwired to zero
+	c.retire()
 	return true
 }
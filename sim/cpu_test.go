@@ -81,6 +81,7 @@ func TestCPU_UART_Hello(t *testing.T) {
 	uart := NewUART(nil)
 	bus := NewBus(ram, uart)
 	cpu := NewCPU(bus)
+	cpu.HaltOnTrap = true
 
 	// Place data string at 0x200.
 	msg := []byte("Hi!\n\x00")
@@ -139,6 +140,7 @@ func TestCPU_Arithmetic_StoreToRAM(t *testing.T) {
 	uart := NewUART(nil)
 	bus := NewBus(ram, uart)
 	cpu := NewCPU(bus)
+	cpu.HaltOnTrap = true
 
 	// x1=5; x2=7; x3=x1+x2; store x3 at [0x300]; ecall
 	pc := uint32(0)
@@ -171,3 +173,38 @@ func TestCPU_Arithmetic_StoreToRAM(t *testing.T) {
 		t.Fatalf("stored value = %d, want 12", v)
 	}
 }
+
+func TestCPU_Halfword_LoadStore(t *testing.T) {
+	ram := NewRAM(4096)
+	bus := NewBus(ram, NewUART(nil))
+	cpu := NewCPU(bus)
+	cpu.HaltOnTrap = true
+
+	// x1 = 0x300; x2 = -2 (0xFFFFFFFE)
+	// sh x2, 2(x1); lh x3, 2(x1); lhu x4, 2(x1); ecall
+	insts := []uint32{
+		encI(OpOPIMM, 1, F3ADDI, x0, 0x300),
+		encI(OpOPIMM, 2, F3ADDI, x0, -2),
+		encS(f3SH, 1, 2, 2),
+		encI(OpLOAD, 3, f3LH, 1, 2),
+		encI(OpLOAD, 4, f3LHU, 1, 2),
+		0x00000073,
+	}
+	for i, ins := range insts {
+		writeInst(t, ram, uint32(i*4), ins)
+	}
+
+	if !runToHalt(cpu, 100) {
+		t.Fatalf("program did not halt in time")
+	}
+	if got := cpu.Reg[3]; got != 0xFFFFFFFE {
+		t.Fatalf("lh = 0x%08x, want 0xfffffffe", got)
+	}
+	if got := cpu.Reg[4]; got != 0x0000FFFE {
+		t.Fatalf("lhu = 0x%08x, want 0x0000fffe", got)
+	}
+	// sh must only touch two bytes.
+	if w, _ := bus.Read32(0x300); w != 0xFFFE0000 {
+		t.Fatalf("word at 0x300 = 0x%08x, want 0xfffe0000", w)
+	}
+}
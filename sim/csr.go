@@ -0,0 +1,468 @@
+package sim
+
+import "fmt"
+
+// CSR addresses (Zicsr). Only the subset that this simulator models is
+// listed; anything else is an illegal CSR access.
+const (
+	// Unprivileged counters (read-only shadows of mcycle/minstret).
+	CSRCycle    = 0xC00
+	CSRInstret  = 0xC02
+	CSRCycleh   = 0xC80
+	CSRInstreth = 0xC82
+
+	// Supervisor trap setup and handling, address translation.
+	CSRSstatus    = 0x100
+	CSRSie        = 0x104
+	CSRStvec      = 0x105
+	CSRScounteren = 0x106
+	CSRSscratch   = 0x140
+	CSRSepc       = 0x141
+	CSRScause     = 0x142
+	CSRStval      = 0x143
+	CSRSip        = 0x144
+	CSRSatp       = 0x180
+
+	// Machine information registers (read-only).
+	CSRMvendorid  = 0xF11
+	CSRMarchid    = 0xF12
+	CSRMimpid     = 0xF13
+	CSRMhartid    = 0xF14
+	CSRMconfigptr = 0xF15
+
+	// Machine trap setup.
+	CSRMstatus    = 0x300
+	CSRMisa       = 0x301
+	CSRMedeleg    = 0x302
+	CSRMideleg    = 0x303
+	CSRMie        = 0x304
+	CSRMtvec      = 0x305
+	CSRMcounteren = 0x306
+
+	// Machine trap handling.
+	CSRMscratch = 0x340
+	CSRMepc     = 0x341
+	CSRMcause   = 0x342
+	CSRMtval    = 0x343
+	CSRMip      = 0x344
+
+	// Machine counters.
+	CSRMcycle    = 0xB00
+	CSRMinstret  = 0xB02
+	CSRMcycleh   = 0xB80
+	CSRMinstreth = 0xB82
+)
+
+var csrNames = map[uint32]string{
+	CSRFflags:     "fflags",
+	CSRFrm:        "frm",
+	CSRFcsr:       "fcsr",
+	CSRCycle:      "cycle",
+	CSRInstret:    "instret",
+	CSRCycleh:     "cycleh",
+	CSRInstreth:   "instreth",
+	CSRSstatus:    "sstatus",
+	CSRSie:        "sie",
+	CSRStvec:      "stvec",
+	CSRScounteren: "scounteren",
+	CSRSscratch:   "sscratch",
+	CSRSepc:       "sepc",
+	CSRScause:     "scause",
+	CSRStval:      "stval",
+	CSRSip:        "sip",
+	CSRSatp:       "satp",
+	CSRMvendorid:  "mvendorid",
+	CSRMarchid:    "marchid",
+	CSRMimpid:     "mimpid",
+	CSRMhartid:    "mhartid",
+	CSRMconfigptr: "mconfigptr",
+	CSRMstatus:    "mstatus",
+	CSRMisa:       "misa",
+	CSRMedeleg:    "medeleg",
+	CSRMideleg:    "mideleg",
+	CSRMcounteren: "mcounteren",
+	CSRMie:        "mie",
+	CSRMtvec:      "mtvec",
+	CSRMscratch:   "mscratch",
+	CSRMepc:       "mepc",
+	CSRMcause:     "mcause",
+	CSRMtval:      "mtval",
+	CSRMip:        "mip",
+	CSRMcycle:     "mcycle",
+	CSRMinstret:   "minstret",
+	CSRMcycleh:    "mcycleh",
+	CSRMinstreth:  "minstreth",
+}
+
+// csrName returns the symbolic name of a CSR, or its hex address if unknown.
+func csrName(addr uint32) string {
+	if n, ok := csrNames[addr]; ok {
+		return n
+	}
+	if n := pmpCSRName(addr); n != "" {
+		return n
+	}
+	return fmt.Sprintf("0x%03x", addr)
+}
+
+// mstatus fields
+const (
+	mstatusSIE  = 1 << 1
+	mstatusMIE  = 1 << 3
+	mstatusSPIE = 1 << 5
+	mstatusMPIE = 1 << 7
+	mstatusSPP  = 1 << 8
+	mstatusMPP  = 3 << 11
+	mstatusMPRV = 1 << 17
+	mstatusSUM  = 1 << 18
+	mstatusMXR  = 1 << 19
+	mstatusTVM  = 1 << 20
+	mstatusTW   = 1 << 21
+	mstatusTSR  = 1 << 22
+
+	mstatusMPPShift = 11
+
+	// Bits visible through sstatus.
+	sstatusMask = mstatusSIE | mstatusSPIE | mstatusSPP | mstatusFS | mstatusSUM | mstatusMXR | mstatusSD
+)
+
+// mie/mip interrupt bits
+const (
+	mipSSIP = 1 << 1
+	mipMSIP = 1 << 3
+	mipSTIP = 1 << 5
+	mipMTIP = 1 << 7
+	mipSEIP = 1 << 9
+	mipMEIP = 1 << 11
+
+	mipSBits = mipSSIP | mipSTIP | mipSEIP
+	mipMBits = mipMSIP | mipMTIP | mipMEIP
+)
+
+// medeleg: every exception except ECALL from M-mode may be delegated.
+const medelegMask = 0xB3FF &^ (1 << CauseEcallM)
+
+// satp
+const satpModeSv32 = 1 << 31
+
+// counter-enable bits (mcounteren/scounteren) for cycle, time, instret.
+const counterenMask = 0x7
+
+// misa: MXL=1 (32-bit) in the top bits, one bit per extension letter.
+const misaMXL32 = 1 << 30
+
+func misaExt(letter byte) uint32 { return 1 << (letter - 'A') }
+
+// csrFile is the architectural CSR state of one hart.
+//
+// Registers are stored raw; WARL/read-only behaviour lives in csrRead and
+// csrWrite so every access path (instructions, ReadCSR/WriteCSR) agrees.
+type csrFile struct {
+	mstatus    uint32
+	medeleg    uint32
+	mideleg    uint32
+	mie        uint32
+	mip        uint32
+	mtvec      uint32
+	mcounteren uint32
+	mscratch   uint32
+	mepc       uint32
+	mcause     uint32
+	mtval      uint32
+	stvec      uint32
+	scounteren uint32
+	sscratch   uint32
+	sepc       uint32
+	scause     uint32
+	stval      uint32
+	satp       uint32
+	pmpcfg     [pmpMaxEntries]uint8
+	pmpaddr    [pmpMaxEntries]uint32
+	irq        uint32 // mip bits driven by interrupt lines (SetInterrupt)
+	fflags     uint32
+	frm        uint32
+	cycle      uint64
+	instret    uint64
+
+	// set when an instruction writes minstret/minstreth so Step does not
+	// count that instruction on top of the written value.
+	instretWritten bool
+}
+
+// csrReadOnly reports whether addr is in a read-only CSR block (bits 11:10 == 3).
+func csrReadOnly(addr uint32) bool { return addr>>10 == 3 }
+
+// csrRead returns the value of a CSR; ok is false if the CSR does not exist.
+func (c *CPU) csrRead(addr uint32) (uint32, bool) {
+	s := &c.csr
+	if pmpCSR(addr) {
+		return c.pmpRead(addr), true
+	}
+	switch addr {
+	case CSRCycle, CSRMcycle:
+		return uint32(s.cycle), true
+	case CSRCycleh, CSRMcycleh:
+		return uint32(s.cycle >> 32), true
+	case CSRInstret, CSRMinstret:
+		return uint32(s.instret), true
+	case CSRInstreth, CSRMinstreth:
+		return uint32(s.instret >> 32), true
+	case CSRMvendorid, CSRMarchid, CSRMimpid, CSRMconfigptr:
+		return 0, true
+	case CSRMhartid:
+		return c.HartID, true
+	case CSRMstatus, CSRSstatus:
+		v := s.mstatus
+		if v&mstatusFS == mstatusFSDirty {
+			v |= mstatusSD
+		}
+		if addr == CSRSstatus {
+			v &= sstatusMask
+		}
+		return v, true
+	case CSRFflags, CSRFrm, CSRFcsr:
+		if !c.fpOn() {
+			return 0, false
+		}
+		switch addr {
+		case CSRFflags:
+			return s.fflags, true
+		case CSRFrm:
+			return s.frm, true
+		}
+		return s.frm<<5 | s.fflags, true
+	case CSRMisa:
+		return misaMXL32 | c.ISA.misa(), true
+	case CSRMedeleg:
+		return s.medeleg, true
+	case CSRMideleg:
+		return s.mideleg, true
+	case CSRMie:
+		return s.mie, true
+	case CSRMip:
+		return c.pendingIRQs(), true
+	case CSRMtvec:
+		return s.mtvec, true
+	case CSRMcounteren:
+		return s.mcounteren, true
+	case CSRMscratch:
+		return s.mscratch, true
+	case CSRMepc:
+		return s.mepc, true
+	case CSRMcause:
+		return s.mcause, true
+	case CSRMtval:
+		return s.mtval, true
+	case CSRSie:
+		return s.mie & s.mideleg, true
+	case CSRSip:
+		return c.pendingIRQs() & s.mideleg, true
+	case CSRStvec:
+		return s.stvec, true
+	case CSRScounteren:
+		return s.scounteren, true
+	case CSRSscratch:
+		return s.sscratch, true
+	case CSRSepc:
+		return s.sepc, true
+	case CSRScause:
+		return s.scause, true
+	case CSRStval:
+		return s.stval, true
+	case CSRSatp:
+		return s.satp, true
+	}
+	return 0, false
+}
+
+// csrWrite stores v into a CSR, applying WARL legalisation. ok is false if
+// the CSR does not exist or is read-only.
+func (c *CPU) csrWrite(addr, v uint32) bool {
+	if csrReadOnly(addr) {
+		return false
+	}
+	s := &c.csr
+	if pmpCSR(addr) {
+		c.pmpWrite(addr, v)
+		return true
+	}
+	switch addr {
+	case CSRMcycle:
+		s.cycle = s.cycle&^0xFFFFFFFF | uint64(v)
+	case CSRMcycleh:
+		s.cycle = s.cycle&0xFFFFFFFF | uint64(v)<<32
+	case CSRMinstret:
+		s.instret = s.instret&^0xFFFFFFFF | uint64(v)
+		s.instretWritten = true
+	case CSRMinstreth:
+		s.instret = s.instret&0xFFFFFFFF | uint64(v)<<32
+		s.instretWritten = true
+	case CSRMstatus, CSRSstatus:
+		mask := uint32(mstatusSIE | mstatusSPIE | mstatusSPP | mstatusSUM | mstatusMXR)
+		if addr == CSRMstatus {
+			mask |= mstatusMIE | mstatusMPIE | mstatusMPP | mstatusMPRV | mstatusTVM | mstatusTW | mstatusTSR
+			if v&mstatusMPP == 2<<mstatusMPPShift { // reserved: keep the old mode
+				v = v&^mstatusMPP | s.mstatus&mstatusMPP
+			}
+		}
+		if c.ISA.Has(ExtF) {
+			mask |= mstatusFS
+		}
+		s.mstatus = s.mstatus&^mask | v&mask
+	case CSRFflags, CSRFrm, CSRFcsr:
+		if !c.fpOn() {
+			return false
+		}
+		switch addr {
+		case CSRFflags:
+			s.fflags = v & 0x1F
+		case CSRFrm:
+			s.frm = v & 7
+		default:
+			s.fflags, s.frm = v&0x1F, v>>5&7
+		}
+		c.fpDirty()
+	case CSRMisa:
+		// WARL: the extension set is fixed; writes are ignored.
+	case CSRMedeleg:
+		s.medeleg = v & medelegMask
+	case CSRMideleg:
+		s.mideleg = v & mipSBits
+	case CSRMie:
+		s.mie = v & (mipMBits | mipSBits)
+	case CSRMip:
+		// Machine-level pending bits are driven by hardware; M-mode
+		// software may post supervisor interrupts.
+		s.mip = s.mip&^mipSBits | v&mipSBits
+	case CSRMtvec:
+		s.mtvec = legalTvec(v)
+	case CSRMcounteren:
+		s.mcounteren = v & counterenMask
+	case CSRMscratch:
+		s.mscratch = v
+	case CSRMepc:
+		s.mepc = v &^ (c.ialign() - 1)
+	case CSRMcause:
+		s.mcause = v
+	case CSRMtval:
+		s.mtval = v
+	case CSRSie:
+		s.mie = s.mie&^s.mideleg | v&s.mideleg
+	case CSRSip:
+		// Only the software interrupt is writable from S-mode.
+		m := s.mideleg & mipSSIP
+		s.mip = s.mip&^m | v&m
+	case CSRStvec:
+		s.stvec = legalTvec(v)
+	case CSRScounteren:
+		s.scounteren = v & counterenMask
+	case CSRSscratch:
+		s.sscratch = v
+	case CSRSepc:
+		s.sepc = v &^ (c.ialign() - 1)
+	case CSRScause:
+		s.scause = v
+	case CSRStval:
+		s.stval = v
+	case CSRSatp:
+		// Bare and Sv32 are the only RV32 modes, so every value is legal.
+		// Writing satp does not flush the TLB; that takes SFENCE.VMA.
+		s.satp = v
+	default:
+		return false
+	}
+	return true
+}
+
+// legalTvec applies the WARL rule for mtvec/stvec: MODE 0 (direct) and 1
+// (vectored) are legal; reserved modes fall back to direct.
+func legalTvec(v uint32) uint32 {
+	if v&3 > 1 {
+		v &^= 3
+	}
+	return v
+}
+
+// csrAllowed reports whether the current privilege level may access addr.
+// Bits 9:8 of the address give the lowest privilege allowed; the counter
+// shadows are further gated by mcounteren (and scounteren for U-mode), and
+// satp by mstatus.TVM.
+func (c *CPU) csrAllowed(addr uint32) bool {
+	if uint32(c.Priv) < addr>>8&3 {
+		return false
+	}
+	if c.Priv == PrivM {
+		return true
+	}
+	if addr >= CSRCycle && addr <= CSRCycle+0x1F || addr >= CSRCycleh && addr <= CSRCycleh+0x1F {
+		bit := uint32(1) << (addr & 0x1F)
+		if c.csr.mcounteren&bit == 0 || c.Priv == PrivU && c.csr.scounteren&bit == 0 {
+			return false
+		}
+	}
+	if addr == CSRSatp && c.csr.mstatus&mstatusTVM != 0 {
+		return false
+	}
+	return true
+}
+
+// ReadCSR reads a CSR as a CSR instruction would, without side effects on
+// the integer registers and without privilege checks. ok is false for CSRs
+// that do not exist.
+func (c *CPU) ReadCSR(addr uint32) (uint32, bool) { return c.csrRead(addr) }
+
+// WriteCSR writes a CSR with the same WARL rules as CSRRW, without
+// privilege checks. ok is false for CSRs that do not exist or are read-only.
+func (c *CPU) WriteCSR(addr, v uint32) bool { return c.csrWrite(addr, v) }
+
+// execCSR executes CSRRW/CSRRS/CSRRC and their immediate forms.
+// It returns false on an illegal CSR access (unknown CSR, write to a
+// read-only CSR, insufficient privilege, or reserved funct3).
+func (c *CPU) execCSR(inst uint32) bool {
+	rd := (inst >> 7) & 0x1F
+	f3 := (inst >> 12) & 0x7
+	rs1 := (inst >> 15) & 0x1F
+	addr := inst >> 20
+
+	src := rs1 // CSRR*I: zero-extended 5-bit immediate in the rs1 field
+	if f3&4 == 0 {
+		src = c.readReg(rs1)
+	}
+
+	// CSRRW always writes; CSRRS/CSRRC only write when the mask
+	// register/immediate field is nonzero (so "csrr" never faults on a
+	// read-only CSR). None of our CSRs have read side effects, so the read
+	// is always performed.
+	var write bool
+	switch f3 {
+	case f3CSRRW, f3CSRRWI:
+		write = true
+	case f3CSRRS, f3CSRRC, f3CSRRSI, f3CSRRCI:
+		write = rs1 != 0
+	default:
+		return false
+	}
+
+	if write && csrReadOnly(addr) || !c.csrAllowed(addr) {
+		return false
+	}
+	old, ok := c.csrRead(addr)
+	if !ok {
+		return false
+	}
+
+	if write {
+		nv := src
+		switch f3 & 3 {
+		case f3CSRRS:
+			nv = old | src
+		case f3CSRRC:
+			nv = old &^ src
+		}
+		if !c.csrWrite(addr, nv) {
+			return false
+		}
+	}
+	c.writeReg(rd, old)
+	return true
+}
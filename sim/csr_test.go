@@ -0,0 +1,154 @@
+package sim
+
+import "testing"
+
+// encCSR encodes a Zicsr instruction; for the immediate forms rs1 is the uimm.
+func encCSR(f3, rd, rs1, csr uint32) uint32 {
+	return encI(opSYSTEM, rd, f3, rs1, int32(csr))
+}
+
+// newTestCPU returns an RV32I hart with 64 KiB of RAM holding insts at 0.
+func newTestCPU(t *testing.T, insts ...uint32) (*CPU, *RAM) {
+	t.Helper()
+	return newISATestCPU(t, 0, insts...)
+}
+
+// newISATestCPU is newTestCPU for a hart with the given extensions.
+func newISATestCPU(t *testing.T, exts ISA, insts ...uint32) (*CPU, *RAM) {
+	t.Helper()
+	ram := NewRAM(64 * 1024)
+	cpu := NewCPU(NewBus(ram, NewUART(nil)), exts)
+	cpu.HaltOnTrap = true
+	for i, ins := range insts {
+		writeInst(t, ram, uint32(i*4), ins)
+	}
+	return cpu, ram
+}
+
+func TestCSR_ReadWriteSetClear(t *testing.T) {
+	cpu, _ := newTestCPU(t,
+		encI(OpOPIMM, 1, F3ADDI, x0, 0x0F0),
+		encCSR(f3CSRRW, x0, 1, CSRMscratch),   // mscratch = 0xF0
+		encI(OpOPIMM, 2, F3ADDI, x0, 0x00F),   // x2 = 0x0F
+		encCSR(f3CSRRS, 3, 2, CSRMscratch),    // x3 = 0xF0; mscratch = 0xFF
+		encCSR(f3CSRRCI, 4, 0x3, CSRMscratch), // x4 = 0xFF; mscratch = 0xFC
+		encCSR(f3CSRRS, 5, x0, CSRMscratch),   // x5 = 0xFC (csrr)
+		encCSR(f3CSRRWI, 6, 7, CSRMscratch),   // x6 = 0xFC; mscratch = 7
+		encCSR(f3CSRRS, 7, x0, CSRMhartid),    // x7 = mhartid
+		instECALL,
+	)
+	cpu.HartID = 3
+	if !runToHalt(cpu, 100) {
+		t.Fatalf("program did not halt in time")
+	}
+	want := map[int]uint32{3: 0xF0, 4: 0xFF, 5: 0xFC, 6: 0xFC, 7: 3}
+	for r, w := range want {
+		if cpu.Reg[r] != w {
+			t.Errorf("x%d = 0x%x, want 0x%x", r, cpu.Reg[r], w)
+		}
+	}
+	if v, _ := cpu.ReadCSR(CSRMscratch); v != 7 {
+		t.Errorf("mscratch = 0x%x, want 7", v)
+	}
+	if pc := cpu.PC; pc != 8*4 {
+		t.Errorf("halted at pc=0x%x, want 0x20", pc)
+	}
+}
+
+func TestCSR_WARL(t *testing.T) {
+	cpu, _ := newTestCPU(t)
+
+	// mtvec: reserved MODE values fall back to direct mode.
+	cpu.WriteCSR(CSRMtvec, 0x1002)
+	if v, _ := cpu.ReadCSR(CSRMtvec); v != 0x1000 {
+		t.Errorf("mtvec = 0x%x, want 0x1000", v)
+	}
+	cpu.WriteCSR(CSRMtvec, 0x1001)
+	if v, _ := cpu.ReadCSR(CSRMtvec); v != 0x1001 {
+		t.Errorf("mtvec = 0x%x, want 0x1001 (vectored)", v)
+	}
+	// mepc: low bits are hardwired to zero.
+	cpu.WriteCSR(CSRMepc, 0x1237)
+	if v, _ := cpu.ReadCSR(CSRMepc); v != 0x1234 {
+		t.Errorf("mepc = 0x%x, want 0x1234", v)
+	}
+	// mstatus: only the modelled fields are writable (no FS without F).
+	cpu.WriteCSR(CSRMstatus, 0xFFFFFFFF)
+	const want = mstatusSIE | mstatusMIE | mstatusSPIE | mstatusMPIE | mstatusSPP | mstatusMPP |
+		mstatusMPRV | mstatusSUM | mstatusMXR | mstatusTVM | mstatusTW | mstatusTSR
+	if v, _ := cpu.ReadCSR(CSRMstatus); v != want {
+		t.Errorf("mstatus = 0x%x, want 0x%x", v, want)
+	}
+	// MPP=2 is reserved: the write leaves MPP unchanged.
+	cpu.WriteCSR(CSRMstatus, 2<<mstatusMPPShift)
+	if v, _ := cpu.ReadCSR(CSRMstatus); v != mstatusMPP {
+		t.Errorf("mstatus after MPP=2 = 0x%x, want MPP=M only", v)
+	}
+	// misa ignores writes.
+	before, _ := cpu.ReadCSR(CSRMisa)
+	cpu.WriteCSR(CSRMisa, 0)
+	if v, _ := cpu.ReadCSR(CSRMisa); v != before || v&misaExt('I') == 0 {
+		t.Errorf("misa = 0x%x, want 0x%x", v, before)
+	}
+	// Read-only and nonexistent CSRs reject writes.
+	if cpu.WriteCSR(CSRMhartid, 1) {
+		t.Errorf("write to mhartid should fail")
+	}
+	if _, ok := cpu.ReadCSR(0x7C0); ok {
+		t.Errorf("read of unknown CSR should fail")
+	}
+}
+
+func TestCSR_IllegalAccessHalts(t *testing.T) {
+	for name, inst := range map[string]uint32{
+		"write read-only": encCSR(f3CSRRW, 1, 2, CSRMhartid),
+		"unknown csr":     encCSR(f3CSRRS, 1, x0, 0x7C0),
+		"reserved funct3": encCSR(0x4, 1, x0, CSRMscratch),
+	} {
+		cpu, _ := newTestCPU(t, inst, encI(OpOPIMM, 5, F3ADDI, x0, 1))
+		if cpu.Step() {
+			t.Errorf("%s: Step should stop on illegal CSR access", name)
+		}
+		if cpu.Reg[1] != 0 {
+			t.Errorf("%s: rd was written", name)
+		}
+	}
+	// Reading a read-only CSR with csrrs x0 as the mask is fine.
+	cpu, _ := newTestCPU(t, encCSR(f3CSRRS, 1, x0, CSRMhartid))
+	if !cpu.Step() {
+		t.Errorf("csrr mhartid should not fault")
+	}
+}
+
+func TestCSR_Instret(t *testing.T) {
+	cpu, _ := newTestCPU(t,
+		encI(OpOPIMM, x0, F3ADDI, x0, 0),
+		encI(OpOPIMM, x0, F3ADDI, x0, 0),
+		encCSR(f3CSRRS, 1, x0, CSRInstret),
+		encCSR(f3CSRRWI, x0, 0, CSRMinstret),
+		encCSR(f3CSRRS, 2, x0, CSRMinstret),
+		instECALL,
+	)
+	runToHalt(cpu, 100)
+	if cpu.Reg[1] != 2 {
+		t.Errorf("instret = %d, want 2", cpu.Reg[1])
+	}
+	if cpu.Reg[2] != 0 {
+		t.Errorf("minstret after write = %d, want 0", cpu.Reg[2])
+	}
+}
+
+func TestDisasm_CSR(t *testing.T) {
+	cases := map[uint32]string{
+		encCSR(f3CSRRW, a0, a1, CSRMtvec):   "csrrw a0, mtvec, a1",
+		encCSR(f3CSRRS, a0, x0, CSRMhartid): "csrrs a0, mhartid, zero",
+		encCSR(f3CSRRCI, x0, 8, CSRMstatus): "csrrci zero, mstatus, 8",
+		encCSR(f3CSRRWI, t0, 1, 0x7C0):      "csrrwi t0, 0x7c0, 1",
+		instEBREAK:                          "ebreak",
+	}
+	for inst, want := range cases {
+		if got := Disasm(0, inst); got != want {
+			t.Errorf("Disasm(0x%08x) = %q, want %q", inst, got, want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package sim
+
+import "encoding/binary"
+
+// Device is a memory-mapped peripheral attached to a Bus with Map.
+//
+// Offsets are relative to the device's base address. size is 1, 2, 4 or 8
+// and the bus only issues naturally aligned accesses that lie entirely
+// inside the device's region. Values are little-endian and zero-extended
+// to 64 bits. Returning ok=false reports an access fault for registers
+// that do not exist or do not support that access size.
+type Device interface {
+	Read(off, size uint32) (v uint64, ok bool)
+	Write(off, size uint32, v uint64) (ok bool)
+}
+
+// byteReader/byteWriter are the byte-wide register accessors the simpler
+// devices (UART, NS16550, CLINT) implement.
+type byteReader func(off uint32) (uint8, bool)
+type byteWriter func(off uint32, v uint8) bool
+
+// readBytes composes a sized little-endian read from byte reads.
+func readBytes(read8 byteReader, off, size uint32) (uint64, bool) {
+	var v uint64
+	for i := range size {
+		b, ok := read8(off + i)
+		if !ok {
+			return 0, false
+		}
+		v |= uint64(b) << (8 * i)
+	}
+	return v, true
+}
+
+// writeBytes splits a sized little-endian write into byte writes.
+func writeBytes(write8 byteWriter, off, size uint32, v uint64) bool {
+	for i := range size {
+		if !write8(off+i, uint8(v>>(8*i))) {
+			return false
+		}
+	}
+	return true
+}
+
+// Read implements Device.
+func (m *RAM) Read(off, size uint32) (uint64, bool) {
+	if uint64(off)+uint64(size) > uint64(len(m.data)) {
+		return 0, false
+	}
+	p := m.data[off:]
+	switch size {
+	case 1:
+		return uint64(p[0]), true
+	case 2:
+		return uint64(binary.LittleEndian.Uint16(p)), true
+	case 4:
+		return uint64(binary.LittleEndian.Uint32(p)), true
+	case 8:
+		return binary.LittleEndian.Uint64(p), true
+	}
+	return 0, false
+}
+
+// Write implements Device.
+func (m *RAM) Write(off, size uint32, v uint64) bool {
+	if uint64(off)+uint64(size) > uint64(len(m.data)) {
+		return false
+	}
+	p := m.data[off:]
+	switch size {
+	case 1:
+		p[0] = uint8(v)
+	case 2:
+		binary.LittleEndian.PutUint16(p, uint16(v))
+	case 4:
+		binary.LittleEndian.PutUint32(p, uint32(v))
+	case 8:
+		binary.LittleEndian.PutUint64(p, v)
+	default:
+		return false
+	}
+	return true
+}
+
+// Read implements Device.
+func (u *UART) Read(off, size uint32) (uint64, bool) { return readBytes(u.Read8, off, size) }
+
+// Write implements Device.
+func (u *UART) Write(off, size uint32, v uint64) bool { return writeBytes(u.Write8, off, size, v) }
+
+// Read implements Device.
+func (u *NS16550) Read(off, size uint32) (uint64, bool) { return readBytes(u.Read8, off, size) }
+
+// Write implements Device.
+func (u *NS16550) Write(off, size uint32, v uint64) bool { return writeBytes(u.Write8, off, size, v) }
+
+// Read implements Device.
+func (k *CLINT) Read(off, size uint32) (uint64, bool) { return readBytes(k.Read8, off, size) }
+
+// Write implements Device.
+func (k *CLINT) Write(off, size uint32, v uint64) bool { return writeBytes(k.Write8, off, size, v) }
+
+// Read implements Device; only word accesses are supported.
+func (p *PLIC) Read(off, size uint32) (uint64, bool) {
+	if size != 4 {
+		return 0, false
+	}
+	v, ok := p.Read32(off)
+	return uint64(v), ok
+}
+
+// Write implements Device; only word accesses are supported.
+func (p *PLIC) Write(off, size uint32, v uint64) bool {
+	return size == 4 && p.Write32(off, uint32(v))
+}
@@ -16,7 +16,37 @@ func rn(i uint32) string {
 	return fmt.Sprintf("x%d", i)
 }
 
+var mulDivNames = [8]string{"mul", "mulh", "mulhsu", "mulhu", "div", "divu", "rem", "remu"}
+
+// fenceSet formats a FENCE predecessor/successor field (low 4 bits of s).
+func fenceSet(s uint32) string {
+	var b []byte
+	for i, ch := range "iorw" {
+		if s&(8>>i) != 0 {
+			b = append(b, byte(ch))
+		}
+	}
+	if len(b) == 0 {
+		return "0"
+	}
+	return string(b)
+}
+
+// InstLen returns the length in bytes (2 or 4) of the instruction whose
+// low bits are inst: anything not ending in 0b11 is a compressed parcel.
+func InstLen(inst uint32) uint32 {
+	if inst&3 != 3 {
+		return 2
+	}
+	return 4
+}
+
+// Disasm returns a human-readable form of inst located at pc. Compressed
+// instructions are passed with the 16-bit parcel in the low half of inst.
 func Disasm(pc, inst uint32) string {
+	if InstLen(inst) == 2 {
+		return disasmC(pc, uint16(inst))
+	}
 	op := inst & 0x7F
 	rd := (inst >> 7) & 0x1F
 	f3 := (inst >> 12) & 0x7
@@ -24,6 +54,10 @@ func Disasm(pc, inst uint32) string {
 	rs2 := (inst >> 20) & 0x1F
 	f7 := (inst >> 25) & 0x7F
 
+	if b, ok := decodeBitmanip(inst); ok {
+		return disasmBitmanip(inst, b)
+	}
+
 	switch op {
 	case OpLUI:
 		return fmt.Sprintf("lui   %s, 0x%x", rn(rd), uint32(immU(inst)))
@@ -55,8 +89,12 @@ func Disasm(pc, inst uint32) string {
 		switch f3 {
 		case f3LB:
 			return fmt.Sprintf("lb    %s, %d(%s)", rn(rd), off, rn(rs1))
+		case f3LH:
+			return fmt.Sprintf("lh    %s, %d(%s)", rn(rd), off, rn(rs1))
 		case F3LBU:
 			return fmt.Sprintf("lbu   %s, %d(%s)", rn(rd), off, rn(rs1))
+		case f3LHU:
+			return fmt.Sprintf("lhu   %s, %d(%s)", rn(rd), off, rn(rs1))
 		case f3LW:
 			return fmt.Sprintf("lw    %s, %d(%s)", rn(rd), off, rn(rs1))
 		}
@@ -65,6 +103,8 @@ func Disasm(pc, inst uint32) string {
 		switch f3 {
 		case F3SB:
 			return fmt.Sprintf("sb    %s, %d(%s)", rn(rs2), off, rn(rs1))
+		case f3SH:
+			return fmt.Sprintf("sh    %s, %d(%s)", rn(rs2), off, rn(rs1))
 		case f3SW:
 			return fmt.Sprintf("sw    %s, %d(%s)", rn(rs2), off, rn(rs1))
 		}
@@ -79,6 +119,10 @@ func Disasm(pc, inst uint32) string {
 			return fmt.Sprintf("ori   %s, %s, %d", rn(rd), rn(rs1), imm)
 		case f3ANDI:
 			return fmt.Sprintf("andi  %s, %s, %d", rn(rd), rn(rs1), imm)
+		case f3SLTI:
+			return fmt.Sprintf("slti  %s, %s, %d", rn(rd), rn(rs1), imm)
+		case f3SLTIU:
+			return fmt.Sprintf("sltiu %s, %s, %d", rn(rd), rn(rs1), imm)
 		case f3SLLI:
 			return fmt.Sprintf("slli  %s, %s, %d", rn(rd), rn(rs1), (uint32(imm) & 0x1F))
 		case f3SRxI:
@@ -88,6 +132,9 @@ func Disasm(pc, inst uint32) string {
 			return fmt.Sprintf("srli  %s, %s, %d", rn(rd), rn(rs1), (uint32(imm) & 0x1F))
 		}
 	case opOP:
+		if f7 == funct7MULDIV {
+			return fmt.Sprintf("%-5s %s, %s, %s", mulDivNames[f3], rn(rd), rn(rs1), rn(rs2))
+		}
 		switch f3 {
 		case f3ADD_SUB:
 			if f7 == funct7SUBSRA {
@@ -112,9 +159,65 @@ func Disasm(pc, inst uint32) string {
 		case f3SLTU:
 			return fmt.Sprintf("sltu  %s, %s, %s", rn(rd), rn(rs1), rn(rs2))
 		}
+	case opLOADFP, opSTOREFP, opMADD, opMSUB, opNMSUB, opNMADD, opOPFP:
+		if s, ok := disasmFP(inst); ok {
+			return s
+		}
+	case opAMO:
+		f5 := inst >> 27
+		name := amoName(f5)
+		if f3 != f3AMOW || name == "" {
+			break
+		}
+		switch (inst >> 25) & 3 { // aq, rl
+		case 1:
+			name += ".rl"
+		case 2:
+			name += ".aq"
+		case 3:
+			name += ".aqrl"
+		}
+		if f5 == f5LR {
+			return fmt.Sprintf("%s %s, (%s)", name, rn(rd), rn(rs1))
+		}
+		return fmt.Sprintf("%s %s, %s, (%s)", name, rn(rd), rn(rs2), rn(rs1))
+	case opMISCMEM:
+		switch f3 {
+		case f3FENCE:
+			return fmt.Sprintf("fence %s, %s", fenceSet(inst>>24), fenceSet(inst>>20))
+		case f3FENCEI:
+			return "fence.i"
+		}
 	case opSYSTEM:
-		if inst == 0x00000073 {
+		switch inst {
+		case instECALL:
 			return "ecall"
+		case instEBREAK:
+			return "ebreak"
+		case instMRET:
+			return "mret"
+		case instSRET:
+			return "sret"
+		case instWFI:
+			return "wfi"
+		}
+		if inst&maskSFENCEVMA == instSFENCEVMA {
+			return fmt.Sprintf("sfence.vma %s, %s", rn(rs1), rn(rs2))
+		}
+		csr := csrName(inst >> 20)
+		switch f3 {
+		case f3CSRRW:
+			return fmt.Sprintf("csrrw %s, %s, %s", rn(rd), csr, rn(rs1))
+		case f3CSRRS:
+			return fmt.Sprintf("csrrs %s, %s, %s", rn(rd), csr, rn(rs1))
+		case f3CSRRC:
+			return fmt.Sprintf("csrrc %s, %s, %s", rn(rd), csr, rn(rs1))
+		case f3CSRRWI:
+			return fmt.Sprintf("csrrwi %s, %s, %d", rn(rd), csr, rs1)
+		case f3CSRRSI:
+			return fmt.Sprintf("csrrsi %s, %s, %d", rn(rd), csr, rs1)
+		case f3CSRRCI:
+			return fmt.Sprintf("csrrci %s, %s, %d", rn(rd), csr, rs1)
 		}
 		return "system"
 	}
@@ -0,0 +1,125 @@
+package sim
+
+import "fmt"
+
+var abiFReg = [...]string{
+	"ft0", "ft1", "ft2", "ft3", "ft4", "ft5", "ft6", "ft7",
+	"fs0", "fs1", "fa0", "fa1", "fa2", "fa3", "fa4", "fa5",
+	"fa6", "fa7", "fs2", "fs3", "fs4", "fs5", "fs6", "fs7",
+	"fs8", "fs9", "fs10", "fs11", "ft8", "ft9", "ft10", "ft11",
+}
+
+func fn(i uint32) string {
+	if i < uint32(len(abiFReg)) {
+		return abiFReg[i]
+	}
+	return fmt.Sprintf("f%d", i)
+}
+
+var rmNames = [8]string{"rne", "rtz", "rdn", "rup", "rmm", "rm5", "rm6", "dyn"}
+
+// fpSuffix maps the fmt field to the mnemonic suffix ("" if unknown).
+func fpSuffix(fmtField uint32) string {
+	switch fmtField {
+	case 0:
+		return "s"
+	case 1:
+		return "d"
+	}
+	return ""
+}
+
+// withRM appends the rounding mode operand, which assemblers omit for dyn.
+func withRM(s string, rm uint32) string {
+	if rm == rmDYN {
+		return s
+	}
+	return s + ", " + rmNames[rm]
+}
+
+// disasmFP formats F/D instructions; ok is false for unknown encodings.
+func disasmFP(inst uint32) (string, bool) {
+	op := inst & 0x7F
+	rd := (inst >> 7) & 0x1F
+	f3 := (inst >> 12) & 0x7
+	rs1 := (inst >> 15) & 0x1F
+	rs2 := (inst >> 20) & 0x1F
+	f7 := inst >> 25
+
+	switch op {
+	case opLOADFP:
+		switch f3 {
+		case f3FLW:
+			return fmt.Sprintf("flw   %s, %d(%s)", fn(rd), immI(inst), rn(rs1)), true
+		case f3FLD:
+			return fmt.Sprintf("fld   %s, %d(%s)", fn(rd), immI(inst), rn(rs1)), true
+		}
+	case opSTOREFP:
+		switch f3 {
+		case f3FSW:
+			return fmt.Sprintf("fsw   %s, %d(%s)", fn(rs2), immS(inst), rn(rs1)), true
+		case f3FSD:
+			return fmt.Sprintf("fsd   %s, %d(%s)", fn(rs2), immS(inst), rn(rs1)), true
+		}
+	case opMADD, opMSUB, opNMSUB, opNMADD:
+		sfx := fpSuffix(f7 & 3)
+		if sfx == "" {
+			break
+		}
+		name := map[uint32]string{opMADD: "fmadd", opMSUB: "fmsub", opNMSUB: "fnmsub", opNMADD: "fnmadd"}[op]
+		return withRM(fmt.Sprintf("%s.%s %s, %s, %s, %s", name, sfx, fn(rd), fn(rs1), fn(rs2), fn(inst>>27)), f3), true
+	case opOPFP:
+		sfx := fpSuffix(f7 & 3)
+		if sfx == "" {
+			break
+		}
+		switch f7 >> 2 {
+		case f5FADD, f5FSUB, f5FMUL, f5FDIV:
+			name := [...]string{"fadd", "fsub", "fmul", "fdiv"}[f7>>2]
+			return withRM(fmt.Sprintf("%s.%s %s, %s, %s", name, sfx, fn(rd), fn(rs1), fn(rs2)), f3), true
+		case f5FCVTFF:
+			if src := fpSuffix(rs2); src != "" && src != sfx {
+				return withRM(fmt.Sprintf("fcvt.%s.%s %s, %s", sfx, src, fn(rd), fn(rs1)), f3), true
+			}
+		case f5FSQRT:
+			return withRM(fmt.Sprintf("fsqrt.%s %s, %s", sfx, fn(rd), fn(rs1)), f3), true
+		case f5FSGNJ:
+			if f3 <= 2 {
+				name := [...]string{"fsgnj", "fsgnjn", "fsgnjx"}[f3]
+				return fmt.Sprintf("%s.%s %s, %s, %s", name, sfx, fn(rd), fn(rs1), fn(rs2)), true
+			}
+		case f5FMINMAX:
+			if f3 <= 1 {
+				name := [...]string{"fmin", "fmax"}[f3]
+				return fmt.Sprintf("%s.%s %s, %s, %s", name, sfx, fn(rd), fn(rs1), fn(rs2)), true
+			}
+		case f5FCMP:
+			if f3 <= 2 {
+				name := [...]string{"fle", "flt", "feq"}[f3]
+				return fmt.Sprintf("%s.%s %s, %s, %s", name, sfx, rn(rd), fn(rs1), fn(rs2)), true
+			}
+		case f5FCVTIF:
+			if rs2 <= 1 {
+				name := [...]string{"fcvt.w", "fcvt.wu"}[rs2]
+				return withRM(fmt.Sprintf("%s.%s %s, %s", name, sfx, rn(rd), fn(rs1)), f3), true
+			}
+		case f5FCVTFI:
+			if rs2 <= 1 {
+				name := [...]string{"w", "wu"}[rs2]
+				return withRM(fmt.Sprintf("fcvt.%s.%s %s, %s", sfx, name, fn(rd), rn(rs1)), f3), true
+			}
+		case f5FMVXF:
+			if f3 == 0 && sfx == "s" {
+				return fmt.Sprintf("fmv.x.w %s, %s", rn(rd), fn(rs1)), true
+			}
+			if f3 == 1 {
+				return fmt.Sprintf("fclass.%s %s, %s", sfx, rn(rd), fn(rs1)), true
+			}
+		case f5FMVFX:
+			if f3 == 0 && sfx == "s" {
+				return fmt.Sprintf("fmv.w.x %s, %s", fn(rd), rn(rs1)), true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,44 @@
+package sim
+
+import "fmt"
+
+// disasmC formats a compressed instruction using its c.* mnemonic. Operands
+// are taken from the expanded form, printed in compressed-assembler order.
+func disasmC(pc uint32, h uint16) string {
+	inst, name := expandC(h)
+	if name == "" {
+		return fmt.Sprintf(".half 0x%04x", h)
+	}
+	rd := (inst >> 7) & 0x1F
+	rs1 := (inst >> 15) & 0x1F
+	rs2 := (inst >> 20) & 0x1F
+
+	switch name {
+	case "c.nop", "c.ebreak":
+		return name
+	case "c.j", "c.jal":
+		return fmt.Sprintf("%s 0x%08x", name, addPC(pc, immJ(inst)))
+	case "c.beqz", "c.bnez":
+		return fmt.Sprintf("%s %s, 0x%08x", name, rn(rs1), addPC(pc, immB(inst)))
+	case "c.jr", "c.jalr":
+		return fmt.Sprintf("%s %s", name, rn(rs1))
+	case "c.mv", "c.add", "c.sub", "c.xor", "c.or", "c.and":
+		return fmt.Sprintf("%s %s, %s", name, rn(rd), rn(rs2))
+	case "c.lui":
+		return fmt.Sprintf("%s %s, 0x%x", name, rn(rd), inst>>12)
+	case "c.slli", "c.srli", "c.srai":
+		return fmt.Sprintf("%s %s, %d", name, rn(rd), rs2)
+	case "c.addi", "c.li", "c.andi", "c.addi16sp":
+		return fmt.Sprintf("%s %s, %d", name, rn(rd), immI(inst))
+	case "c.addi4spn":
+		return fmt.Sprintf("%s %s, sp, %d", name, rn(rd), immI(inst))
+	case "c.lw", "c.lwsp":
+		return fmt.Sprintf("%s %s, %d(%s)", name, rn(rd), immI(inst), rn(rs1))
+	case "c.sw", "c.swsp":
+		return fmt.Sprintf("%s %s, %d(%s)", name, rn(rs2), immS(inst), rn(rs1))
+	case "c.flw", "c.fld", "c.flwsp", "c.fldsp":
+		return fmt.Sprintf("%s %s, %d(%s)", name, fn(rd), immI(inst), rn(rs1))
+	default: // c.fsw, c.fsd, c.fswsp, c.fsdsp
+		return fmt.Sprintf("%s %s, %d(%s)", name, fn(rs2), immS(inst), rn(rs1))
+	}
+}
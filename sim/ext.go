@@ -0,0 +1,121 @@
+package sim
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ISA is the set of optional extensions a CPU implements on top of RV32I.
+// The zero value is a pure RV32I machine.
+type ISA uint32
+
+const (
+	ExtM   ISA = 1 << iota // integer multiply/divide
+	ExtA                   // atomics (LR/SC, AMO)
+	ExtC                   // compressed 16-bit instructions
+	ExtF                   // single-precision floating point
+	ExtD                   // double-precision floating point (requires F)
+	ExtZba                 // address generation (shNadd)
+	ExtZbb                 // basic bit manipulation
+	ExtZbc                 // carry-less multiplication
+	ExtZbs                 // single-bit instructions
+)
+
+// Has reports whether every extension in ext is enabled.
+func (i ISA) Has(ext ISA) bool { return i&ext == ext }
+
+// Single-letter extensions in canonical ISA-string order.
+var isaLetters = []struct {
+	letter byte
+	ext    ISA
+}{
+	{'m', ExtM},
+	{'a', ExtA},
+	{'f', ExtF},
+	{'d', ExtD},
+	{'c', ExtC},
+}
+
+// Multi-letter extensions, written after the single letters and separated
+// by underscores ("rv32imc_zba_zbb").
+var isaNames = []struct {
+	name string
+	ext  ISA
+}{
+	{"zba", ExtZba},
+	{"zbb", ExtZbb},
+	{"zbc", ExtZbc},
+	{"zbs", ExtZbs},
+}
+
+// String returns the canonical ISA string, e.g. "rv32im" or "rv32ic_zbb".
+func (i ISA) String() string {
+	var sb strings.Builder
+	sb.WriteString("rv32i")
+	for _, l := range isaLetters {
+		if i.Has(l.ext) {
+			sb.WriteByte(l.letter)
+		}
+	}
+	for _, n := range isaNames {
+		if i.Has(n.ext) {
+			sb.WriteString("_" + n.name)
+		}
+	}
+	return sb.String()
+}
+
+// misa returns the misa extension bits for the enabled extensions. The S
+// and U privilege modes are always implemented.
+func (i ISA) misa() uint32 {
+	v := misaExt('I') | misaExt('S') | misaExt('U')
+	for _, l := range isaLetters {
+		if i.Has(l.ext) {
+			v |= misaExt(l.letter - 'a' + 'A')
+		}
+	}
+	return v
+}
+
+// ParseISA parses a -march style string such as "rv32im", "rv32gc" (G is
+// shorthand for IMAFD) or "rv32i_zba_zbb". zicsr and zifencei are accepted
+// and ignored since those instructions are always available.
+func ParseISA(s string) (ISA, error) {
+	s = strings.ToLower(s)
+	var isa ISA
+	rest, ok := strings.CutPrefix(s, "rv32i")
+	if !ok {
+		if rest, ok = strings.CutPrefix(s, "rv32g"); !ok {
+			return 0, fmt.Errorf("ISA %q: must start with rv32i or rv32g", s)
+		}
+		isa = ExtM | ExtA | ExtF | ExtD
+	}
+	rest, multi, _ := strings.Cut(rest, "_")
+next:
+	for _, ch := range []byte(rest) {
+		for _, l := range isaLetters {
+			if ch == l.letter {
+				isa |= l.ext
+				continue next
+			}
+		}
+		return 0, fmt.Errorf("ISA %q: unsupported extension %q", s, ch)
+	}
+nextName:
+	for _, name := range strings.Split(multi, "_") {
+		if name == "" || name == "zicsr" || name == "zifencei" {
+			continue
+		}
+		for _, n := range isaNames {
+			if name == n.name {
+				isa |= n.ext
+				continue nextName
+			}
+		}
+		return 0, fmt.Errorf("ISA %q: unsupported extension %q", s, name)
+	}
+	if isa.Has(ExtD) && !isa.Has(ExtF) {
+		return 0, fmt.Errorf("ISA %q: D requires F", s)
+	}
+	return isa, nil
+}
@@ -0,0 +1,93 @@
+package sim
+
+import (
+	"fmt"
+	"os"
+)
+
+// Test finisher (SiFive "test" / syscon device, as on QEMU's virt machine),
+// in the MMIO window above RAM after the virtio slots.
+const (
+	FinisherBase uint32 = 0x1010_0000
+	FinisherSize        = 0x1000
+
+	finisherFail  = 0x3333 // upper 16 bits: exit code
+	finisherPass  = 0x5555
+	finisherReset = 0x7777
+)
+
+// FinishKind tells how a program ended through the test finisher.
+type FinishKind uint8
+
+const (
+	FinishNone  FinishKind = iota // still running
+	FinishPass                    // 0x5555 written
+	FinishFail                    // 0x3333 | code<<16 written
+	FinishReset                   // 0x7777 written
+)
+
+// FinishResult is what the program reported to the test finisher.
+type FinishResult struct {
+	Kind FinishKind
+	Code uint16 // exit code of a FinishFail
+}
+
+func (r FinishResult) String() string {
+	switch r.Kind {
+	case FinishPass:
+		return "pass"
+	case FinishFail:
+		return fmt.Sprintf("fail (code %d)", r.Code)
+	case FinishReset:
+		return "reset"
+	}
+	return "running"
+}
+
+// TestFinisher lets a program end the simulation with a pass/fail status.
+// A 16- or 32-bit store to offset 0 whose low half is 0x5555 (pass),
+// 0x3333 (fail, with the exit code in the upper half) or 0x7777 (reset)
+// records the result and stops every hart after the storing instruction.
+// Other values are ignored and the registers read as zero.
+type TestFinisher struct {
+	harts  []*CPU
+	result FinishResult
+}
+
+// NewTestFinisher returns a finisher that stops harts when written.
+func NewTestFinisher(harts ...*CPU) *TestFinisher { return &TestFinisher{harts: harts} }
+
+// Result returns what the program reported; Kind is FinishNone until then.
+func (f *TestFinisher) Result() FinishResult { return f.result }
+
+// Read implements Device.
+func (f *TestFinisher) Read(off, size uint32) (uint64, bool) {
+	return 0, off < FinisherSize && (size == 2 || size == 4)
+}
+
+// Write implements Device.
+func (f *TestFinisher) Write(off, size uint32, v uint64) bool {
+	if off >= FinisherSize || (size != 2 && size != 4) {
+		return false
+	}
+	if off != 0 {
+		return true
+	}
+	r := FinishResult{}
+	switch v & 0xFFFF {
+	case finisherPass:
+		r.Kind = FinishPass
+	case finisherFail:
+		r.Kind, r.Code = FinishFail, uint16(v>>16)
+	case finisherReset:
+		r.Kind = FinishReset
+	default:
+		return true
+	}
+	f.result = r
+	fmt.Fprintf(os.Stderr, "\n[halt] test finisher: %s\n", r)
+	for _, c := range f.harts {
+		c.Stop()
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+package sim
+
+import "testing"
+
+func TestFinisher_Values(t *testing.T) {
+	for _, tc := range []struct {
+		size uint32
+		v    uint64
+		want FinishResult
+	}{
+		{4, 0x5555, FinishResult{Kind: FinishPass}},
+		{4, 0x002A_3333, FinishResult{Kind: FinishFail, Code: 42}},
+		{2, 0x3333, FinishResult{Kind: FinishFail}},
+		{4, 0x7777, FinishResult{Kind: FinishReset}},
+		{4, 0x1234, FinishResult{}}, // ignored
+	} {
+		cpu, _ := newTestCPU(t)
+		f := NewTestFinisher(cpu)
+		if !f.Write(0, tc.size, tc.v) {
+			t.Fatalf("write 0x%x failed", tc.v)
+		}
+		if got := f.Result(); got != tc.want {
+			t.Errorf("write 0x%x: result %v, want %v", tc.v, got, tc.want)
+		}
+		if stopped := tc.want.Kind != FinishNone; cpu.stopped != stopped {
+			t.Errorf("write 0x%x: hart stopped = %v", tc.v, cpu.stopped)
+		}
+	}
+	f := NewTestFinisher()
+	if f.Write(0, 1, finisherPass) || f.Write(0, 8, finisherPass) {
+		t.Errorf("byte/doubleword store accepted")
+	}
+}
+
+func TestFinisher_StopsRun(t *testing.T) {
+	const t1 = 6
+	cpu, _ := newTestCPU(t,
+		encU(OpLUI, t0, FinisherBase),
+		encU(OpLUI, t1, 0x73000),
+		encI(OpOPIMM, t1, F3ADDI, t1, 0x333),
+		encS(f3SW, t0, t1, 0), // 0x0c: fail, code 7
+		encI(OpOPIMM, a0, F3ADDI, x0, 1),
+		instECALL,
+	)
+	f := NewTestFinisher(cpu)
+	if err := cpu.Bus.Map("finisher", FinisherBase, FinisherSize, f); err != nil {
+		t.Fatal(err)
+	}
+	steps := 0
+	for cpu.Step() {
+		steps++
+	}
+	if steps != 3 || cpu.PC != 0x10 || cpu.Reg[a0] != 0 {
+		t.Errorf("stopped after %d steps at pc=0x%x (a0=%d)", steps, cpu.PC, cpu.Reg[a0])
+	}
+	if r := f.Result(); r != (FinishResult{Kind: FinishFail, Code: 7}) {
+		t.Errorf("result = %v", r)
+	}
+	if cpu.Step() || cpu.PC != 0x10 {
+		t.Errorf("hart ran on after the finisher stopped it")
+	}
+}
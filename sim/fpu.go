@@ -0,0 +1,268 @@
+package sim
+
+// F and D extensions: 32 FP registers, fcsr (fflags + frm) and the single-
+// and double-precision instructions. Registers are 64 bits wide (FLEN=64);
+// single-precision values are NaN-boxed (upper 32 bits all ones) and a
+// single read from a register that is not properly boxed yields the
+// canonical NaN.
+//
+// Arithmetic is done by the software IEEE core in softfloat.go.
+
+// FP CSRs
+const (
+	CSRFflags = 0x001
+	CSRFrm    = 0x002
+	CSRFcsr   = 0x003
+)
+
+// mstatus.FS (FP unit state) and the summary dirty bit.
+const (
+	mstatusFS        = 3 << 13
+	mstatusFSInitial = 1 << 13
+	mstatusFSDirty   = 3 << 13
+	mstatusSD        = 1 << 31
+)
+
+const nanBox = 0xFFFFFFFF_00000000
+
+// fpOn reports whether FP instructions and CSRs are usable: the extension
+// is present and mstatus.FS is not Off.
+func (c *CPU) fpOn() bool {
+	return c.ISA.Has(ExtF) && c.csr.mstatus&mstatusFS != 0
+}
+
+// fpDirty marks the FP state as modified (mstatus.FS = Dirty).
+func (c *CPU) fpDirty() { c.csr.mstatus |= mstatusFSDirty }
+
+// fpFormat returns the format selected by an instruction's fmt field, if
+// this CPU implements it.
+func (c *CPU) fpFormat(fmtField uint32) (fpFormat, bool) {
+	switch fmtField {
+	case 0:
+		return fmtS, c.ISA.Has(ExtF)
+	case 1:
+		return fmtD, c.ISA.Has(ExtF | ExtD)
+	}
+	return fpFormat{}, false
+}
+
+func (c *CPU) readF(f fpFormat, r uint32) uint64 {
+	v := c.F[r]
+	if f == fmtS {
+		if v&nanBox != nanBox {
+			return fmtS.nan()
+		}
+		return v &^ nanBox
+	}
+	return v
+}
+
+func (c *CPU) writeF(f fpFormat, r uint32, v uint64) {
+	if f == fmtS {
+		v |= nanBox
+	}
+	c.F[r] = v
+	c.fpDirty()
+}
+
+func (c *CPU) setFFlags(fl uint32) {
+	if fl != 0 {
+		c.csr.fflags |= fl
+		c.fpDirty()
+	}
+}
+
+// roundingMode resolves an instruction rm field (DYN reads frm). ok is false
+// for the reserved encodings, which make the instruction illegal.
+func (c *CPU) roundingMode(rm uint32) (uint32, bool) {
+	if rm == rmDYN {
+		rm = c.csr.frm
+	}
+	return rm, rm <= rmRMM
+}
+
+// execFP executes an FP load/store, fused multiply-add or OP-FP instruction.
+// It returns false if the instruction raised an exception.
+func (c *CPU) execFP(inst uint32) bool {
+	op := inst & 0x7F
+	rd := (inst >> 7) & 0x1F
+	f3 := (inst >> 12) & 0x7
+	rs1 := (inst >> 15) & 0x1F
+	rs2 := (inst >> 20) & 0x1F
+
+	if !c.fpOn() {
+		return c.illegal()
+	}
+
+	switch op {
+	case opLOADFP:
+		addr := c.readReg(rs1) + uint32(immI(inst))
+		switch {
+		case f3 == f3FLW:
+			w, ok := c.memRead(addr, 4, accLoad)
+			if !ok {
+				return false
+			}
+			c.writeF(fmtS, rd, w)
+		case f3 == f3FLD && c.ISA.Has(ExtD):
+			d, ok := c.memRead(addr, 8, accLoad)
+			if !ok {
+				return false
+			}
+			c.writeF(fmtD, rd, d)
+		default:
+			return c.illegal()
+		}
+
+	case opSTOREFP:
+		addr := c.readReg(rs1) + uint32(immS(inst))
+		switch {
+		case f3 == f3FSW:
+			if !c.memWrite(addr, 4, c.F[rs2]) {
+				return false
+			}
+		case f3 == f3FSD && c.ISA.Has(ExtD):
+			if !c.memWrite(addr, 8, c.F[rs2]) {
+				return false
+			}
+		default:
+			return c.illegal()
+		}
+
+	case opMADD, opMSUB, opNMSUB, opNMADD:
+		f, ok := c.fpFormat((inst >> 25) & 3)
+		rm, rmOK := c.roundingMode(f3)
+		if !ok || !rmOK {
+			return c.illegal()
+		}
+		rs3 := inst >> 27
+		negProd := op == opNMSUB || op == opNMADD
+		negAddend := op == opMSUB || op == opNMADD
+		r, fl := f.fma(c.readF(f, rs1), c.readF(f, rs2), c.readF(f, rs3), negProd, negAddend, rm)
+		c.writeF(f, rd, r)
+		c.setFFlags(fl)
+
+	default: // opOPFP
+		return c.execOPFP(inst)
+	}
+	return true
+}
+
+func (c *CPU) execOPFP(inst uint32) bool {
+	rd := (inst >> 7) & 0x1F
+	f3 := (inst >> 12) & 0x7
+	rs1 := (inst >> 15) & 0x1F
+	rs2 := (inst >> 20) & 0x1F
+	f7 := inst >> 25
+
+	f, ok := c.fpFormat(f7 & 3)
+	if !ok {
+		return c.illegal()
+	}
+	a, b := c.readF(f, rs1), c.readF(f, rs2)
+
+	switch f7 >> 2 {
+	case f5FADD, f5FSUB, f5FMUL, f5FDIV, f5FSQRT:
+		rm, ok := c.roundingMode(f3)
+		if !ok || (f7>>2 == f5FSQRT && rs2 != 0) {
+			return c.illegal()
+		}
+		var r uint64
+		var fl uint32
+		switch f7 >> 2 {
+		case f5FADD:
+			r, fl = f.add(a, b, rm)
+		case f5FSUB:
+			r, fl = f.sub(a, b, rm)
+		case f5FMUL:
+			r, fl = f.mul(a, b, rm)
+		case f5FDIV:
+			r, fl = f.div(a, b, rm)
+		default:
+			r, fl = f.sqrt(a, rm)
+		}
+		c.writeF(f, rd, r)
+		c.setFFlags(fl)
+
+	case f5FSGNJ:
+		sign := f.signBit()
+		switch f3 {
+		case 0: // FSGNJ
+			c.writeF(f, rd, a&^sign|b&sign)
+		case 1: // FSGNJN
+			c.writeF(f, rd, a&^sign|^b&sign)
+		case 2: // FSGNJX
+			c.writeF(f, rd, a^b&sign)
+		default:
+			return c.illegal()
+		}
+
+	case f5FMINMAX:
+		if f3 > 1 {
+			return c.illegal()
+		}
+		r, fl := f.minMax(a, b, f3 == 1)
+		c.writeF(f, rd, r)
+		c.setFFlags(fl)
+
+	case f5FCMP:
+		if f3 > cmpEQ {
+			return c.illegal()
+		}
+		res, fl := f.compare(a, b, f3)
+		var v uint32
+		if res {
+			v = 1
+		}
+		c.writeReg(rd, v)
+		c.setFFlags(fl)
+
+	case f5FCVTFF: // FCVT.S.D / FCVT.D.S: fmt is the destination, rs2 the source
+		from, ok := c.fpFormat(rs2)
+		rm, rmOK := c.roundingMode(f3)
+		if !ok || !rmOK || from == f {
+			return c.illegal()
+		}
+		r, fl := f.convert(from, c.readF(from, rs1), rm)
+		c.writeF(f, rd, r)
+		c.setFFlags(fl)
+
+	case f5FCVTIF: // FCVT.W[U].fmt
+		rm, ok := c.roundingMode(f3)
+		if !ok || rs2 > 1 {
+			return c.illegal()
+		}
+		v, fl := f.toInt(a, rs2 == 0, rm)
+		c.writeReg(rd, v)
+		c.setFFlags(fl)
+
+	case f5FCVTFI: // FCVT.fmt.W[U]
+		rm, ok := c.roundingMode(f3)
+		if !ok || rs2 > 1 {
+			return c.illegal()
+		}
+		r, fl := f.fromInt(c.readReg(rs1), rs2 == 0, rm)
+		c.writeF(f, rd, r)
+		c.setFFlags(fl)
+
+	case f5FMVXF:
+		switch {
+		case f3 == 0 && rs2 == 0 && f == fmtS: // FMV.X.W: raw low bits, no unboxing
+			c.writeReg(rd, uint32(c.F[rs1]))
+		case f3 == 1 && rs2 == 0: // FCLASS
+			c.writeReg(rd, f.class(a))
+		default:
+			return c.illegal()
+		}
+
+	case f5FMVFX: // FMV.W.X
+		if f3 != 0 || rs2 != 0 || f != fmtS {
+			return c.illegal()
+		}
+		c.writeF(fmtS, rd, uint64(c.readReg(rs1)))
+
+	default:
+		return c.illegal()
+	}
+	return true
+}
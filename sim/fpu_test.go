@@ -0,0 +1,198 @@
+package sim
+
+import "testing"
+
+func encFP(f5, fmtField, rd, rs1, rs2, rm uint32) uint32 {
+	return (f5<<2|fmtField)<<25 | rs2<<20 | rs1<<15 | rm<<12 | rd<<7 | opOPFP
+}
+
+func encFStore(f3, rs1, rs2 uint32, imm int32) uint32 {
+	return encS(f3, rs1, rs2, imm)&^0x7F | opSTOREFP
+}
+
+func TestFPU_LoadComputeStore(t *testing.T) {
+	const fa0, fa1, fa2 = 10, 11, 12
+	cpu, _ := newISATestCPU(t, ExtF,
+		encI(OpOPIMM, 1, F3ADDI, x0, 0x300),
+		encI(opLOADFP, fa0, f3FLW, 1, 0),       // flw fa0, 0(x1)
+		encI(opLOADFP, fa1, f3FLW, 1, 4),       // flw fa1, 4(x1)
+		encFP(f5FDIV, 0, fa2, fa0, fa1, rmDYN), // fdiv.s fa2, fa0, fa1
+		encFStore(f3FSW, 1, fa2, 8),            // fsw fa2, 8(x1)
+		encFP(f5FMVXF, 0, 2, fa2, 0, 0),        // fmv.x.w x2, fa2
+		encFP(f5FCVTIF, 0, 3, fa0, 0, rmRTZ),   // fcvt.w.s x3, fa0, rtz
+		encCSR(f3CSRRS, 4, x0, CSRFflags),      // frflags x4
+		encFP(f5FCMP, 0, 5, fa0, fa1, cmpLT),   // flt.s x5, fa0, fa1
+		instECALL,
+	)
+	cpu.Bus.Write32(0x300, 0x3F800000) // 1.0
+	cpu.Bus.Write32(0x304, 0x40400000) // 3.0
+
+	if !runToHalt(cpu, 100) {
+		t.Fatalf("program did not halt in time")
+	}
+	if v, _ := cpu.Bus.Read32(0x308); v != 0x3EAAAAAB {
+		t.Errorf("stored 1/3 = 0x%08x, want 0x3eaaaaab", v)
+	}
+	if cpu.Reg[2] != 0x3EAAAAAB {
+		t.Errorf("fmv.x.w = 0x%08x", cpu.Reg[2])
+	}
+	if cpu.Reg[3] != 1 {
+		t.Errorf("fcvt.w.s = %d, want 1", cpu.Reg[3])
+	}
+	if cpu.Reg[4] != flagNX {
+		t.Errorf("fflags = %05b, want NX", cpu.Reg[4])
+	}
+	if cpu.Reg[5] != 1 {
+		t.Errorf("flt.s = %d, want 1", cpu.Reg[5])
+	}
+	if cpu.F[fa2]>>32 != 0xFFFFFFFF {
+		t.Errorf("fa2 = 0x%016x, single not NaN-boxed", cpu.F[fa2])
+	}
+	if v, _ := cpu.ReadCSR(CSRMstatus); v&mstatusFS != mstatusFSDirty || v&mstatusSD == 0 {
+		t.Errorf("mstatus = 0x%08x, want FS=Dirty and SD", v)
+	}
+}
+
+func TestFPU_DynamicRoundingMode(t *testing.T) {
+	const fa0, fa1, fa2 = 10, 11, 12
+	cpu, _ := newISATestCPU(t, ExtF,
+		encCSR(f3CSRRWI, x0, rmRUP, CSRFrm),
+		encFP(f5FDIV, 0, fa2, fa0, fa1, rmDYN),
+		encFP(f5FDIV, 0, 13, fa0, fa1, rmRTZ),
+		encCSR(f3CSRRS, 1, x0, CSRFcsr),
+		instECALL,
+	)
+	cpu.F[fa0] = nanBox | 0x3F800000
+	cpu.F[fa1] = nanBox | 0x40400000
+	runToHalt(cpu, 100)
+	if got := uint32(cpu.F[fa2]); got != 0x3EAAAAAB {
+		t.Errorf("frm=rup: 1/3 = 0x%08x", got)
+	}
+	if got := uint32(cpu.F[13]); got != 0x3EAAAAAA {
+		t.Errorf("rm=rtz: 1/3 = 0x%08x", got)
+	}
+	if cpu.Reg[1] != rmRUP<<5|flagNX {
+		t.Errorf("fcsr = 0x%x", cpu.Reg[1])
+	}
+}
+
+func TestFPU_NaNBoxing(t *testing.T) {
+	cpu, _ := newISATestCPU(t, ExtF,
+		encFP(f5FADD, 0, 2, 1, 1, rmRNE), // fadd.s f2, f1, f1
+		instECALL,
+	)
+	cpu.F[1] = 0x00000000_3F800000 // 1.0 without the NaN box
+	runToHalt(cpu, 10)
+	if cpu.F[2] != nanBox|0x7FC00000 {
+		t.Fatalf("f2 = 0x%016x, improperly boxed input must read as canonical NaN", cpu.F[2])
+	}
+}
+
+func TestFPU_Double(t *testing.T) {
+	const fa0, fa1, fa2, fa3 = 10, 11, 12, 13
+	cpu, _ := newISATestCPU(t, ExtF|ExtD,
+		encI(OpOPIMM, 1, F3ADDI, x0, 0x300),
+		encI(opLOADFP, fa0, f3FLD, 1, 0),       // fld fa0, 0(x1)
+		encI(opLOADFP, fa1, f3FLD, 1, 8),       // fld fa1, 8(x1)
+		encFP(f5FDIV, 1, fa2, fa0, fa1, rmDYN), // fdiv.d fa2, fa0, fa1
+		encFStore(f3FSD, 1, fa2, 16),           // fsd fa2, 16(x1)
+		encFP(f5FCVTFF, 0, fa3, fa2, 1, rmDYN), // fcvt.s.d fa3, fa2
+		encFP(f5FCVTFF, 1, 14, fa3, 0, rmDYN),  // fcvt.d.s fa4, fa3
+		encFP(f5FCVTFF, 1, 15, 5, 0, rmDYN),    // fcvt.d.s fa5, ft5 (not boxed)
+		encFP(f5FCVTIF, 1, 2, fa2, 0, rmRTZ),   // fcvt.w.d x2, fa2, rtz
+		encFP(f5FCMP, 1, 3, fa1, fa0, cmpLT),   // flt.d x3, fa1, fa0
+		encI(opLOADFP, 6, f3FLD, 1, 4),         // fld ft6, 4(x1): misaligned
+		instECALL,
+	)
+	cpu.Bus.Write64(0x300, f64(10))
+	cpu.Bus.Write64(0x308, f64(4))
+	cpu.F[5] = f64(1) // a double in an FP register is not a valid single
+
+	if !runToHalt(cpu, 100) {
+		t.Fatalf("program did not halt in time")
+	}
+	if v, _ := cpu.Bus.Read64(0x310); v != f64(2.5) {
+		t.Errorf("stored 10/4 = 0x%016x, want 2.5", v)
+	}
+	if cpu.F[fa3] != nanBox|f32(2.5) {
+		t.Errorf("fcvt.s.d = 0x%016x", cpu.F[fa3])
+	}
+	if cpu.F[14] != f64(2.5) {
+		t.Errorf("fcvt.d.s = 0x%016x", cpu.F[14])
+	}
+	if cpu.F[15] != fmtD.nan() {
+		t.Errorf("fcvt.d.s of unboxed single = 0x%016x, want canonical NaN", cpu.F[15])
+	}
+	if cpu.Reg[2] != 2 || cpu.Reg[3] != 1 {
+		t.Errorf("fcvt.w.d = %d, flt.d = %d", cpu.Reg[2], cpu.Reg[3])
+	}
+	if cpu.PC != 40 {
+		t.Errorf("misaligned fld should stop at pc 40, got %d", cpu.PC)
+	}
+
+	// Without D the fmt=1 encodings are rejected.
+	cpu, _ = newISATestCPU(t, ExtF, encFP(f5FADD, 1, fa2, fa0, fa1, rmDYN), instECALL)
+	cpu.F[fa0] = f64(1)
+	runToHalt(cpu, 10)
+	if cpu.F[fa2] != 0 {
+		t.Errorf("rv32if executed fadd.d")
+	}
+}
+
+func TestFPU_DisabledOrOff(t *testing.T) {
+	prog := []uint32{
+		encFP(f5FMVFX, 0, 1, 5, 0, 0), // fmv.w.x f1, t0
+		instECALL,
+	}
+	// No F extension: instruction is rejected, fcsr does not exist.
+	cpu, _ := newISATestCPU(t, 0, prog...)
+	cpu.Reg[t0] = 42
+	runToHalt(cpu, 10)
+	if cpu.F[1] != 0 {
+		t.Errorf("rv32i executed fmv.w.x")
+	}
+	if _, ok := cpu.ReadCSR(CSRFcsr); ok {
+		t.Errorf("fcsr exists without F")
+	}
+
+	// F present but mstatus.FS=Off: same.
+	cpu, _ = newISATestCPU(t, ExtF, prog...)
+	cpu.WriteCSR(CSRMstatus, 0)
+	cpu.Reg[t0] = 42
+	runToHalt(cpu, 10)
+	if cpu.F[1] != 0 {
+		t.Errorf("FS=Off executed fmv.w.x")
+	}
+	if _, ok := cpu.ReadCSR(CSRFflags); ok {
+		t.Errorf("fflags accessible with FS=Off")
+	}
+}
+
+func TestDisasm_FP(t *testing.T) {
+	cases := map[uint32]string{
+		encI(opLOADFP, 10, f3FLW, a1, 8):                  "flw   fa0, 8(a1)",
+		encFStore(f3FSW, 2, 8, -4):                        "fsw   fs0, -4(sp)",
+		encFP(f5FADD, 0, 10, 11, 12, rmDYN):               "fadd.s fa0, fa1, fa2",
+		encFP(f5FMUL, 0, 10, 11, 12, rmRTZ):               "fmul.s fa0, fa1, fa2, rtz",
+		encFP(f5FSQRT, 0, 0, 1, 0, rmDYN):                 "fsqrt.s ft0, ft1",
+		encFP(f5FSGNJ, 0, 10, 11, 11, 1):                  "fsgnjn.s fa0, fa1, fa1",
+		encFP(f5FCMP, 0, a0, 10, 11, cmpEQ):               "feq.s a0, fa0, fa1",
+		encFP(f5FCVTIF, 0, a0, 10, 1, rmRTZ):              "fcvt.wu.s a0, fa0, rtz",
+		encFP(f5FCVTFI, 0, 10, a0, 0, rmDYN):              "fcvt.s.w fa0, a0",
+		encFP(f5FMVXF, 0, a0, 10, 0, 1):                   "fclass.s a0, fa0",
+		encFP(f5FMVFX, 0, 10, a0, 0, 0):                   "fmv.w.x fa0, a0",
+		12<<27 | 11<<20 | 10<<15 | 7<<12 | 13<<7 | opMADD: "fmadd.s fa3, fa0, fa1, fa2",
+		0x6002:                               "c.flwsp ft0, 0(sp)",
+		encI(opLOADFP, 10, f3FLD, 2, 16):     "fld   fa0, 16(sp)",
+		encFStore(f3FSD, 2, 8, 8):            "fsd   fs0, 8(sp)",
+		encFP(f5FADD, 1, 10, 11, 12, rmDYN):  "fadd.d fa0, fa1, fa2",
+		encFP(f5FCVTFF, 0, 10, 11, 1, rmDYN): "fcvt.s.d fa0, fa1",
+		encFP(f5FCVTFF, 1, 10, 11, 0, rmDYN): "fcvt.d.s fa0, fa1",
+		encFP(f5FCVTIF, 1, a0, 10, 0, rmRTZ): "fcvt.w.d a0, fa0, rtz",
+	}
+	for inst, want := range cases {
+		if got := Disasm(0, inst); got != want {
+			t.Errorf("Disasm(0x%08x) = %q, want %q", inst, got, want)
+		}
+	}
+}
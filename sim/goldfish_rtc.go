@@ -0,0 +1,179 @@
+package sim
+
+import (
+	"math/bits"
+	"time"
+)
+
+// Goldfish RTC, in the MMIO window above RAM and on the PLIC source QEMU's
+// virt machine uses.
+const (
+	GoldfishRTCBase uint32 = 0x1010_1000
+	GoldfishRTCSize        = 0x1000
+
+	// GoldfishRTCIRQ is the PLIC source the RTC is wired to by convention.
+	GoldfishRTCIRQ = 11
+)
+
+// Goldfish RTC registers (byte offsets, 32 bits wide).
+const (
+	rtcTimeLow        = 0x00 // read: low half of the time; latches the high half
+	rtcTimeHigh       = 0x04 // high half latched by reading rtcTimeLow
+	rtcAlarmLow       = 0x08 // write: arm the alarm at alarm_high<<32 | value
+	rtcAlarmHigh      = 0x0C
+	rtcIRQEnabled     = 0x10
+	rtcClearAlarm     = 0x14
+	rtcAlarmStatus    = 0x18 // read: 1 while the alarm is armed
+	rtcClearInterrupt = 0x1C
+)
+
+// GoldfishRTC is the Goldfish real-time clock Linux's rtc-goldfish driver
+// expects: a 64-bit count of nanoseconds since the Unix epoch and a
+// one-shot alarm that raises IRQ while it is pending and enabled.
+//
+// By default the clock is virtual: it starts at the epoch given to
+// NewGoldfishRTC and advances with the hart's cycle counter, CPUHz cycles
+// per second, so timestamps are the same on every run. Set Clock to read
+// host time instead. Either way the program may set the time by writing
+// TIME_HIGH and then TIME_LOW.
+//
+// Register the RTC with CPU.AddClocked so that the alarm fires as the hart
+// runs, including while it waits in WFI.
+type GoldfishRTC struct {
+	// IRQ is the RTC's interrupt line, e.g. plic.Line(GoldfishRTCIRQ).
+	IRQ IRQLine
+	// CPUHz is the hart clock of the virtual time; 0 counts one
+	// nanosecond per cycle.
+	CPUHz uint64
+	// Clock, if set, supplies host time in place of the virtual clock.
+	Clock func() time.Time
+
+	base   uint64 // virtual: time at the last write to TIME_LOW
+	cycles uint64 // virtual: hart cycles since then
+	offset uint64 // host: added to Clock's time by writes to TIME_LOW
+
+	timeHigh   uint32 // TIME_HIGH as latched or written
+	alarmHigh  uint32
+	alarm      uint64
+	armed      bool
+	irqEnabled bool
+	irqPending bool
+}
+
+// NewGoldfishRTC returns an RTC whose virtual clock starts at epoch.
+func NewGoldfishRTC(epoch time.Time) *GoldfishRTC {
+	return &GoldfishRTC{base: uint64(epoch.UnixNano())}
+}
+
+// Now returns the current time in nanoseconds since the Unix epoch.
+func (r *GoldfishRTC) Now() uint64 {
+	if r.Clock != nil {
+		return uint64(r.Clock().UnixNano()) + r.offset
+	}
+	if r.CPUHz == 0 {
+		return r.base + r.cycles
+	}
+	hi, lo := bits.Mul64(r.cycles, uint64(time.Second))
+	q, _ := bits.Div64(hi%r.CPUHz, lo, r.CPUHz)
+	return r.base + q
+}
+
+// setTime makes the clock read t from now on.
+func (r *GoldfishRTC) setTime(t uint64) {
+	if r.Clock != nil {
+		r.offset = t - uint64(r.Clock().UnixNano())
+		return
+	}
+	r.base, r.cycles = t, 0
+}
+
+// check fires the alarm once its time has come.
+func (r *GoldfishRTC) check() {
+	if r.armed && r.Now() >= r.alarm {
+		r.armed, r.irqPending = false, true
+	}
+	r.IRQ.Set(r.irqPending && r.irqEnabled)
+}
+
+// Advance implements Clocked.
+func (r *GoldfishRTC) Advance(n uint64) {
+	r.cycles += n
+	r.check()
+}
+
+// NextEvent implements Clocked: the cycles until an armed alarm is due. On
+// host time a waiting hart instead wakes up every uartPollCycles to look.
+func (r *GoldfishRTC) NextEvent() (uint64, bool) {
+	if !r.armed {
+		return 0, false
+	}
+	if r.Clock != nil {
+		return uartPollCycles, true
+	}
+	ns := r.alarm - r.Now()
+	if r.CPUHz == 0 {
+		return ns, true
+	}
+	// Cycles for the remaining nanoseconds, rounded up.
+	hi, lo := bits.Mul64(ns, r.CPUHz)
+	lo, carry := bits.Add64(lo, uint64(time.Second)-1, 0)
+	hi += carry
+	if hi >= uint64(time.Second) {
+		return ^uint64(0), true
+	}
+	q, _ := bits.Div64(hi, lo, uint64(time.Second))
+	return q, true
+}
+
+// Read implements Device.
+func (r *GoldfishRTC) Read(off, size uint32) (uint64, bool) {
+	if off >= GoldfishRTCSize || size != 4 {
+		return 0, false
+	}
+	switch off {
+	case rtcTimeLow:
+		t := r.Now()
+		r.timeHigh = uint32(t >> 32)
+		return uint64(uint32(t)), true
+	case rtcTimeHigh:
+		return uint64(r.timeHigh), true
+	case rtcAlarmLow:
+		return uint64(uint32(r.alarm)), true
+	case rtcAlarmHigh:
+		return r.alarm >> 32, true
+	case rtcIRQEnabled:
+		if r.irqEnabled {
+			return 1, true
+		}
+	case rtcAlarmStatus:
+		if r.armed {
+			return 1, true
+		}
+	}
+	return 0, true
+}
+
+// Write implements Device.
+func (r *GoldfishRTC) Write(off, size uint32, v uint64) bool {
+	if off >= GoldfishRTCSize || size != 4 {
+		return false
+	}
+	switch off {
+	case rtcTimeLow:
+		r.setTime(uint64(r.timeHigh)<<32 | uint64(uint32(v)))
+	case rtcTimeHigh:
+		r.timeHigh = uint32(v)
+	case rtcAlarmLow:
+		r.alarm, r.armed = uint64(r.alarmHigh)<<32|uint64(uint32(v)), true
+	case rtcAlarmHigh:
+		r.alarmHigh = uint32(v)
+	case rtcIRQEnabled:
+		r.irqEnabled = v&1 != 0
+	case rtcClearAlarm:
+		r.armed = false
+	case rtcClearInterrupt:
+		r.irqPending = false
+	}
+	r.check()
+	return true
+}
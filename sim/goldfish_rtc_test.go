@@ -0,0 +1,133 @@
+package sim
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestRTC(t *testing.T, epoch time.Time) (*GoldfishRTC, *Bus, *CPU) {
+	t.Helper()
+	bus := NewBus(NewRAM(4096), nil)
+	cpu := NewCPU(bus)
+	plic := NewPLIC(31, cpu)
+	rtc := NewGoldfishRTC(epoch)
+	rtc.IRQ = plic.Line(GoldfishRTCIRQ)
+	if err := bus.Map("plic", PLICBase, PLICSize, plic); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Map("rtc", GoldfishRTCBase, GoldfishRTCSize, rtc); err != nil {
+		t.Fatal(err)
+	}
+	cpu.AddClocked(rtc)
+	bus.Write32(PLICBase+GoldfishRTCIRQ*4, 1)
+	bus.Write32(PLICBase+plicEnable, 1<<GoldfishRTCIRQ)
+	return rtc, bus, cpu
+}
+
+// rtcTime reads the time the way the Linux driver does.
+func rtcTime(bus *Bus) uint64 {
+	lo, _ := bus.Read32(GoldfishRTCBase + rtcTimeLow)
+	hi, _ := bus.Read32(GoldfishRTCBase + rtcTimeHigh)
+	return uint64(hi)<<32 | uint64(lo)
+}
+
+func TestGoldfishRTC_VirtualTime(t *testing.T) {
+	epoch := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	rtc, bus, cpu := newTestRTC(t, epoch)
+	rtc.CPUHz = 100_000_000 // 10 ns per cycle
+
+	if got := rtcTime(bus); got != uint64(epoch.UnixNano()) {
+		t.Fatalf("time at start = %d, want %d", got, epoch.UnixNano())
+	}
+	cpu.advance(250)
+	if got := rtcTime(bus); got != uint64(epoch.UnixNano())+2500 {
+		t.Errorf("time after 250 cycles = +%d ns, want +2500", got-uint64(epoch.UnixNano()))
+	}
+
+	// Writing TIME_HIGH then TIME_LOW sets the clock.
+	bus.Write32(GoldfishRTCBase+rtcTimeHigh, 1)
+	bus.Write32(GoldfishRTCBase+rtcTimeLow, 5)
+	cpu.advance(1)
+	if got := rtcTime(bus); got != 1<<32|15 {
+		t.Errorf("time after set = %#x, want %#x", got, uint64(1<<32|15))
+	}
+	if bus.Write8(GoldfishRTCBase+rtcTimeLow, 0) {
+		t.Errorf("byte write accepted")
+	}
+}
+
+func TestGoldfishRTC_Alarm(t *testing.T) {
+	rtc, bus, cpu := newTestRTC(t, time.Unix(0, 0))
+	bus.Write32(GoldfishRTCBase+rtcIRQEnabled, 1)
+	bus.Write32(GoldfishRTCBase+rtcAlarmHigh, 0)
+	bus.Write32(GoldfishRTCBase+rtcAlarmLow, 1000)
+	if st, _ := bus.Read32(GoldfishRTCBase + rtcAlarmStatus); st != 1 {
+		t.Fatalf("ALARM_STATUS = %d after arming", st)
+	}
+	if n, ok := rtc.NextEvent(); !ok || n != 1000 {
+		t.Errorf("NextEvent = %d, %v; want 1000 cycles", n, ok)
+	}
+	cpu.advance(999)
+	if csr(t, cpu, CSRMip)&mipMEIP != 0 {
+		t.Fatalf("alarm fired early")
+	}
+	cpu.advance(1)
+	if csr(t, cpu, CSRMip)&mipMEIP == 0 {
+		t.Fatalf("alarm did not fire")
+	}
+	if st, _ := bus.Read32(GoldfishRTCBase + rtcAlarmStatus); st != 0 {
+		t.Errorf("alarm still armed after firing")
+	}
+	if _, ok := rtc.NextEvent(); ok {
+		t.Errorf("NextEvent with no alarm armed")
+	}
+	bus.Write32(GoldfishRTCBase+rtcClearInterrupt, 1)
+	if id, _ := bus.Read32(plicCtx(0, 4)); id != GoldfishRTCIRQ {
+		t.Fatalf("claimed source %d, want %d", id, GoldfishRTCIRQ)
+	}
+	bus.Write32(plicCtx(0, 4), GoldfishRTCIRQ)
+	if csr(t, cpu, CSRMip)&mipMEIP != 0 {
+		t.Errorf("interrupt still raised after CLEAR_INTERRUPT")
+	}
+
+	// An alarm in the past fires at once; a cleared one never does.
+	bus.Write32(GoldfishRTCBase+rtcAlarmLow, 10)
+	if csr(t, cpu, CSRMip)&mipMEIP == 0 {
+		t.Errorf("past alarm did not fire")
+	}
+	bus.Write32(GoldfishRTCBase+rtcClearInterrupt, 1)
+	bus.Read32(plicCtx(0, 4))
+	bus.Write32(plicCtx(0, 4), GoldfishRTCIRQ)
+	bus.Write32(GoldfishRTCBase+rtcAlarmLow, 5000)
+	bus.Write32(GoldfishRTCBase+rtcClearAlarm, 1)
+	cpu.advance(10000)
+	if csr(t, cpu, CSRMip)&mipMEIP != 0 {
+		t.Errorf("cleared alarm fired")
+	}
+}
+
+func TestGoldfishRTC_HostClock(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	rtc, bus, cpu := newTestRTC(t, time.Unix(0, 0))
+	rtc.Clock = func() time.Time { return now }
+	if got := rtcTime(bus); got != uint64(now.UnixNano()) {
+		t.Fatalf("time = %d, want host time %d", got, now.UnixNano())
+	}
+	bus.Write32(GoldfishRTCBase+rtcTimeHigh, 0)
+	bus.Write32(GoldfishRTCBase+rtcTimeLow, 100)
+	now = now.Add(50)
+	if got := rtcTime(bus); got != 150 {
+		t.Errorf("time after set = %d, want 150", got)
+	}
+
+	bus.Write32(GoldfishRTCBase+rtcIRQEnabled, 1)
+	bus.Write32(GoldfishRTCBase+rtcAlarmLow, 200)
+	if n, ok := rtc.NextEvent(); !ok || n != uartPollCycles {
+		t.Errorf("NextEvent on host time = %d, %v", n, ok)
+	}
+	now = now.Add(50)
+	cpu.advance(1)
+	if csr(t, cpu, CSRMip)&mipMEIP == 0 {
+		t.Errorf("alarm did not fire on host time")
+	}
+}
@@ -0,0 +1,127 @@
+package sim
+
+import (
+	"fmt"
+	"os"
+)
+
+// Interrupts.
+//
+// Devices drive the machine/supervisor software, timer and external lines
+// with SetInterrupt; the lines show up in mip next to the bits software may
+// write itself (SSIP, STIP, SEIP). Between instructions Step takes the
+// highest-priority interrupt that is pending, enabled in mie and not masked
+// by the privilege mode and mstatus.MIE/SIE.
+//
+// WFI parks the hart until an interrupt is pending in mip&mie. While it is
+// parked Step does not spin: it jumps simulated time straight to the next
+// event any Clocked device has scheduled.
+
+// Interrupt numbers: bit positions in mip/mie and mcause codes.
+const (
+	IRQSSoft  = 1
+	IRQMSoft  = 3
+	IRQSTimer = 5
+	IRQMTimer = 7
+	IRQSExt   = 9
+	IRQMExt   = 11
+)
+
+// irqPriority lists interrupts from highest to lowest priority.
+var irqPriority = [...]uint32{IRQMExt, IRQMSoft, IRQMTimer, IRQSExt, IRQSSoft, IRQSTimer}
+
+var irqNames = map[uint32]string{
+	IRQSSoft:  "supervisor software interrupt",
+	IRQMSoft:  "machine software interrupt",
+	IRQSTimer: "supervisor timer interrupt",
+	IRQMTimer: "machine timer interrupt",
+	IRQSExt:   "supervisor external interrupt",
+	IRQMExt:   "machine external interrupt",
+}
+
+// A Clocked device keeps time with the hart: Step advances it by the
+// cycles each instruction takes, and a hart idling in WFI skips ahead to
+// the device's next event.
+type Clocked interface {
+	// Advance moves the device's time forward by n cycles.
+	Advance(n uint64)
+	// NextEvent returns the number of cycles until the device next changes
+	// an interrupt line, or ok=false if it has nothing scheduled.
+	NextEvent() (n uint64, ok bool)
+}
+
+// AddClocked registers d to be advanced with the hart's cycle count.
+func (c *CPU) AddClocked(d Clocked) { c.clocked = append(c.clocked, d) }
+
+// SetInterrupt raises (level=true) or lowers one of the interrupt lines
+// IRQSSoft..IRQMExt.
+func (c *CPU) SetInterrupt(irq uint32, level bool) {
+	if level {
+		c.csr.irq |= 1 << irq
+	} else {
+		c.csr.irq &^= 1 << irq
+	}
+}
+
+// Waiting reports whether the hart is parked in WFI.
+func (c *CPU) Waiting() bool { return c.wfi }
+
+// pendingIRQs is mip as software reads it: software-set bits plus lines.
+func (c *CPU) pendingIRQs() uint32 { return c.csr.mip | c.csr.irq }
+
+// interrupt takes the highest-priority interrupt that may be taken now and
+// reports whether it did. Interrupts not delegated through mideleg go to M
+// and are masked in M-mode by MIE; delegated ones go to S, are masked in
+// S-mode by SIE and never interrupt M-mode.
+func (c *CPU) interrupt() bool {
+	pending := c.pendingIRQs() & c.csr.mie
+	if pending == 0 {
+		return false
+	}
+	ms := c.csr.mstatus
+	mOn := c.Priv < PrivM || ms&mstatusMIE != 0
+	sOn := c.Priv < PrivS || c.Priv == PrivS && ms&mstatusSIE != 0
+	for _, irq := range irqPriority {
+		if pending>>irq&1 == 0 {
+			continue
+		}
+		if c.csr.mideleg>>irq&1 != 0 && !sOn || c.csr.mideleg>>irq&1 == 0 && !mOn {
+			continue
+		}
+		if c.Trace {
+			fmt.Fprintf(os.Stderr, "[trap] %s at pc=%08x\n", irqNames[irq], c.PC)
+		}
+		c.wfi = false
+		c.takeTrap(causeInterrupt|irq, 0)
+		return true
+	}
+	return false
+}
+
+// idle lets simulated time pass while the hart waits in WFI. It returns
+// false if no device will ever wake the hart.
+func (c *CPU) idle() bool {
+	var next uint64
+	found := false
+	for _, d := range c.clocked {
+		if n, ok := d.NextEvent(); ok && (!found || n < next) {
+			next, found = n, true
+		}
+	}
+	if !found {
+		fmt.Fprintf(os.Stderr, "\n[halt] WFI with no pending events at pc=%08x\n", c.PC)
+		return false
+	}
+	c.tick(max(next, 1))
+	return true
+}
+
+// advance moves every Clocked device forward by n cycles.
+func (c *CPU) advance(n uint64) {
+	if n == 0 {
+		return
+	}
+	for _, d := range c.clocked {
+		d.Advance(n)
+	}
+}
@@ -0,0 +1,161 @@
+package sim
+
+import "testing"
+
+// timerDev raises an interrupt line once its countdown expires.
+type timerDev struct {
+	cpu   *CPU
+	irq   uint32
+	left  uint64
+	armed bool
+}
+
+func (d *timerDev) Advance(n uint64) {
+	if !d.armed {
+		return
+	}
+	if n >= d.left {
+		d.armed = false
+		d.cpu.SetInterrupt(d.irq, true)
+		return
+	}
+	d.left -= n
+}
+
+func (d *timerDev) NextEvent() (uint64, bool) { return d.left, d.armed }
+
+func TestIRQ_PriorityAndGating(t *testing.T) {
+	const nop = 0x00000013
+	cases := []struct {
+		name    string
+		priv    PrivLevel
+		mstatus uint32
+		mideleg uint32
+		lines   []uint32
+		cause   uint32 // 0: no interrupt taken
+		target  PrivLevel
+	}{
+		{"M with MIE", PrivM, mstatusMIE, 0, []uint32{IRQMTimer, IRQMExt}, IRQMExt, PrivM},
+		{"M without MIE", PrivM, 0, 0, []uint32{IRQMTimer}, 0, PrivM},
+		{"soft before timer", PrivM, mstatusMIE, 0, []uint32{IRQMTimer, IRQMSoft}, IRQMSoft, PrivM},
+		{"M before S", PrivS, 0, mipSBits, []uint32{IRQSExt, IRQMTimer}, IRQMTimer, PrivM},
+		{"U ignores MIE", PrivU, 0, 0, []uint32{IRQSTimer}, IRQSTimer, PrivM},
+		{"delegated from U", PrivU, 0, mipSTIP, []uint32{IRQSTimer}, IRQSTimer, PrivS},
+		{"delegated, S without SIE", PrivS, 0, mipSTIP, []uint32{IRQSTimer}, 0, PrivS},
+		{"delegated, S with SIE", PrivS, mstatusSIE, mipSTIP, []uint32{IRQSTimer}, IRQSTimer, PrivS},
+		{"delegated never preempts M", PrivM, mstatusMIE | mstatusSIE, mipSTIP, []uint32{IRQSTimer}, 0, PrivM},
+	}
+	for _, tc := range cases {
+		cpu := newPrivTestCPU(t, nop, nop)
+		cpu.WriteCSR(CSRMstatus, tc.mstatus)
+		cpu.WriteCSR(CSRMideleg, tc.mideleg)
+		cpu.WriteCSR(CSRMie, mipMBits|mipSBits)
+		cpu.Priv = tc.priv
+		for _, l := range tc.lines {
+			cpu.SetInterrupt(l, true)
+		}
+		cpu.PC = 4
+		cpu.Step()
+		if tc.cause == 0 {
+			if cpu.PC != 8 {
+				t.Errorf("%s: interrupt taken, pc=0x%x", tc.name, cpu.PC)
+			}
+			continue
+		}
+		causeCSR, epcCSR, vec := uint32(CSRMcause), uint32(CSRMepc), uint32(0x100)
+		if tc.target == PrivS {
+			causeCSR, epcCSR, vec = CSRScause, CSRSepc, 0x200
+		}
+		if cpu.Priv != tc.target || cpu.PC != vec {
+			t.Errorf("%s: in %v at 0x%x, want %v at 0x%x", tc.name, cpu.Priv, cpu.PC, tc.target, vec)
+			continue
+		}
+		if c := csr(t, cpu, causeCSR); c != causeInterrupt|tc.cause {
+			t.Errorf("%s: cause = 0x%x, want 0x%x", tc.name, c, causeInterrupt|tc.cause)
+		}
+		if epc := csr(t, cpu, epcCSR); epc != 4 {
+			t.Errorf("%s: epc = 0x%x, want the interrupted instruction", tc.name, epc)
+		}
+	}
+}
+
+func TestIRQ_LinesInMipAndVectoring(t *testing.T) {
+	cpu := newPrivTestCPU(t)
+	cpu.SetInterrupt(IRQMExt, true)
+	cpu.SetInterrupt(IRQSExt, true)
+	cpu.WriteCSR(CSRMip, 0) // lines cannot be cleared by software
+	if v := csr(t, cpu, CSRMip); v != mipMEIP|mipSEIP {
+		t.Errorf("mip = 0x%x", v)
+	}
+	cpu.WriteCSR(CSRMideleg, mipSEIP)
+	if v := csr(t, cpu, CSRSip); v != mipSEIP {
+		t.Errorf("sip = 0x%x", v)
+	}
+	cpu.SetInterrupt(IRQSExt, false)
+	cpu.SetInterrupt(IRQMExt, false)
+	if v := csr(t, cpu, CSRMip); v != 0 {
+		t.Errorf("mip after lowering = 0x%x", v)
+	}
+
+	cpu.WriteCSR(CSRMtvec, 0x101)
+	cpu.WriteCSR(CSRMie, mipMTIP)
+	cpu.WriteCSR(CSRMstatus, mstatusMIE)
+	cpu.SetInterrupt(IRQMTimer, true)
+	cpu.Step()
+	if cpu.PC != 0x100+4*IRQMTimer {
+		t.Errorf("vectored timer interrupt at 0x%x", cpu.PC)
+	}
+	if st := csr(t, cpu, CSRMstatus); st&mstatusMIE != 0 || st&mstatusMPIE == 0 {
+		t.Errorf("mstatus = 0x%x, want MIE stacked", st)
+	}
+}
+
+func TestIRQ_WFI(t *testing.T) {
+	cpu := newPrivTestCPU(t,
+		encI(OpOPIMM, t0, F3ADDI, x0, mipMTIP),
+		encCSR(f3CSRRW, x0, t0, CSRMie),
+		instWFI,
+		encI(OpOPIMM, a0, F3ADDI, x0, 1),
+	)
+	dev := &timerDev{cpu: cpu, irq: IRQMTimer, left: 100000, armed: true}
+	cpu.AddClocked(dev)
+	steps := 0
+	for cpu.PC != 16 && steps < 10 {
+		if !cpu.Step() {
+			t.Fatalf("hart stopped at pc=0x%x", cpu.PC)
+		}
+		steps++
+	}
+	// addi, csrw, wfi, one idle step, then the woken addi (MIE is clear,
+	// so no trap is taken).
+	if steps != 5 || cpu.Reg[a0] != 1 {
+		t.Fatalf("steps=%d a0=%d pc=0x%x", steps, cpu.Reg[a0], cpu.PC)
+	}
+	if cyc := csr(t, cpu, CSRMcycle); cyc < 100000 || cyc > 100010 {
+		t.Errorf("mcycle = %d, want time skipped to the timer event", cyc)
+	}
+	if got := Disasm(0, instWFI); got != "wfi" {
+		t.Errorf("Disasm(wfi) = %q", got)
+	}
+
+	// Nothing can wake the hart: Step stops instead of spinning.
+	cpu = newPrivTestCPU(t, instWFI)
+	cpu.Step()
+	if !cpu.Waiting() || cpu.Step() {
+		t.Errorf("WFI without events did not stop the hart")
+	}
+
+	// U-mode, and S-mode with TW, may not wait.
+	for _, tc := range []struct {
+		priv    PrivLevel
+		mstatus uint32
+	}{{PrivU, 0}, {PrivS, mstatusTW}} {
+		cpu := newPrivTestCPU(t, instWFI)
+		cpu.WriteCSR(CSRMstatus, tc.mstatus)
+		cpu.Priv = tc.priv
+		cpu.Step()
+		if cpu.Waiting() || csr(t, cpu, CSRMcause) != CauseIllegalInst {
+			t.Errorf("wfi in %v (mstatus=0x%x) not illegal", tc.priv, tc.mstatus)
+		}
+	}
+}
@@ -2,16 +2,41 @@ package sim
 
 // Opcodes
 const (
-	OpLUI    = 0x37
-	opAUIPC  = 0x17
-	opJAL    = 0x6F
-	opJALR   = 0x67
-	opBRANCH = 0x63
-	OpLOAD   = 0x03
-	opSTORE  = 0x23
-	OpOPIMM  = 0x13
-	opOP     = 0x33
-	opSYSTEM = 0x73
+	OpLUI     = 0x37
+	opAUIPC   = 0x17
+	opJAL     = 0x6F
+	opJALR    = 0x67
+	opBRANCH  = 0x63
+	OpLOAD    = 0x03
+	opSTORE   = 0x23
+	OpOPIMM   = 0x13
+	opOP      = 0x33
+	opSYSTEM  = 0x73
+	opMISCMEM = 0x0F // FENCE, FENCE.I
+
+	// F/D loads and stores (also targets of the compressed FP forms)
+	opLOADFP  = 0x07
+	opSTOREFP = 0x27
+
+	// F/D computational
+	opMADD  = 0x43
+	opMSUB  = 0x47
+	opNMSUB = 0x4B
+	opNMADD = 0x4F
+	opOPFP  = 0x53
+)
+
+// Fixed SYSTEM encodings
+const (
+	instECALL  = 0x00000073
+	instEBREAK = 0x00100073
+	instMRET   = 0x30200073
+	instSRET   = 0x10200073
+	instWFI    = 0x10500073
+
+	// SFENCE.VMA rs1, rs2: match under maskSFENCEVMA (rs1/rs2 free)
+	instSFENCEVMA = 0x12000073
+	maskSFENCEVMA = 0xFE007FFF
 )
 
 // funct7 markers
@@ -31,20 +56,31 @@ const (
 
 	// LOAD
 	f3LB  = 0x0
+	f3LH  = 0x1
 	F3LBU = 0x4
+	f3LHU = 0x5
 	f3LW  = 0x2
 
 	// STORE
 	F3SB = 0x0
+	f3SH = 0x1
 	f3SW = 0x2
 
+	// LOAD-FP / STORE-FP (width)
+	f3FLW = 0x2
+	f3FLD = 0x3
+	f3FSW = 0x2
+	f3FSD = 0x3
+
 	// OP-IMM
-	F3ADDI = 0x0
-	f3XORI = 0x4
-	f3ORI  = 0x6
-	f3ANDI = 0x7
-	f3SLLI = 0x1
-	f3SRxI = 0x5 // SRLI / SRAI (via funct7)
+	F3ADDI  = 0x0
+	f3XORI  = 0x4
+	f3ORI   = 0x6
+	f3ANDI  = 0x7
+	f3SLLI  = 0x1
+	f3SRxI  = 0x5 // SRLI / SRAI (via funct7)
+	f3SLTI  = 0x2
+	f3SLTIU = 0x3
 
 	// OP
 	f3ADD_SUB = 0x0
@@ -55,4 +91,67 @@ const (
 	f3SRx     = 0x5 // SRL / SRA (via funct7)
 	f3SLT     = 0x2
 	f3SLTU    = 0x3
+
+	// MISC-MEM
+	f3FENCE  = 0x0
+	f3FENCEI = 0x1 // Zifencei
+
+	// SYSTEM (Zicsr); funct3=0 is ECALL/EBREAK/xRET/WFI
+	f3PRIV   = 0x0
+	f3CSRRW  = 0x1
+	f3CSRRS  = 0x2
+	f3CSRRC  = 0x3
+	f3CSRRWI = 0x5
+	f3CSRRSI = 0x6
+	f3CSRRCI = 0x7
+)
+
+// funct7 for the RV32M multiply/divide group on opcode OP
+const funct7MULDIV = 0x01
+
+// funct3 values for RV32M (opcode OP, funct7=0x01)
+const (
+	f3MUL    = 0x0
+	f3MULH   = 0x1
+	f3MULHSU = 0x2
+	f3MULHU  = 0x3
+	f3DIV    = 0x4
+	f3DIVU   = 0x5
+	f3REM    = 0x6
+	f3REMU   = 0x7
+)
+
+// RV32A: opcode AMO, funct3=2 (word), operation in funct5 (inst[31:27]).
+const (
+	opAMO  = 0x2F
+	f3AMOW = 0x2
+
+	f5AMOADD  = 0x00
+	f5AMOSWAP = 0x01
+	f5LR      = 0x02
+	f5SC      = 0x03
+	f5AMOXOR  = 0x04
+	f5AMOOR   = 0x08
+	f5AMOAND  = 0x0C
+	f5AMOMIN  = 0x10
+	f5AMOMAX  = 0x14
+	f5AMOMINU = 0x18
+	f5AMOMAXU = 0x1C
+)
+
+// OP-FP: funct7 = funct5<<2 | fmt, where fmt (inst[26:25]) is 0=S, 1=D.
+const (
+	f5FADD    = 0x00
+	f5FSUB    = 0x01
+	f5FMUL    = 0x02
+	f5FDIV    = 0x03
+	f5FSGNJ   = 0x04 // funct3: 0 FSGNJ, 1 FSGNJN, 2 FSGNJX
+	f5FMINMAX = 0x05 // funct3: 0 FMIN, 1 FMAX
+	f5FCVTFF  = 0x08 // FCVT.S.D / FCVT.D.S (source format in rs2)
+	f5FSQRT   = 0x0B
+	f5FCMP    = 0x14 // funct3: 0 FLE, 1 FLT, 2 FEQ
+	f5FCVTIF  = 0x18 // FCVT.W[U].fmt (rs2: 0 W, 1 WU)
+	f5FCVTFI  = 0x1A // FCVT.fmt.W[U] (rs2: 0 W, 1 WU)
+	f5FMVXF   = 0x1C // funct3: 0 FMV.X.W, 1 FCLASS
+	f5FMVFX   = 0x1E // FMV.W.X
 )
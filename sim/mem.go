@@ -0,0 +1,98 @@
+package sim
+
+// Every memory access made by an instruction goes through memRead/memWrite,
+// which check alignment, translate the address (see mmu.go), check PMP
+// (see pmp.go) and turn bus failures into the matching exception.
+
+// accessType says which exception causes an access raises.
+type accessType uint8
+
+const (
+	accFetch accessType = iota
+	accLoad
+	accStore // stores and AMOs (including the read half of an AMO)
+)
+
+var (
+	misalignedCause = [...]uint32{CauseInstMisaligned, CauseLoadMisaligned, CauseStoreMisaligned}
+	accessCause     = [...]uint32{CauseInstAccessFault, CauseLoadAccessFault, CauseStoreAccessFault}
+)
+
+// memRead reads size bytes (1, 2, 4 or 8) at virtual address addr. On
+// failure it raises an address-misaligned, page-fault or access-fault
+// exception and returns ok=false.
+func (c *CPU) memRead(addr, size uint32, acc accessType) (uint64, bool) {
+	if addr&(size-1) != 0 {
+		return 0, c.exception(misalignedCause[acc], addr)
+	}
+	pa, ok := c.translate(addr, acc)
+	if !ok {
+		return 0, false
+	}
+	return c.physRead(pa, addr, size, acc)
+}
+
+// memWrite writes the low size bytes of v at virtual address addr, raising
+// a store/AMO exception on failure.
+func (c *CPU) memWrite(addr, size uint32, v uint64) bool {
+	if addr&(size-1) != 0 {
+		return c.exception(CauseStoreMisaligned, addr)
+	}
+	pa, ok := c.translate(addr, accStore)
+	if !ok {
+		return false
+	}
+	return c.physWrite(pa, addr, size, v)
+}
+
+// physRead reads size bytes at the already translated address pa; va is
+// reported in mtval on an access fault.
+func (c *CPU) physRead(pa, va, size uint32, acc accessType) (uint64, bool) {
+	if !c.pmpAllows(pa, size, acc, false) {
+		return 0, c.exception(accessCause[acc], va)
+	}
+	var v uint64
+	var ok bool
+	switch size {
+	case 1:
+		var b uint8
+		b, ok = c.Bus.Read8(pa)
+		v = uint64(b)
+	case 2:
+		var h uint16
+		h, ok = c.Bus.Read16(pa)
+		v = uint64(h)
+	case 4:
+		var w uint32
+		w, ok = c.Bus.Read32(pa)
+		v = uint64(w)
+	case 8:
+		v, ok = c.Bus.Read64(pa)
+	}
+	if !ok {
+		return 0, c.exception(accessCause[acc], va)
+	}
+	return v, true
+}
+
+// physWrite is the store counterpart of physRead.
+func (c *CPU) physWrite(pa, va, size uint32, v uint64) bool {
+	if !c.pmpAllows(pa, size, accStore, true) {
+		return c.exception(CauseStoreAccessFault, va)
+	}
+	var ok bool
+	switch size {
+	case 1:
+		ok = c.Bus.Write8(pa, uint8(v))
+	case 2:
+		ok = c.Bus.Write16(pa, uint16(v))
+	case 4:
+		ok = c.Bus.Write32(pa, uint32(v))
+	case 8:
+		ok = c.Bus.Write64(pa, v)
+	}
+	if !ok {
+		return c.exception(CauseStoreAccessFault, va)
+	}
+	return true
+}
@@ -0,0 +1,246 @@
+package sim
+
+// Sv32 address translation.
+//
+// When satp.MODE selects Sv32 and the effective privilege is S or U, every
+// virtual address is translated through a two-level page table rooted at
+// satp.PPN. Leaf PTEs may sit at level 1 (4 MiB megapages) or level 0
+// (4 KiB pages). The walker sets the A and D bits in memory itself, so
+// kernels need not emulate them.
+//
+// Translations are cached in a small fully-associative TLB tagged with the
+// ASID. Like real hardware the TLB is not kept coherent with the page
+// tables: software must execute SFENCE.VMA after changing a PTE (or satp's
+// mapping without a new ASID), which makes stale-TLB bugs observable in
+// class exercises.
+
+// PTE bits
+const (
+	pteV = 1 << 0
+	pteR = 1 << 1
+	pteW = 1 << 2
+	pteX = 1 << 3
+	pteU = 1 << 4
+	pteG = 1 << 5
+	pteA = 1 << 6
+	pteD = 1 << 7
+)
+
+// satp fields (Sv32)
+const (
+	satpASIDShift = 22
+	satpASIDMask  = 0x1FF
+	satpPPNMask   = 0x3FFFFF
+)
+
+const (
+	pageShift = 12
+	tlbSize   = 16
+)
+
+var pageFaultCause = [...]uint32{CauseInstPageFault, CauseLoadPageFault, CauseStorePageFault}
+
+// TLBStats counts TLB activity since the hart was created.
+type TLBStats struct {
+	Hits       uint64 // translations served from the TLB
+	Misses     uint64 // translations that needed a page-table walk
+	Flushes    uint64 // SFENCE.VMA instructions executed
+	PageFaults uint64 // page-fault exceptions raised by translation
+}
+
+type tlbEntry struct {
+	valid bool
+	mega  bool   // 4 MiB megapage: only vpn[1] is compared
+	vpn   uint32 // va >> 12
+	asid  uint32
+	pte   uint32 // leaf PTE as last written by the walker
+}
+
+// tlb is a fully-associative translation cache with round-robin
+// replacement.
+type tlb struct {
+	entries [tlbSize]tlbEntry
+	next    int
+	stats   TLBStats
+}
+
+func (e *tlbEntry) matches(vpn, asid uint32) bool {
+	if !e.valid || e.pte&pteG == 0 && e.asid != asid {
+		return false
+	}
+	if e.mega {
+		return e.vpn>>10 == vpn>>10
+	}
+	return e.vpn == vpn
+}
+
+func (t *tlb) lookup(vpn, asid uint32) *tlbEntry {
+	for i := range t.entries {
+		if t.entries[i].matches(vpn, asid) {
+			return &t.entries[i]
+		}
+	}
+	return nil
+}
+
+// insert caches e, replacing a stale entry for the same page (e.g. one
+// cached before a store set D) or else the next victim.
+func (t *tlb) insert(e tlbEntry) *tlbEntry {
+	if old := t.lookup(e.vpn, e.asid); old != nil {
+		*old = e
+		return old
+	}
+	slot := &t.entries[t.next]
+	*slot = e
+	t.next = (t.next + 1) % tlbSize
+	return slot
+}
+
+// flush implements SFENCE.VMA. A nil va or asid means "all"; global
+// mappings survive an ASID-specific flush.
+func (t *tlb) flush(va, asid *uint32) {
+	t.stats.Flushes++
+	for i := range t.entries {
+		e := &t.entries[i]
+		if va != nil && !e.matches(*va>>pageShift, e.asid) {
+			continue
+		}
+		if asid != nil && (e.pte&pteG != 0 || e.asid != *asid) {
+			continue
+		}
+		e.valid = false
+	}
+}
+
+// TLBStats returns the hart's TLB counters.
+func (c *CPU) TLBStats() TLBStats { return c.tlb.stats }
+
+// dataPriv is the privilege loads and stores are checked against: with
+// mstatus.MPRV set, M-mode accesses use the mode in MPP.
+func (c *CPU) dataPriv() PrivLevel {
+	if c.Priv == PrivM && c.csr.mstatus&mstatusMPRV != 0 {
+		return PrivLevel(c.csr.mstatus & mstatusMPP >> mstatusMPPShift)
+	}
+	return c.Priv
+}
+
+// translate maps the virtual address va to a physical address for an
+// access of type acc. On failure it raises a page fault (or an access fault
+// if the page table itself is unreachable) and returns ok=false.
+func (c *CPU) translate(va uint32, acc accessType) (uint32, bool) {
+	priv := c.Priv
+	if acc != accFetch {
+		priv = c.dataPriv()
+	}
+	satp := c.csr.satp
+	if priv == PrivM || satp&satpModeSv32 == 0 {
+		return va, true
+	}
+	asid := satp >> satpASIDShift & satpASIDMask
+	vpn := va >> pageShift
+
+	// A cached entry is only usable if the walker would not have to update
+	// A/D for this access; otherwise walk again.
+	e := c.tlb.lookup(vpn, asid)
+	if e != nil && (acc != accStore || e.pte&pteD != 0) {
+		c.tlb.stats.Hits++
+	} else {
+		c.tlb.stats.Misses++
+		var ok bool
+		if e, ok = c.walk(va, asid, priv, acc); !ok {
+			return 0, false
+		}
+	}
+	if !c.pteAllows(e.pte, priv, acc) {
+		return 0, c.pageFault(va, acc)
+	}
+	pa := uint64(e.pte>>10) << pageShift
+	if e.mega {
+		pa = pa&^0x3FFFFF | uint64(va&0x3FFFFF)
+	} else {
+		pa |= uint64(va & 0xFFF)
+	}
+	if pa>>32 != 0 { // beyond the 32-bit bus
+		return 0, c.exception(accessCause[acc], va)
+	}
+	return uint32(pa), true
+}
+
+// walk performs the Sv32 page-table walk for va, updates A (and D for
+// stores) in the leaf PTE and caches the result.
+func (c *CPU) walk(va, asid uint32, priv PrivLevel, acc accessType) (*tlbEntry, bool) {
+	table := uint64(c.csr.satp&satpPPNMask) << pageShift
+	for level := 1; level >= 0; level-- {
+		pteAddr := table + uint64(va>>(pageShift+10*level)&0x3FF)*4
+		// Implicit accesses are checked by PMP as S-mode loads/stores.
+		if pteAddr>>32 != 0 || !c.pmpCheck(uint32(pteAddr), 4, pmpR, PrivS) {
+			return nil, c.exception(accessCause[acc], va)
+		}
+		pte, ok := c.Bus.Read32(uint32(pteAddr))
+		if !ok {
+			return nil, c.exception(accessCause[acc], va)
+		}
+		if pte&pteV == 0 || pte&(pteR|pteW) == pteW {
+			return nil, c.pageFault(va, acc)
+		}
+		if pte&(pteR|pteX) == 0 { // pointer to the next level
+			table = uint64(pte>>10) << pageShift
+			continue
+		}
+		if level == 1 && pte>>10&0x3FF != 0 { // misaligned megapage
+			return nil, c.pageFault(va, acc)
+		}
+		if !c.pteAllows(pte, priv, acc) {
+			return nil, c.pageFault(va, acc)
+		}
+		upd := pte | pteA
+		if acc == accStore {
+			upd |= pteD
+		}
+		if upd != pte && (!c.pmpCheck(uint32(pteAddr), 4, pmpW, PrivS) || !c.Bus.Write32(uint32(pteAddr), upd)) {
+			return nil, c.exception(accessCause[acc], va)
+		}
+		return c.tlb.insert(tlbEntry{valid: true, mega: level == 1, vpn: va >> pageShift, asid: asid, pte: upd}), true
+	}
+	return nil, c.pageFault(va, acc)
+}
+
+// pteAllows checks the R/W/X and U permissions of a leaf PTE against the
+// current mstatus.SUM/MXR settings. S-mode may never execute user pages.
+func (c *CPU) pteAllows(pte uint32, priv PrivLevel, acc accessType) bool {
+	ms := c.csr.mstatus
+	if pte&pteU != 0 {
+		if priv == PrivS && (acc == accFetch || ms&mstatusSUM == 0) {
+			return false
+		}
+	} else if priv == PrivU {
+		return false
+	}
+	switch acc {
+	case accFetch:
+		return pte&pteX != 0
+	case accLoad:
+		return pte&pteR != 0 || ms&mstatusMXR != 0 && pte&pteX != 0
+	}
+	return pte&pteW != 0
+}
+
+func (c *CPU) pageFault(va uint32, acc accessType) bool {
+	c.tlb.stats.PageFaults++
+	return c.exception(pageFaultCause[acc], va)
+}
+
+// sfenceVMA executes SFENCE.VMA rs1, rs2: rs1=x0 flushes every address and
+// rs2=x0 every address space.
+func (c *CPU) sfenceVMA(rs1, rs2 uint32) {
+	var va, asid *uint32
+	if rs1 != 0 {
+		v := c.readReg(rs1)
+		va = &v
+	}
+	if rs2 != 0 {
+		a := c.readReg(rs2) & satpASIDMask
+		asid = &a
+	}
+	c.tlb.flush(va, asid)
+}
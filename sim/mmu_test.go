@@ -0,0 +1,238 @@
+package sim
+
+import "testing"
+
+// Page-table layout used by the MMU tests (newTestCPU's 64 KiB of RAM):
+//
+//	0x1000  root table (satp.PPN = 1)
+//	0x2000  level-0 table for VA 0x4000_0000..0x403F_FFFF
+//	0x3000+ data pages
+const (
+	mmuRoot = 0x1000
+	mmuL0   = 0x2000
+	mmuVA   = 0x4000_0000
+)
+
+func pte(pa, flags uint32) uint32 { return pa>>pageShift<<10 | flags }
+
+func newMMUTestCPU(t *testing.T) *CPU {
+	t.Helper()
+	cpu, _ := newTestCPU(t)
+	cpu.WriteCSR(CSRSatp, satpModeSv32|mmuRoot>>pageShift)
+	cpu.Priv = PrivS
+	mapPTE(t, cpu, mmuRoot+(mmuVA>>22)*4, pte(mmuL0, pteV))
+	return cpu
+}
+
+// mapPTE writes a PTE at physical address at.
+func mapPTE(t *testing.T, cpu *CPU, at, v uint32) {
+	t.Helper()
+	if !cpu.Bus.Write32(at, v) {
+		t.Fatalf("PTE at 0x%x is outside RAM", at)
+	}
+}
+
+// mapPage maps the 4 KiB page at mmuVA+n*4096 to pa.
+func mapPage(t *testing.T, cpu *CPU, n, pa, flags uint32) {
+	t.Helper()
+	mapPTE(t, cpu, mmuL0+n*4, pte(pa, flags))
+}
+
+func TestMMU_TranslateAndAD(t *testing.T) {
+	cpu := newMMUTestCPU(t)
+	mapPage(t, cpu, 0, 0x3000, pteV|pteR|pteW)
+	cpu.Bus.Write32(0x3010, 0xCAFEF00D)
+
+	v, ok := cpu.memRead(mmuVA+0x10, 4, accLoad)
+	if !ok || v != 0xCAFEF00D {
+		t.Fatalf("load via page table = 0x%x ok=%v", v, ok)
+	}
+	if p, _ := cpu.Bus.Read32(mmuL0); p&(pteA|pteD) != pteA {
+		t.Errorf("after load: PTE = 0x%x, want A set and D clear", p)
+	}
+	if !cpu.memWrite(mmuVA+0x14, 4, 0x1234) {
+		t.Fatalf("store faulted")
+	}
+	if w, _ := cpu.Bus.Read32(0x3014); w != 0x1234 {
+		t.Errorf("store landed elsewhere: [0x3014] = 0x%x", w)
+	}
+	if p, _ := cpu.Bus.Read32(mmuL0); p&(pteA|pteD) != pteA|pteD {
+		t.Errorf("after store: PTE = 0x%x, want A and D set", p)
+	}
+	cpu.memRead(mmuVA, 4, accLoad)
+	cpu.memWrite(mmuVA, 4, 0)
+
+	// load miss, store miss (D not cached yet), then two hits.
+	if s := cpu.TLBStats(); s.Misses != 2 || s.Hits != 2 || s.PageFaults != 0 {
+		t.Errorf("stats = %+v, want 2 misses and 2 hits", s)
+	}
+
+	// M-mode ignores satp, unless MPRV makes loads/stores use MPP=S.
+	cpu.Priv = PrivM
+	if pa, _ := cpu.translate(mmuVA, accLoad); pa != mmuVA {
+		t.Errorf("M-mode translated 0x%x -> 0x%x", uint32(mmuVA), pa)
+	}
+	cpu.WriteCSR(CSRMstatus, mstatusMPRV|uint32(PrivS)<<mstatusMPPShift)
+	if pa, _ := cpu.translate(mmuVA+4, accLoad); pa != 0x3004 {
+		t.Errorf("MPRV load translated to 0x%x, want 0x3004", pa)
+	}
+	if pa, ok := cpu.translate(mmuVA, accFetch); !ok || pa != mmuVA {
+		t.Errorf("MPRV must not affect fetches: 0x%x", pa)
+	}
+}
+
+func TestMMU_MegapageFetch(t *testing.T) {
+	cpu := newMMUTestCPU(t)
+	// VA 0x8000_0000 -> PA 0 as a 4 MiB executable megapage.
+	mapPTE(t, cpu, mmuRoot+0x200*4, pte(0, pteV|pteR|pteX))
+	writeInst(t, cpu.Bus.RAM, 0x4000, encI(OpOPIMM, a0, F3ADDI, x0, 42))
+	cpu.PC = 0x8000_4000
+	if !cpu.Step() || cpu.Reg[a0] != 42 || cpu.PC != 0x8000_4004 {
+		t.Fatalf("fetch through megapage: a0=%d pc=0x%x", cpu.Reg[a0], cpu.PC)
+	}
+
+	// A megapage whose PPN[0] is non-zero is misaligned.
+	mapPTE(t, cpu, mmuRoot+0x201*4, pte(0x1000, pteV|pteR|pteX))
+	cpu.PC = 0x8040_0000
+	if cpu.Step() {
+		t.Fatalf("misaligned megapage fetched")
+	}
+	if c := csr(t, cpu, CSRMcause); c != CauseInstPageFault {
+		t.Errorf("mcause = %d, want instruction page fault", c)
+	}
+	if v := csr(t, cpu, CSRMtval); v != 0x8040_0000 {
+		t.Errorf("mtval = 0x%x, want the faulting VA", v)
+	}
+}
+
+func TestMMU_Permissions(t *testing.T) {
+	const (
+		user   = pteV | pteR | pteW | pteX | pteU
+		ro     = pteV | pteR
+		xonly  = pteV | pteX
+		wonly  = pteV | pteW // reserved
+		notV   = pteR | pteW
+		kernel = pteV | pteR | pteW | pteX
+	)
+	cases := []struct {
+		name    string
+		flags   uint32
+		priv    PrivLevel
+		mstatus uint32
+		acc     accessType
+		ok      bool
+	}{
+		{"S load user page", user, PrivS, 0, accLoad, false},
+		{"S load user page with SUM", user, PrivS, mstatusSUM, accLoad, true},
+		{"S fetch user page with SUM", user, PrivS, mstatusSUM, accFetch, false},
+		{"U load user page", user, PrivU, 0, accLoad, true},
+		{"U load kernel page", kernel, PrivU, 0, accLoad, false},
+		{"store to read-only", ro, PrivS, 0, accStore, false},
+		{"fetch from read-only", ro, PrivS, 0, accFetch, false},
+		{"load from exec-only", xonly, PrivS, 0, accLoad, false},
+		{"load from exec-only with MXR", xonly, PrivS, mstatusMXR, accLoad, true},
+		{"W without R", wonly, PrivS, 0, accStore, false},
+		{"invalid PTE", notV, PrivS, 0, accLoad, false},
+	}
+	for _, tc := range cases {
+		cpu := newMMUTestCPU(t)
+		mapPage(t, cpu, 1, 0x3000, tc.flags)
+		cpu.WriteCSR(CSRMstatus, tc.mstatus)
+		cpu.Priv = tc.priv
+		_, ok := cpu.translate(mmuVA+0x1008, tc.acc)
+		if ok != tc.ok {
+			t.Errorf("%s: ok=%v, want %v", tc.name, ok, tc.ok)
+			continue
+		}
+		if ok {
+			continue
+		}
+		if c := csr(t, cpu, CSRMcause); c != pageFaultCause[tc.acc] {
+			t.Errorf("%s: mcause=%d, want %d", tc.name, c, pageFaultCause[tc.acc])
+		}
+		if v := csr(t, cpu, CSRMtval); v != mmuVA+0x1008 {
+			t.Errorf("%s: mtval=0x%x", tc.name, v)
+		}
+		if cpu.TLBStats().PageFaults != 1 {
+			t.Errorf("%s: PageFaults = %d", tc.name, cpu.TLBStats().PageFaults)
+		}
+	}
+
+	// A page table outside RAM gives an access fault, not a page fault.
+	cpu := newMMUTestCPU(t)
+	mapPTE(t, cpu, mmuRoot+(mmuVA>>22)*4, pte(0x7000_0000, pteV))
+	if _, ok := cpu.translate(mmuVA, accStore); ok {
+		t.Fatalf("walk through unmapped table succeeded")
+	}
+	if c := csr(t, cpu, CSRMcause); c != CauseStoreAccessFault {
+		t.Errorf("mcause = %d, want store access fault", c)
+	}
+}
+
+func TestMMU_SfenceVMA(t *testing.T) {
+	cpu := newMMUTestCPU(t)
+	mapPage(t, cpu, 0, 0x3000, pteV|pteR|pteW|pteA|pteD)
+	mapPage(t, cpu, 1, 0x4000, pteV|pteR|pteW|pteA|pteD|pteG)
+	cpu.translate(mmuVA, accLoad)
+	cpu.translate(mmuVA+0x1000, accLoad)
+
+	// Remap both pages; the TLB keeps serving the old translations.
+	mapPage(t, cpu, 0, 0x5000, pteV|pteR|pteW|pteA|pteD)
+	mapPage(t, cpu, 1, 0x6000, pteV|pteR|pteW|pteA|pteD|pteG)
+	if pa, _ := cpu.translate(mmuVA, accLoad); pa != 0x3000 {
+		t.Fatalf("stale entry not used: pa=0x%x", pa)
+	}
+
+	// sfence.vma x0, a1 with the current ASID (0) spares the global page.
+	run := func(inst uint32) bool {
+		t.Helper()
+		cpu.Bus.Write32(0x100, inst)
+		cpu.PC = 0x100
+		cpu.WriteCSR(CSRSatp, 0) // fetch untranslated
+		defer cpu.WriteCSR(CSRSatp, satpModeSv32|mmuRoot>>pageShift)
+		return cpu.Step()
+	}
+	cpu.Reg[a1] = 0
+	if !run(instSFENCEVMA | a1<<20) {
+		t.Fatalf("sfence.vma stopped the hart")
+	}
+	if pa, _ := cpu.translate(mmuVA, accLoad); pa != 0x5000 {
+		t.Errorf("ASID flush: pa=0x%x, want new mapping", pa)
+	}
+	if pa, _ := cpu.translate(mmuVA+0x1000, accLoad); pa != 0x4000 {
+		t.Errorf("ASID flush dropped a global entry: pa=0x%x", pa)
+	}
+
+	// sfence.vma a0, x0 flushes that address in every address space.
+	cpu.Reg[a0] = mmuVA + 0x1234
+	run(instSFENCEVMA | a0<<15)
+	if pa, _ := cpu.translate(mmuVA+0x1000, accLoad); pa != 0x6000 {
+		t.Errorf("address flush: pa=0x%x, want new mapping", pa)
+	}
+	if s := cpu.TLBStats(); s.Flushes != 2 {
+		t.Errorf("Flushes = %d", s.Flushes)
+	}
+
+	// Entries are tagged with the ASID.
+	cpu.WriteCSR(CSRSatp, satpModeSv32|7<<satpASIDShift|mmuRoot>>pageShift)
+	before := cpu.TLBStats().Misses
+	cpu.translate(mmuVA, accLoad)
+	if cpu.TLBStats().Misses != before+1 {
+		t.Errorf("entry from ASID 0 hit under ASID 7")
+	}
+
+	// SFENCE.VMA is illegal in U-mode and in S-mode under TVM.
+	for _, tc := range []struct {
+		priv    PrivLevel
+		mstatus uint32
+	}{{PrivU, 0}, {PrivS, mstatusTVM}} {
+		cpu.WriteCSR(CSRMstatus, tc.mstatus)
+		cpu.Priv = tc.priv
+		if run(instSFENCEVMA) {
+			t.Errorf("sfence.vma executed in %v (mstatus=0x%x)", tc.priv, tc.mstatus)
+		}
+	}
+	if got := Disasm(0, instSFENCEVMA|a0<<15|a1<<20); got != "sfence.vma a0, a1" {
+		t.Errorf("Disasm = %q", got)
+	}
+}
@@ -0,0 +1,48 @@
+package sim
+
+import "math"
+
+// mulDiv computes one RV32M operation selected by funct3.
+// Division by zero and signed overflow never trap; they return the
+// results mandated by the spec:
+//
+//	x / 0          = -1 (all ones)     x % 0          = x
+//	MinInt32 / -1  = MinInt32          MinInt32 % -1  = 0
+func mulDiv(f3, a, b uint32) uint32 {
+	switch f3 {
+	case f3MUL:
+		return a * b
+	case f3MULH:
+		return uint32(uint64(int64(int32(a))*int64(int32(b))) >> 32)
+	case f3MULHSU:
+		return uint32(uint64(int64(int32(a))*int64(b)) >> 32)
+	case f3MULHU:
+		return uint32(uint64(a) * uint64(b) >> 32)
+	case f3DIV:
+		switch {
+		case b == 0:
+			return math.MaxUint32
+		case int32(a) == math.MinInt32 && int32(b) == -1:
+			return a
+		}
+		return uint32(int32(a) / int32(b))
+	case f3DIVU:
+		if b == 0 {
+			return math.MaxUint32
+		}
+		return a / b
+	case f3REM:
+		switch {
+		case b == 0:
+			return a
+		case int32(a) == math.MinInt32 && int32(b) == -1:
+			return 0
+		}
+		return uint32(int32(a) % int32(b))
+	default: // f3REMU
+		if b == 0 {
+			return a
+		}
+		return a % b
+	}
+}
@@ -0,0 +1,93 @@
+package sim
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMulDiv_Results(t *testing.T) {
+	const minInt = 0x80000000
+	neg := func(v int32) uint32 { return uint32(v) }
+	cases := []struct {
+		name string
+		f3   uint32
+		a, b uint32
+		want uint32
+	}{
+		{"mul", f3MUL, 7, neg(-3), neg(-21)},
+		{"mulh", f3MULH, neg(-1), neg(-1), 0},
+		{"mulh neg", f3MULH, minInt, 2, neg(-1)},
+		{"mulhsu", f3MULHSU, neg(-1), 0xFFFFFFFF, neg(-1)},
+		{"mulhu", f3MULHU, 0xFFFFFFFF, 0xFFFFFFFF, 0xFFFFFFFE},
+		{"div", f3DIV, neg(-7), 2, neg(-3)},
+		{"div by zero", f3DIV, 5, 0, math.MaxUint32},
+		{"div overflow", f3DIV, minInt, neg(-1), minInt},
+		{"divu", f3DIVU, 0xFFFFFFFE, 2, 0x7FFFFFFF},
+		{"divu by zero", f3DIVU, 5, 0, math.MaxUint32},
+		{"rem", f3REM, neg(-7), 2, neg(-1)},
+		{"rem by zero", f3REM, neg(-7), 0, neg(-7)},
+		{"rem overflow", f3REM, minInt, neg(-1), 0},
+		{"remu", f3REMU, 7, 3, 1},
+		{"remu by zero", f3REMU, 7, 0, 7},
+	}
+	for _, tc := range cases {
+		if got := mulDiv(tc.f3, tc.a, tc.b); got != tc.want {
+			t.Errorf("%s: got 0x%08x, want 0x%08x", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCPU_MulRequiresExtM(t *testing.T) {
+	prog := []uint32{
+		encI(OpOPIMM, 1, F3ADDI, x0, 6),
+		encI(OpOPIMM, 2, F3ADDI, x0, 7),
+		encR(3, f3MUL, 1, 2, funct7MULDIV),
+		instECALL,
+	}
+
+	cpu, _ := newTestCPU(t, prog...)
+	cpu.ISA = ExtM
+	runToHalt(cpu, 100)
+	if cpu.Reg[3] != 42 {
+		t.Fatalf("rv32im: mul = %d, want 42", cpu.Reg[3])
+	}
+
+	cpu, _ = newTestCPU(t, prog...)
+	runToHalt(cpu, 100)
+	if cpu.Reg[3] != 0 {
+		t.Fatalf("rv32i: mul executed, x3 = %d", cpu.Reg[3])
+	}
+}
+
+func TestParseISA(t *testing.T) {
+	isa, err := ParseISA("RV32IM")
+	if err != nil || isa != ExtM {
+		t.Fatalf("ParseISA(RV32IM) = (%v, %v)", isa, err)
+	}
+	if s := isa.String(); s != "rv32im" {
+		t.Fatalf("String() = %q", s)
+	}
+	if _, err := ParseISA("rv64i"); err == nil {
+		t.Fatalf("rv64i should be rejected")
+	}
+	if _, err := ParseISA("rv32iq"); err == nil {
+		t.Fatalf("unknown extension should be rejected")
+	}
+	if isa, err := ParseISA("rv32gc"); err != nil || isa != ExtM|ExtA|ExtF|ExtD|ExtC {
+		t.Fatalf("ParseISA(rv32gc) = (%v, %v)", isa, err)
+	} else if s := isa.String(); s != "rv32imafdc" {
+		t.Fatalf("rv32gc String() = %q", s)
+	}
+	if _, err := ParseISA("rv32id"); err == nil {
+		t.Fatalf("D without F should be rejected")
+	}
+}
+
+func TestDisasm_MulDiv(t *testing.T) {
+	if got := Disasm(0, encR(a0, f3MULHSU, a1, t0, funct7MULDIV)); got != "mulhsu a0, a1, t0" {
+		t.Fatalf("got %q", got)
+	}
+	if got := Disasm(0, encR(a0, f3REMU, a1, t0, funct7MULDIV)); got != "remu  a0, a1, t0" {
+		t.Fatalf("got %q", got)
+	}
+}
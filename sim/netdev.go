@@ -0,0 +1,165 @@
+package sim
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// NetLoopback is a NetBackend that returns every frame to the guest
+// unchanged, like a cable plugged back into the NIC.
+type NetLoopback struct {
+	receive func([]byte)
+}
+
+// Attach and Transmit implement NetBackend.
+func (l *NetLoopback) Attach(receive func([]byte)) { l.receive = receive }
+func (l *NetLoopback) Transmit(frame []byte)       { l.receive(frame) }
+func (l *NetLoopback) synchronous() bool           { return true }
+
+// NetSwitch is an in-process Ethernet switch connecting the NICs of
+// several simulated machines, which may run on different goroutines.
+// It learns which port each source address lives on, forwards unicast
+// frames to that port and floods the rest to every other port.
+type NetSwitch struct {
+	mu    sync.Mutex
+	ports []*switchPort
+	table map[[6]byte]*switchPort
+}
+
+func NewNetSwitch() *NetSwitch { return &NetSwitch{table: make(map[[6]byte]*switchPort)} }
+
+// Port adds a port to the switch and returns it as the backend of one NIC.
+func (s *NetSwitch) Port() NetBackend {
+	p := &switchPort{sw: s}
+	s.mu.Lock()
+	s.ports = append(s.ports, p)
+	s.mu.Unlock()
+	return p
+}
+
+type switchPort struct {
+	sw      *NetSwitch
+	receive func([]byte)
+}
+
+// Attach and Transmit implement NetBackend.
+func (p *switchPort) Attach(receive func([]byte)) {
+	p.sw.mu.Lock()
+	p.receive = receive
+	p.sw.mu.Unlock()
+}
+
+func (p *switchPort) Transmit(frame []byte) {
+	if len(frame) < 14 {
+		return // not even an Ethernet header
+	}
+	var dst, src [6]byte
+	copy(dst[:], frame[0:6])
+	copy(src[:], frame[6:12])
+
+	s := p.sw
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if src[0]&1 == 0 {
+		s.table[src] = p
+	}
+	if out, ok := s.table[dst]; ok && dst[0]&1 == 0 {
+		if out != p && out.receive != nil {
+			out.receive(frame)
+		}
+		return
+	}
+	for _, out := range s.ports {
+		if out != p && out.receive != nil {
+			out.receive(frame)
+		}
+	}
+}
+
+// pcap file format (libpcap 2.4) with Ethernet link type.
+const (
+	pcapMagic    = 0xa1b2c3d4
+	pcapSnaplen  = 65535
+	pcapEthernet = 1
+)
+
+// NetPcap is a NetBackend that records every frame the guest sends and
+// receives to a pcap file for Wireshark or tcpdump, passing them on to
+// an inner backend. With no inner backend it is a sink that only records
+// what the guest sends.
+type NetPcap struct {
+	// Clock timestamps the records; time.Now when nil.
+	Clock func() time.Time
+
+	w     io.Writer
+	inner NetBackend
+	mu    sync.Mutex
+	err   error
+}
+
+// NewNetPcap writes the pcap file header to w and returns the recorder.
+func NewNetPcap(w io.Writer, inner NetBackend) (*NetPcap, error) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnaplen)
+	binary.LittleEndian.PutUint32(hdr[20:], pcapEthernet)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &NetPcap{w: w, inner: inner}, nil
+}
+
+// Err returns the first error writing a record, if any.
+func (p *NetPcap) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *NetPcap) record(frame []byte) {
+	now := time.Now
+	if p.Clock != nil {
+		now = p.Clock
+	}
+	t := now()
+	n := min(len(frame), pcapSnaplen)
+	rec := make([]byte, 16, 16+n)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(n))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(frame)))
+	rec = append(rec, frame[:n]...)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		_, p.err = p.w.Write(rec)
+	}
+}
+
+// Attach and Transmit implement NetBackend; frames are recorded in both
+// directions.
+func (p *NetPcap) Attach(receive func([]byte)) {
+	if p.inner != nil {
+		p.inner.Attach(func(frame []byte) {
+			p.record(frame)
+			receive(frame)
+		})
+	}
+}
+
+func (p *NetPcap) Transmit(frame []byte) {
+	p.record(frame)
+	if p.inner != nil {
+		p.inner.Transmit(frame)
+	}
+}
+
+func (p *NetPcap) synchronous() bool {
+	s, ok := p.inner.(netSynchronous)
+	return p.inner == nil || ok && s.synchronous()
+}
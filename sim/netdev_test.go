@@ -0,0 +1,98 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// capture is a NetBackend receive function that keeps frames.
+type capture struct{ frames [][]byte }
+
+func (c *capture) receive(f []byte) { c.frames = append(c.frames, append([]byte(nil), f...)) }
+
+func TestNetSwitch_LearnsAndFloods(t *testing.T) {
+	sw := NewNetSwitch()
+	var caps [3]capture
+	var ports [3]NetBackend
+	macs := [3][6]byte{{2, 0, 0, 0, 0, 1}, {2, 0, 0, 0, 0, 2}, {2, 0, 0, 0, 0, 3}}
+	for i := range ports {
+		ports[i] = sw.Port()
+		ports[i].Attach(caps[i].receive)
+	}
+	bcast := [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+	// Broadcasts and unknown destinations are flooded.
+	ports[0].Transmit(testFrame(bcast, macs[0], "who"))
+	ports[1].Transmit(testFrame(macs[0], macs[1], "me"))
+	ports[2].Transmit(testFrame(macs[1], macs[2], "?"))
+	if len(caps[0].frames) != 1 || len(caps[1].frames) != 2 || len(caps[2].frames) != 1 {
+		t.Fatalf("frames per port: %d %d %d", len(caps[0].frames), len(caps[1].frames), len(caps[2].frames))
+	}
+	if string(caps[0].frames[0][14:]) != "me" || string(caps[1].frames[1][14:]) != "?" {
+		t.Errorf("unicast went to the wrong port")
+	}
+	ports[0].Transmit(testFrame(macs[2], macs[0], "to3"))
+	if len(caps[1].frames) != 2 || string(caps[2].frames[1][14:]) != "to3" {
+		t.Errorf("learned unicast was flooded or lost")
+	}
+	ports[0].Transmit([]byte{1, 2, 3}) // runt: ignored
+}
+
+// Two machines on one switch: the second NIC receives what the first sends.
+func TestNetSwitch_TwoMachines(t *testing.T) {
+	sw := NewNetSwitch()
+	a, b := [6]byte{2, 0, 0, 0, 0, 0xa}, [6]byte{2, 0, 0, 0, 0, 0xb}
+	nicA, nicB := NewVirtioNet(a, sw.Port()), NewVirtioNet(b, sw.Port())
+	_, da := newTestVirtio(t, nicA)
+	_, db := newTestVirtio(t, nicB)
+	da.init(0)
+	db.init(0)
+	if _, ok := nicB.NextEvent(); !ok {
+		t.Errorf("switched NIC is not polled")
+	}
+	db.submit(virtioNetRx, vqBuf{0x3000, 1526, true})
+	frame := testFrame(b, a, "hello b")
+	sendFrame(da, 0x4000, frame)
+	nicB.Advance(1)
+	if got := recvFrame(db, 0x3000); !bytes.Equal(got, frame) {
+		t.Errorf("B received % x", got)
+	}
+}
+
+func TestNetPcap_Records(t *testing.T) {
+	var out bytes.Buffer
+	p, err := NewNetPcap(&out, &NetLoopback{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Clock = func() time.Time { return time.Unix(1000, 5000) }
+	var c capture
+	p.Attach(c.receive)
+	p.Transmit([]byte("frame"))
+	if len(c.frames) != 1 {
+		t.Fatalf("inner backend not used")
+	}
+
+	b := out.Bytes()
+	if len(b) != 24+2*(16+5) {
+		t.Fatalf("pcap is %d bytes", len(b))
+	}
+	if binary.LittleEndian.Uint32(b) != pcapMagic || binary.LittleEndian.Uint32(b[20:]) != pcapEthernet {
+		t.Errorf("bad file header % x", b[:24])
+	}
+	for i, rec := range [][]byte{b[24:45], b[45:]} {
+		if binary.LittleEndian.Uint32(rec) != 1000 || binary.LittleEndian.Uint32(rec[4:]) != 5 ||
+			binary.LittleEndian.Uint32(rec[8:]) != 5 || string(rec[16:]) != "frame" {
+			t.Errorf("record %d: % x", i, rec)
+		}
+	}
+
+	sink, _ := NewNetPcap(&out, nil)
+	sink.Attach(c.receive)
+	sink.Transmit([]byte("x"))
+	if len(c.frames) != 1 || sink.Err() != nil {
+		t.Errorf("sink delivered a frame (or failed: %v)", sink.Err())
+	}
+}
@@ -0,0 +1,310 @@
+package sim
+
+import "io"
+
+// NS16550Size is the size of the region an NS16550 is mapped into. The
+// eight registers are byte-spaced at its start (reg-shift 0, as on QEMU's
+// virt machine); the rest of the region reads as zero.
+const NS16550Size = 0x100
+
+// NS16550 register offsets. Several offsets select different registers
+// for reads and writes, or when LCR.DLAB is set.
+const (
+	ns16550RBR = 0 // read: receive buffer; write: THR; DLAB: DLL
+	ns16550IER = 1 // DLAB: DLM
+	ns16550IIR = 2 // read: IIR; write: FCR
+	ns16550LCR = 3
+	ns16550MCR = 4
+	ns16550LSR = 5
+	ns16550MSR = 6
+	ns16550SCR = 7
+)
+
+// NS16550 register bits.
+const (
+	ierRDI  = 1 << 0 // received data available
+	ierTHRI = 1 << 1 // transmitter holding register empty
+	ierRLSI = 1 << 2 // receiver line status
+	ierMSI  = 1 << 3 // modem status
+
+	iirNoInt = 0x01 // no interrupt pending
+	iirRLSI  = 0x06
+	iirRDI   = 0x04
+	iirCTI   = 0x0C // character timeout
+	iirTHRI  = 0x02
+	iirFIFO  = 0xC0 // FIFOs enabled
+
+	fcrEnable  = 1 << 0
+	fcrClearRX = 1 << 1
+	fcrClearTX = 1 << 2
+	fcrTrigger = 0xC0 // RX trigger level: 1, 4, 8 or 14 bytes
+
+	lcrDLAB = 1 << 7
+
+	mcrDTR  = 1 << 0
+	mcrRTS  = 1 << 1
+	mcrOUT1 = 1 << 2
+	mcrOUT2 = 1 << 3
+	mcrLoop = 1 << 4
+
+	lsrDR   = 1 << 0 // data ready
+	lsrOE   = 1 << 1 // overrun error
+	lsrTHRE = 1 << 5
+	lsrTEMT = 1 << 6
+
+	msrCTS = 1 << 4
+	msrDSR = 1 << 5
+	msrRI  = 1 << 6
+	msrDCD = 1 << 7
+)
+
+const (
+	ns16550FIFODepth = 16
+
+	// ns16550TimeoutCycles stands in for the four character times after
+	// which a FIFO holding fewer bytes than the trigger level reports a
+	// character timeout.
+	ns16550TimeoutCycles = 10000
+)
+
+// NS16550 models the 16550A UART that real firmware (OpenSBI, Linux
+// earlycon, U-Boot, Zephyr) expects, as an alternative to the teaching
+// UART:
+//   - RBR/THR, IER, IIR/FCR, LCR, MCR, LSR, MSR and SCR, with the divisor
+//     latches behind LCR.DLAB. The divisor and line settings are stored
+//     but have no effect: bytes are sent instantly, so THRE and TEMT are
+//     always set.
+//   - With FCR.FIFO enabled the receiver has a 16-byte FIFO and signals
+//     "data available" at the trigger level, or a character timeout once
+//     fewer bytes have sat unread for a while; otherwise it holds one byte.
+//   - Interrupts are identified in IIR by priority (line status, received
+//     data or timeout, THR empty) and IRQ is held high while one is pending.
+//   - MCR.LOOP routes transmitted bytes back to the receiver and reflects
+//     the MCR outputs in MSR; a byte looped into a full FIFO sets LSR.OE.
+//
+// The modem inputs are fixed (CTS, DSR and DCD asserted), so there are
+// no modem status interrupts. Input comes from SetInput as for UART;
+// register the device with CPU.AddClocked so it arrives, and timeouts
+// fire, while the hart runs or waits in WFI.
+type NS16550 struct {
+	serialOut
+	serialIn
+
+	// IRQ is the UART's interrupt line, e.g. plic.Line(UARTIRQ).
+	IRQ IRQLine
+
+	rx         []byte
+	rxIdle     uint64 // cycles since the RX FIFO was last filled or read
+	ier        uint8
+	fcr        uint8 // fcrEnable and fcrTrigger
+	lcr        uint8
+	mcr        uint8
+	scr        uint8
+	dll, dlm   uint8
+	lsrErr     uint8 // error bits, cleared by reading LSR
+	thrPending bool  // THR empty interrupt, cleared by IIR read or THR write
+}
+
+func NewNS16550(w io.Writer) *NS16550 {
+	u := &NS16550{}
+	u.Out = w
+	return u
+}
+
+func (u *NS16550) depth() int {
+	if u.fcr&fcrEnable == 0 {
+		return 1
+	}
+	return ns16550FIFODepth
+}
+
+func (u *NS16550) trigger() int {
+	if u.fcr&fcrEnable == 0 {
+		return 1
+	}
+	return [4]int{1, 4, 8, 14}[u.fcr>>6]
+}
+
+// timeoutArmed reports whether the FIFO holds data below the trigger level,
+// so that a character timeout is due after ns16550TimeoutCycles.
+func (u *NS16550) timeoutArmed() bool {
+	return u.fcr&fcrEnable != 0 && len(u.rx) > 0 && len(u.rx) < u.trigger()
+}
+
+// poll moves available input into the receiver without blocking. Nothing
+// is received from outside in loopback mode.
+func (u *NS16550) poll() {
+	if u.mcr&mcrLoop == 0 {
+		n := len(u.rx)
+		if u.rx = u.receive(u.rx, u.depth()); len(u.rx) != n {
+			u.rxIdle = 0
+		}
+	}
+	u.updateIRQ()
+}
+
+// iir returns the highest priority pending interrupt, without side effects.
+func (u *NS16550) iir() uint8 {
+	id := uint8(iirNoInt)
+	switch {
+	case u.ier&ierRLSI != 0 && u.lsrErr != 0:
+		id = iirRLSI
+	case u.ier&ierRDI != 0 && len(u.rx) >= u.trigger():
+		id = iirRDI
+	case u.ier&ierRDI != 0 && u.timeoutArmed() && u.rxIdle >= ns16550TimeoutCycles:
+		id = iirCTI
+	case u.ier&ierTHRI != 0 && u.thrPending:
+		id = iirTHRI
+	}
+	if u.fcr&fcrEnable != 0 {
+		id |= iirFIFO
+	}
+	return id
+}
+
+func (u *NS16550) updateIRQ() { u.IRQ.Set(u.iir()&iirNoInt == 0) }
+
+// Advance implements Clocked.
+func (u *NS16550) Advance(n uint64) {
+	u.rxIdle += n
+	u.poll()
+}
+
+// NextEvent implements Clocked: the next character timeout, or the next
+// look for live input while there is room for it.
+func (u *NS16550) NextEvent() (uint64, bool) {
+	next, ok := uint64(0), false
+	if u.live() && len(u.rx) < u.depth() && u.mcr&mcrLoop == 0 {
+		next, ok = uartPollCycles, true
+	}
+	if u.ier&ierRDI != 0 && u.timeoutArmed() && u.rxIdle < ns16550TimeoutCycles {
+		if d := ns16550TimeoutCycles - u.rxIdle; !ok || d < next {
+			next, ok = d, true
+		}
+	}
+	return next, ok
+}
+
+func (u *NS16550) Read8(off uint32) (uint8, bool) {
+	if off >= NS16550Size {
+		return 0, false
+	}
+	dlab := u.lcr&lcrDLAB != 0
+	switch off {
+	case ns16550RBR:
+		if dlab {
+			return u.dll, true
+		}
+		u.poll()
+		if len(u.rx) == 0 {
+			return 0, true
+		}
+		b := u.rx[0]
+		u.rx = u.rx[1:]
+		u.rxIdle = 0
+		u.poll()
+		return b, true
+	case ns16550IER:
+		if dlab {
+			return u.dlm, true
+		}
+		return u.ier, true
+	case ns16550IIR:
+		u.poll()
+		id := u.iir()
+		if id&^iirFIFO == iirTHRI {
+			u.thrPending = false
+			u.updateIRQ()
+		}
+		return id, true
+	case ns16550LCR:
+		return u.lcr, true
+	case ns16550MCR:
+		return u.mcr, true
+	case ns16550LSR:
+		u.poll()
+		lsr := u.lsrErr | lsrTHRE | lsrTEMT
+		if len(u.rx) > 0 {
+			lsr |= lsrDR
+		}
+		u.lsrErr = 0
+		u.updateIRQ()
+		return lsr, true
+	case ns16550MSR:
+		return u.msr(), true
+	case ns16550SCR:
+		return u.scr, true
+	}
+	return 0, true
+}
+
+// msr returns the modem inputs: fixed, or wired to the MCR outputs in
+// loopback mode.
+func (u *NS16550) msr() uint8 {
+	if u.mcr&mcrLoop == 0 {
+		return msrCTS | msrDSR | msrDCD
+	}
+	var v uint8
+	if u.mcr&mcrRTS != 0 {
+		v |= msrCTS
+	}
+	if u.mcr&mcrDTR != 0 {
+		v |= msrDSR
+	}
+	if u.mcr&mcrOUT1 != 0 {
+		v |= msrRI
+	}
+	if u.mcr&mcrOUT2 != 0 {
+		v |= msrDCD
+	}
+	return v
+}
+
+func (u *NS16550) Write8(off uint32, v uint8) bool {
+	if off >= NS16550Size {
+		return false
+	}
+	dlab := u.lcr&lcrDLAB != 0
+	switch off {
+	case ns16550RBR:
+		if dlab {
+			u.dll = v
+			break
+		}
+		if u.mcr&mcrLoop != 0 {
+			if len(u.rx) < u.depth() {
+				u.rx = append(u.rx, v)
+				u.rxIdle = 0
+			} else {
+				u.lsrErr |= lsrOE
+			}
+		} else {
+			u.transmit(v)
+		}
+		u.thrPending = true // sent at once, so THR is empty again
+	case ns16550IER:
+		if dlab {
+			u.dlm = v
+			break
+		}
+		if v&ierTHRI != 0 && u.ier&ierTHRI == 0 {
+			u.thrPending = true
+		} else if v&ierTHRI == 0 {
+			u.thrPending = false
+		}
+		u.ier = v & (ierRDI | ierTHRI | ierRLSI | ierMSI)
+	case ns16550IIR: // FCR
+		if (v^u.fcr)&fcrEnable != 0 || v&fcrClearRX != 0 {
+			u.rx, u.rxIdle = nil, 0 // switching FIFO mode also clears them
+		}
+		u.fcr = v & (fcrEnable | fcrTrigger)
+	case ns16550LCR:
+		u.lcr = v
+	case ns16550MCR:
+		u.mcr = v & (mcrDTR | mcrRTS | mcrOUT1 | mcrOUT2 | mcrLoop)
+	case ns16550SCR:
+		u.scr = v
+	}
+	u.updateIRQ()
+	return true
+}
@@ -0,0 +1,181 @@
+package sim
+
+import (
+	"strings"
+	"testing"
+)
+
+func newTestNS16550(t *testing.T) (*NS16550, *Bus) {
+	t.Helper()
+	u := NewNS16550(nil)
+	bus := NewBus(NewRAM(4096), nil)
+	if err := bus.Map("uart", UARTBase, NS16550Size, u); err != nil {
+		t.Fatal(err)
+	}
+	return u, bus
+}
+
+func TestNS16550_Registers(t *testing.T) {
+	u, bus := newTestNS16550(t)
+	reg := func(off uint32) uint8 { v, _ := bus.Read8(UARTBase + off); return v }
+
+	if iir, lsr := reg(ns16550IIR), reg(ns16550LSR); iir != iirNoInt || lsr != lsrTHRE|lsrTEMT {
+		t.Errorf("reset IIR=0x%02x LSR=0x%02x", iir, lsr)
+	}
+	if msr := reg(ns16550MSR); msr != msrCTS|msrDSR|msrDCD {
+		t.Errorf("MSR = 0x%02x", msr)
+	}
+
+	// The divisor latches hide behind DLAB without touching THR or IER.
+	bus.Write8(UARTBase+ns16550LCR, lcrDLAB|0x03)
+	bus.Write8(UARTBase+ns16550RBR, 0x01)
+	bus.Write8(UARTBase+ns16550IER, 0x02)
+	if reg(ns16550RBR) != 0x01 || reg(ns16550IER) != 0x02 {
+		t.Errorf("divisor latch readback failed")
+	}
+	bus.Write8(UARTBase+ns16550LCR, 0x03) // 8N1
+	if reg(ns16550IER) != 0 || u.String() != "" {
+		t.Errorf("DLAB writes leaked into IER or THR")
+	}
+
+	bus.Write8(UARTBase+ns16550SCR, 0x5A)
+	if reg(ns16550SCR) != 0x5A {
+		t.Errorf("scratch register lost its value")
+	}
+
+	for _, c := range []byte("ok\n") {
+		bus.Write8(UARTBase+ns16550RBR, c)
+	}
+	if u.String() != "ok\n" {
+		t.Errorf("transmitted %q", u.String())
+	}
+	if _, ok := bus.Read8(UARTBase + NS16550Size); ok {
+		t.Errorf("access past the UART succeeded")
+	}
+}
+
+func TestNS16550_FIFOAndInterrupts(t *testing.T) {
+	u, bus := newTestNS16550(t)
+	reg := func(off uint32) uint8 { v, _ := bus.Read8(UARTBase + off); return v }
+	u.SetInput(strings.NewReader("0123456789abcdefXYZ"))
+
+	// Without FIFOs the receiver holds one byte.
+	if reg(ns16550LSR)&lsrDR == 0 || len(u.rx) != 1 {
+		t.Fatalf("holding register: %d bytes", len(u.rx))
+	}
+	bus.Write8(UARTBase+ns16550IER, ierRDI)
+	if iir := reg(ns16550IIR); iir != iirRDI {
+		t.Errorf("IIR = 0x%02x, want data available", iir)
+	}
+
+	// Enabling the FIFOs clears them (dropping "0"); trigger level 8.
+	bus.Write8(UARTBase+ns16550IIR, fcrEnable|0x80)
+	if iir := reg(ns16550IIR); iir != iirFIFO|iirRDI || len(u.rx) != ns16550FIFODepth {
+		t.Errorf("IIR = 0x%02x with %d bytes queued", iir, len(u.rx))
+	}
+	var got []byte
+	for range 13 {
+		got = append(got, reg(ns16550RBR))
+	}
+	if string(got) != "123456789abcd" {
+		t.Errorf("received %q", got)
+	}
+
+	// Below the trigger level only a character timeout is reported.
+	if iir := reg(ns16550IIR); iir != iirFIFO|iirNoInt {
+		t.Errorf("IIR below trigger = 0x%02x", iir)
+	}
+	if n, ok := u.NextEvent(); !ok || n != ns16550TimeoutCycles {
+		t.Errorf("NextEvent = %d, %v; want the character timeout", n, ok)
+	}
+	u.Advance(ns16550TimeoutCycles)
+	if iir := reg(ns16550IIR); iir != iirFIFO|iirCTI {
+		t.Errorf("IIR after timeout = 0x%02x", iir)
+	}
+	bus.Write8(UARTBase+ns16550IIR, fcrEnable|0x80|fcrClearRX)
+	if reg(ns16550LSR)&lsrDR != 0 {
+		t.Errorf("data ready after clearing the RX FIFO")
+	}
+
+	// THR empty: raised by enabling ETBEI, cleared by reading IIR.
+	bus.Write8(UARTBase+ns16550IIR, 0)
+	u.SetInput(strings.NewReader(""))
+	bus.Write8(UARTBase+ns16550IER, ierTHRI)
+	if iir := reg(ns16550IIR); iir != iirTHRI {
+		t.Errorf("IIR = 0x%02x, want THR empty", iir)
+	}
+	if iir := reg(ns16550IIR); iir != iirNoInt {
+		t.Errorf("THR empty not cleared by reading IIR: 0x%02x", iir)
+	}
+	bus.Write8(UARTBase+ns16550RBR, 'x')
+	if iir := reg(ns16550IIR); iir != iirTHRI {
+		t.Errorf("THR empty not raised after a write: 0x%02x", iir)
+	}
+}
+
+func TestNS16550_LoopbackAndPLIC(t *testing.T) {
+	u, bus := newTestNS16550(t)
+	cpu := NewCPU(bus)
+	plic := NewPLIC(31, cpu)
+	bus.Map("plic", PLICBase, PLICSize, plic)
+	u.IRQ = plic.Line(UARTIRQ)
+	bus.Write32(PLICBase+UARTIRQ*4, 1)
+	bus.Write32(PLICBase+plicEnable, 1<<UARTIRQ)
+	reg := func(off uint32) uint8 { v, _ := bus.Read8(UARTBase + off); return v }
+
+	bus.Write8(UARTBase+ns16550MCR, mcrLoop|mcrRTS|mcrOUT2)
+	if msr := reg(ns16550MSR); msr != msrCTS|msrDCD {
+		t.Errorf("loopback MSR = 0x%02x", msr)
+	}
+	bus.Write8(UARTBase+ns16550IER, ierRDI|ierRLSI)
+	bus.Write8(UARTBase+ns16550RBR, 'a')
+	bus.Write8(UARTBase+ns16550RBR, 'b') // overruns the holding register
+	if u.String() != "" {
+		t.Errorf("loopback byte was transmitted")
+	}
+	if csr(t, cpu, CSRMip)&mipMEIP == 0 {
+		t.Fatalf("UART interrupt not raised")
+	}
+	if iir := reg(ns16550IIR); iir != iirRLSI {
+		t.Errorf("IIR = 0x%02x, want line status", iir)
+	}
+	if lsr := reg(ns16550LSR); lsr&(lsrOE|lsrDR) != lsrOE|lsrDR {
+		t.Errorf("LSR = 0x%02x", lsr)
+	}
+	if b := reg(ns16550RBR); b != 'a' {
+		t.Errorf("looped back %q", b)
+	}
+	if csr(t, cpu, CSRMip)&mipMEIP == 0 {
+		t.Errorf("pending PLIC source dropped before claim")
+	}
+	bus.Read32(plicCtx(0, 4))
+	bus.Write32(plicCtx(0, 4), UARTIRQ)
+	if csr(t, cpu, CSRMip)&mipMEIP != 0 {
+		t.Errorf("UART interrupt still raised with nothing pending")
+	}
+}
+
+// The usual 8250 console putc: wait for LSR.THRE, then write THR.
+func TestNS16550_PollingPutc(t *testing.T) {
+	const s0 = 8
+	u, bus := newTestNS16550(t)
+	cpu := NewCPU(bus)
+	cpu.HaltOnTrap = true
+	for i, ins := range []uint32{
+		encU(OpLUI, s0, UARTBase),
+		encI(OpOPIMM, a0, F3ADDI, x0, 'h'),
+		encI(OpLOAD, t0, F3LBU, s0, ns16550LSR), // 0x08
+		encI(OpOPIMM, t0, f3ANDI, t0, lsrTHRE),
+		encB(F3BEQ, t0, x0, -8),
+		encS(F3SB, s0, a0, ns16550RBR),
+		instECALL,
+	} {
+		writeInst(t, bus.RAM, uint32(i*4), ins)
+	}
+	if !runToHalt(cpu, 100) {
+		t.Fatalf("putc did not finish")
+	}
+	if u.String() != "h" {
+		t.Errorf("transmitted %q", u.String())
+	}
+}
@@ -0,0 +1,210 @@
+package sim
+
+// PLIC register layout (RISC-V PLIC specification).
+const (
+	PLICBase uint32 = 0x0C00_0000
+	PLICSize        = 0x0400_0000
+
+	plicPriority  = 0x000000 // 4 bytes per source
+	plicPending   = 0x001000 // bitmap
+	plicEnable    = 0x002000 // bitmap, 0x80 bytes per context
+	plicContext   = 0x200000 // threshold and claim/complete, 0x1000 per context
+	plicMaxPrio   = 7
+	plicMaxSource = 1023
+)
+
+// PLIC is the platform-level interrupt controller. Sources 1..n (see
+// NewPLIC) are level-triggered inputs driven through Line; source 0 does
+// not exist. Each hart has two contexts, M-mode (2*hart) and S-mode
+// (2*hart+1), whose outputs drive the hart's MEIP and SEIP lines.
+//
+// A context is interrupted while some source enabled for it is pending
+// with a priority above its threshold. Reading claim returns the highest
+// priority such source (lowest ID on ties) and clears its pending bit; the
+// source cannot become pending again until its ID is written back to
+// complete.
+//
+// Like real PLICs, the registers only support 32-bit accesses.
+type PLIC struct {
+	harts     []*CPU
+	sources   int
+	priority  []uint32
+	level     []bool // current input levels
+	pending   []bool
+	claimed   []bool     // in service: between claim and complete
+	enable    [][]uint32 // per context, bitmap of sources
+	threshold []uint32   // per context
+}
+
+// NewPLIC returns a PLIC with the given number of sources (at most 1023)
+// serving harts, hart i of the PLIC being harts[i].
+func NewPLIC(sources int, harts ...*CPU) *PLIC {
+	sources = min(max(sources, 0), plicMaxSource)
+	p := &PLIC{
+		harts:     harts,
+		sources:   sources,
+		priority:  make([]uint32, sources+1),
+		level:     make([]bool, sources+1),
+		pending:   make([]bool, sources+1),
+		claimed:   make([]bool, sources+1),
+		enable:    make([][]uint32, 2*len(harts)),
+		threshold: make([]uint32, 2*len(harts)),
+	}
+	for i := range p.enable {
+		p.enable[i] = make([]uint32, (sources+32)/32)
+	}
+	return p
+}
+
+// IRQLine is one input of an interrupt controller. The zero IRQLine is
+// unconnected and ignores Set, so devices work without a PLIC.
+type IRQLine struct {
+	plic *PLIC
+	src  int
+}
+
+// Line returns the input for source src.
+func (p *PLIC) Line(src int) IRQLine { return IRQLine{p, src} }
+
+// Set drives the line high (level=true) or low.
+func (l IRQLine) Set(level bool) {
+	if l.plic != nil {
+		l.plic.setLevel(l.src, level)
+	}
+}
+
+func (p *PLIC) setLevel(src int, level bool) {
+	if src < 1 || src > p.sources {
+		return
+	}
+	p.level[src] = level
+	if level && !p.claimed[src] {
+		p.pending[src] = true
+	}
+	p.update()
+}
+
+func (p *PLIC) enabled(ctx, src int) bool { return p.enable[ctx][src/32]>>(src%32)&1 != 0 }
+
+// best returns the source context ctx would claim now, or 0.
+func (p *PLIC) best(ctx int) int {
+	id, prio := 0, p.threshold[ctx]
+	for src := 1; src <= p.sources; src++ {
+		if p.pending[src] && p.priority[src] > prio && p.enabled(ctx, src) {
+			id, prio = src, p.priority[src]
+		}
+	}
+	return id
+}
+
+// update drives every hart's MEIP/SEIP from its two contexts.
+func (p *PLIC) update() {
+	for h, c := range p.harts {
+		c.SetInterrupt(IRQMExt, p.best(2*h) != 0)
+		c.SetInterrupt(IRQSExt, p.best(2*h+1) != 0)
+	}
+}
+
+// contextReg decodes an offset in the enable or context areas, returning
+// the context and the offset within its block, or ctx=-1.
+func (p *PLIC) contextReg(off, base, stride, limit uint32) (ctx int, rel uint32) {
+	if off < base || off >= limit {
+		return -1, 0
+	}
+	ctx = int((off - base) / stride)
+	if ctx >= len(p.enable) {
+		return -1, 0
+	}
+	return ctx, (off - base) % stride
+}
+
+func (p *PLIC) Read32(off uint32) (uint32, bool) {
+	if off >= PLICSize || off&3 != 0 {
+		return 0, false
+	}
+	switch {
+	case off < plicPending:
+		if src := int(off / 4); src >= 1 && src <= p.sources {
+			return p.priority[src], true
+		}
+	case off < plicEnable:
+		var v uint32
+		for b := range 32 {
+			if src := int(off-plicPending)*8 + b; src <= p.sources && p.pending[src] {
+				v |= 1 << b
+			}
+		}
+		return v, true
+	case off < plicContext:
+		if ctx, rel := p.contextReg(off, plicEnable, 0x80, plicContext); ctx >= 0 && int(rel/4) < len(p.enable[ctx]) {
+			return p.enable[ctx][rel/4], true
+		}
+	default:
+		ctx, rel := p.contextReg(off, plicContext, 0x1000, PLICSize)
+		switch {
+		case ctx < 0:
+		case rel == 0:
+			return p.threshold[ctx], true
+		case rel == 4:
+			return uint32(p.claim(ctx)), true
+		}
+	}
+	return 0, true // reserved: reads as zero
+}
+
+func (p *PLIC) Write32(off, v uint32) bool {
+	if off >= PLICSize || off&3 != 0 {
+		return false
+	}
+	switch {
+	case off < plicPending:
+		if src := int(off / 4); src >= 1 && src <= p.sources {
+			p.priority[src] = min(v, plicMaxPrio)
+		}
+	case off < plicEnable:
+		// pending bits are read-only
+	case off < plicContext:
+		if ctx, rel := p.contextReg(off, plicEnable, 0x80, plicContext); ctx >= 0 && int(rel/4) < len(p.enable[ctx]) {
+			w := int(rel / 4)
+			for b := range 32 {
+				if src := w*32 + b; src == 0 || src > p.sources {
+					v &^= 1 << b
+				}
+			}
+			p.enable[ctx][w] = v
+		}
+	default:
+		ctx, rel := p.contextReg(off, plicContext, 0x1000, PLICSize)
+		switch {
+		case ctx < 0:
+		case rel == 0:
+			p.threshold[ctx] = min(v, plicMaxPrio)
+		case rel == 4:
+			p.complete(ctx, int(v))
+		}
+	}
+	p.update()
+	return true
+}
+
+func (p *PLIC) claim(ctx int) int {
+	src := p.best(ctx)
+	if src != 0 {
+		p.pending[src] = false
+		p.claimed[src] = true
+		p.update()
+	}
+	return src
+}
+
+// complete ends service of src. IDs that are not enabled for the context
+// are ignored; a source whose line is still high becomes pending again.
+func (p *PLIC) complete(ctx, src int) {
+	if src < 1 || src > p.sources || !p.enabled(ctx, src) {
+		return
+	}
+	p.claimed[src] = false
+	if p.level[src] {
+		p.pending[src] = true
+	}
+}
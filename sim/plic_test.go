@@ -0,0 +1,105 @@
+package sim
+
+import "testing"
+
+func plicCtx(ctx int, reg uint32) uint32 { return PLICBase + plicContext + uint32(ctx)*0x1000 + reg }
+
+func TestPLIC_ClaimComplete(t *testing.T) {
+	bus := NewBus(NewRAM(4096), NewUART(nil))
+	h0, h1 := NewCPU(bus), NewCPU(bus)
+	plic := NewPLIC(40, h0, h1)
+	if err := bus.Map("plic", PLICBase, PLICSize, plic); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sources 3 and 33 at priority 2 and 5, enabled for hart 0's M context.
+	bus.Write32(PLICBase+3*4, 2)
+	bus.Write32(PLICBase+33*4, 99) // clamped to 7
+	if v, _ := bus.Read32(PLICBase + 33*4); v != plicMaxPrio {
+		t.Errorf("priority33 = %d, want %d", v, plicMaxPrio)
+	}
+	bus.Write32(PLICBase+plicEnable, 0xFFFFFFFF) // bit 0 (source 0) is hardwired off
+	bus.Write32(PLICBase+plicEnable+4, 1<<1)
+	if v, _ := bus.Read32(PLICBase + plicEnable); v != 0xFFFFFFFE {
+		t.Errorf("enable word 0 = 0x%x", v)
+	}
+
+	l3, l33 := plic.Line(3), plic.Line(33)
+	l3.Set(true)
+	if csr(t, h0, CSRMip)&mipMEIP == 0 || csr(t, h0, CSRMip)&mipSEIP != 0 || csr(t, h1, CSRMip)&mipMEIP != 0 {
+		t.Fatalf("source 3 did not raise only hart 0's MEIP")
+	}
+	l33.Set(true)
+	if v, _ := bus.Read32(PLICBase + plicPending + 4); v != 1<<1 {
+		t.Errorf("pending word 1 = 0x%x", v)
+	}
+
+	// Higher priority first; claim clears pending.
+	if id, _ := bus.Read32(plicCtx(0, 4)); id != 33 {
+		t.Fatalf("first claim = %d, want 33", id)
+	}
+	if id, _ := bus.Read32(plicCtx(0, 4)); id != 3 {
+		t.Fatalf("second claim = %d, want 3", id)
+	}
+	if id, _ := bus.Read32(plicCtx(0, 4)); id != 0 || csr(t, h0, CSRMip)&mipMEIP != 0 {
+		t.Fatalf("claim with nothing pending = %d", id)
+	}
+
+	// A claimed source stays quiet until completed; a line still high then
+	// pends again.
+	l33.Set(false)
+	l33.Set(true)
+	if csr(t, h0, CSRMip)&mipMEIP != 0 {
+		t.Errorf("in-service source re-raised MEIP")
+	}
+	bus.Write32(plicCtx(0, 4), 33)
+	if csr(t, h0, CSRMip)&mipMEIP == 0 {
+		t.Errorf("completed source with line high not pending again")
+	}
+	l3.Set(false)
+	bus.Write32(plicCtx(0, 4), 3)
+	if v, _ := bus.Read32(PLICBase + plicPending); v != 0 {
+		t.Errorf("source 3 pending after completion with line low: 0x%x", v)
+	}
+
+	// Threshold masks priorities at or below it.
+	bus.Write32(plicCtx(0, 0), 7)
+	if csr(t, h0, CSRMip)&mipMEIP != 0 {
+		t.Errorf("threshold 7 did not mask priority 7")
+	}
+	bus.Write32(plicCtx(0, 0), 6)
+	if csr(t, h0, CSRMip)&mipMEIP == 0 {
+		t.Errorf("threshold 6 masked priority 7")
+	}
+
+	// Hart 1's S context (context 3) drives its SEIP.
+	bus.Write32(PLICBase+plicEnable+3*0x80+4, 1<<1)
+	if csr(t, h1, CSRMip)&mipSEIP == 0 || csr(t, h1, CSRMip)&mipMEIP != 0 {
+		t.Errorf("context 3 did not drive hart 1's SEIP")
+	}
+
+	// Only word accesses are supported.
+	if _, ok := bus.Read8(PLICBase + 4); ok {
+		t.Errorf("byte access to the PLIC succeeded")
+	}
+}
+
+func TestPLIC_UARTLineAndZeroLine(t *testing.T) {
+	var l IRQLine
+	l.Set(true) // unconnected: no-op
+
+	uart := NewUART(nil)
+	bus := NewBus(NewRAM(4096), uart)
+	cpu := NewCPU(bus)
+	plic := NewPLIC(31, cpu)
+	if err := bus.Map("plic", PLICBase, PLICSize, plic); err != nil {
+		t.Fatal(err)
+	}
+	uart.IRQ = plic.Line(UARTIRQ)
+	bus.Write32(PLICBase+UARTIRQ*4, 1)
+	bus.Write32(PLICBase+plicEnable, 1<<UARTIRQ)
+	uart.IRQ.Set(true)
+	if id, _ := bus.Read32(plicCtx(0, 4)); id != UARTIRQ {
+		t.Errorf("claim = %d, want the UART source", id)
+	}
+}
@@ -0,0 +1,165 @@
+package sim
+
+import "fmt"
+
+// Physical Memory Protection.
+//
+// PMPEntries entries (16 after NewCPU, at most 64) are configured through
+// pmpcfg0..15, four 8-bit entry configurations per register, and
+// pmpaddr0..63, which hold bits 33:2 of the region address. Entries beyond
+// PMPEntries read as zero and ignore writes.
+//
+// Every physical access (fetch, load, store, and the page-table walker's
+// implicit accesses) is checked against the lowest-numbered entry that
+// matches any of its bytes; the access must then lie entirely inside that
+// region and have the R/W/X permission. Unlocked entries only constrain S
+// and U-mode; locked entries (L) also bind M-mode and cannot be changed
+// until reset. An S/U access matching no entry fails, except that while
+// every entry is OFF PMP imposes no restrictions at all, so programs that
+// never configure PMP keep working.
+
+// PMP CSR addresses
+const (
+	CSRPmpcfg0  = 0x3A0 // ..0x3AF
+	CSRPmpaddr0 = 0x3B0 // ..0x3EF
+
+	pmpMaxEntries = 64
+)
+
+// pmpcfg entry bits
+const (
+	pmpR      = 1 << 0
+	pmpW      = 1 << 1
+	pmpX      = 1 << 2
+	pmpA      = 3 << 3
+	pmpL      = 1 << 7
+	pmpATOR   = 1 << 3
+	pmpANA4   = 2 << 3
+	pmpANAPOT = 3 << 3
+)
+
+// pmpCSR reports whether addr is a pmpcfg or pmpaddr register.
+func pmpCSR(addr uint32) bool {
+	return addr >= CSRPmpcfg0 && addr < CSRPmpaddr0+pmpMaxEntries
+}
+
+// pmpCSRName returns "pmpcfgN"/"pmpaddrN", or "" if addr is not a PMP CSR.
+func pmpCSRName(addr uint32) string {
+	switch {
+	case !pmpCSR(addr):
+		return ""
+	case addr < CSRPmpaddr0:
+		return fmt.Sprintf("pmpcfg%d", addr-CSRPmpcfg0)
+	}
+	return fmt.Sprintf("pmpaddr%d", addr-CSRPmpaddr0)
+}
+
+// pmpEntries is the number of implemented entries.
+func (c *CPU) pmpEntries() int { return min(max(c.PMPEntries, 0), pmpMaxEntries) }
+
+func (c *CPU) pmpLocked(i int) bool { return c.csr.pmpcfg[i]&pmpL != 0 }
+
+// pmpRead returns a pmpcfg/pmpaddr register.
+func (c *CPU) pmpRead(addr uint32) uint32 {
+	s := &c.csr
+	if addr >= CSRPmpaddr0 {
+		return s.pmpaddr[addr-CSRPmpaddr0]
+	}
+	var v uint32
+	for b := range 4 {
+		v |= uint32(s.pmpcfg[int(addr-CSRPmpcfg0)*4+b]) << (8 * b)
+	}
+	return v
+}
+
+// pmpWrite applies the WARL and lock rules to a pmpcfg/pmpaddr write.
+func (c *CPU) pmpWrite(addr, v uint32) {
+	s := &c.csr
+	n := c.pmpEntries()
+	if addr >= CSRPmpaddr0 {
+		i := int(addr - CSRPmpaddr0)
+		// A locked TOR entry also locks the address below it.
+		if i >= n || c.pmpLocked(i) || i+1 < n && c.pmpLocked(i+1) && s.pmpcfg[i+1]&pmpA == pmpATOR {
+			return
+		}
+		s.pmpaddr[i] = v
+		return
+	}
+	for b := range 4 {
+		i := int(addr-CSRPmpcfg0)*4 + b
+		if i >= n || c.pmpLocked(i) {
+			continue
+		}
+		cfg := uint8(v>>(8*b)) & (pmpR | pmpW | pmpX | pmpA | pmpL)
+		if cfg&(pmpR|pmpW) == pmpW { // reserved: W requires R
+			cfg &^= pmpW
+		}
+		s.pmpcfg[i] = cfg
+	}
+}
+
+// pmpRange returns the byte range [lo, hi) covered by entry i, with ok=false
+// if the entry is OFF.
+func (c *CPU) pmpRange(i int) (lo, hi uint64, ok bool) {
+	s := &c.csr
+	a := uint64(s.pmpaddr[i])
+	switch s.pmpcfg[i] & pmpA {
+	case pmpATOR:
+		if i > 0 {
+			lo = uint64(s.pmpaddr[i-1]) << 2
+		}
+		return lo, a << 2, true
+	case pmpANA4:
+		return a << 2, a<<2 + 4, true
+	case pmpANAPOT:
+		ones := uint64(0)
+		for a>>ones&1 == 1 {
+			ones++
+		}
+		size := uint64(8) << ones
+		lo = (a &^ (1<<ones - 1)) << 2
+		return lo, lo + size, true
+	}
+	return 0, 0, false
+}
+
+// pmpCheck reports whether an access of size bytes at physical address pa
+// with permissions perm (pmpR/pmpW/pmpX) is allowed in mode priv.
+func (c *CPU) pmpCheck(pa, size uint32, perm uint8, priv PrivLevel) bool {
+	first, last := uint64(pa), uint64(pa)+uint64(size)
+	active := false
+	for i := range c.pmpEntries() {
+		lo, hi, ok := c.pmpRange(i)
+		if !ok {
+			continue
+		}
+		active = true
+		if lo >= hi || last <= lo || first >= hi { // empty TOR range, or no overlap
+			continue
+		}
+		if first < lo || last > hi { // only partially covered
+			return false
+		}
+		cfg := c.csr.pmpcfg[i]
+		if priv == PrivM && cfg&pmpL == 0 {
+			return true
+		}
+		return cfg&perm == perm
+	}
+	return priv == PrivM || !active
+}
+
+// pmpAllows checks an instruction's access against PMP: fetches use the
+// current mode, loads and stores the MPRV-adjusted one. AMOs (accStore
+// reads) need both R and W.
+func (c *CPU) pmpAllows(pa, size uint32, acc accessType, write bool) bool {
+	switch {
+	case acc == accFetch:
+		return c.pmpCheck(pa, size, pmpX, c.Priv)
+	case write:
+		return c.pmpCheck(pa, size, pmpW, c.dataPriv())
+	case acc == accStore:
+		return c.pmpCheck(pa, size, pmpR|pmpW, c.dataPriv())
+	}
+	return c.pmpCheck(pa, size, pmpR, c.dataPriv())
+}
@@ -0,0 +1,145 @@
+package sim
+
+import "testing"
+
+// napot returns the pmpaddr value for the naturally aligned region
+// [base, base+size), size >= 8.
+func napot(base, size uint32) uint32 { return base>>2 | (size/2-1)>>2 }
+
+func TestPMP_CSRs(t *testing.T) {
+	cpu, _ := newTestCPU(t,
+		encI(OpOPIMM, t0, F3ADDI, x0, pmpR|pmpX|pmpANAPOT),
+		encCSR(f3CSRRW, x0, t0, CSRPmpcfg0), // the firmware's first PMP write
+		instECALL,
+	)
+	runToHalt(cpu, 10)
+	if cpu.PC != 8 || csr(t, cpu, CSRPmpcfg0) != pmpR|pmpX|pmpANAPOT {
+		t.Fatalf("csrw pmpcfg0: pc=0x%x pmpcfg0=0x%x", cpu.PC, csr(t, cpu, CSRPmpcfg0))
+	}
+
+	// W without R is reserved; reserved bits 6:5 read as zero.
+	cpu.WriteCSR(CSRPmpcfg0+1, pmpW|0x60<<8|(pmpR|pmpW)<<8)
+	if v := csr(t, cpu, CSRPmpcfg0+1); v != (pmpR|pmpW)<<8 {
+		t.Errorf("pmpcfg1 = 0x%x", v)
+	}
+
+	// Entries past PMPEntries are hardwired to zero.
+	cpu.WriteCSR(CSRPmpcfg0+4, 0xFFFFFFFF)
+	cpu.WriteCSR(CSRPmpaddr0+16, 0x1234)
+	if csr(t, cpu, CSRPmpcfg0+4) != 0 || csr(t, cpu, CSRPmpaddr0+16) != 0 {
+		t.Errorf("entry 16 is writable with 16 entries")
+	}
+	cpu.PMPEntries = 64
+	cpu.WriteCSR(CSRPmpaddr0+63, 0x1234)
+	if csr(t, cpu, CSRPmpaddr0+63) != 0x1234 {
+		t.Errorf("pmpaddr63 not writable with 64 entries")
+	}
+
+	// Locked entries ignore writes, and a locked TOR entry also locks the
+	// address register below it.
+	cpu.WriteCSR(CSRPmpaddr0+2, 0x100)
+	cpu.WriteCSR(CSRPmpaddr0+3, 0x200)
+	cpu.WriteCSR(CSRPmpcfg0, (pmpL|pmpATOR|pmpR)<<24)
+	cpu.WriteCSR(CSRPmpcfg0, 0)
+	cpu.WriteCSR(CSRPmpaddr0+2, 0)
+	cpu.WriteCSR(CSRPmpaddr0+3, 0)
+	if v := csr(t, cpu, CSRPmpcfg0); v != (pmpL|pmpATOR|pmpR)<<24 {
+		t.Errorf("locked pmpcfg0 = 0x%x", v)
+	}
+	if csr(t, cpu, CSRPmpaddr0+2) != 0x100 || csr(t, cpu, CSRPmpaddr0+3) != 0x200 {
+		t.Errorf("locked TOR addresses changed")
+	}
+	if got := Disasm(0, encCSR(f3CSRRW, x0, t0, CSRPmpaddr0+5)); got != "csrrw zero, pmpaddr5, t0" {
+		t.Errorf("Disasm = %q", got)
+	}
+}
+
+func TestPMP_Regions(t *testing.T) {
+	// Entry 0: NA4 at 0x100, no permissions (shadows entry 1).
+	// Entry 1: NAPOT 0x000-0x7FF read/execute.
+	// Entry 2: TOR 0x800-0x900 read/write.
+	setup := func(cpu *CPU) {
+		cpu.WriteCSR(CSRPmpaddr0, 0x100>>2)
+		cpu.WriteCSR(CSRPmpaddr0+1, napot(0, 0x800))
+		cpu.WriteCSR(CSRPmpaddr0+2, 0x900>>2)
+		cpu.WriteCSR(CSRPmpcfg0, uint32(pmpANA4)|(pmpANAPOT|pmpR|pmpX)<<8|(pmpATOR|pmpR|pmpW)<<16)
+	}
+	cases := []struct {
+		name   string
+		priv   PrivLevel
+		addr   uint32
+		size   uint32
+		acc    accessType
+		write  bool
+		ok     bool
+		reason string
+	}{
+		{"U fetch code", PrivU, 0x40, 4, accFetch, false, true, ""},
+		{"U load code", PrivU, 0x40, 4, accLoad, false, true, ""},
+		{"U store code", PrivU, 0x40, 4, accStore, true, false, "no W"},
+		{"U load NA4 hole", PrivU, 0x100, 4, accLoad, false, false, "entry 0 wins"},
+		{"U load next to hole", PrivU, 0x104, 4, accLoad, false, true, ""},
+		{"S store TOR", PrivS, 0x8FC, 4, accStore, true, true, ""},
+		{"S amo TOR", PrivS, 0x800, 4, accStore, false, true, ""},
+		{"S fetch TOR", PrivS, 0x800, 4, accFetch, false, false, "no X"},
+		{"S straddles TOR end", PrivS, 0x8FC, 8, accLoad, false, false, "partial match"},
+		{"S unmatched", PrivS, 0xA00, 4, accLoad, false, false, "no entry"},
+		{"M unmatched", PrivM, 0xA00, 4, accStore, true, true, ""},
+		{"M store code", PrivM, 0x40, 4, accStore, true, true, "unlocked"},
+	}
+	for _, tc := range cases {
+		cpu, _ := newTestCPU(t)
+		setup(cpu)
+		cpu.Priv = tc.priv
+		if got := cpu.pmpAllows(tc.addr, tc.size, tc.acc, tc.write); got != tc.ok {
+			t.Errorf("%s: allowed=%v, want %v (%s)", tc.name, got, tc.ok, tc.reason)
+		}
+	}
+
+	// Locked entries bind M-mode; MPRV makes M loads use MPP's view.
+	cpu, _ := newTestCPU(t)
+	setup(cpu)
+	cpu.WriteCSR(CSRPmpcfg0, uint32(pmpANA4)|(pmpL|pmpANAPOT|pmpR)<<8|(pmpATOR|pmpR|pmpW)<<16)
+	if cpu.pmpCheck(0x400, 4, pmpW, PrivM) {
+		t.Errorf("M-mode store to a locked read-only region succeeded")
+	}
+	cpu.WriteCSR(CSRMstatus, mstatusMPRV|uint32(PrivU)<<mstatusMPPShift)
+	if cpu.pmpAllows(0xA00, 4, accLoad, false) {
+		t.Errorf("MPRV load with MPP=U ignored PMP")
+	}
+	if !cpu.pmpAllows(0xA00, 4, accFetch, false) {
+		t.Errorf("MPRV affected an M-mode fetch")
+	}
+
+	// With every entry OFF, PMP does not restrict S/U.
+	cpu, _ = newTestCPU(t)
+	if !cpu.pmpCheck(0x40, 4, pmpW, PrivU) {
+		t.Errorf("unconfigured PMP blocked U-mode")
+	}
+}
+
+func TestPMP_AccessFaults(t *testing.T) {
+	cpu, ram := newTestCPU(t)
+	cpu.HaltOnTrap = false
+	cpu.WriteCSR(CSRMtvec, 0x800)
+	cpu.WriteCSR(CSRPmpaddr0, napot(0, 0x400))
+	cpu.WriteCSR(CSRPmpcfg0, pmpANAPOT|pmpR|pmpX)
+	writeInst(t, ram, 0x40, encS(f3SW, a1, x0, 0))
+	writeInst(t, ram, 0x44, encI(OpLOAD, a0, f3LW, a1, 0))
+
+	cpu.Priv, cpu.PC, cpu.Reg[a1] = PrivU, 0x40, 0x200
+	cpu.Step()
+	if c, v := csr(t, cpu, CSRMcause), csr(t, cpu, CSRMtval); c != CauseStoreAccessFault || v != 0x200 {
+		t.Errorf("store: mcause=%d mtval=0x%x", c, v)
+	}
+	cpu.Priv, cpu.PC, cpu.Reg[a1] = PrivU, 0x44, 0x600
+	cpu.Step()
+	if c := csr(t, cpu, CSRMcause); c != CauseLoadAccessFault {
+		t.Errorf("load: mcause=%d", c)
+	}
+	cpu.Priv, cpu.PC = PrivU, 0x500
+	cpu.Step()
+	if c := csr(t, cpu, CSRMcause); c != CauseInstAccessFault || cpu.PC != 0x800 {
+		t.Errorf("fetch: mcause=%d pc=0x%x", c, cpu.PC)
+	}
+}
@@ -0,0 +1,22 @@
+package sim
+
+// PrivLevel is a RISC-V privilege mode. The hart implements M, S and U.
+type PrivLevel uint8
+
+const (
+	PrivU PrivLevel = 0
+	PrivS PrivLevel = 1
+	PrivM PrivLevel = 3
+)
+
+func (p PrivLevel) String() string {
+	switch p {
+	case PrivU:
+		return "U"
+	case PrivS:
+		return "S"
+	case PrivM:
+		return "M"
+	}
+	return "?"
+}
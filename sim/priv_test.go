@@ -0,0 +1,227 @@
+package sim
+
+import "testing"
+
+// newPrivTestCPU returns a hart that takes traps (no HaltOnTrap) with
+// mtvec=0x100 and stvec=0x200.
+func newPrivTestCPU(t *testing.T, insts ...uint32) *CPU {
+	t.Helper()
+	cpu, _ := newTestCPU(t, insts...)
+	cpu.HaltOnTrap = false
+	cpu.WriteCSR(CSRMtvec, 0x100)
+	cpu.WriteCSR(CSRStvec, 0x200)
+	return cpu
+}
+
+func csr(t *testing.T, cpu *CPU, addr uint32) uint32 {
+	t.Helper()
+	v, ok := cpu.ReadCSR(addr)
+	if !ok {
+		t.Fatalf("CSR %s does not exist", csrName(addr))
+	}
+	return v
+}
+
+func TestPriv_MRETToUserAndBack(t *testing.T) {
+	cpu := newPrivTestCPU(t,
+		encI(OpOPIMM, t0, F3ADDI, x0, 0xC),
+		encCSR(f3CSRRW, x0, t0, CSRMepc),
+		instMRET,
+		encCSR(f3CSRRS, a0, x0, CSRMstatus), // 0xc, in U-mode: illegal
+	)
+	cpu.WriteCSR(CSRMstatus, 0) // MPP=U
+	for i := 0; i < 3; i++ {
+		cpu.Step()
+	}
+	if cpu.Priv != PrivU || cpu.PC != 0xC {
+		t.Fatalf("after mret: priv=%v pc=0x%x, want U at 0xc", cpu.Priv, cpu.PC)
+	}
+	cpu.Step()
+	if cpu.Priv != PrivM || cpu.PC != 0x100 {
+		t.Fatalf("csrr mstatus in U: priv=%v pc=0x%x, want M handler", cpu.Priv, cpu.PC)
+	}
+	if c := csr(t, cpu, CSRMcause); c != CauseIllegalInst {
+		t.Errorf("mcause = %d, want illegal instruction", c)
+	}
+	if st := csr(t, cpu, CSRMstatus); st&mstatusMPP != 0 {
+		t.Errorf("MPP = %d, want U", st&mstatusMPP>>mstatusMPPShift)
+	}
+}
+
+func TestPriv_EcallCausesAndDelegation(t *testing.T) {
+	for _, tc := range []struct {
+		priv    PrivLevel
+		medeleg uint32
+		cause   uint32
+		target  PrivLevel
+		pc      uint32
+	}{
+		{PrivU, 0, CauseEcallU, PrivM, 0x100},
+		{PrivS, 0, CauseEcallS, PrivM, 0x100},
+		{PrivU, 1 << CauseEcallU, CauseEcallU, PrivS, 0x200},
+		{PrivS, 1 << CauseEcallU, CauseEcallS, PrivM, 0x100},
+		{PrivM, 0xFFFFFFFF, CauseEcallM, PrivM, 0x100}, // M traps are never delegated
+	} {
+		cpu := newPrivTestCPU(t, instECALL)
+		cpu.WriteCSR(CSRMedeleg, tc.medeleg)
+		cpu.Priv = tc.priv
+		cpu.Step()
+		if cpu.Priv != tc.target || cpu.PC != tc.pc {
+			t.Errorf("ecall from %v (medeleg=0x%x): in %v at 0x%x, want %v at 0x%x",
+				tc.priv, tc.medeleg, cpu.Priv, cpu.PC, tc.target, tc.pc)
+			continue
+		}
+		var causeCSR, epcCSR uint32 = CSRMcause, CSRMepc
+		if tc.target == PrivS {
+			causeCSR, epcCSR = CSRScause, CSRSepc
+		}
+		if c := csr(t, cpu, causeCSR); c != tc.cause {
+			t.Errorf("ecall from %v: %s = %d, want %d", tc.priv, csrName(causeCSR), c, tc.cause)
+		}
+		if epc := csr(t, cpu, epcCSR); epc != 0 {
+			t.Errorf("ecall from %v: %s = 0x%x", tc.priv, csrName(epcCSR), epc)
+		}
+	}
+
+	if v := func() uint32 {
+		cpu := newPrivTestCPU(t)
+		cpu.WriteCSR(CSRMedeleg, 0xFFFFFFFF)
+		return csr(t, cpu, CSRMedeleg)
+	}(); v&(1<<CauseEcallM) != 0 {
+		t.Errorf("medeleg = 0x%x: ECALL from M must not be delegable", v)
+	}
+}
+
+func TestPriv_SRET(t *testing.T) {
+	// U-mode ECALL delegated to S, handler returns with SRET.
+	cpu := newPrivTestCPU(t, instECALL, encI(OpOPIMM, a0, F3ADDI, x0, 1))
+	ram := cpu.Bus.RAM
+	for i, ins := range []uint32{
+		encCSR(f3CSRRS, t0, x0, CSRSepc),
+		encI(OpOPIMM, t0, F3ADDI, t0, 4),
+		encCSR(f3CSRRW, x0, t0, CSRSepc),
+		instSRET,
+	} {
+		writeInst(t, ram, 0x200+uint32(i*4), ins)
+	}
+	cpu.WriteCSR(CSRMedeleg, 1<<CauseEcallU)
+	cpu.WriteCSR(CSRSstatus, mstatusSIE)
+	cpu.Priv = PrivU
+
+	cpu.Step()
+	st := csr(t, cpu, CSRSstatus)
+	if cpu.Priv != PrivS || st&mstatusSPP != 0 || st&mstatusSIE != 0 || st&mstatusSPIE == 0 {
+		t.Fatalf("S trap entry: priv=%v sstatus=0x%x", cpu.Priv, st)
+	}
+	for i := 0; i < 5; i++ {
+		cpu.Step()
+	}
+	st = csr(t, cpu, CSRSstatus)
+	if cpu.Priv != PrivU || cpu.Reg[a0] != 1 || st&mstatusSIE == 0 || st&mstatusSPIE == 0 {
+		t.Fatalf("after sret: priv=%v a0=%d sstatus=0x%x", cpu.Priv, cpu.Reg[a0], st)
+	}
+
+	// SRET is illegal in U-mode, and in S-mode when TSR is set; MRET is
+	// illegal below M.
+	for _, tc := range []struct {
+		priv PrivLevel
+		inst uint32
+		tsr  bool
+	}{
+		{PrivU, instSRET, false},
+		{PrivS, instSRET, true},
+		{PrivS, instMRET, false},
+	} {
+		cpu := newPrivTestCPU(t, tc.inst)
+		if tc.tsr {
+			cpu.WriteCSR(CSRMstatus, mstatusTSR)
+		}
+		cpu.Priv = tc.priv
+		cpu.Step()
+		if c := csr(t, cpu, CSRMcause); cpu.PC != 0x100 || c != CauseIllegalInst {
+			t.Errorf("%s in %v (tsr=%v): pc=0x%x mcause=%d, want illegal", Disasm(0, tc.inst), tc.priv, tc.tsr, cpu.PC, c)
+		}
+	}
+}
+
+func TestPriv_CSRAccess(t *testing.T) {
+	rdcycle := encCSR(f3CSRRS, a0, x0, CSRCycle)
+	cases := []struct {
+		name       string
+		priv       PrivLevel
+		inst       uint32
+		mcounteren uint32
+		scounteren uint32
+		mstatus    uint32
+		legal      bool
+	}{
+		{"S reads sstatus", PrivS, encCSR(f3CSRRS, a0, x0, CSRSstatus), 0, 0, 0, true},
+		{"S reads mstatus", PrivS, encCSR(f3CSRRS, a0, x0, CSRMstatus), 0, 0, 0, false},
+		{"U reads sscratch", PrivU, encCSR(f3CSRRS, a0, x0, CSRSscratch), 0, 0, 0, false},
+		{"S rdcycle, mcounteren=0", PrivS, rdcycle, 0, 0, 0, false},
+		{"S rdcycle, mcounteren.CY", PrivS, rdcycle, 1, 0, 0, true},
+		{"U rdcycle, scounteren=0", PrivU, rdcycle, 1, 0, 0, false},
+		{"U rdcycle, both set", PrivU, rdcycle, 1, 1, 0, true},
+		{"S satp", PrivS, encCSR(f3CSRRS, a0, x0, CSRSatp), 0, 0, 0, true},
+		{"S satp with TVM", PrivS, encCSR(f3CSRRS, a0, x0, CSRSatp), 0, 0, mstatusTVM, false},
+		{"M satp with TVM", PrivM, encCSR(f3CSRRS, a0, x0, CSRSatp), 0, 0, mstatusTVM, true},
+	}
+	for _, tc := range cases {
+		cpu := newPrivTestCPU(t, tc.inst)
+		cpu.WriteCSR(CSRMcounteren, tc.mcounteren)
+		cpu.WriteCSR(CSRScounteren, tc.scounteren)
+		cpu.WriteCSR(CSRMstatus, tc.mstatus|uint32(PrivM)<<mstatusMPPShift)
+		cpu.Priv = tc.priv
+		cpu.Step()
+		if legal := cpu.PC == 4; legal != tc.legal {
+			t.Errorf("%s: legal=%v, want %v", tc.name, legal, tc.legal)
+		}
+	}
+}
+
+func TestPriv_SupervisorViews(t *testing.T) {
+	cpu := newPrivTestCPU(t)
+	// sstatus writes only reach the S fields.
+	cpu.WriteCSR(CSRMstatus, mstatusMIE)
+	cpu.WriteCSR(CSRSstatus, 0xFFFFFFFF)
+	st := csr(t, cpu, CSRMstatus)
+	if st&mstatusMIE == 0 || st&mstatusMPP != 0 || st&(mstatusSIE|mstatusSPP|mstatusSUM|mstatusMXR) != mstatusSIE|mstatusSPP|mstatusSUM|mstatusMXR {
+		t.Errorf("mstatus after sstatus write = 0x%x", st)
+	}
+	if ss := csr(t, cpu, CSRSstatus); ss&^sstatusMask != 0 {
+		t.Errorf("sstatus exposes M fields: 0x%x", ss)
+	}
+
+	// sie/sip are the delegated subset of mie/mip.
+	cpu.WriteCSR(CSRMideleg, 0xFFFFFFFF)
+	if d := csr(t, cpu, CSRMideleg); d != mipSBits {
+		t.Errorf("mideleg = 0x%x, want S interrupt bits only", d)
+	}
+	cpu.WriteCSR(CSRMideleg, mipSTIP)
+	cpu.WriteCSR(CSRMie, mipMTIP|mipSTIP|mipSSIP)
+	if sie := csr(t, cpu, CSRSie); sie != mipSTIP {
+		t.Errorf("sie = 0x%x, want STIP", sie)
+	}
+	cpu.WriteCSR(CSRSie, 0)
+	if mie := csr(t, cpu, CSRMie); mie != mipMTIP|mipSSIP {
+		t.Errorf("mie after clearing sie = 0x%x", mie)
+	}
+	cpu.WriteCSR(CSRMip, mipSTIP|mipMTIP)
+	if mip := csr(t, cpu, CSRMip); mip != mipSTIP {
+		t.Errorf("mip = 0x%x, want only STIP writable", mip)
+	}
+	if sip := csr(t, cpu, CSRSip); sip != mipSTIP {
+		t.Errorf("sip = 0x%x", sip)
+	}
+
+	cpu.WriteCSR(CSRSatp, satpModeSv32|0x1234)
+	if v := csr(t, cpu, CSRSatp); v != satpModeSv32|0x1234 {
+		t.Errorf("satp = 0x%x", v)
+	}
+	if misa := csr(t, cpu, CSRMisa); misa&misaExt('S') == 0 || misa&misaExt('U') == 0 {
+		t.Errorf("misa = 0x%x, want S and U", misa)
+	}
+	if got := Disasm(0, instSRET); got != "sret" {
+		t.Errorf("Disasm(sret) = %q", got)
+	}
+}
@@ -0,0 +1,56 @@
+package sim
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand/v2"
+)
+
+// Simple MMIO entropy device, in the MMIO window above RAM next to the
+// test finisher.
+const (
+	RNGBase uint32 = 0x1010_2000
+	RNGSize        = 0x1000
+
+	RNGData   = 0x00 // read: fresh random bits of the access size
+	RNGStatus = 0x04 // read: RNGStatusReady
+
+	RNGStatusReady = 1
+)
+
+// NewSeededEntropy returns a deterministic random byte stream (ChaCha8)
+// for the entropy devices, so that runs are reproducible. Use
+// crypto/rand.Reader instead for real host entropy.
+func NewSeededEntropy(seed uint64) io.Reader {
+	var s [32]byte
+	binary.LittleEndian.PutUint64(s[:], seed)
+	return rand.NewChaCha8(s)
+}
+
+// RNG is a minimal entropy device: every read of DATA returns new random
+// bits from its source, and STATUS always reports data ready. Writes are
+// ignored.
+type RNG struct {
+	src io.Reader
+}
+
+func NewRNG(src io.Reader) *RNG { return &RNG{src: src} }
+
+// Read implements Device.
+func (r *RNG) Read(off, size uint32) (uint64, bool) {
+	if off >= RNGSize {
+		return 0, false
+	}
+	switch off {
+	case RNGData:
+		var b [8]byte
+		_, _ = io.ReadFull(r.src, b[:size])
+		return binary.LittleEndian.Uint64(b[:]), true
+	case RNGStatus:
+		return RNGStatusReady, true
+	}
+	return 0, true
+}
+
+// Write implements Device.
+func (r *RNG) Write(off, size uint32, v uint64) bool { return off < RNGSize }
@@ -0,0 +1,192 @@
+package sim
+
+// RV32C: every 16-bit instruction is expanded into the 32-bit instruction it
+// is defined to be equivalent to, so CPU.Step executes it through the normal
+// paths. Only the PC increment (2 instead of 4) and the link address differ.
+
+// Field builders for the expanded 32-bit instructions.
+func mkI(op, rd, f3, rs1 uint32, imm int32) uint32 {
+	return (uint32(imm)&0xFFF)<<20 | rs1<<15 | f3<<12 | rd<<7 | op
+}
+
+func mkS(op, f3, rs1, rs2 uint32, imm int32) uint32 {
+	u := uint32(imm) & 0xFFF
+	return (u>>5)<<25 | rs2<<20 | rs1<<15 | f3<<12 | (u&0x1F)<<7 | op
+}
+
+func mkB(f3, rs1, rs2 uint32, imm int32) uint32 {
+	i := uint32(imm) & 0x1FFF
+	return (i>>12&1)<<31 | (i>>5&0x3F)<<25 | rs2<<20 | rs1<<15 | f3<<12 |
+		(i>>1&0xF)<<8 | (i>>11&1)<<7 | opBRANCH
+}
+
+func mkJ(rd uint32, imm int32) uint32 {
+	i := uint32(imm) & 0x1FFFFF
+	return (i>>20&1)<<31 | (i>>1&0x3FF)<<21 | (i>>11&1)<<20 | (i>>12&0xFF)<<12 | rd<<7 | opJAL
+}
+
+func mkR(f7, rs2, rs1, f3, rd uint32) uint32 {
+	return f7<<25 | rs2<<20 | rs1<<15 | f3<<12 | rd<<7 | opOP
+}
+
+// cbits extracts h[hi:lo] and places it at bit position 'at'.
+func cbits(h uint32, hi, lo, at uint) uint32 {
+	return (h >> lo) & (1<<(hi-lo+1) - 1) << at
+}
+
+// creg maps a 3-bit compressed register field (rd'/rs1'/rs2') to x8..x15.
+func creg(f uint32) uint32 { return 8 + f&7 }
+
+// expandC returns the 32-bit equivalent of the compressed instruction h and
+// its mnemonic. name is "" for reserved/illegal encodings (including the
+// all-zero parcel). Forms that need F or D expand to the regular FP
+// load/store, which Step rejects if that extension is disabled.
+func expandC(h uint16) (inst uint32, name string) {
+	c := uint32(h)
+	f3 := c >> 13
+	rd := c >> 7 & 0x1F // also rs1 in CI/CR forms
+	rs2 := c >> 2 & 0x1F
+	rdp := creg(c >> 2)  // rd'/rs2' in bits 4:2
+	rs1p := creg(c >> 7) // rs1'/rd' in bits 9:7
+
+	// Common immediates.
+	imm6 := sext(cbits(c, 12, 12, 5)|cbits(c, 6, 2, 0), 6) // CI: imm[5|4:0]
+	shamt := cbits(c, 6, 2, 0)
+	lwOff := int32(cbits(c, 12, 10, 3) | cbits(c, 6, 6, 2) | cbits(c, 5, 5, 6))
+	ldOff := int32(cbits(c, 12, 10, 3) | cbits(c, 6, 5, 6))
+
+	switch c & 3 {
+	case 0: // quadrant 0
+		switch f3 {
+		case 0: // C.ADDI4SPN
+			nz := cbits(c, 12, 11, 4) | cbits(c, 10, 7, 6) | cbits(c, 6, 6, 2) | cbits(c, 5, 5, 3)
+			if nz == 0 {
+				return 0, ""
+			}
+			return mkI(OpOPIMM, rdp, F3ADDI, 2, int32(nz)), "c.addi4spn"
+		case 1:
+			return mkI(opLOADFP, rdp, f3FLD, rs1p, ldOff), "c.fld"
+		case 2:
+			return mkI(OpLOAD, rdp, f3LW, rs1p, lwOff), "c.lw"
+		case 3:
+			return mkI(opLOADFP, rdp, f3FLW, rs1p, lwOff), "c.flw"
+		case 5:
+			return mkS(opSTOREFP, f3FSD, rs1p, rdp, ldOff), "c.fsd"
+		case 6:
+			return mkS(opSTORE, f3SW, rs1p, rdp, lwOff), "c.sw"
+		case 7:
+			return mkS(opSTOREFP, f3FSW, rs1p, rdp, lwOff), "c.fsw"
+		}
+
+	case 1: // quadrant 1
+		switch f3 {
+		case 0: // C.ADDI (rd=0 is C.NOP)
+			if rd == 0 {
+				return mkI(OpOPIMM, 0, F3ADDI, 0, 0), "c.nop"
+			}
+			return mkI(OpOPIMM, rd, F3ADDI, rd, imm6), "c.addi"
+		case 1, 5: // C.JAL (RV32 only) / C.J
+			off := sext(cbits(c, 12, 12, 11)|cbits(c, 11, 11, 4)|cbits(c, 10, 9, 8)|
+				cbits(c, 8, 8, 10)|cbits(c, 7, 7, 6)|cbits(c, 6, 6, 7)|
+				cbits(c, 5, 3, 1)|cbits(c, 2, 2, 5), 12)
+			if f3 == 1 {
+				return mkJ(1, off), "c.jal"
+			}
+			return mkJ(0, off), "c.j"
+		case 2:
+			return mkI(OpOPIMM, rd, F3ADDI, 0, imm6), "c.li"
+		case 3:
+			if rd == 2 { // C.ADDI16SP
+				nz := sext(cbits(c, 12, 12, 9)|cbits(c, 6, 6, 4)|cbits(c, 5, 5, 6)|
+					cbits(c, 4, 3, 7)|cbits(c, 2, 2, 5), 10)
+				if nz == 0 {
+					return 0, ""
+				}
+				return mkI(OpOPIMM, 2, F3ADDI, 2, nz), "c.addi16sp"
+			}
+			if imm6 == 0 {
+				return 0, ""
+			}
+			return uint32(imm6)<<12 | rd<<7 | OpLUI, "c.lui"
+		case 4:
+			switch c >> 10 & 3 {
+			case 0, 1: // C.SRLI / C.SRAI; shamt[5]=1 is reserved on RV32
+				if c>>12&1 != 0 {
+					return 0, ""
+				}
+				if c>>10&3 == 0 {
+					return mkI(OpOPIMM, rs1p, f3SRxI, rs1p, int32(shamt)), "c.srli"
+				}
+				return mkI(OpOPIMM, rs1p, f3SRxI, rs1p, int32(funct7SUBSRA<<5|shamt)), "c.srai"
+			case 2:
+				return mkI(OpOPIMM, rs1p, f3ANDI, rs1p, imm6), "c.andi"
+			default:
+				if c>>12&1 != 0 { // C.SUBW/C.ADDW are RV64 only
+					return 0, ""
+				}
+				switch c >> 5 & 3 {
+				case 0:
+					return mkR(funct7SUBSRA, rdp, rs1p, f3ADD_SUB, rs1p), "c.sub"
+				case 1:
+					return mkR(0, rdp, rs1p, f3XOR, rs1p), "c.xor"
+				case 2:
+					return mkR(0, rdp, rs1p, f3OR, rs1p), "c.or"
+				default:
+					return mkR(0, rdp, rs1p, f3AND, rs1p), "c.and"
+				}
+			}
+		case 6, 7: // C.BEQZ / C.BNEZ
+			off := sext(cbits(c, 12, 12, 8)|cbits(c, 11, 10, 3)|cbits(c, 6, 5, 6)|
+				cbits(c, 4, 3, 1)|cbits(c, 2, 2, 5), 9)
+			if f3 == 6 {
+				return mkB(F3BEQ, rs1p, 0, off), "c.beqz"
+			}
+			return mkB(f3BNE, rs1p, 0, off), "c.bnez"
+		}
+
+	case 2: // quadrant 2
+		lwspOff := int32(cbits(c, 12, 12, 5) | cbits(c, 6, 4, 2) | cbits(c, 3, 2, 6))
+		ldspOff := int32(cbits(c, 12, 12, 5) | cbits(c, 6, 5, 3) | cbits(c, 4, 2, 6))
+		swspOff := int32(cbits(c, 12, 9, 2) | cbits(c, 8, 7, 6))
+		sdspOff := int32(cbits(c, 12, 10, 3) | cbits(c, 9, 7, 6))
+		switch f3 {
+		case 0: // C.SLLI; shamt[5]=1 is reserved on RV32
+			if c>>12&1 != 0 {
+				return 0, ""
+			}
+			return mkI(OpOPIMM, rd, f3SLLI, rd, int32(shamt)), "c.slli"
+		case 1:
+			return mkI(opLOADFP, rd, f3FLD, 2, ldspOff), "c.fldsp"
+		case 2:
+			if rd == 0 {
+				return 0, ""
+			}
+			return mkI(OpLOAD, rd, f3LW, 2, lwspOff), "c.lwsp"
+		case 3:
+			return mkI(opLOADFP, rd, f3FLW, 2, lwspOff), "c.flwsp"
+		case 4:
+			switch {
+			case c>>12&1 == 0 && rs2 == 0: // C.JR
+				if rd == 0 {
+					return 0, ""
+				}
+				return mkI(opJALR, 0, 0, rd, 0), "c.jr"
+			case c>>12&1 == 0: // C.MV
+				return mkR(0, rs2, 0, f3ADD_SUB, rd), "c.mv"
+			case rd == 0 && rs2 == 0:
+				return instEBREAK, "c.ebreak"
+			case rs2 == 0: // C.JALR
+				return mkI(opJALR, 1, 0, rd, 0), "c.jalr"
+			default: // C.ADD
+				return mkR(0, rs2, rd, f3ADD_SUB, rd), "c.add"
+			}
+		case 5:
+			return mkS(opSTOREFP, f3FSD, 2, rs2, sdspOff), "c.fsdsp"
+		case 6:
+			return mkS(opSTORE, f3SW, 2, rs2, swspOff), "c.swsp"
+		case 7:
+			return mkS(opSTOREFP, f3FSW, 2, rs2, swspOff), "c.fswsp"
+		}
+	}
+	return 0, ""
+}
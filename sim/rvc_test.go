@@ -0,0 +1,155 @@
+package sim
+
+import "testing"
+
+func TestExpandC(t *testing.T) {
+	const sp = 2
+	cases := []struct {
+		h    uint16
+		want uint32
+		name string
+	}{
+		{0x0001, encI(OpOPIMM, x0, F3ADDI, x0, 0), "c.nop"},
+		{0x0505, encI(OpOPIMM, a0, F3ADDI, a0, 1), "c.addi"},
+		{0x4515, encI(OpOPIMM, a0, F3ADDI, x0, 5), "c.li"},
+		{0x6505, encU(OpLUI, a0, 0x1000), "c.lui"},
+		{0x757D, encU(OpLUI, a0, 0xFFFFF000), "c.lui"},
+		{0x7139, encI(OpOPIMM, sp, F3ADDI, sp, -64), "c.addi16sp"},
+		{0x0808, encI(OpOPIMM, a0, F3ADDI, sp, 16), "c.addi4spn"},
+		{0x41C8, encI(OpLOAD, a0, f3LW, a1, 4), "c.lw"},
+		{0xC1C8, encS(f3SW, a1, a0, 4), "c.sw"},
+		{0x4532, encI(OpLOAD, a0, f3LW, sp, 12), "c.lwsp"},
+		{0xC62A, encS(f3SW, sp, a0, 12), "c.swsp"},
+		{0x8109, encI(OpOPIMM, a0, f3SRxI, a0, 2), "c.srli"},
+		{0x8509, encI(OpOPIMM, a0, f3SRxI, a0, 2, funct7SUBSRA), "c.srai"},
+		{0x997D, encI(OpOPIMM, a0, f3ANDI, a0, -1), "c.andi"},
+		{0x050E, encI(OpOPIMM, a0, f3SLLI, a0, 3), "c.slli"},
+		{0x8D0D, encR(a0, f3ADD_SUB, a0, a1, funct7SUBSRA), "c.sub"},
+		{0x8D2D, encR(a0, f3XOR, a0, a1, 0), "c.xor"},
+		{0x8D4D, encR(a0, f3OR, a0, a1, 0), "c.or"},
+		{0x8D6D, encR(a0, f3AND, a0, a1, 0), "c.and"},
+		{0x85AA, encR(a1, f3ADD_SUB, x0, a0, 0), "c.mv"},
+		{0x952E, encR(a0, f3ADD_SUB, a0, a1, 0), "c.add"},
+		{0x8082, encI(opJALR, x0, 0, 1, 0), "c.jr"},
+		{0x9502, encI(opJALR, 1, 0, a0, 0), "c.jalr"},
+		{0x9002, instEBREAK, "c.ebreak"},
+		{0xA001, encJ(x0, 0), "c.j"},
+		{0xA011, encJ(x0, 4), "c.j"},
+		{0x2001, encJ(1, 0), "c.jal"},
+		{0xC119, encB(F3BEQ, a0, x0, 6), "c.beqz"},
+		{0xE101, encB(f3BNE, a0, x0, 0), "c.bnez"},
+	}
+	for _, tc := range cases {
+		got, name := expandC(tc.h)
+		if got != tc.want || name != tc.name {
+			t.Errorf("expandC(0x%04x) = (0x%08x, %q), want (0x%08x, %q)", tc.h, got, name, tc.want, tc.name)
+		}
+	}
+
+	// Reserved encodings.
+	for _, h := range []uint16{
+		0x0000,                // all-zero parcel (C.ADDI4SPN with nzuimm=0)
+		0x6101,                // C.ADDI16SP with nzimm=0
+		0x6501,                // C.LUI with nzimm=0
+		0x4502 &^ (0x1F << 7), // C.LWSP with rd=0
+		0x8002,                // C.JR with rs1=0
+		0x9101,                // C.SRLI with shamt[5]=1 (RV64 only)
+		0x9D0D,                // C.SUBW (RV64 only)
+	} {
+		if _, name := expandC(h); name != "" {
+			t.Errorf("expandC(0x%04x) = %q, want reserved", h, name)
+		}
+	}
+}
+
+// writeHalf stores a 16-bit parcel at addr.
+func writeHalf(t *testing.T, ram *RAM, addr uint32, h uint16) {
+	t.Helper()
+	if !ram.Write8(addr, uint8(h)) || !ram.Write8(addr+1, uint8(h>>8)) {
+		t.Fatalf("writeHalf OOB at %d", addr)
+	}
+}
+
+func TestCPU_CompressedProgram(t *testing.T) {
+	cpu, ram := newISATestCPU(t, ExtC)
+
+	// 0x00: c.li   a0, 5
+	// 0x02: addi   a1, zero, 7   (32-bit, straddles the word at 0x04)
+	// 0x06: c.add  a0, a1
+	// 0x08: c.jal  +4 -> 0x0C    (ra = 0x0A)
+	// 0x0A: c.ebreak
+	// 0x0C: c.jr   ra
+	writeHalf(t, ram, 0x00, 0x4515)
+	addi := encI(OpOPIMM, a1, F3ADDI, x0, 7)
+	writeHalf(t, ram, 0x02, uint16(addi))
+	writeHalf(t, ram, 0x04, uint16(addi>>16))
+	writeHalf(t, ram, 0x06, 0x952E)
+	writeHalf(t, ram, 0x08, 0x2011)
+	writeHalf(t, ram, 0x0A, 0x9002)
+	writeHalf(t, ram, 0x0C, 0x8082)
+
+	if !runToHalt(cpu, 20) {
+		t.Fatalf("program did not halt in time")
+	}
+	if cpu.Reg[a0] != 12 {
+		t.Errorf("a0 = %d, want 12", cpu.Reg[a0])
+	}
+	if cpu.Reg[1] != 0x0A {
+		t.Errorf("ra = 0x%x, want 0x0a (pc+2)", cpu.Reg[1])
+	}
+	if cpu.PC != 0x0A {
+		t.Errorf("halted at pc=0x%x, want 0x0a", cpu.PC)
+	}
+}
+
+func TestCPU_IALIGN(t *testing.T) {
+	// jalr to a 2-byte aligned target is legal only with C.
+	prog := []uint32{
+		encI(OpOPIMM, 1, F3ADDI, x0, 6),
+		encI(opJALR, x0, 0, 1, 0),
+	}
+	cpu, _ := newTestCPU(t, prog...)
+	cpu.Step()
+	if cpu.Step() {
+		t.Fatalf("rv32i: jalr to 0x6 should trap")
+	}
+
+	cpu, _ = newTestCPU(t, prog...)
+	cpu.ISA = ExtC
+	cpu.Step()
+	if !cpu.Step() || cpu.PC != 6 {
+		t.Fatalf("rv32ic: jalr to 0x6 failed, pc=0x%x", cpu.PC)
+	}
+
+	// mepc keeps bit 1 only with C.
+	cpu.WriteCSR(CSRMepc, 0x1236)
+	if v, _ := cpu.ReadCSR(CSRMepc); v != 0x1236 {
+		t.Fatalf("rv32ic: mepc = 0x%x, want 0x1236", v)
+	}
+}
+
+func TestDisasm_Compressed(t *testing.T) {
+	cases := map[uint32]string{
+		0x4515: "c.li a0, 5",
+		0x7139: "c.addi16sp sp, -64",
+		0x0808: "c.addi4spn a0, sp, 16",
+		0x41C8: "c.lw a0, 4(a1)",
+		0xC62A: "c.swsp a0, 12(sp)",
+		0x8D0D: "c.sub a0, a1",
+		0x8082: "c.jr ra",
+		0xA011: "c.j 0x00000104",
+		0xC119: "c.beqz a0, 0x00000106",
+		0x6505: "c.lui a0, 0x1",
+		0x8509: "c.srai a0, 2",
+		0x0001: "c.nop",
+		0x0000: ".half 0x0000",
+	}
+	for inst, want := range cases {
+		if got := Disasm(0x100, inst); got != want {
+			t.Errorf("Disasm(0x%04x) = %q, want %q", inst, got, want)
+		}
+	}
+	if InstLen(0x4515) != 2 || InstLen(instECALL) != 4 {
+		t.Errorf("InstLen mismatch")
+	}
+}
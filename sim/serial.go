@@ -0,0 +1,98 @@
+package sim
+
+import (
+	"bytes"
+	"io"
+)
+
+// serialOut is the transmit side shared by the UART models.
+//   - Every byte sent is appended to an internal buffer (see String).
+//   - If Out is set, bytes are mirrored to it as well, one line at a time
+//     when LineBuffered is set.
+type serialOut struct {
+	Out          io.Writer // optional, can be nil
+	LineBuffered bool
+	buf          bytes.Buffer
+	lineBuf      bytes.Buffer
+}
+
+func (s *serialOut) transmit(v uint8) {
+	_ = s.buf.WriteByte(v)
+
+	if s.Out != nil {
+		if s.LineBuffered {
+			_ = s.lineBuf.WriteByte(v)
+			if v == '\n' {
+				_, _ = s.Out.Write(s.lineBuf.Bytes())
+				s.lineBuf.Reset()
+			}
+		} else {
+			_, _ = s.Out.Write([]byte{v})
+		}
+	}
+}
+
+// String returns everything transmitted since the last Reset.
+func (s *serialOut) String() string { return s.buf.String() }
+func (s *serialOut) Reset()         { s.buf.Reset() }
+
+// serialIn is the receive side shared by the UART models.
+type serialIn struct {
+	in   io.Reader   // in-memory input, read synchronously
+	inCh <-chan byte // live input from the reader goroutine
+}
+
+// SetInput feeds the receive side from r. In-memory readers (anything with
+// a Len method, e.g. bytes.Reader, strings.Reader or bytes.Buffer) are
+// drained on demand, so tests see their bytes at once. Any other reader,
+// such as os.Stdin, is read by a background goroutine and its bytes show
+// up as they arrive.
+func (s *serialIn) SetInput(r io.Reader) {
+	s.in, s.inCh = nil, nil
+	if _, ok := r.(interface{ Len() int }); ok {
+		s.in = r
+		return
+	}
+	ch := make(chan byte, 256)
+	s.inCh = ch
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := r.Read(buf)
+			for _, b := range buf[:n] {
+				ch <- b
+			}
+			if err != nil {
+				close(ch)
+				return
+			}
+		}
+	}()
+}
+
+// live reports whether input may still arrive from a background reader.
+func (s *serialIn) live() bool { return s.inCh != nil }
+
+// receive appends available input to fifo, up to depth bytes in total,
+// without blocking.
+func (s *serialIn) receive(fifo []byte, depth int) []byte {
+	if space := depth - len(fifo); s.in != nil && space > 0 {
+		buf := make([]byte, space)
+		n, _ := s.in.Read(buf)
+		fifo = append(fifo, buf[:n]...)
+	}
+loop:
+	for s.inCh != nil && len(fifo) < depth {
+		select {
+		case b, ok := <-s.inCh:
+			if !ok {
+				s.inCh = nil // EOF
+				break loop
+			}
+			fifo = append(fifo, b)
+		default:
+			break loop
+		}
+	}
+	return fifo
+}
@@ -0,0 +1,495 @@
+package sim
+
+import "math/big"
+
+// Software IEEE-754 binary floating point for the F (and D) extensions.
+//
+// Go's native float32/float64 arithmetic only rounds to nearest-even and does
+// not report exception flags, so every operation here is computed exactly on
+// integers (sign, big.Int mantissa, binary exponent) and rounded once by
+// fpFormat.round in the requested RISC-V rounding mode. Operations whose
+// exact result is not finite in binary (div, sqrt) keep a "sticky" bit that
+// records that the true value lies strictly between two points, which is
+// all the final rounding needs to be correct in every mode.
+//
+// Values are passed around as raw bit patterns (uint64, low bits used for
+// binary32) so NaN payloads and signed zeros are never disturbed by Go.
+
+// fpFormat describes a binary interchange format.
+type fpFormat struct {
+	expBits, fracBits uint
+}
+
+var (
+	fmtS = fpFormat{8, 23}  // binary32
+	fmtD = fpFormat{11, 52} // binary64
+)
+
+// Rounding modes (the instruction rm field and frm).
+const (
+	rmRNE = 0 // round to nearest, ties to even
+	rmRTZ = 1 // round towards zero
+	rmRDN = 2 // round down (towards -inf)
+	rmRUP = 3 // round up (towards +inf)
+	rmRMM = 4 // round to nearest, ties to max magnitude
+	rmDYN = 7 // use frm (instruction field only)
+)
+
+// Accrued exception flags (fflags).
+const (
+	flagNX = 1 << 0 // inexact
+	flagUF = 1 << 1 // underflow
+	flagOF = 1 << 2 // overflow
+	flagDZ = 1 << 3 // divide by zero
+	flagNV = 1 << 4 // invalid operation
+)
+
+func (f fpFormat) bias() int        { return 1<<(f.expBits-1) - 1 }
+func (f fpFormat) emin() int        { return 1 - f.bias() }
+func (f fpFormat) prec() int        { return int(f.fracBits) + 1 }
+func (f fpFormat) expMax() uint64   { return 1<<f.expBits - 1 }
+func (f fpFormat) fracMask() uint64 { return 1<<f.fracBits - 1 }
+func (f fpFormat) signBit() uint64  { return 1 << (f.expBits + f.fracBits) }
+
+func (f fpFormat) exp(a uint64) uint64 { return a >> f.fracBits & f.expMax() }
+func (f fpFormat) neg(a uint64) bool   { return a&f.signBit() != 0 }
+func (f fpFormat) isZero(a uint64) bool {
+	return a&^f.signBit() == 0
+}
+func (f fpFormat) isInf(a uint64) bool {
+	return f.exp(a) == f.expMax() && a&f.fracMask() == 0
+}
+func (f fpFormat) isNaN(a uint64) bool {
+	return f.exp(a) == f.expMax() && a&f.fracMask() != 0
+}
+func (f fpFormat) isSNaN(a uint64) bool {
+	return f.isNaN(a) && a>>(f.fracBits-1)&1 == 0
+}
+
+// nan returns the canonical quiet NaN (0x7fc00000 / 0x7ff8000000000000).
+func (f fpFormat) nan() uint64 { return f.expMax()<<f.fracBits | 1<<(f.fracBits-1) }
+
+func (f fpFormat) inf(neg bool) uint64 { return f.withSign(f.expMax()<<f.fracBits, neg) }
+
+func (f fpFormat) zero(neg bool) uint64 { return f.withSign(0, neg) }
+
+func (f fpFormat) maxFinite(neg bool) uint64 {
+	return f.withSign((f.expMax()-1)<<f.fracBits|f.fracMask(), neg)
+}
+
+func (f fpFormat) withSign(a uint64, neg bool) uint64 {
+	if neg {
+		return a | f.signBit()
+	}
+	return a
+}
+
+// snanFlags returns NV if any operand is a signaling NaN.
+func (f fpFormat) snanFlags(ops ...uint64) uint32 {
+	for _, a := range ops {
+		if f.isSNaN(a) {
+			return flagNV
+		}
+	}
+	return 0
+}
+
+// fpNum is the finite value (-1)^neg · m · 2^e.
+type fpNum struct {
+	neg bool
+	m   *big.Int
+	e   int
+}
+
+// unpack decodes a finite (normal, subnormal or zero) value exactly.
+func (f fpFormat) unpack(a uint64) fpNum {
+	m := a & f.fracMask()
+	e := int(f.exp(a))
+	if e == 0 {
+		e = 1 // subnormal: same scale as the smallest normal, no hidden bit
+	} else {
+		m |= 1 << f.fracBits
+	}
+	return fpNum{f.neg(a), new(big.Int).SetUint64(m), e - f.bias() - int(f.fracBits)}
+}
+
+// roundShift returns m >> s rounded per rm (neg is the sign of the value),
+// and whether any nonzero bits were discarded. The result must fit in 64 bits.
+func roundShift(m *big.Int, s int, neg bool, rm uint32) (uint64, bool) {
+	if s <= 0 {
+		return m.Uint64() << uint(-s), false
+	}
+	k := new(big.Int).Rsh(m, uint(s)).Uint64()
+	tz := int(m.TrailingZeroBits())
+	if m.Sign() == 0 || tz >= s {
+		return k, false
+	}
+	half := m.Bit(s-1) == 1
+	var up bool
+	switch rm {
+	case rmRNE:
+		up = half && (tz < s-1 || k&1 == 1)
+	case rmRMM:
+		up = half
+	case rmRDN:
+		up = neg
+	case rmRUP:
+		up = !neg
+	}
+	if up {
+		k++
+	}
+	return k, true
+}
+
+// round packs n into format f using rounding mode rm and returns the bits
+// plus exception flags. If sticky is set, the true value lies strictly
+// between n and the next value of n's precision away from zero; n.m must
+// then have at least prec()+1 bits.
+//
+// Tininess is detected after rounding, as RISC-V requires.
+func (f fpFormat) round(n fpNum, sticky bool, rm uint32) (uint64, uint32) {
+	m, e := n.m, n.e
+	if sticky {
+		m = new(big.Int).Lsh(m, 1)
+		m.SetBit(m, 0, 1)
+		e--
+	}
+	if m.Sign() == 0 {
+		return f.zero(n.neg), 0
+	}
+
+	p := f.prec()
+	lead := e + m.BitLen() - 1 // exponent of the leading one
+	qmin := f.emin() - int(f.fracBits)
+	q := max(lead-p+1, qmin) // exponent of the result's last place
+
+	k, inexact := roundShift(m, q-e, n.neg, rm)
+	var flags uint32
+	if inexact {
+		flags |= flagNX
+		tiny := lead < f.emin()
+		if lead == f.emin()-1 {
+			// Would rounding to full precision reach 2^emin anyway?
+			if k2, _ := roundShift(m, lead-p+1-e, n.neg, rm); k2 == 1<<p {
+				tiny = false
+			}
+		}
+		if tiny {
+			flags |= flagUF
+		}
+	}
+	if k == 1<<p { // rounded up into the next binade
+		k >>= 1
+		q++
+	}
+
+	if k>>(p-1) == 0 { // subnormal or zero
+		return f.withSign(k, n.neg), flags
+	}
+	biased := uint64(q + int(f.fracBits) + f.bias())
+	if biased >= f.expMax() {
+		return f.overflow(n.neg, rm), flags | flagOF | flagNX
+	}
+	return f.withSign(biased<<f.fracBits|k&f.fracMask(), n.neg), flags
+}
+
+// overflow returns the result of an overflowing operation: infinity, or the
+// largest finite number when rounding towards zero from that side.
+func (f fpFormat) overflow(neg bool, rm uint32) uint64 {
+	switch rm {
+	case rmRTZ:
+		return f.maxFinite(neg)
+	case rmRDN:
+		if !neg {
+			return f.maxFinite(false)
+		}
+	case rmRUP:
+		if neg {
+			return f.maxFinite(true)
+		}
+	}
+	return f.inf(neg)
+}
+
+// addNum returns the correctly rounded x + y.
+func (f fpFormat) addNum(x, y fpNum, rm uint32) (uint64, uint32) {
+	e := min(x.e, y.e)
+	mx := new(big.Int).Lsh(x.m, uint(x.e-e))
+	my := new(big.Int).Lsh(y.m, uint(y.e-e))
+	if x.neg {
+		mx.Neg(mx)
+	}
+	if y.neg {
+		my.Neg(my)
+	}
+	sum := mx.Add(mx, my)
+	if sum.Sign() == 0 {
+		// Exact zero: -0 only if both addends are -0, or opposite signs under RDN.
+		neg := x.neg && y.neg
+		if x.neg != y.neg {
+			neg = rm == rmRDN
+		}
+		return f.zero(neg), 0
+	}
+	neg := sum.Sign() < 0
+	return f.round(fpNum{neg, sum.Abs(sum), e}, false, rm)
+}
+
+func (f fpFormat) add(a, b uint64, rm uint32) (uint64, uint32) {
+	switch {
+	case f.isNaN(a) || f.isNaN(b):
+		return f.nan(), f.snanFlags(a, b)
+	case f.isInf(a) && f.isInf(b) && f.neg(a) != f.neg(b):
+		return f.nan(), flagNV
+	case f.isInf(a):
+		return a, 0
+	case f.isInf(b):
+		return b, 0
+	}
+	return f.addNum(f.unpack(a), f.unpack(b), rm)
+}
+
+func (f fpFormat) sub(a, b uint64, rm uint32) (uint64, uint32) {
+	return f.add(a, b^f.signBit(), rm)
+}
+
+func (f fpFormat) mul(a, b uint64, rm uint32) (uint64, uint32) {
+	neg := f.neg(a) != f.neg(b)
+	switch {
+	case f.isNaN(a) || f.isNaN(b):
+		return f.nan(), f.snanFlags(a, b)
+	case f.isInf(a) || f.isInf(b):
+		if f.isZero(a) || f.isZero(b) {
+			return f.nan(), flagNV
+		}
+		return f.inf(neg), 0
+	}
+	x, y := f.unpack(a), f.unpack(b)
+	return f.round(fpNum{neg, x.m.Mul(x.m, y.m), x.e + y.e}, false, rm)
+}
+
+func (f fpFormat) div(a, b uint64, rm uint32) (uint64, uint32) {
+	neg := f.neg(a) != f.neg(b)
+	switch {
+	case f.isNaN(a) || f.isNaN(b):
+		return f.nan(), f.snanFlags(a, b)
+	case f.isInf(a) && f.isInf(b), f.isZero(a) && f.isZero(b):
+		return f.nan(), flagNV
+	case f.isInf(a):
+		return f.inf(neg), 0
+	case f.isInf(b):
+		return f.zero(neg), 0
+	case f.isZero(b):
+		return f.inf(neg), flagDZ
+	case f.isZero(a):
+		return f.zero(neg), 0
+	}
+	x, y := f.unpack(a), f.unpack(b)
+	// Scale the dividend so the quotient has at least prec()+2 bits.
+	k := f.prec() + 2 + y.m.BitLen()
+	q, r := new(big.Int).QuoRem(x.m.Lsh(x.m, uint(k)), y.m, new(big.Int))
+	return f.round(fpNum{neg, q, x.e - y.e - k}, r.Sign() != 0, rm)
+}
+
+func (f fpFormat) sqrt(a uint64, rm uint32) (uint64, uint32) {
+	switch {
+	case f.isNaN(a):
+		return f.nan(), f.snanFlags(a)
+	case f.isZero(a):
+		return a, 0 // sqrt(±0) = ±0
+	case f.neg(a):
+		return f.nan(), flagNV
+	case f.isInf(a):
+		return a, 0
+	}
+	x := f.unpack(a)
+	// Scale by an even power of two so the root has at least prec()+2 bits.
+	k := 2 * (f.prec() + 2)
+	if (x.e-k)%2 != 0 {
+		k++
+	}
+	m := x.m.Lsh(x.m, uint(k))
+	s := new(big.Int).Sqrt(m)
+	exact := new(big.Int).Mul(s, s).Cmp(m) == 0
+	return f.round(fpNum{false, s, (x.e - k) / 2}, !exact, rm)
+}
+
+// fma returns ±(a·b) ± c with a single rounding. negProd negates the
+// product and negAddend negates c (FMSUB, FNMSUB, FNMADD).
+func (f fpFormat) fma(a, b, c uint64, negProd, negAddend bool, rm uint32) (uint64, uint32) {
+	invalidProd := f.isInf(a) && f.isZero(b) || f.isZero(a) && f.isInf(b)
+	if f.isNaN(a) || f.isNaN(b) || f.isNaN(c) {
+		// ∞·0 is invalid even when the addend is a quiet NaN.
+		fl := f.snanFlags(a, b, c)
+		if invalidProd {
+			fl |= flagNV
+		}
+		return f.nan(), fl
+	}
+	if invalidProd {
+		return f.nan(), flagNV
+	}
+	pneg := f.neg(a) != f.neg(b) != negProd
+	cneg := f.neg(c) != negAddend
+	switch {
+	case f.isInf(a) || f.isInf(b):
+		if f.isInf(c) && cneg != pneg {
+			return f.nan(), flagNV
+		}
+		return f.inf(pneg), 0
+	case f.isInf(c):
+		return f.inf(cneg), 0
+	}
+	x, y, z := f.unpack(a), f.unpack(b), f.unpack(c)
+	prod := fpNum{pneg, x.m.Mul(x.m, y.m), x.e + y.e}
+	z.neg = cneg
+	return f.addNum(prod, z, rm)
+}
+
+// less orders two non-NaN values. If zerosEqual is false, -0 < +0 (as
+// FMIN/FMAX require); otherwise the zeros compare equal (FLT/FLE).
+func (f fpFormat) less(a, b uint64, zerosEqual bool) bool {
+	if zerosEqual && f.isZero(a) && f.isZero(b) {
+		return false
+	}
+	na, nb := f.neg(a), f.neg(b)
+	switch {
+	case na != nb:
+		return na
+	case na:
+		return a&^f.signBit() > b&^f.signBit()
+	default:
+		return a < b
+	}
+}
+
+// minMax implements FMIN/FMAX (IEEE 754-2019 minimumNumber/maximumNumber):
+// a single NaN operand is ignored, two NaNs give the canonical NaN.
+func (f fpFormat) minMax(a, b uint64, isMax bool) (uint64, uint32) {
+	fl := f.snanFlags(a, b)
+	switch {
+	case f.isNaN(a) && f.isNaN(b):
+		return f.nan(), fl
+	case f.isNaN(a):
+		return b, fl
+	case f.isNaN(b):
+		return a, fl
+	}
+	if f.less(a, b, false) != isMax {
+		return a, fl
+	}
+	return b, fl
+}
+
+// Comparison kinds for compare (match funct3 of FLE/FLT/FEQ).
+const (
+	cmpLE = 0
+	cmpLT = 1
+	cmpEQ = 2
+)
+
+// compare implements FEQ (quiet: NV only for signaling NaNs) and FLT/FLE
+// (signaling: NV for any NaN). NaN operands compare false.
+func (f fpFormat) compare(a, b uint64, kind uint32) (bool, uint32) {
+	if f.isNaN(a) || f.isNaN(b) {
+		if kind == cmpEQ {
+			return false, f.snanFlags(a, b)
+		}
+		return false, flagNV
+	}
+	eq := a == b || f.isZero(a) && f.isZero(b)
+	switch kind {
+	case cmpEQ:
+		return eq, 0
+	case cmpLT:
+		return f.less(a, b, true), 0
+	default:
+		return eq || f.less(a, b, true), 0
+	}
+}
+
+// class returns the FCLASS bit mask of a.
+func (f fpFormat) class(a uint64) uint32 {
+	neg := f.neg(a)
+	var bit uint
+	switch {
+	case f.isNaN(a):
+		if f.isSNaN(a) {
+			return 1 << 8
+		}
+		return 1 << 9
+	case f.isInf(a):
+		bit = 7
+	case f.isZero(a):
+		bit = 4
+	case f.exp(a) == 0:
+		bit = 5 // subnormal
+	default:
+		bit = 6 // normal
+	}
+	if neg {
+		bit = 7 - bit
+	}
+	return 1 << bit
+}
+
+// toInt converts a to a 32-bit integer (FCVT.W[U]). Out-of-range values and
+// NaNs saturate and raise NV; NaN converts like +inf.
+func (f fpFormat) toInt(a uint64, signed bool, rm uint32) (uint32, uint32) {
+	lo, hi := uint32(0), uint32(0xFFFFFFFF)
+	if signed {
+		lo, hi = 0x80000000, 0x7FFFFFFF
+	}
+	switch {
+	case f.isNaN(a):
+		return hi, flagNV
+	case f.isInf(a):
+		if f.neg(a) {
+			return lo, flagNV
+		}
+		return hi, flagNV
+	}
+	x := f.unpack(a)
+	if x.m.Sign() != 0 && x.e+x.m.BitLen()-1 >= 32 {
+		if x.neg {
+			return lo, flagNV
+		}
+		return hi, flagNV
+	}
+	k, inexact := roundShift(x.m, -x.e, x.neg, rm)
+	switch {
+	case x.neg && k > uint64(lo): // for unsigned, any negative nonzero result
+		return lo, flagNV
+	case !x.neg && k > uint64(hi):
+		return hi, flagNV
+	}
+	var fl uint32
+	if inexact {
+		fl = flagNX
+	}
+	if x.neg {
+		return uint32(-int64(k)), fl
+	}
+	return uint32(k), fl
+}
+
+// fromInt converts a 32-bit integer to format f (FCVT.S.W[U]).
+func (f fpFormat) fromInt(v uint32, signed bool, rm uint32) (uint64, uint32) {
+	mag, neg := uint64(v), false
+	if signed && int32(v) < 0 {
+		mag, neg = uint64(-int64(int32(v))), true
+	}
+	return f.round(fpNum{neg, new(big.Int).SetUint64(mag), 0}, false, rm)
+}
+
+// convert rounds a value of format from into format f (FCVT.S.D/FCVT.D.S).
+func (f fpFormat) convert(from fpFormat, a uint64, rm uint32) (uint64, uint32) {
+	switch {
+	case from.isNaN(a):
+		return f.nan(), from.snanFlags(a)
+	case from.isInf(a):
+		return f.inf(from.neg(a)), 0
+	}
+	return f.round(from.unpack(a), false, rm)
+}
@@ -0,0 +1,389 @@
+package sim
+
+import (
+	"math"
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+func f32(v float32) uint64 { return uint64(math.Float32bits(v)) }
+
+func TestSoftFloat_VectorsS(t *testing.T) {
+	const (
+		one     = 0x3F800000
+		two     = 0x40000000
+		three   = 0x40400000
+		qnan    = 0x7FC00000
+		snan    = 0x7F800001
+		inf     = 0x7F800000
+		negInf  = 0xFF800000
+		maxF    = 0x7F7FFFFF
+		minNorm = 0x00800000
+		minSub  = 0x00000001
+		negZero = 0x80000000
+	)
+	f := fmtS
+	type op func(a, b uint64, rm uint32) (uint64, uint32)
+	cases := []struct {
+		name   string
+		fn     op
+		a, b   uint64
+		rm     uint32
+		want   uint64
+		wantFl uint32
+	}{
+		{"1/3 rne", f.div, one, three, rmRNE, 0x3EAAAAAB, flagNX},
+		{"1/3 rtz", f.div, one, three, rmRTZ, 0x3EAAAAAA, flagNX},
+		{"1/3 rdn", f.div, one, three, rmRDN, 0x3EAAAAAA, flagNX},
+		{"1/3 rup", f.div, one, three, rmRUP, 0x3EAAAAAB, flagNX},
+		{"-1/3 rdn", f.div, one | negZero, three, rmRDN, 0xBEAAAAAB, flagNX},
+		{"1/0", f.div, one, 0, rmRNE, inf, flagDZ},
+		{"0/0", f.div, 0, 0, rmRNE, qnan, flagNV},
+		{"inf-inf", f.sub, inf, inf, rmRNE, qnan, flagNV},
+		{"snan+1", f.add, snan, one, rmRNE, qnan, flagNV},
+		{"qnan+1", f.add, 0x7FC12345, one, rmRNE, qnan, 0},
+		{"1-1 rne", f.sub, one, one, rmRNE, 0, 0},
+		{"1-1 rdn", f.sub, one, one, rmRDN, negZero, 0},
+		{"-0+-0", f.add, negZero, negZero, rmRNE, negZero, 0},
+		{"max*2 rne", f.mul, maxF, two, rmRNE, inf, flagOF | flagNX},
+		{"max*2 rtz", f.mul, maxF, two, rmRTZ, maxF, flagOF | flagNX},
+		{"-max*2 rup", f.mul, maxF | negZero, two, rmRUP, maxF | negZero, flagOF | flagNX},
+		{"inf*0", f.mul, inf, 0, rmRNE, qnan, flagNV},
+		{"minNorm/2 exact", f.div, minNorm, two, rmRNE, 0x00400000, 0},
+		{"minSub/2 rne", f.div, minSub, two, rmRNE, 0, flagUF | flagNX},
+		{"minSub/2 rup", f.div, minSub, two, rmRUP, minSub, flagUF | flagNX},
+		{"minSub*1.5 rne", f.mul, minSub, 0x3FC00000, rmRNE, 2, flagUF | flagNX},
+		// (2^-126 - 2^-149)(1 + 2^-23) rounds to 2^-126 at full precision:
+		// not tiny after rounding under RNE, tiny under RTZ.
+		{"tiny after rounding rne", f.mul, 0x007FFFFF, 0x3F800001, rmRNE, minNorm, flagNX},
+		{"tiny after rounding rtz", f.mul, 0x007FFFFF, 0x3F800001, rmRTZ, 0x007FFFFF, flagUF | flagNX},
+	}
+	for _, tc := range cases {
+		got, fl := tc.fn(tc.a, tc.b, tc.rm)
+		if got != tc.want || fl != tc.wantFl {
+			t.Errorf("%s: got (0x%08x, %05b), want (0x%08x, %05b)", tc.name, got, fl, tc.want, tc.wantFl)
+		}
+	}
+
+	if got, fl := f.sqrt(negInf, rmRNE); got != qnan || fl != flagNV {
+		t.Errorf("sqrt(-inf) = (0x%x, %b)", got, fl)
+	}
+	if got, fl := f.sqrt(negZero, rmRNE); got != negZero || fl != 0 {
+		t.Errorf("sqrt(-0) = (0x%x, %b)", got, fl)
+	}
+	if got, fl := f.sqrt(two, rmRTZ); got != 0x3FB504F3 || fl != flagNX {
+		t.Errorf("sqrt(2) rtz = (0x%x, %b)", got, fl)
+	}
+}
+
+func f64(v float64) uint64 { return math.Float64bits(v) }
+
+// TestSoftFloat_VectorsD uses cases from the riscv-tests rv32ud suite
+// (fadd, fdiv, fmadd, fcvt_w, fcvt).
+func TestSoftFloat_VectorsD(t *testing.T) {
+	f := fmtD
+	type op func(a, b uint64, rm uint32) (uint64, uint32)
+	cases := []struct {
+		name   string
+		fn     op
+		a, b   float64
+		want   uint64
+		wantFl uint32
+	}{
+		{"fadd.d", f.add, 2.5, 1.0, f64(3.5), 0},
+		{"fadd.d", f.add, -1235.1, 1.1, f64(-1234), flagNX},
+		{"fadd.d", f.add, 3.14159265, 0.00000001, f64(3.14159266), flagNX},
+		{"fsub.d", f.sub, -1235.1, -1.1, f64(-1234), flagNX},
+		{"fsub.d", f.sub, 3.14159265, 0.00000001, f64(3.1415926400000001), flagNX},
+		{"fmul.d", f.mul, -1235.1, -1.1, f64(1358.61), flagNX},
+		{"fmul.d", f.mul, 3.14159265, 0.00000001, f64(3.14159265e-8), flagNX},
+		{"fsub.d inf-inf", f.sub, math.Inf(1), math.Inf(1), 0x7FF8000000000000, flagNV},
+		{"fdiv.d", f.div, 3.14159265, 2.71828182, f64(1.1557273520668288), flagNX},
+		{"fdiv.d", f.div, -1234, 1235.1, f64(-0.9991093838555584), flagNX},
+		{"fdiv.d", f.div, 3.14159265, 1.0, f64(3.14159265), 0},
+	}
+	for _, tc := range cases {
+		got, fl := tc.fn(f64(tc.a), f64(tc.b), rmRNE)
+		if got != tc.want || fl != tc.wantFl {
+			t.Errorf("%s(%g, %g) = (0x%016x, %05b), want (0x%016x, %05b)", tc.name, tc.a, tc.b, got, fl, tc.want, tc.wantFl)
+		}
+	}
+
+	if got, fl := f.sqrt(f64(3.14159265), rmRNE); got != f64(1.7724538498928541) || fl != flagNX {
+		t.Errorf("fsqrt.d(pi) = (0x%x, %b)", got, fl)
+	}
+	if got, fl := f.sqrt(f64(10000), rmRNE); got != f64(100) || fl != 0 {
+		t.Errorf("fsqrt.d(10000) = (0x%x, %b)", got, fl)
+	}
+	if got, fl := f.sqrt(f64(-1), rmRNE); got != f.nan() || fl != flagNV {
+		t.Errorf("fsqrt.d(-1) = (0x%x, %b)", got, fl)
+	}
+	if got, fl := f.fma(f64(-1), f64(-1235.1), f64(1.1), false, false, rmRNE); got != f64(1236.1999999999999) || fl != flagNX {
+		t.Errorf("fmadd.d = (0x%x, %b)", got, fl)
+	}
+	if got, _ := f.fma(f64(2), f64(-5), f64(-2), false, false, rmRNE); got != f64(-12) {
+		t.Errorf("fmadd.d(2,-5,-2) = 0x%x", got)
+	}
+	if got, _ := f.fma(f64(1), f64(2.5), f64(1), true, true, rmRNE); got != f64(-3.5) {
+		t.Errorf("fnmadd.d(1,2.5,1) = 0x%x", got)
+	}
+
+	ints := []struct {
+		a      float64
+		signed bool
+		want   uint32
+		wantFl uint32
+	}{
+		{-1.1, true, 0xFFFFFFFF, flagNX},
+		{-0.9, true, 0, flagNX},
+		{1.1, true, 1, flagNX},
+		{-3e9, true, 0x80000000, flagNV},
+		{3e9, true, 0x7FFFFFFF, flagNV},
+		{-3.0, false, 0, flagNV},
+		{-0.9, false, 0, flagNX},
+		{3e9, false, 3000000000, 0},
+	}
+	for _, tc := range ints {
+		got, fl := f.toInt(f64(tc.a), tc.signed, rmRTZ)
+		if got != tc.want || fl != tc.wantFl {
+			t.Errorf("toInt(%g, signed=%v) = (0x%x, %b), want (0x%x, %b)", tc.a, tc.signed, got, fl, tc.want, tc.wantFl)
+		}
+	}
+	// Every int32 is exact in binary64.
+	if got, fl := f.fromInt(0x80000001, true, rmRNE); got != f64(-2147483647) || fl != 0 {
+		t.Errorf("fcvt.d.w(-2^31+1) = (0x%x, %b)", got, fl)
+	}
+}
+
+func TestSoftFloat_ConvertSD(t *testing.T) {
+	if got, fl := fmtD.convert(fmtS, f32(-1.5), rmRNE); got != f64(-1.5) || fl != 0 {
+		t.Errorf("fcvt.d.s(-1.5) = (0x%x, %b)", got, fl)
+	}
+	if got, fl := fmtS.convert(fmtD, f64(-1.5), rmRNE); got != f32(-1.5) || fl != 0 {
+		t.Errorf("fcvt.s.d(-1.5) = (0x%x, %b)", got, fl)
+	}
+	if got, fl := fmtS.convert(fmtD, f64(0.1), rmRNE); got != f32(0.1) || fl != flagNX {
+		t.Errorf("fcvt.s.d(0.1) = (0x%x, %b)", got, fl)
+	}
+	if got, fl := fmtS.convert(fmtD, f64(1e300), rmRTZ); got != 0x7F7FFFFF || fl != flagOF|flagNX {
+		t.Errorf("fcvt.s.d(1e300) rtz = (0x%x, %b)", got, fl)
+	}
+	if got, fl := fmtS.convert(fmtD, f64(1e-300), rmRNE); got != 0 || fl != flagUF|flagNX {
+		t.Errorf("fcvt.s.d(1e-300) = (0x%x, %b)", got, fl)
+	}
+	// NaNs become the canonical NaN of the destination; sNaN raises NV.
+	if got, fl := fmtD.convert(fmtS, 0x7F800001, rmRNE); got != fmtD.nan() || fl != flagNV {
+		t.Errorf("fcvt.d.s(sNaN) = (0x%x, %b)", got, fl)
+	}
+	if got, fl := fmtS.convert(fmtD, math.Float64bits(math.Inf(-1)), rmRNE); got != 0xFF800000 || fl != 0 {
+		t.Errorf("fcvt.s.d(-inf) = (0x%x, %b)", got, fl)
+	}
+}
+
+func TestSoftFloat_FMA(t *testing.T) {
+	f := fmtS
+	// (1+2^-23)^2 - (1+2^-22) = 2^-46 exactly; an unfused mul+add gives 0.
+	a := uint64(0x3F800001)
+	c := uint64(0x3F800002)
+	if got, fl := f.fma(a, a, c, false, true, rmRNE); got != 0x28800000 || fl != 0 {
+		t.Errorf("fmsub = (0x%08x, %b), want 0x28800000", got, fl)
+	}
+	// FNMADD: -(2*3) - 1 = -7
+	if got, _ := f.fma(0x40000000, 0x40400000, 0x3F800000, true, true, rmRNE); got != 0xC0E00000 {
+		t.Errorf("fnmadd = 0x%08x, want 0xc0e00000", got)
+	}
+	// inf*0 + qNaN still raises NV.
+	if got, fl := f.fma(0x7F800000, 0, 0x7FC00000, false, false, rmRNE); got != f.nan() || fl != flagNV {
+		t.Errorf("fma(inf,0,qnan) = (0x%x, %b)", got, fl)
+	}
+	// inf + -inf via the addend.
+	if _, fl := f.fma(0x7F800000, 0x3F800000, 0xFF800000, false, false, rmRNE); fl != flagNV {
+		t.Errorf("fma(inf,1,-inf) flags = %b", fl)
+	}
+}
+
+func TestSoftFloat_Convert(t *testing.T) {
+	f := fmtS
+	cases := []struct {
+		a      float32
+		signed bool
+		rm     uint32
+		want   uint32
+		wantFl uint32
+	}{
+		{2.5, true, rmRNE, 2, flagNX},
+		{2.5, true, rmRMM, 3, flagNX},
+		{-2.5, true, rmRDN, uint32(0xFFFFFFFD), flagNX},
+		{-2.5, true, rmRTZ, uint32(0xFFFFFFFE), flagNX},
+		{3e9, true, rmRNE, 0x7FFFFFFF, flagNV},
+		{3e9, false, rmRNE, 3000000000, 0},
+		{-1, false, rmRNE, 0, flagNV},
+		{-0.5, false, rmRTZ, 0, flagNX},
+		{-2147483648, true, rmRNE, 0x80000000, 0},
+		{float32(math.Inf(-1)), false, rmRNE, 0, flagNV},
+	}
+	for _, tc := range cases {
+		got, fl := f.toInt(f32(tc.a), tc.signed, tc.rm)
+		if got != tc.want || fl != tc.wantFl {
+			t.Errorf("toInt(%g, signed=%v, rm=%d) = (0x%x, %b), want (0x%x, %b)", tc.a, tc.signed, tc.rm, got, fl, tc.want, tc.wantFl)
+		}
+	}
+	if got, fl := f.toInt(f.nan(), true, rmRNE); got != 0x7FFFFFFF || fl != flagNV {
+		t.Errorf("toInt(NaN) = (0x%x, %b)", got, fl)
+	}
+
+	if got, fl := f.fromInt(16777217, true, rmRNE); got != 0x4B800000 || fl != flagNX {
+		t.Errorf("fromInt(2^24+1) rne = (0x%x, %b)", got, fl)
+	}
+	if got, _ := f.fromInt(16777217, true, rmRUP); got != 0x4B800001 {
+		t.Errorf("fromInt(2^24+1) rup = 0x%x", got)
+	}
+	if got, _ := f.fromInt(0xFFFFFFFF, true, rmRNE); got != f32(-1) {
+		t.Errorf("fromInt(-1) = 0x%x", got)
+	}
+	if got, _ := f.fromInt(0xFFFFFFFF, false, rmRNE); got != f32(4294967296) {
+		t.Errorf("fromInt(uint32 max) = 0x%x", got)
+	}
+}
+
+func TestSoftFloat_CompareMinMaxClass(t *testing.T) {
+	f := fmtS
+	negZero, snan, qnan := uint64(0x80000000), uint64(0x7F800001), uint64(0x7FC00000)
+
+	if r, _ := f.minMax(negZero, 0, false); r != negZero {
+		t.Errorf("fmin(-0,+0) = 0x%x", r)
+	}
+	if r, _ := f.minMax(negZero, 0, true); r != 0 {
+		t.Errorf("fmax(-0,+0) = 0x%x", r)
+	}
+	if r, fl := f.minMax(snan, f32(1), false); r != f32(1) || fl != flagNV {
+		t.Errorf("fmin(sNaN,1) = (0x%x, %b)", r, fl)
+	}
+	if r, fl := f.minMax(qnan, qnan, true); r != f.nan() || fl != 0 {
+		t.Errorf("fmax(qNaN,qNaN) = (0x%x, %b)", r, fl)
+	}
+
+	if r, fl := f.compare(qnan, f32(1), cmpEQ); r || fl != 0 {
+		t.Errorf("feq(qNaN,1) = (%v, %b)", r, fl)
+	}
+	if r, fl := f.compare(qnan, f32(1), cmpLT); r || fl != flagNV {
+		t.Errorf("flt(qNaN,1) = (%v, %b)", r, fl)
+	}
+	if r, _ := f.compare(negZero, 0, cmpLE); !r {
+		t.Errorf("fle(-0,+0) = false")
+	}
+	if r, _ := f.compare(f32(-2), f32(-1), cmpLT); !r {
+		t.Errorf("flt(-2,-1) = false")
+	}
+
+	classes := map[uint64]uint32{
+		0xFF800000: 1 << 0, f32(-1): 1 << 1, 0x80000001: 1 << 2, negZero: 1 << 3,
+		0: 1 << 4, 1: 1 << 5, f32(1): 1 << 6, 0x7F800000: 1 << 7, snan: 1 << 8, qnan: 1 << 9,
+	}
+	for a, want := range classes {
+		if got := f.class(a); got != want {
+			t.Errorf("class(0x%08x) = 0x%x, want 0x%x", a, got, want)
+		}
+	}
+}
+
+// TestSoftFloat_RandomS compares against Go's own binary32 arithmetic (ties
+// to even) and math/big (directed modes) for results in the normal range.
+func TestSoftFloat_RandomS(t *testing.T) {
+	f := fmtS
+	rng := rand.New(rand.NewSource(1))
+	bigModes := map[uint32]big.RoundingMode{
+		rmRNE: big.ToNearestEven, rmRTZ: big.ToZero, rmRDN: big.ToNegativeInf,
+		rmRUP: big.ToPositiveInf, rmRMM: big.ToNearestAway,
+	}
+	normal := func(v float32) bool {
+		a := math.Abs(float64(v))
+		return a >= math.SmallestNonzeroFloat32*(1<<23) && a <= math.MaxFloat32
+	}
+	randF := func() float32 {
+		return float32(rng.NormFloat64() * math.Pow(2, float64(rng.Intn(40)-20)))
+	}
+
+	for i := 0; i < 3000; i++ {
+		x, y := randF(), randF()
+		a, b := f32(x), f32(y)
+
+		// Ties-to-even against native Go float32 arithmetic.
+		native := []struct {
+			name string
+			got  uint64
+			want float32
+		}{
+			{"add", first(f.add(a, b, rmRNE)), x + y},
+			{"sub", first(f.sub(a, b, rmRNE)), x - y},
+			{"mul", first(f.mul(a, b, rmRNE)), x * y},
+			{"div", first(f.div(a, b, rmRNE)), x / y},
+			{"sqrt", first(f.sqrt(f32(float32(math.Abs(float64(x)))), rmRNE)),
+				float32(math.Sqrt(math.Abs(float64(x))))},
+		}
+		for _, n := range native {
+			if normal(n.want) && n.got != f32(n.want) {
+				t.Fatalf("%s(%g, %g) = 0x%08x, want 0x%08x", n.name, x, y, n.got, f32(n.want))
+			}
+		}
+
+		// All modes against math/big with 24-bit precision.
+		for rm, mode := range bigModes {
+			ref := func(op func(z, x, y *big.Float) *big.Float) (float32, bool) {
+				z := new(big.Float).SetPrec(24).SetMode(mode)
+				op(z, big.NewFloat(float64(x)), big.NewFloat(float64(y)))
+				v, _ := z.Float32()
+				return v, z.Acc() != big.Exact
+			}
+			for name, c := range map[string]struct {
+				fn  func(a, b uint64, rm uint32) (uint64, uint32)
+				ref func(z, x, y *big.Float) *big.Float
+			}{
+				"add": {f.add, (*big.Float).Add},
+				"mul": {f.mul, (*big.Float).Mul},
+				"div": {f.div, (*big.Float).Quo},
+			} {
+				want, inexact := ref(c.ref)
+				if !normal(want) {
+					continue
+				}
+				got, fl := c.fn(a, b, rm)
+				if got != f32(want) || (fl&flagNX != 0) != inexact {
+					t.Fatalf("%s(%g, %g) rm=%d = (0x%08x, %b), want 0x%08x inexact=%v",
+						name, x, y, rm, got, fl, f32(want), inexact)
+				}
+			}
+		}
+	}
+}
+
+func first(v uint64, _ uint32) uint64 { return v }
+
+// TestSoftFloat_RandomD compares against Go's binary64 arithmetic, which
+// rounds ties to even, for results in the normal range.
+func TestSoftFloat_RandomD(t *testing.T) {
+	f := fmtD
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 3000; i++ {
+		x := rng.NormFloat64() * math.Pow(2, float64(rng.Intn(80)-40))
+		y := rng.NormFloat64() * math.Pow(2, float64(rng.Intn(80)-40))
+		a, b := f64(x), f64(y)
+		for _, n := range []struct {
+			name string
+			got  uint64
+			want float64
+		}{
+			{"add", first(f.add(a, b, rmRNE)), x + y},
+			{"sub", first(f.sub(a, b, rmRNE)), x - y},
+			{"mul", first(f.mul(a, b, rmRNE)), x * y},
+			{"div", first(f.div(a, b, rmRNE)), x / y},
+			{"sqrt", first(f.sqrt(f64(math.Abs(x)), rmRNE)), math.Sqrt(math.Abs(x))},
+			{"fma", first(f.fma(a, b, a, false, false, rmRNE)), math.FMA(x, y, x)},
+		} {
+			if n.got != f64(n.want) {
+				t.Fatalf("%s(%g, %g) = 0x%016x, want 0x%016x", n.name, x, y, n.got, f64(n.want))
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package sim
+
+import (
+	"fmt"
+	"os"
+)
+
+// Exception causes (mcause values with the interrupt bit clear).
+const (
+	CauseInstMisaligned   = 0
+	CauseInstAccessFault  = 1
+	CauseIllegalInst      = 2
+	CauseBreakpoint       = 3
+	CauseLoadMisaligned   = 4
+	CauseLoadAccessFault  = 5
+	CauseStoreMisaligned  = 6 // store or AMO
+	CauseStoreAccessFault = 7 // store or AMO
+	CauseEcallU           = 8
+	CauseEcallS           = 9
+	CauseEcallM           = 11
+	CauseInstPageFault    = 12
+	CauseLoadPageFault    = 13
+	CauseStorePageFault   = 15 // store or AMO
+)
+
+// causeInterrupt is the mcause bit that marks an interrupt.
+const causeInterrupt = 1 << 31
+
+var causeNames = map[uint32]string{
+	CauseInstMisaligned:   "instruction address misaligned",
+	CauseInstAccessFault:  "instruction access fault",
+	CauseIllegalInst:      "illegal instruction",
+	CauseBreakpoint:       "breakpoint",
+	CauseLoadMisaligned:   "load address misaligned",
+	CauseLoadAccessFault:  "load access fault",
+	CauseStoreMisaligned:  "store/AMO address misaligned",
+	CauseStoreAccessFault: "store/AMO access fault",
+	CauseEcallU:           "environment call from U-mode",
+	CauseEcallS:           "environment call from S-mode",
+	CauseEcallM:           "environment call from M-mode",
+	CauseInstPageFault:    "instruction page fault",
+	CauseLoadPageFault:    "load page fault",
+	CauseStorePageFault:   "store/AMO page fault",
+}
+
+// trapVector returns the handler address for cause given a trap-vector
+// CSR (mtvec or stvec): its BASE, or BASE+4*cause for interrupts in
+// vectored mode (MODE=1). Synchronous exceptions always go to BASE.
+func trapVector(tvec, cause uint32) uint32 {
+	base := tvec &^ 3
+	if tvec&3 == 1 && cause&causeInterrupt != 0 {
+		return base + 4*(cause&^causeInterrupt)
+	}
+	return base
+}
+
+// delegated reports whether a trap with this cause taken in the current
+// mode goes to S-mode: traps never drop privilege, so only U/S-mode traps
+// whose bit is set in medeleg (mideleg for interrupts) are delegated.
+func (c *CPU) delegated(cause uint32) bool {
+	if c.Priv == PrivM {
+		return false
+	}
+	deleg := c.csr.medeleg
+	if cause&causeInterrupt != 0 {
+		deleg = c.csr.mideleg
+	}
+	return deleg>>(cause&^causeInterrupt)&1 != 0
+}
+
+// exception raises a synchronous exception on the instruction at PC.
+// xepc, xcause and xtval of the target mode (S if delegated, else M) are
+// always recorded. With HaltOnTrap the hart then stops with PC still on
+// the faulting instruction, reporting the halt on stderr; otherwise the
+// trap is taken.
+//
+// It returns false ("the instruction did not complete") so executors can
+// simply `return c.exception(...)`.
+func (c *CPU) exception(cause, tval uint32) bool {
+	if c.HaltOnTrap {
+		c.recordTrap(cause, tval)
+		c.haltCause, c.haltedOnTrap = cause, true
+		switch cause {
+		case CauseEcallU, CauseEcallS, CauseEcallM:
+			fmt.Fprintln(os.Stderr, "\n[halt] ECALL")
+		case CauseBreakpoint:
+			fmt.Fprintln(os.Stderr, "\n[halt] EBREAK")
+		default:
+			fmt.Fprintf(os.Stderr, "\n[trap] %s (mtval=0x%08x) at pc=%08x\n", causeNames[cause], tval, c.PC)
+		}
+		return false
+	}
+	if c.Trace {
+		fmt.Fprintf(os.Stderr, "[trap] %s (mtval=0x%08x) at pc=%08x\n", causeNames[cause], tval, c.PC)
+	}
+	c.takeTrap(cause, tval)
+	return false
+}
+
+// HaltCause returns the cause of the exception that stopped the hart with
+// HaltOnTrap set; ok is false if it has not stopped on a trap.
+func (c *CPU) HaltCause() (cause uint32, ok bool) { return c.haltCause, c.haltedOnTrap }
+
+// recordTrap writes the trap CSRs of the mode that handles cause and
+// returns that mode.
+func (c *CPU) recordTrap(cause, tval uint32) PrivLevel {
+	s := &c.csr
+	if c.delegated(cause) {
+		s.sepc, s.scause, s.stval = c.PC, cause, tval
+		return PrivS
+	}
+	s.mepc, s.mcause, s.mtval = c.PC, cause, tval
+	return PrivM
+}
+
+// takeTrap enters the trap handler for cause: the xIE bit of the target
+// mode is stacked into xPIE and cleared, the previous mode is saved in xPP,
+// and PC moves to the target's trap vector.
+func (c *CPU) takeTrap(cause, tval uint32) {
+	s := &c.csr
+	if c.recordTrap(cause, tval) == PrivS {
+		s.mstatus = stackIE(s.mstatus, mstatusSIE, mstatusSPIE)
+		s.mstatus &^= mstatusSPP
+		if c.Priv == PrivS {
+			s.mstatus |= mstatusSPP
+		}
+		c.Priv = PrivS
+		c.PC = trapVector(s.stvec, cause)
+		return
+	}
+	s.mstatus = stackIE(s.mstatus, mstatusMIE, mstatusMPIE)
+	s.mstatus = s.mstatus&^mstatusMPP | uint32(c.Priv)<<mstatusMPPShift
+	c.Priv = PrivM
+	c.PC = trapVector(s.mtvec, cause)
+}
+
+// stackIE implements xPIE <- xIE, xIE <- 0.
+func stackIE(mstatus, ie, pie uint32) uint32 {
+	v := mstatus &^ (ie | pie)
+	if mstatus&ie != 0 {
+		v |= pie
+	}
+	return v
+}
+
+// unstackIE implements xIE <- xPIE, xPIE <- 1.
+func unstackIE(mstatus, ie, pie uint32) uint32 {
+	v := mstatus&^ie | pie
+	if mstatus&pie != 0 {
+		v |= ie
+	}
+	return v
+}
+
+// mret returns from an M-mode trap handler to the mode in MPP (which then
+// becomes U) and re-enables interrupts per MPIE. Execution resumes at mepc.
+func (c *CPU) mret() uint32 {
+	s := &c.csr
+	c.Priv = PrivLevel(s.mstatus & mstatusMPP >> mstatusMPPShift)
+	s.mstatus = unstackIE(s.mstatus, mstatusMIE, mstatusMPIE)
+	s.mstatus &^= mstatusMPP
+	if c.Priv != PrivM {
+		s.mstatus &^= mstatusMPRV
+	}
+	return s.mepc
+}
+
+// sret returns from an S-mode trap handler to the mode in SPP (which then
+// becomes U). Execution resumes at sepc.
+func (c *CPU) sret() uint32 {
+	s := &c.csr
+	c.Priv = PrivU
+	if s.mstatus&mstatusSPP != 0 {
+		c.Priv = PrivS
+	}
+	s.mstatus = unstackIE(s.mstatus, mstatusSIE, mstatusSPIE)
+	s.mstatus &^= mstatusSPP | mstatusMPRV
+	return s.sepc
+}
+
+// illegal handles an undefined or disabled encoding of the instruction being
+// executed. In strict mode it raises an illegal-instruction exception with
+// mtval set to the instruction bits (16 bits for a compressed instruction).
+// With Lenient set it only prints a warning and returns true, so the
+// instruction retires as a no-op.
+func (c *CPU) illegal() bool {
+	if c.Lenient {
+		fmt.Fprintf(os.Stderr, "[warn] illegal instruction 0x%0*x at pc=%08x\n", c.ilen*2, c.ir, c.PC)
+		return true
+	}
+	return c.exception(CauseIllegalInst, c.ir)
+}
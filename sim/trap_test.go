@@ -0,0 +1,252 @@
+package sim
+
+import "testing"
+
+func TestIllegal_RaisesException(t *testing.T) {
+	cases := []struct {
+		name string
+		inst uint32
+	}{
+		{"all-zero word", 0x00000000},
+		{"all-ones word", 0xFFFFFFFF},
+		{"unknown opcode", 0x0000007B},
+		{"OP bad funct7", encR(a0, f3ADD_SUB, a0, a1, 0x40)},
+		{"OP funct7=0x20 on XOR", encR(a0, f3XOR, a0, a1, funct7SUBSRA)},
+		{"SLLI shamt[5]", encI(OpOPIMM, a0, f3SLLI, a0, 32)},
+		{"SLLI funct7=0x20", encI(OpOPIMM, a0, f3SLLI, a0, 1, funct7SUBSRA)},
+		{"SRLI bad funct7", encI(OpOPIMM, a0, f3SRxI, a0, 1, 0x01)},
+		{"BRANCH f3=2", encB(F3BEQ, a0, a1, 8) | 2<<12},
+		{"LOAD f3=3", encI(OpLOAD, a0, 3, a0, 0)},
+		{"STORE f3=3", encS(F3SB, a0, a1, 0) | 3<<12},
+		{"JALR f3=1", encI(opJALR, a0, 1, a0, 0)},
+		{"MUL without M", encR(a0, f3MUL, a0, a1, funct7MULDIV)},
+		{"clz without Zbb", encI(OpOPIMM, a0, 1, a1, 0x600)},
+		{"SYSTEM f3=0 unknown", 0x00200073},
+		{"unknown CSR", encCSR(f3CSRRS, a0, x0, 0x7C0)},
+	}
+	for _, tc := range cases {
+		cpu, _ := newTestCPU(t, encI(OpOPIMM, a0, F3ADDI, x0, 5), tc.inst)
+		cpu.Reg[a1] = 3
+		if !cpu.Step() {
+			t.Fatalf("%s: addi stopped the hart", tc.name)
+		}
+		if cpu.Step() {
+			t.Errorf("%s: 0x%08x executed without an exception", tc.name, tc.inst)
+			continue
+		}
+		mcause, _ := cpu.ReadCSR(CSRMcause)
+		mepc, _ := cpu.ReadCSR(CSRMepc)
+		mtval, _ := cpu.ReadCSR(CSRMtval)
+		if mcause != CauseIllegalInst || mepc != 4 || mtval != tc.inst {
+			t.Errorf("%s: mcause=%d mepc=0x%x mtval=0x%08x, want %d 0x4 0x%08x",
+				tc.name, mcause, mepc, mtval, CauseIllegalInst, tc.inst)
+		}
+		if cpu.Reg[a0] != 5 || cpu.PC != 4 {
+			t.Errorf("%s: architectural state changed: a0=%d pc=0x%x", tc.name, cpu.Reg[a0], cpu.PC)
+		}
+	}
+}
+
+func TestIllegal_CompressedAndLenient(t *testing.T) {
+	cpu, ram := newTestCPU(t)
+	cpu.ISA = ExtC
+	writeHalf(t, ram, 0, 0x0000) // all-zero parcel is illegal
+	if cpu.Step() {
+		t.Fatalf("c.unimp executed")
+	}
+	if mtval, _ := cpu.ReadCSR(CSRMtval); mtval != 0 {
+		t.Errorf("mtval = 0x%x, want 0", mtval)
+	}
+	writeHalf(t, ram, 0, 0x0004) // c.addi4spn with nzuimm=0 is reserved
+	if cpu.Step() {
+		t.Fatalf("reserved c.addi4spn executed")
+	}
+	if mtval, _ := cpu.ReadCSR(CSRMtval); mtval != 0x0004 {
+		t.Errorf("mtval = 0x%x, want 16-bit parcel 0x0004", mtval)
+	}
+
+	// Lenient: warn, skip, keep going.
+	cpu, _ = newTestCPU(t,
+		0x00000000,
+		encR(a0, f3ADD_SUB, a0, a1, 0x40),
+		encCSR(f3CSRRS, a1, x0, 0x8FF), // no such CSR
+		encI(OpOPIMM, a0, F3ADDI, x0, 7),
+		instECALL,
+	)
+	cpu.Lenient = true
+	if !runToHalt(cpu, 10) || cpu.Reg[a0] != 7 || cpu.PC != 16 {
+		t.Fatalf("lenient run: a0=%d pc=0x%x", cpu.Reg[a0], cpu.PC)
+	}
+}
+
+func TestHaltCause(t *testing.T) {
+	cpu, _ := newTestCPU(t, instECALL)
+	if _, ok := cpu.HaltCause(); ok {
+		t.Fatalf("halt cause before running")
+	}
+	if cpu.Step() {
+		t.Fatalf("ECALL did not halt")
+	}
+	if cause, ok := cpu.HaltCause(); !ok || cause != CauseEcallM {
+		t.Errorf("HaltCause = %d, %v; want ECALL from M-mode", cause, ok)
+	}
+
+	cpu, _ = newTestCPU(t, 0x00000000)
+	cpu.Step()
+	if cause, ok := cpu.HaltCause(); !ok || cause != CauseIllegalInst {
+		t.Errorf("HaltCause = %d, %v; want illegal instruction", cause, ok)
+	}
+}
+
+func TestFenceAndSetLessThanImm(t *testing.T) {
+	cpu, _ := newTestCPU(t,
+		0x0FF0000F, // fence iorw, iorw
+		0x0000100F, // fence.i
+		encI(OpOPIMM, a0, f3SLTI, x0, -1),
+		encI(OpOPIMM, a1, f3SLTIU, x0, -1),
+		instECALL,
+	)
+	if !runToHalt(cpu, 10) || cpu.PC != 16 {
+		t.Fatalf("stopped at pc=0x%x", cpu.PC)
+	}
+	if cpu.Reg[a0] != 0 || cpu.Reg[a1] != 1 {
+		t.Fatalf("slti 0<-1 = %d, sltiu 0<0xffffffff = %d", cpu.Reg[a0], cpu.Reg[a1])
+	}
+	if got := Disasm(0, 0x0FF0000F); got != "fence iorw, iorw" {
+		t.Errorf("Disasm(fence) = %q", got)
+	}
+	if got := Disasm(0, 0x0000100F); got != "fence.i" {
+		t.Errorf("Disasm(fence.i) = %q", got)
+	}
+}
+
+func TestTrap_HandlerAndMRET(t *testing.T) {
+	const t1, s0, a2, a3 = 6, 8, 12, 13
+	cpu, ram := newTestCPU(t,
+		encI(OpOPIMM, t0, F3ADDI, x0, 0x100),
+		encCSR(f3CSRRW, x0, t0, CSRMtvec),
+		encCSR(f3CSRRSI, x0, mstatusMIE, CSRMstatus),
+		instECALL,
+		encI(OpLOAD, a2, f3LW, x0, 1), // misaligned: handler skips it
+		encI(OpOPIMM, a3, F3ADDI, x0, 1),
+		encJ(x0, 0),
+	)
+	// Handler: record mcause at s0, skip the trapping instruction, return.
+	for i, ins := range []uint32{
+		encCSR(f3CSRRS, t1, x0, CSRMcause),
+		encS(f3SW, s0, t1, 0),
+		encI(OpOPIMM, s0, F3ADDI, s0, 4),
+		encCSR(f3CSRRS, t1, x0, CSRMepc),
+		encI(OpOPIMM, t1, F3ADDI, t1, 4),
+		encCSR(f3CSRRW, x0, t1, CSRMepc),
+		instMRET,
+	} {
+		writeInst(t, ram, 0x100+uint32(i*4), ins)
+	}
+	cpu.HaltOnTrap = false
+	cpu.Reg[s0] = 0x200
+
+	for i := 0; i < 4; i++ {
+		if !cpu.Step() {
+			t.Fatalf("hart stopped at pc=0x%x", cpu.PC)
+		}
+	}
+	mstatus, _ := cpu.ReadCSR(CSRMstatus)
+	if cpu.PC != 0x100 || mstatus&mstatusMIE != 0 || mstatus&mstatusMPIE == 0 || mstatus&mstatusMPP != mstatusMPP {
+		t.Fatalf("after ecall: pc=0x%x mstatus=0x%x, want handler with MIE stacked", cpu.PC, mstatus)
+	}
+	if instret, _ := cpu.ReadCSR(CSRInstret); instret != 3 {
+		t.Errorf("instret = %d, ecall must not retire", instret)
+	}
+
+	runToHalt(cpu, 40)
+	if c, _ := cpu.Bus.Read32(0x200); c != CauseEcallM {
+		t.Errorf("first mcause = %d, want %d", c, CauseEcallM)
+	}
+	if c, _ := cpu.Bus.Read32(0x204); c != CauseLoadMisaligned {
+		t.Errorf("second mcause = %d, want %d", c, CauseLoadMisaligned)
+	}
+	if mtval, _ := cpu.ReadCSR(CSRMtval); mtval != 1 {
+		t.Errorf("mtval = 0x%x, want the misaligned address", mtval)
+	}
+	mstatus, _ = cpu.ReadCSR(CSRMstatus)
+	if cpu.PC != 0x18 || cpu.Reg[a3] != 1 || cpu.Reg[a2] != 0 || mstatus&mstatusMIE == 0 {
+		t.Errorf("after mret: pc=0x%x a3=%d a2=%d mstatus=0x%x", cpu.PC, cpu.Reg[a3], cpu.Reg[a2], mstatus)
+	}
+	if got := Disasm(0, instMRET); got != "mret" {
+		t.Errorf("Disasm(mret) = %q", got)
+	}
+}
+
+func TestTrap_Causes(t *testing.T) {
+	const t1 = 6
+	cases := []struct {
+		name  string
+		inst  uint32
+		isa   ISA
+		cause uint32
+		tval  uint32
+	}{
+		{"ebreak", instEBREAK, 0, CauseBreakpoint, 0},
+		{"jal misaligned", encJ(x0, 6), 0, CauseInstMisaligned, 4 + 6},
+		{"jalr misaligned", encI(opJALR, x0, 0, a1, 2), 0, CauseInstMisaligned, 0x202},
+		{"lw access fault", encI(OpLOAD, a0, f3LW, t1, 4), 0, CauseLoadAccessFault, 0x7000_0004},
+		{"lh misaligned", encI(OpLOAD, a0, f3LH, a1, 1), 0, CauseLoadMisaligned, 0x201},
+		{"sw misaligned", encS(f3SW, a1, a0, 2), 0, CauseStoreMisaligned, 0x202},
+		{"sb access fault", encS(F3SB, x0, a0, -16), 0, CauseStoreAccessFault, 0xFFFFFFF0},
+		{"lr misaligned", encAMO(f5LR, 0, a0, t0, 0), ExtA, CauseLoadMisaligned, 0x202},
+		{"amoadd misaligned", encAMO(f5AMOADD, 0, a0, t0, a1), ExtA, CauseStoreMisaligned, 0x202},
+		{"amoadd access fault", encAMO(f5AMOADD, 0, a0, t1, a1), ExtA, CauseStoreAccessFault, 0x7000_0000},
+	}
+	for _, tc := range cases {
+		cpu, _ := newTestCPU(t, encI(OpOPIMM, x0, F3ADDI, x0, 0), tc.inst)
+		cpu.ISA = tc.isa
+		cpu.Reg[a1], cpu.Reg[t0], cpu.Reg[t1] = 0x200, 0x202, 0x7000_0000
+		cpu.Step()
+		if cpu.Step() {
+			t.Errorf("%s: no trap", tc.name)
+			continue
+		}
+		mcause, _ := cpu.ReadCSR(CSRMcause)
+		mtval, _ := cpu.ReadCSR(CSRMtval)
+		mepc, _ := cpu.ReadCSR(CSRMepc)
+		want := tc.tval
+		if tc.cause == CauseBreakpoint {
+			want = 4
+		}
+		if mcause != tc.cause || mtval != want || mepc != 4 {
+			t.Errorf("%s: mcause=%d mtval=0x%x mepc=0x%x, want %d 0x%x 0x4", tc.name, mcause, mtval, mepc, tc.cause, want)
+		}
+	}
+
+	// Fetch outside RAM: mepc is the bad PC itself.
+	cpu, _ := newTestCPU(t)
+	cpu.PC = 0x8000_0000
+	if cpu.Step() {
+		t.Fatalf("fetch from unmapped memory succeeded")
+	}
+	if mcause, _ := cpu.ReadCSR(CSRMcause); mcause != CauseInstAccessFault {
+		t.Errorf("fetch fault mcause = %d", mcause)
+	}
+	if mepc, _ := cpu.ReadCSR(CSRMepc); mepc != 0x8000_0000 {
+		t.Errorf("fetch fault mepc = 0x%x", mepc)
+	}
+}
+
+func TestTrap_VectoredMode(t *testing.T) {
+	cpu, _ := newTestCPU(t, instECALL)
+	cpu.HaltOnTrap = false
+	cpu.WriteCSR(CSRMtvec, 0x101) // vectored, BASE=0x100
+	if !cpu.Step() {
+		t.Fatalf("ecall stopped the hart without HaltOnTrap")
+	}
+	if cpu.PC != 0x100 {
+		t.Errorf("exception in vectored mode went to 0x%x, want BASE", cpu.PC)
+	}
+	if v := trapVector(0x101, causeInterrupt|7); v != 0x11C {
+		t.Errorf("interrupt 7 vector = 0x%x, want 0x11c", v)
+	}
+	if v := trapVector(0x100, causeInterrupt|7); v != 0x100 {
+		t.Errorf("direct-mode interrupt vector = 0x%x, want 0x100", v)
+	}
+}
@@ -1,55 +1,117 @@
 package sim
 
-import (
-	"bytes"
-	"io"
-)
+import "io"
 
 const (
-	// UART occupies a small 256-byte region; we only use DATA at offset 0.
+	// UART occupies a small 256-byte region with three byte-wide registers.
 	UARTSize = 0x100
+
+	// UARTIRQ is the PLIC source the UART is wired to by convention.
+	UARTIRQ = 10
+)
+
+// UART registers (byte offsets) and bits.
+const (
+	UARTData   = 0x00 // write: transmit; read: pop the RX FIFO (0 if empty)
+	UARTStatus = 0x04 // read-only
+	UARTCtrl   = 0x08
+
+	UARTStatusRxReady = 1 << 0 // RX FIFO not empty
+	UARTStatusTxEmpty = 1 << 1 // always set: transmission is instantaneous
+	UARTCtrlRxIE      = 1 << 0 // raise IRQ while RX data is available
+)
+
+const (
+	uartFIFODepth = 16
+
+	// uartPollCycles is how long a hart idling in WFI waits before looking
+	// for new live input again.
+	uartPollCycles = 10000
 )
 
-// UART is a trivial TX-only UART.
-//   - Write8(offset==0) transmits a byte: it is appended to Buf and optionally
+// UART is a simple byte-oriented UART.
+//   - Writing DATA transmits a byte: it is appended to Buf and optionally
 //     mirrored to Out (e.g., os.Stdout).
-//   - Read8 returns 0 for all offsets (no RX in this teaching model).
+//   - Reading DATA pops the 16-byte RX FIFO, which is refilled from the
+//     reader given to SetInput; STATUS shows whether data is waiting.
+//   - With CTRL.RXIE set, IRQ is held high while the FIFO is not empty.
+//
+// Register the UART with CPU.AddClocked so input arriving while the program
+// runs (or waits in WFI) raises the interrupt without polling STATUS.
 type UART struct {
-	Out          io.Writer // optional, can be nil
-	buf          bytes.Buffer
-	lineBuf      bytes.Buffer
-	LineBuffered bool
+	serialOut
+	serialIn
+
+	// IRQ is the UART's interrupt line, e.g. plic.Line(UARTIRQ).
+	IRQ IRQLine
+
+	rx   []byte
+	ctrl uint8
 }
 
-func NewUART(w io.Writer) *UART { return &UART{Out: w} }
+func NewUART(w io.Writer) *UART {
+	u := &UART{}
+	u.Out = w
+	return u
+}
 
-func (u *UART) Read8(off uint32) (uint8, bool) {
-	// No RX implemented; reading DATA returns 0.
-	if off < UARTSize {
-		return 0, true
+// poll moves available input into the RX FIFO without blocking.
+func (u *UART) poll() {
+	u.rx = u.receive(u.rx, uartFIFODepth)
+	u.updateIRQ()
+}
+
+func (u *UART) updateIRQ() { u.IRQ.Set(u.ctrl&UARTCtrlRxIE != 0 && len(u.rx) > 0) }
+
+// Advance implements Clocked.
+func (u *UART) Advance(uint64) { u.poll() }
+
+// NextEvent implements Clocked: while live input may still arrive, a
+// waiting hart wakes up every uartPollCycles to look for it.
+func (u *UART) NextEvent() (uint64, bool) {
+	if u.live() && len(u.rx) == 0 {
+		return uartPollCycles, true
 	}
 	return 0, false
 }
 
+func (u *UART) Read8(off uint32) (uint8, bool) {
+	if off >= UARTSize {
+		return 0, false
+	}
+	switch off {
+	case UARTData:
+		u.poll()
+		if len(u.rx) == 0 {
+			return 0, true
+		}
+		b := u.rx[0]
+		u.rx = u.rx[1:]
+		u.poll()
+		return b, true
+	case UARTStatus:
+		u.poll()
+		st := uint8(UARTStatusTxEmpty)
+		if len(u.rx) > 0 {
+			st |= UARTStatusRxReady
+		}
+		return st, true
+	case UARTCtrl:
+		return u.ctrl, true
+	}
+	return 0, true
+}
+
 func (u *UART) Write8(off uint32, v uint8) bool {
 	if off >= UARTSize {
 		return false
 	}
-	_ = u.buf.WriteByte(v)
-
-	if u.Out != nil {
-		if u.LineBuffered {
-			_ = u.lineBuf.WriteByte(v)
-			if v == '\n' {
-				_, _ = u.Out.Write(u.lineBuf.Bytes())
-				u.lineBuf.Reset()
-			}
-		} else {
-			_, _ = u.Out.Write([]byte{v})
-		}
+	switch off {
+	case UARTData:
+		u.transmit(v)
+	case UARTCtrl:
+		u.ctrl = v & UARTCtrlRxIE
+		u.updateIRQ()
 	}
 	return true
 }
-
-func (u *UART) String() string { return u.buf.String() }
-func (u *UART) Reset()         { u.buf.Reset() }
@@ -1,6 +1,12 @@
 package sim
 
-import "testing"
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestUART_WriteAndReadViaBus(t *testing.T) {
 	ram := NewRAM(1024)
@@ -20,3 +26,124 @@ func TestUART_WriteAndReadViaBus(t *testing.T) {
 		t.Fatalf("UART Read8 = (%d,%v), want (0,true)", b, ok)
 	}
 }
+
+func TestUART_ReceiveFIFOAndStatus(t *testing.T) {
+	uart := NewUART(nil)
+	bus := NewBus(NewRAM(1024), uart)
+	status := func() uint8 { s, _ := bus.Read8(UARTBase + UARTStatus); return s }
+
+	if status() != UARTStatusTxEmpty {
+		t.Fatalf("status without input = 0x%x", status())
+	}
+	in := strings.Repeat("abcdefghij", 2) // more than the FIFO holds
+	uart.SetInput(strings.NewReader(in))
+	if status() != UARTStatusTxEmpty|UARTStatusRxReady {
+		t.Fatalf("status with input = 0x%x", status())
+	}
+	if len(uart.rx) != uartFIFODepth {
+		t.Errorf("FIFO holds %d bytes, want %d", len(uart.rx), uartFIFODepth)
+	}
+	var got []byte
+	for status()&UARTStatusRxReady != 0 {
+		b, _ := bus.Read8(UARTBase + UARTData)
+		got = append(got, b)
+	}
+	if string(got) != in {
+		t.Errorf("received %q, want %q", got, in)
+	}
+	if b, ok := bus.Read8(UARTBase + UARTData); !ok || b != 0 {
+		t.Errorf("empty FIFO read = (%d, %v)", b, ok)
+	}
+
+	// Only DATA transmits; a word store sends its low byte.
+	bus.Write8(UARTBase+UARTStatus, 'x')
+	bus.Write8(UARTBase+UARTCtrl, 0)
+	bus.Write32(UARTBase+UARTData, 'y')
+	if uart.String() != "y" {
+		t.Errorf("transmitted %q, want %q", uart.String(), "y")
+	}
+}
+
+func TestUART_RxInterrupt(t *testing.T) {
+	uart := NewUART(nil)
+	bus := NewBus(NewRAM(1024), uart)
+	cpu := NewCPU(bus)
+	plic := NewPLIC(31, cpu)
+	bus.Map("plic", PLICBase, PLICSize, plic)
+	uart.IRQ = plic.Line(UARTIRQ)
+	cpu.AddClocked(uart)
+	bus.Write32(PLICBase+UARTIRQ*4, 1)
+	bus.Write32(PLICBase+plicEnable, 1<<UARTIRQ)
+
+	uart.SetInput(bytes.NewReader([]byte("k")))
+	cpu.advance(1)
+	if csr(t, cpu, CSRMip)&mipMEIP != 0 {
+		t.Errorf("RX interrupt raised with RXIE clear")
+	}
+	bus.Write8(UARTBase+UARTCtrl, UARTCtrlRxIE)
+	if csr(t, cpu, CSRMip)&mipMEIP == 0 {
+		t.Fatalf("RX interrupt not raised")
+	}
+	if id, _ := bus.Read32(plicCtx(0, 4)); id != UARTIRQ {
+		t.Fatalf("claimed source %d, want %d", id, UARTIRQ)
+	}
+	bus.Read8(UARTBase + UARTData)
+	bus.Write32(plicCtx(0, 4), UARTIRQ)
+	if csr(t, cpu, CSRMip)&mipMEIP != 0 {
+		t.Errorf("RX interrupt still raised after the FIFO drained")
+	}
+}
+
+func TestUART_LiveInput(t *testing.T) {
+	uart := NewUART(nil)
+	r, w := io.Pipe()
+	uart.SetInput(r)
+	if n, ok := uart.NextEvent(); !ok || n != uartPollCycles {
+		t.Errorf("NextEvent with live input = %d, %v", n, ok)
+	}
+	go w.Write([]byte("z"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if s, _ := uart.Read8(UARTStatus); s&UARTStatusRxReady != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("live input never arrived")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if b, _ := uart.Read8(UARTData); b != 'z' {
+		t.Errorf("received %q", b)
+	}
+	w.Close()
+	for uart.inCh != nil && time.Now().Before(deadline) {
+		uart.poll()
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := uart.NextEvent(); ok {
+		t.Errorf("NextEvent after EOF still schedules polling")
+	}
+}
+
+// An echo loop as a program: poll STATUS, copy DATA back until newline.
+func TestUART_EchoProgram(t *testing.T) {
+	const t1, s0 = 6, 8
+	cpu, _ := newTestCPU(t,
+		encU(OpLUI, s0, UARTBase),
+		encI(OpLOAD, t0, F3LBU, s0, UARTStatus), // 0x04: poll
+		encI(OpOPIMM, t0, f3ANDI, t0, UARTStatusRxReady),
+		encB(F3BEQ, t0, x0, -8),
+		encI(OpLOAD, t1, F3LBU, s0, UARTData),
+		encS(F3SB, s0, t1, UARTData),
+		encI(OpOPIMM, t0, F3ADDI, x0, '\n'),
+		encB(f3BNE, t1, t0, -24),
+		instECALL,
+	)
+	cpu.Bus.UART.SetInput(strings.NewReader("hello\n"))
+	if !runToHalt(cpu, 1000) {
+		t.Fatalf("echo loop did not finish")
+	}
+	if got := cpu.Bus.UART.String(); got != "hello\n" {
+		t.Errorf("echoed %q", got)
+	}
+}
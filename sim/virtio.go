@@ -0,0 +1,511 @@
+package sim
+
+import (
+	"fmt"
+	"os"
+)
+
+// virtio-mmio transport slots, laid out as on QEMU's virt machine: slot i
+// is at VirtioBase + i*VirtioSize and wired to PLIC source VirtioIRQ + i.
+const (
+	VirtioBase  uint32 = 0x1000_1000
+	VirtioSize         = 0x1000
+	VirtioIRQ          = 1
+	VirtioSlots        = 8
+)
+
+// virtio-mmio version 2 register offsets (virtio 1.x, section 4.2.2).
+const (
+	virtioMagicValue        = 0x000
+	virtioVersion           = 0x004
+	virtioDeviceID          = 0x008
+	virtioVendorID          = 0x00c
+	virtioDeviceFeatures    = 0x010
+	virtioDeviceFeaturesSel = 0x014
+	virtioDriverFeatures    = 0x020
+	virtioDriverFeaturesSel = 0x024
+	virtioQueueSel          = 0x030
+	virtioQueueNumMax       = 0x034
+	virtioQueueNum          = 0x038
+	virtioQueueReady        = 0x044
+	virtioQueueNotify       = 0x050
+	virtioInterruptStatus   = 0x060
+	virtioInterruptACK      = 0x064
+	virtioStatus            = 0x070
+	virtioQueueDescLow      = 0x080
+	virtioQueueDescHigh     = 0x084
+	virtioQueueDriverLow    = 0x090
+	virtioQueueDriverHigh   = 0x094
+	virtioQueueDeviceLow    = 0x0a0
+	virtioQueueDeviceHigh   = 0x0a4
+	virtioConfigGeneration  = 0x0fc
+	virtioConfig            = 0x100
+
+	virtioMagic  = 0x74726976 // "virt"
+	virtioVendor = 0x554d4551 // "QEMU", which is what guests expect to see
+)
+
+// Device status bits, feature bits and interrupt causes.
+const (
+	virtioStatusAcknowledge = 1
+	virtioStatusDriver      = 2
+	virtioStatusDriverOK    = 4
+	virtioStatusFeaturesOK  = 8
+	virtioStatusNeedsReset  = 64
+	virtioStatusFailed      = 128
+
+	virtioFVersion1 = 1 << 32
+
+	virtioIntUsedBuffer = 1 << 0
+	virtioIntConfig     = 1 << 1
+
+	virtioQueueMax = 256
+
+	// virtioChainMax bounds the total buffer size of one descriptor chain,
+	// which the device copies through host memory.
+	virtioChainMax = 4 << 20
+)
+
+// Split virtqueue layout (virtio 1.x, section 2.7).
+const (
+	vringDescSize   = 16
+	vringDescNext   = 1
+	vringDescWrite  = 2
+	vringDescIndir  = 4
+	vringAvailNoInt = 1 // avail.flags: driver does not want interrupts
+)
+
+// virtioDevice is a device type behind the virtio-mmio transport.
+type virtioDevice interface {
+	deviceID() uint32
+	features() uint64 // device-specific feature bits; VERSION_1 is added
+	numQueues() int
+	config() []byte // device configuration space (read-only)
+	notify(q *virtqueue)
+	reset()
+}
+
+// virtioAttacher is implemented by device types that use their queues on
+// their own, not only when notified (e.g. to deliver host input).
+type virtioAttacher interface {
+	attach(v *VirtioMMIO)
+}
+
+// VirtioMMIO is the virtio-mmio (version 2) transport: it implements the
+// register interface, feature negotiation and split virtqueues, and hands
+// available buffers to a device type such as VirtioBlk. Buffers are read
+// and written through the Bus ("DMA") when the driver notifies a queue,
+// and IRQ is held high while InterruptStatus is non-zero.
+//
+// Registers below the configuration space only support 32-bit accesses.
+type VirtioMMIO struct {
+	// IRQ is the transport's interrupt line, e.g. plic.Line(VirtioIRQ).
+	IRQ IRQLine
+
+	bus         *Bus
+	dev         virtioDevice
+	status      uint32
+	devFeatSel  uint32
+	drvFeatSel  uint32
+	drvFeatures uint64
+	queueSel    uint32
+	queues      []virtqueue
+	intStatus   uint32
+}
+
+// NewVirtioMMIO returns a transport for dev that accesses guest memory
+// through bus.
+func NewVirtioMMIO(bus *Bus, dev virtioDevice) *VirtioMMIO {
+	v := &VirtioMMIO{bus: bus, dev: dev, queues: make([]virtqueue, dev.numQueues())}
+	for i := range v.queues {
+		v.queues[i] = virtqueue{t: v, idx: i}
+	}
+	if a, ok := dev.(virtioAttacher); ok {
+		a.attach(v)
+	}
+	return v
+}
+
+func (v *VirtioMMIO) features() uint64 { return v.dev.features() | virtioFVersion1 }
+
+// negotiated reports whether the driver accepted feature f.
+func (v *VirtioMMIO) negotiated(f uint64) bool {
+	return v.status&virtioStatusFeaturesOK != 0 && v.drvFeatures&f != 0
+}
+
+// running reports whether the driver has finished initialisation and the
+// device may use its queues.
+func (v *VirtioMMIO) running() bool {
+	return v.status&(virtioStatusDriverOK|virtioStatusNeedsReset) == virtioStatusDriverOK
+}
+
+// reset returns the transport and the device to their initial state.
+func (v *VirtioMMIO) reset() {
+	v.status, v.devFeatSel, v.drvFeatSel, v.drvFeatures, v.queueSel = 0, 0, 0, 0, 0
+	for i := range v.queues {
+		v.queues[i] = virtqueue{t: v, idx: i}
+	}
+	v.intStatus = 0
+	v.updateIRQ()
+	v.dev.reset()
+}
+
+// fail marks the device broken after a driver error; the driver has to
+// reset it.
+func (v *VirtioMMIO) fail(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "[warn] virtio: "+format+"\n", args...)
+	v.status |= virtioStatusNeedsReset
+	v.raise(virtioIntConfig)
+}
+
+func (v *VirtioMMIO) raise(cause uint32) {
+	v.intStatus |= cause
+	v.updateIRQ()
+}
+
+func (v *VirtioMMIO) updateIRQ() { v.IRQ.Set(v.intStatus != 0) }
+
+func (v *VirtioMMIO) queue() *virtqueue { return v.queueAt(int(v.queueSel)) }
+
+// queueAt returns queue i, or nil if the device has no such queue.
+func (v *VirtioMMIO) queueAt(i int) *virtqueue {
+	if i >= 0 && i < len(v.queues) {
+		return &v.queues[i]
+	}
+	return nil
+}
+
+// Read implements Device.
+func (v *VirtioMMIO) Read(off, size uint32) (uint64, bool) {
+	if off >= VirtioSize {
+		return 0, false
+	}
+	if off >= virtioConfig {
+		cfg := v.dev.config()
+		var val uint64
+		for i := range size {
+			if o := off - virtioConfig + i; o < uint32(len(cfg)) {
+				val |= uint64(cfg[o]) << (8 * i)
+			}
+		}
+		return val, true
+	}
+	if size != 4 {
+		return 0, false
+	}
+	q := v.queue()
+	var val uint32
+	switch off {
+	case virtioMagicValue:
+		val = virtioMagic
+	case virtioVersion:
+		val = 2
+	case virtioDeviceID:
+		val = v.dev.deviceID()
+	case virtioVendorID:
+		val = virtioVendor
+	case virtioDeviceFeatures:
+		if v.devFeatSel < 2 {
+			val = uint32(v.features() >> (32 * v.devFeatSel))
+		}
+	case virtioQueueNumMax:
+		if q != nil {
+			val = virtioQueueMax
+		}
+	case virtioQueueReady:
+		if q != nil && q.ready {
+			val = 1
+		}
+	case virtioInterruptStatus:
+		val = v.intStatus
+	case virtioStatus:
+		val = v.status
+	case virtioConfigGeneration:
+		val = 0 // configuration never changes
+	}
+	return uint64(val), true
+}
+
+// Write implements Device.
+func (v *VirtioMMIO) Write(off, size uint32, val64 uint64) bool {
+	if off >= VirtioSize {
+		return false
+	}
+	if off >= virtioConfig {
+		return true // configuration space is read-only
+	}
+	if size != 4 {
+		return false
+	}
+	val := uint32(val64)
+	q := v.queue()
+	switch off {
+	case virtioDeviceFeaturesSel:
+		v.devFeatSel = val
+	case virtioDriverFeatures:
+		if v.drvFeatSel < 2 {
+			shift := 32 * v.drvFeatSel
+			v.drvFeatures = v.drvFeatures&^(0xFFFFFFFF<<shift) | uint64(val)<<shift
+		}
+	case virtioDriverFeaturesSel:
+		v.drvFeatSel = val
+	case virtioQueueSel:
+		v.queueSel = val
+	case virtioQueueNum:
+		if q != nil {
+			q.num = val
+		}
+	case virtioQueueReady:
+		if q != nil {
+			q.setReady(val&1 != 0)
+		}
+	case virtioQueueNotify:
+		if q := v.queueAt(int(val)); q != nil && v.running() && q.ready {
+			v.dev.notify(q)
+		}
+	case virtioInterruptACK:
+		v.intStatus &^= val
+		v.updateIRQ()
+	case virtioStatus:
+		v.setStatus(val)
+	case virtioQueueDescLow, virtioQueueDescHigh:
+		if q != nil {
+			setHalf(&q.desc, off == virtioQueueDescHigh, val)
+		}
+	case virtioQueueDriverLow, virtioQueueDriverHigh:
+		if q != nil {
+			setHalf(&q.driver, off == virtioQueueDriverHigh, val)
+		}
+	case virtioQueueDeviceLow, virtioQueueDeviceHigh:
+		if q != nil {
+			setHalf(&q.device, off == virtioQueueDeviceHigh, val)
+		}
+	}
+	return true
+}
+
+func setHalf(p *uint64, high bool, v uint32) {
+	if high {
+		*p = *p&0xFFFFFFFF | uint64(v)<<32
+	} else {
+		*p = *p&^0xFFFFFFFF | uint64(v)
+	}
+}
+
+// setStatus handles a driver write to Status: 0 resets the device, and
+// FEATURES_OK only sticks if the driver accepted a subset of the offered
+// features that includes VERSION_1.
+func (v *VirtioMMIO) setStatus(val uint32) {
+	if val == 0 {
+		v.reset()
+		return
+	}
+	if val&virtioStatusFeaturesOK != 0 && v.status&virtioStatusFeaturesOK == 0 {
+		if v.drvFeatures&^v.features() != 0 || v.drvFeatures&virtioFVersion1 == 0 {
+			val &^= virtioStatusFeaturesOK
+		}
+	}
+	v.status = val | v.status&virtioStatusNeedsReset
+}
+
+// virtqueue is one split virtqueue of a transport.
+type virtqueue struct {
+	t      *VirtioMMIO
+	idx    int    // index within the device
+	num    uint32 // queue size chosen by the driver
+	ready  bool
+	desc   uint64 // descriptor table
+	driver uint64 // available ring
+	device uint64 // used ring
+
+	lastAvail uint16 // next available ring entry to consume
+	usedIdx   uint16 // next used ring entry to fill
+}
+
+func (q *virtqueue) setReady(ready bool) {
+	if ready && !q.ready {
+		q.lastAvail, q.usedIdx = 0, 0
+	}
+	q.ready = ready
+}
+
+// vqBuf is one guest buffer of a descriptor chain.
+type vqBuf struct {
+	addr, len uint32
+	write     bool // device-writable
+}
+
+// vqChain is a descriptor chain taken from the available ring.
+type vqChain struct {
+	head uint16
+	bufs []vqBuf
+}
+
+// valid reports whether the queue's rings lie in the 32-bit bus space.
+func (q *virtqueue) valid() bool {
+	if q.num == 0 || q.num > virtioQueueMax {
+		return false
+	}
+	return q.desc+uint64(q.num)*vringDescSize <= 1<<32 &&
+		q.driver+6+2*uint64(q.num) <= 1<<32 &&
+		q.device+6+8*uint64(q.num) <= 1<<32
+}
+
+// pending reports whether the driver has made buffers available.
+func (q *virtqueue) pending() bool {
+	if !q.ready || !q.t.running() || !q.valid() {
+		return false
+	}
+	idx, ok := q.t.bus.Read16(uint32(q.driver) + 2)
+	return ok && idx != q.lastAvail
+}
+
+// pop takes the next available descriptor chain. It returns false when
+// the ring is empty or broken; a broken ring also marks the device as
+// needing a reset. Every buffer must lie inside one mapped bus region and
+// the chain may hold at most virtioChainMax bytes.
+func (q *virtqueue) pop() (*vqChain, bool) {
+	if !q.pending() {
+		return nil, false
+	}
+	bus := q.t.bus
+	head, ok := bus.Read16(uint32(q.driver) + 4 + 2*(uint32(q.lastAvail)%q.num))
+	if !ok {
+		q.t.fail("available ring at 0x%x is not readable", q.driver)
+		return nil, false
+	}
+	q.lastAvail++
+	c := &vqChain{head: head}
+	var total uint64
+	for i, n := uint32(head), uint32(0); ; n++ {
+		if i >= q.num || n >= q.num {
+			q.t.fail("bad descriptor chain at head %d", head)
+			return nil, false
+		}
+		d := uint32(q.desc) + i*vringDescSize
+		addr, ok1 := bus.Read64(d)
+		length, ok2 := bus.Read32(d + 8)
+		flags, ok3 := bus.Read16(d + 12)
+		next, ok4 := bus.Read16(d + 14)
+		if !ok1 || !ok2 || !ok3 || !ok4 || addr+uint64(length) > 1<<32 || flags&vringDescIndir != 0 {
+			q.t.fail("bad descriptor %d", i)
+			return nil, false
+		}
+		if length > 0 && bus.find(uint32(addr), length) == nil {
+			q.t.fail("descriptor %d: buffer 0x%x+0x%x is not in one mapped region", i, addr, length)
+			return nil, false
+		}
+		if total += uint64(length); total > virtioChainMax {
+			q.t.fail("descriptor chain at head %d exceeds %d bytes", head, virtioChainMax)
+			return nil, false
+		}
+		c.bufs = append(c.bufs, vqBuf{uint32(addr), length, flags&vringDescWrite != 0})
+		if flags&vringDescNext == 0 {
+			return c, true
+		}
+		i = uint32(next)
+	}
+}
+
+// push returns a chain to the driver through the used ring, with written
+// bytes stored into its writable buffers, and interrupts the driver
+// unless it asked not to be. A used ring that cannot be written marks the
+// device as needing a reset.
+func (q *virtqueue) push(c *vqChain, written uint32) {
+	bus := q.t.bus
+	e := uint32(q.device) + 4 + 8*(uint32(q.usedIdx)%q.num)
+	if !bus.Write32(e, uint32(c.head)) || !bus.Write32(e+4, written) ||
+		!bus.Write16(uint32(q.device)+2, q.usedIdx+1) {
+		q.t.fail("used ring at 0x%x is not writable", q.device)
+		return
+	}
+	q.usedIdx++
+	if flags, _ := bus.Read16(uint32(q.driver)); flags&vringAvailNoInt == 0 {
+		q.t.raise(virtioIntUsedBuffer)
+	}
+}
+
+// process hands every available chain to fn and returns it to the driver
+// with the number of bytes fn wrote into it.
+func (q *virtqueue) process(fn func(c *vqChain) uint32) {
+	for {
+		c, ok := q.pop()
+		if !ok {
+			return
+		}
+		q.push(c, fn(c))
+	}
+}
+
+// readable returns the contents of the chain's device-readable buffers.
+func (c *vqChain) readable(bus *Bus) ([]byte, bool) {
+	var p []byte
+	for _, b := range c.bufs {
+		if b.write {
+			continue
+		}
+		start := len(p)
+		p = append(p, make([]byte, b.len)...)
+		if !dmaRead(bus, b.addr, p[start:]) {
+			return nil, false
+		}
+	}
+	return p, true
+}
+
+// writableLen returns the total size of the chain's device-writable
+// buffers, which pop has bounded by virtioChainMax.
+func (c *vqChain) writableLen() uint32 {
+	var n uint64
+	for _, b := range c.bufs {
+		if b.write {
+			n += uint64(b.len)
+		}
+	}
+	return uint32(n)
+}
+
+// writeAt stores p into the chain's device-writable buffers, viewed as
+// one contiguous area, starting off bytes in. It returns how many bytes
+// fitted.
+func (c *vqChain) writeAt(bus *Bus, off uint32, p []byte) (uint32, bool) {
+	var n uint32
+	for _, b := range c.bufs {
+		if !b.write || len(p) == 0 {
+			continue
+		}
+		if off >= b.len {
+			off -= b.len
+			continue
+		}
+		k := min(b.len-off, uint32(len(p)))
+		if !dmaWrite(bus, b.addr+off, p[:k]) {
+			return n, false
+		}
+		p, off = p[k:], 0
+		n += k
+	}
+	return n, true
+}
+
+// dmaRead and dmaWrite copy between guest memory and p through the bus,
+// without the hart's address translation or PMP.
+func dmaRead(bus *Bus, addr uint32, p []byte) bool {
+	for i := range p {
+		b, ok := bus.Read8(addr + uint32(i))
+		if !ok {
+			return false
+		}
+		p[i] = b
+	}
+	return true
+}
+
+func dmaWrite(bus *Bus, addr uint32, p []byte) bool {
+	for i, b := range p {
+		if !bus.Write8(addr+uint32(i), b) {
+			return false
+		}
+	}
+	return true
+}
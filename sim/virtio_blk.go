@@ -0,0 +1,168 @@
+package sim
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// virtio-blk (virtio 1.x, section 5.2).
+const (
+	virtioBlkID         = 2
+	virtioBlkSectorSize = 512
+
+	virtioBlkFRO    = 1 << 5
+	virtioBlkFFlush = 1 << 9
+
+	virtioBlkTIn    = 0
+	virtioBlkTOut   = 1
+	virtioBlkTFlush = 4
+	virtioBlkTGetID = 8
+
+	virtioBlkSOK     = 0
+	virtioBlkSIOErr  = 1
+	virtioBlkSUnsupp = 2
+
+	virtioBlkIDLen = 20
+)
+
+// DiskMode selects how a VirtioBlk treats writes to its image file.
+type DiskMode int
+
+const (
+	DiskReadWrite   DiskMode = iota // writes go to the image file
+	DiskReadOnly                    // the device is read-only (VIRTIO_BLK_F_RO)
+	DiskCopyOnWrite                 // writes are kept in memory; the file is untouched
+)
+
+// VirtioBlk is a virtio block device backed by a host disk image. The
+// capacity is the image size in 512-byte sectors (a partial last sector
+// is not visible). It handles read, write, flush and get-ID requests.
+type VirtioBlk struct {
+	f       *os.File
+	mode    DiskMode
+	sectors uint64
+	overlay map[uint64][]byte // copy-on-write sectors
+}
+
+// OpenVirtioBlk opens the disk image at path. Attach the device with
+// NewVirtioMMIO and release the file with Close.
+func OpenVirtioBlk(path string, mode DiskMode) (*VirtioBlk, error) {
+	flag := os.O_RDWR
+	if mode != DiskReadWrite {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &VirtioBlk{
+		f:       f,
+		mode:    mode,
+		sectors: uint64(st.Size()) / virtioBlkSectorSize,
+		overlay: make(map[uint64][]byte),
+	}, nil
+}
+
+// Close closes the image file. Copy-on-write data is discarded.
+func (b *VirtioBlk) Close() error { return b.f.Close() }
+
+// Sectors returns the capacity in 512-byte sectors.
+func (b *VirtioBlk) Sectors() uint64 { return b.sectors }
+
+func (b *VirtioBlk) deviceID() uint32 { return virtioBlkID }
+func (b *VirtioBlk) numQueues() int   { return 1 }
+func (b *VirtioBlk) reset()           {}
+
+func (b *VirtioBlk) features() uint64 {
+	f := uint64(virtioBlkFFlush)
+	if b.mode == DiskReadOnly {
+		f |= virtioBlkFRO
+	}
+	return f
+}
+
+// config is struct virtio_blk_config up to the capacity field.
+func (b *VirtioBlk) config() []byte { return binary.LittleEndian.AppendUint64(nil, b.sectors) }
+
+func (b *VirtioBlk) notify(q *virtqueue) {
+	bus := q.t.bus
+	q.process(func(c *vqChain) uint32 {
+		if c.writableLen() == 0 {
+			return 0 // nowhere to put the status
+		}
+		data, status := b.request(c, bus)
+		// The status byte is the last writable byte, after any data.
+		n, _ := c.writeAt(bus, 0, data)
+		c.writeAt(bus, c.writableLen()-1, []byte{status})
+		return n + 1
+	})
+}
+
+// request executes one request chain and returns the data to send back
+// (for reads) and the status byte.
+func (b *VirtioBlk) request(c *vqChain, bus *Bus) ([]byte, uint8) {
+	in, ok := c.readable(bus)
+	out := c.writableLen()
+	if !ok || len(in) < 16 {
+		return nil, virtioBlkSIOErr
+	}
+	typ := binary.LittleEndian.Uint32(in)
+	sector := binary.LittleEndian.Uint64(in[8:])
+	data := in[16:]
+	switch typ {
+	case virtioBlkTIn:
+		p := make([]byte, out-1)
+		if !b.rw(sector, p, false) {
+			return nil, virtioBlkSIOErr
+		}
+		return p, virtioBlkSOK
+	case virtioBlkTOut:
+		if b.mode == DiskReadOnly || !b.rw(sector, data, true) {
+			return nil, virtioBlkSIOErr
+		}
+		return nil, virtioBlkSOK
+	case virtioBlkTFlush:
+		if b.mode == DiskReadWrite && b.f.Sync() != nil {
+			return nil, virtioBlkSIOErr
+		}
+		return nil, virtioBlkSOK
+	case virtioBlkTGetID:
+		id := make([]byte, min(out-1, virtioBlkIDLen))
+		copy(id, fmt.Sprintf("rv32sim-blk-%d", b.sectors))
+		return id, virtioBlkSOK
+	}
+	return nil, virtioBlkSUnsupp
+}
+
+// rw reads or writes whole sectors starting at sector.
+func (b *VirtioBlk) rw(sector uint64, p []byte, write bool) bool {
+	n := uint64(len(p)) / virtioBlkSectorSize
+	if uint64(len(p))%virtioBlkSectorSize != 0 || sector > b.sectors || n > b.sectors-sector {
+		return false
+	}
+	for i := range n {
+		s, buf := sector+i, p[i*virtioBlkSectorSize:(i+1)*virtioBlkSectorSize]
+		off := int64(s * virtioBlkSectorSize)
+		switch {
+		case write && b.mode == DiskCopyOnWrite:
+			b.overlay[s] = append([]byte(nil), buf...)
+		case write:
+			if _, err := b.f.WriteAt(buf, off); err != nil {
+				return false
+			}
+		case b.overlay[s] != nil:
+			copy(buf, b.overlay[s])
+		default:
+			if _, err := b.f.ReadAt(buf, off); err != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestBlk opens a disk image of the given number of sectors in which
+// every byte of sector s is s.
+func newTestBlk(t *testing.T, sectors int, mode DiskMode) *VirtioBlk {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "disk.img")
+	var img []byte
+	for s := range sectors {
+		img = append(img, bytes.Repeat([]byte{byte(s)}, virtioBlkSectorSize)...)
+	}
+	if err := os.WriteFile(path, append(img, 0xEE), 0o644); err != nil { // partial sector is ignored
+		t.Fatal(err)
+	}
+	b, err := OpenVirtioBlk(path, mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// blkRequest submits a request whose data buffer is at 0x4000 and returns
+// the status byte and the used length.
+func blkRequest(d *testDriver, typ uint32, sector uint64, data []byte, dataLen uint32) (status uint8, n uint32) {
+	hdr := binary.LittleEndian.AppendUint32(nil, typ)
+	hdr = binary.LittleEndian.AppendUint32(hdr, 0)
+	hdr = binary.LittleEndian.AppendUint64(hdr, sector)
+	d.poke(0x3000, hdr)
+	d.poke(0x3100, []byte{0xFF})
+	bufs := []vqBuf{{0x3000, 16, false}}
+	if data != nil {
+		d.poke(0x4000, data)
+		bufs = append(bufs, vqBuf{0x4000, uint32(len(data)), false})
+	} else if dataLen > 0 {
+		bufs = append(bufs, vqBuf{0x4000, dataLen, true})
+	}
+	bufs = append(bufs, vqBuf{0x3100, 1, true})
+	d.submit(0, bufs...)
+	_, n = d.used(0)
+	return d.peek(0x3100, 1)[0], n
+}
+
+func TestVirtioBlk_ReadWrite(t *testing.T) {
+	blk := newTestBlk(t, 8, DiskReadWrite)
+	_, d := newTestVirtio(t, blk)
+	d.init(virtioBlkFFlush)
+
+	if st, n := blkRequest(d, virtioBlkTIn, 2, nil, 1024); st != virtioBlkSOK || n != 1025 {
+		t.Fatalf("read: status %d, used len %d", st, n)
+	}
+	got := d.peek(0x4000, 1024)
+	if got[0] != 2 || got[511] != 2 || got[512] != 3 || got[1023] != 3 {
+		t.Errorf("read sectors 2-3: % x ...", got[:4])
+	}
+
+	data := bytes.Repeat([]byte{0xAB}, 512)
+	if st, n := blkRequest(d, virtioBlkTOut, 7, data, 0); st != virtioBlkSOK || n != 1 {
+		t.Fatalf("write: status %d, used len %d", st, n)
+	}
+	if st, _ := blkRequest(d, virtioBlkTFlush, 0, nil, 0); st != virtioBlkSOK {
+		t.Errorf("flush: status %d", st)
+	}
+	img, _ := os.ReadFile(blk.f.Name())
+	if !bytes.Equal(img[7*512:8*512], data) {
+		t.Errorf("write did not reach the image file")
+	}
+
+	// Out of range, partial sectors and unknown requests fail.
+	if st, _ := blkRequest(d, virtioBlkTIn, 7, nil, 1024); st != virtioBlkSIOErr {
+		t.Errorf("read past the end: status %d", st)
+	}
+	if st, _ := blkRequest(d, virtioBlkTIn, 0, nil, 100); st != virtioBlkSIOErr {
+		t.Errorf("partial-sector read: status %d", st)
+	}
+	if st, _ := blkRequest(d, 99, 0, nil, 0); st != virtioBlkSUnsupp {
+		t.Errorf("unknown request: status %d", st)
+	}
+
+	if st, n := blkRequest(d, virtioBlkTGetID, 0, nil, virtioBlkIDLen); st != virtioBlkSOK || n != virtioBlkIDLen+1 {
+		t.Errorf("get ID: status %d, used len %d", st, n)
+	}
+	if id := d.peek(0x4000, virtioBlkIDLen); !bytes.HasPrefix(id, []byte("rv32sim")) {
+		t.Errorf("ID = %q", id)
+	}
+}
+
+func TestVirtioBlk_ReadOnlyAndCopyOnWrite(t *testing.T) {
+	data := bytes.Repeat([]byte{0x5A}, 512)
+
+	ro := newTestBlk(t, 4, DiskReadOnly)
+	_, d := newTestVirtio(t, ro)
+	d.init(virtioBlkFRO)
+	if st, _ := blkRequest(d, virtioBlkTOut, 1, data, 0); st != virtioBlkSIOErr {
+		t.Errorf("write to a read-only disk: status %d", st)
+	}
+
+	cow := newTestBlk(t, 4, DiskCopyOnWrite)
+	_, d = newTestVirtio(t, cow)
+	d.init(0)
+	if st, _ := blkRequest(d, virtioBlkTOut, 1, data, 0); st != virtioBlkSOK {
+		t.Fatalf("copy-on-write write: status %d", st)
+	}
+	if st, _ := blkRequest(d, virtioBlkTIn, 0, nil, 1024); st != virtioBlkSOK {
+		t.Fatalf("copy-on-write read: status %d", st)
+	}
+	if got := d.peek(0x4000, 1024); got[0] != 0 || !bytes.Equal(got[512:], data) {
+		t.Errorf("copy-on-write read back % x / % x", got[:2], got[512:514])
+	}
+	img, _ := os.ReadFile(cow.f.Name())
+	if img[512] != 1 {
+		t.Errorf("copy-on-write modified the image file")
+	}
+}
@@ -0,0 +1,219 @@
+package sim
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// virtio-console (virtio 1.x, section 5.3).
+const (
+	virtioConsoleID = 3
+
+	virtioConsoleFMultiport = 1 << 1
+
+	// Queues: port 0 receiveq/transmitq, then the control queues, then
+	// receiveq/transmitq of ports 1, 2, ...
+	virtioConsoleCtrlRx = 2
+	virtioConsoleCtrlTx = 3
+
+	// Control events.
+	virtioConsoleDeviceReady = 0
+	virtioConsoleDeviceAdd   = 1
+	virtioConsolePortReady   = 3
+	virtioConsoleConsolePort = 4
+	virtioConsolePortOpen    = 6
+	virtioConsolePortName    = 7
+
+	// consoleRxBuffer bounds host input read ahead of the guest, per port.
+	consoleRxBuffer = 4096
+)
+
+// ConsolePort describes one port of a VirtioConsole.
+type ConsolePort struct {
+	Name string        // announced to the guest, e.g. /dev/virtio-ports/NAME on Linux
+	RW   io.ReadWriter // host side; nil leaves the port unconnected
+}
+
+// VirtioConsole is a virtio console device with one or more ports, each an
+// independent byte channel to a host io.ReadWriter: what the guest sends
+// is written to RW, and what is read from RW is delivered to the guest
+// (see SetInput in serial.go for how readers are drained).
+//
+// Port 0 is announced as the console (hvc0 on Linux). Drivers that do not
+// negotiate VIRTIO_CONSOLE_F_MULTIPORT only see port 0. Register the
+// device with CPU.AddClocked so host input reaches the guest while it runs.
+type VirtioConsole struct {
+	v     *VirtioMMIO
+	ports []consolePort
+	ctrl  [][]byte // control messages waiting for a buffer
+}
+
+type consolePort struct {
+	serialIn
+	name  string
+	out   io.Writer
+	rx    []byte // host input waiting for a receive buffer
+	ready bool   // the driver reported PORT_READY
+}
+
+// NewVirtioConsole returns a console with the given ports; with none, it
+// has a single unconnected port.
+func NewVirtioConsole(ports ...ConsolePort) *VirtioConsole {
+	if len(ports) == 0 {
+		ports = []ConsolePort{{}}
+	}
+	c := &VirtioConsole{ports: make([]consolePort, len(ports))}
+	for i, p := range ports {
+		c.ports[i].name = p.Name
+		if p.RW != nil {
+			c.ports[i].out = p.RW
+			c.ports[i].SetInput(p.RW)
+		}
+	}
+	return c
+}
+
+func (c *VirtioConsole) deviceID() uint32     { return virtioConsoleID }
+func (c *VirtioConsole) features() uint64     { return virtioConsoleFMultiport }
+func (c *VirtioConsole) numQueues() int       { return 2*len(c.ports) + 2 }
+func (c *VirtioConsole) attach(v *VirtioMMIO) { c.v = v }
+
+// config is struct virtio_console_config: cols, rows (no size reported),
+// max_nr_ports and emerg_wr.
+func (c *VirtioConsole) config() []byte {
+	cfg := make([]byte, 12)
+	binary.LittleEndian.PutUint32(cfg[4:], uint32(len(c.ports)))
+	return cfg
+}
+
+func (c *VirtioConsole) reset() {
+	for i := range c.ports {
+		c.ports[i].ready = false
+	}
+	c.ctrl = nil
+}
+
+// rxQueue returns the receiveq index of port i; its transmitq follows.
+func rxQueue(i int) int {
+	if i == 0 {
+		return 0
+	}
+	return 2*i + 2
+}
+
+func (c *VirtioConsole) notify(q *virtqueue) {
+	switch {
+	case q.idx == virtioConsoleCtrlRx:
+		c.flushCtrl()
+	case q.idx == virtioConsoleCtrlTx:
+		q.process(func(ch *vqChain) uint32 {
+			if msg, ok := ch.readable(c.v.bus); ok {
+				c.control(msg)
+			}
+			return 0
+		})
+		c.flushCtrl()
+	case q.idx%2 == 1: // a transmitq
+		p := &c.ports[max(q.idx-2, 0)/2]
+		q.process(func(ch *vqChain) uint32 {
+			if data, ok := ch.readable(c.v.bus); ok && p.out != nil {
+				_, _ = p.out.Write(data)
+			}
+			return 0
+		})
+	default:
+		c.deliver(max(q.idx-2, 0) / 2)
+	}
+}
+
+// control handles a struct virtio_console_control from the driver.
+func (c *VirtioConsole) control(msg []byte) {
+	if len(msg) < 8 {
+		return
+	}
+	id := binary.LittleEndian.Uint32(msg)
+	event := binary.LittleEndian.Uint16(msg[4:])
+	value := binary.LittleEndian.Uint16(msg[6:])
+	switch event {
+	case virtioConsoleDeviceReady:
+		if value == 1 {
+			for i := range c.ports {
+				c.sendCtrl(uint32(i), virtioConsoleDeviceAdd, 1, "")
+			}
+		}
+	case virtioConsolePortReady:
+		if id >= uint32(len(c.ports)) || value != 1 {
+			return
+		}
+		p := &c.ports[id]
+		p.ready = true
+		if id == 0 {
+			c.sendCtrl(0, virtioConsoleConsolePort, 1, "")
+		}
+		if p.name != "" {
+			c.sendCtrl(id, virtioConsolePortName, 1, p.name)
+		}
+		c.sendCtrl(id, virtioConsolePortOpen, 1, "") // the host side is always open
+		c.deliver(int(id))
+	}
+	// PORT_OPEN from the guest needs no action: input is only delivered
+	// into buffers the guest provides anyway.
+}
+
+func (c *VirtioConsole) sendCtrl(id uint32, event, value uint16, name string) {
+	msg := binary.LittleEndian.AppendUint32(nil, id)
+	msg = binary.LittleEndian.AppendUint16(msg, event)
+	msg = binary.LittleEndian.AppendUint16(msg, value)
+	c.ctrl = append(c.ctrl, append(msg, name...))
+}
+
+// flushCtrl sends queued control messages while the driver has buffers.
+func (c *VirtioConsole) flushCtrl() {
+	q := c.v.queueAt(virtioConsoleCtrlRx)
+	for len(c.ctrl) > 0 {
+		ch, ok := q.pop()
+		if !ok {
+			return
+		}
+		n, _ := ch.writeAt(c.v.bus, 0, c.ctrl[0])
+		q.push(ch, n)
+		c.ctrl = c.ctrl[1:]
+	}
+}
+
+// deliver moves host input of port i into the guest's receive buffers.
+func (c *VirtioConsole) deliver(i int) {
+	p := &c.ports[i]
+	if c.v == nil || !(p.ready || i == 0 && !c.v.negotiated(virtioConsoleFMultiport)) {
+		return
+	}
+	p.rx = p.receive(p.rx, consoleRxBuffer)
+	q := c.v.queueAt(rxQueue(i))
+	for len(p.rx) > 0 {
+		ch, ok := q.pop()
+		if !ok {
+			return
+		}
+		n, _ := ch.writeAt(c.v.bus, 0, p.rx)
+		q.push(ch, n)
+		p.rx = p.rx[n:]
+	}
+}
+
+// Advance implements Clocked.
+func (c *VirtioConsole) Advance(uint64) {
+	for i := range c.ports {
+		c.deliver(i)
+	}
+}
+
+// NextEvent implements Clocked: while live input may still arrive, a
+// waiting hart wakes up every uartPollCycles to look for it.
+func (c *VirtioConsole) NextEvent() (uint64, bool) {
+	for i := range c.ports {
+		if c.ports[i].live() {
+			return uartPollCycles, true
+		}
+	}
+	return 0, false
+}
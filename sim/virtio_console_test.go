@@ -0,0 +1,146 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hostPort is an in-memory host end of a console port.
+type hostPort struct {
+	*strings.Reader
+	out bytes.Buffer
+}
+
+func (h *hostPort) Write(p []byte) (int, error) { return h.out.Write(p) }
+
+// ctrlMsg is a decoded struct virtio_console_control plus any name.
+type ctrlMsg struct {
+	id           uint32
+	event, value uint16
+	name         string
+}
+
+// ctrlMsgs returns the control messages the device has put into the
+// control receive buffers, starting with used entry from. The buffer of
+// descriptor i is at 0x5000 + i*0x40.
+func ctrlMsgs(d *testDriver, from uint16) []ctrlMsg {
+	used := uint32(vtUsed + virtioConsoleCtrlRx*vtQueueStride)
+	idx, _ := d.bus.Read16(used + 2)
+	var msgs []ctrlMsg
+	for i := from; i != idx; i++ {
+		head, _ := d.bus.Read32(used + 4 + 8*uint32(i%vtNum))
+		n, _ := d.bus.Read32(used + 8 + 8*uint32(i%vtNum))
+		p := d.peek(0x5000+head*0x40, n)
+		msgs = append(msgs, ctrlMsg{
+			binary.LittleEndian.Uint32(p),
+			binary.LittleEndian.Uint16(p[4:]),
+			binary.LittleEndian.Uint16(p[6:]),
+			string(p[8:]),
+		})
+	}
+	return msgs
+}
+
+func sendCtrl(d *testDriver, id uint32, event, value uint16) {
+	msg := binary.LittleEndian.AppendUint32(nil, id)
+	msg = binary.LittleEndian.AppendUint16(msg, event)
+	msg = binary.LittleEndian.AppendUint16(msg, value)
+	d.poke(0x4800, msg)
+	d.submit(virtioConsoleCtrlTx, vqBuf{0x4800, 8, false})
+}
+
+func TestVirtioConsole_Multiport(t *testing.T) {
+	con, ctl := &hostPort{Reader: strings.NewReader("hi")}, &hostPort{Reader: strings.NewReader("go")}
+	dev := NewVirtioConsole(ConsolePort{RW: con}, ConsolePort{Name: "ctl", RW: ctl})
+	v, d := newTestVirtio(t, dev)
+	if ports, _ := d.bus.Read32(d.base + virtioConfig + 4); ports != 2 {
+		t.Errorf("max_nr_ports = %d", ports)
+	}
+	d.init(virtioConsoleFMultiport)
+	for range 7 {
+		h := d.nextDesc[virtioConsoleCtrlRx]
+		d.submit(virtioConsoleCtrlRx, vqBuf{0x5000 + uint32(h)*0x40, 0x40, true})
+	}
+
+	// Port 0 gets no input before the driver reports it ready.
+	d.submit(0, vqBuf{0x3000, 16, true})
+	if idx, _ := d.used(0); idx != 0 {
+		t.Fatalf("input delivered to a port that is not ready")
+	}
+
+	sendCtrl(d, 0, virtioConsoleDeviceReady, 1)
+	want := []ctrlMsg{{0, virtioConsoleDeviceAdd, 1, ""}, {1, virtioConsoleDeviceAdd, 1, ""}}
+	if got := ctrlMsgs(d, 0); !slices.Equal(got, want) {
+		t.Fatalf("after DEVICE_READY: %v", got)
+	}
+	sendCtrl(d, 0, virtioConsolePortReady, 1)
+	sendCtrl(d, 1, virtioConsolePortReady, 1)
+	want = []ctrlMsg{
+		{0, virtioConsoleConsolePort, 1, ""},
+		{0, virtioConsolePortOpen, 1, ""},
+		{1, virtioConsolePortName, 1, "ctl"},
+		{1, virtioConsolePortOpen, 1, ""},
+	}
+	if got := ctrlMsgs(d, 2); !slices.Equal(got, want) {
+		t.Fatalf("after PORT_READY: %v", got)
+	}
+
+	// The buffer posted earlier now holds port 0's input.
+	if idx, n := d.used(0); idx != 1 || string(d.peek(0x3000, n)) != "hi" {
+		t.Errorf("port 0 received %q", d.peek(0x3000, n))
+	}
+	d.submit(uint32(rxQueue(1)), vqBuf{0x3100, 16, true})
+	if _, n := d.used(uint32(rxQueue(1))); string(d.peek(0x3100, n)) != "go" {
+		t.Errorf("port 1 received %q", d.peek(0x3100, n))
+	}
+
+	// Each port's transmitq goes to its own host writer.
+	d.poke(0x3200, []byte("log"))
+	d.submit(1, vqBuf{0x3200, 3, false})
+	d.poke(0x3300, []byte("cmd"))
+	d.submit(uint32(rxQueue(1)+1), vqBuf{0x3300, 3, false})
+	if con.out.String() != "log" || ctl.out.String() != "cmd" {
+		t.Errorf("host saw %q and %q", con.out.String(), ctl.out.String())
+	}
+	if v.intStatus&virtioIntUsedBuffer == 0 {
+		t.Errorf("no used-buffer interrupt")
+	}
+}
+
+// Without MULTIPORT the device is a plain single-port console.
+func TestVirtioConsole_SinglePort(t *testing.T) {
+	r, w := io.Pipe()
+	var out bytes.Buffer
+	dev := NewVirtioConsole(ConsolePort{RW: struct {
+		io.Reader
+		io.Writer
+	}{r, &out}})
+	_, d := newTestVirtio(t, dev)
+	d.init(0)
+	d.submit(0, vqBuf{0x3000, 16, true})
+	if n, ok := dev.NextEvent(); !ok || n != uartPollCycles {
+		t.Errorf("NextEvent with live input = %d, %v", n, ok)
+	}
+	go w.Write([]byte("x"))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		dev.Advance(1)
+		if idx, _ := d.used(0); idx == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if idx, n := d.used(0); idx != 1 || string(d.peek(0x3000, n)) != "x" {
+		t.Errorf("received %q (used idx %d)", d.peek(0x3000, n), idx)
+	}
+	d.poke(0x3200, []byte("out"))
+	d.submit(1, vqBuf{0x3200, 3, false})
+	if out.String() != "out" {
+		t.Errorf("host saw %q", out.String())
+	}
+}
@@ -0,0 +1,151 @@
+package sim
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// virtio-net (virtio 1.x, section 5.1).
+const (
+	virtioNetID = 1
+
+	virtioNetFMAC    = 1 << 5
+	virtioNetFStatus = 1 << 16
+
+	virtioNetRx = 0
+	virtioNetTx = 1
+
+	virtioNetLinkUp = 1
+
+	// virtioNetHdrLen is sizeof(struct virtio_net_hdr) with VERSION_1,
+	// which prefixes every frame in both directions.
+	virtioNetHdrLen = 12
+
+	// netInboxFrames bounds frames waiting for receive buffers; more are
+	// dropped, as a NIC without free descriptors would.
+	netInboxFrames = 256
+)
+
+// DefaultMAC is the MAC address QEMU gives its first NIC.
+var DefaultMAC = [6]byte{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+
+// NetBackend is the host side of a VirtioNet: where the frames the guest
+// sends go, and where the frames it receives come from.
+type NetBackend interface {
+	// Attach is called once, by NewVirtioNet, with the function that
+	// queues a frame for the guest. receive may be called from any
+	// goroutine and does not keep the slice.
+	Attach(receive func(frame []byte))
+	// Transmit is called with every Ethernet frame the guest sends. The
+	// backend must not keep frame after returning.
+	Transmit(frame []byte)
+}
+
+// netSynchronous is implemented by backends that only deliver frames
+// from inside Transmit, so an idle guest need not poll them.
+type netSynchronous interface {
+	synchronous() bool
+}
+
+// VirtioNet is a virtio network card with one receive and one transmit
+// queue, a fixed MAC address and the link always up. No offloads are
+// offered, so frames pass through unchanged apart from the virtio-net
+// header; received frames that do not fit the guest's buffer are dropped.
+//
+// Register the device with CPU.AddClocked: frames from the backend are
+// handed to the guest as the hart runs.
+type VirtioNet struct {
+	v       *VirtioMMIO
+	mac     [6]byte
+	backend NetBackend
+
+	mu    sync.Mutex
+	inbox [][]byte // frames from the backend waiting for receive buffers
+}
+
+// NewVirtioNet returns a NIC with address mac attached to backend; a nil
+// backend drops every frame.
+func NewVirtioNet(mac [6]byte, backend NetBackend) *VirtioNet {
+	n := &VirtioNet{mac: mac, backend: backend}
+	if backend != nil {
+		backend.Attach(n.receive)
+	}
+	return n
+}
+
+func (n *VirtioNet) deviceID() uint32     { return virtioNetID }
+func (n *VirtioNet) features() uint64     { return virtioNetFMAC | virtioNetFStatus }
+func (n *VirtioNet) numQueues() int       { return 2 }
+func (n *VirtioNet) attach(v *VirtioMMIO) { n.v = v }
+
+// config is struct virtio_net_config up to the status field.
+func (n *VirtioNet) config() []byte {
+	return binary.LittleEndian.AppendUint16(n.mac[:], virtioNetLinkUp)
+}
+
+func (n *VirtioNet) reset() {
+	n.mu.Lock()
+	n.inbox = nil
+	n.mu.Unlock()
+}
+
+// receive queues a frame for the guest; see NetBackend.Attach.
+func (n *VirtioNet) receive(frame []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.inbox) < netInboxFrames {
+		n.inbox = append(n.inbox, append([]byte(nil), frame...))
+	}
+}
+
+func (n *VirtioNet) notify(q *virtqueue) {
+	if q.idx == virtioNetTx {
+		q.process(func(c *vqChain) uint32 {
+			p, ok := c.readable(n.v.bus)
+			if ok && len(p) >= virtioNetHdrLen && n.backend != nil {
+				n.backend.Transmit(p[virtioNetHdrLen:])
+			}
+			return 0
+		})
+	}
+	n.deliver() // a loopback backend answers at once
+}
+
+// deliver moves queued frames into the guest's receive buffers.
+func (n *VirtioNet) deliver() {
+	if n.v == nil {
+		return
+	}
+	q := n.v.queueAt(virtioNetRx)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for len(n.inbox) > 0 {
+		c, ok := q.pop()
+		if !ok {
+			return
+		}
+		frame := n.inbox[0]
+		n.inbox = n.inbox[1:]
+		if c.writableLen() < virtioNetHdrLen+uint32(len(frame)) {
+			q.push(c, 0) // too big for the buffer: dropped
+			continue
+		}
+		hdr := make([]byte, virtioNetHdrLen)
+		binary.LittleEndian.PutUint16(hdr[10:], 1) // num_buffers
+		w, _ := c.writeAt(n.v.bus, 0, append(hdr, frame...))
+		q.push(c, w)
+	}
+}
+
+// Advance implements Clocked.
+func (n *VirtioNet) Advance(uint64) { n.deliver() }
+
+// NextEvent implements Clocked: unless the backend only answers inside
+// Transmit, a waiting hart wakes up every uartPollCycles to look for
+// frames.
+func (n *VirtioNet) NextEvent() (uint64, bool) {
+	if s, ok := n.backend.(netSynchronous); n.backend == nil || ok && s.synchronous() {
+		return 0, false
+	}
+	return uartPollCycles, true
+}
@@ -0,0 +1,63 @@
+package sim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testFrame returns an Ethernet frame from src to dst with a payload.
+func testFrame(dst, src [6]byte, payload string) []byte {
+	f := append(dst[:], src[:]...)
+	f = binary.BigEndian.AppendUint16(f, 0x88B5) // local experimental EtherType
+	return append(f, payload...)
+}
+
+// sendFrame transmits frame from the driver's buffer at addr.
+func sendFrame(d *testDriver, addr uint32, frame []byte) {
+	d.poke(addr, append(make([]byte, virtioNetHdrLen), frame...))
+	d.submit(virtioNetTx, vqBuf{addr, uint32(virtioNetHdrLen + len(frame)), false})
+}
+
+// recvFrame returns the frame in the latest used receive buffer at addr.
+func recvFrame(d *testDriver, addr uint32) []byte {
+	idx, n := d.used(virtioNetRx)
+	if idx == 0 || n < virtioNetHdrLen {
+		return nil
+	}
+	return d.peek(addr+virtioNetHdrLen, n-virtioNetHdrLen)
+}
+
+func TestVirtioNet_Loopback(t *testing.T) {
+	mac := [6]byte{2, 0, 0, 0, 0, 1}
+	nic := NewVirtioNet(mac, &NetLoopback{})
+	_, d := newTestVirtio(t, nic)
+	if c, _ := d.bus.Read64(d.base + virtioConfig); c != 0x0001_0100_0000_0002 {
+		t.Errorf("config = 0x%016x, want MAC then link up", c)
+	}
+	d.init(virtioNetFMAC | virtioNetFStatus)
+	if _, ok := nic.NextEvent(); ok {
+		t.Errorf("loopback NIC asked to be polled")
+	}
+
+	frame := testFrame(mac, mac, "ping")
+	d.submit(virtioNetRx, vqBuf{0x3000, 1526, true})
+	sendFrame(d, 0x4000, frame)
+	if got := recvFrame(d, 0x3000); !bytes.Equal(got, frame) {
+		t.Fatalf("looped back % x", got)
+	}
+	if hdr := d.peek(0x3000, virtioNetHdrLen); binary.LittleEndian.Uint16(hdr[10:]) != 1 {
+		t.Errorf("num_buffers = %d", binary.LittleEndian.Uint16(hdr[10:]))
+	}
+
+	// A frame waits for a receive buffer, and one that does not fit is
+	// dropped.
+	sendFrame(d, 0x4000, frame)
+	if idx, _ := d.used(virtioNetRx); idx != 1 {
+		t.Fatalf("frame delivered without a buffer")
+	}
+	d.submit(virtioNetRx, vqBuf{0x3000, 8, true})
+	if idx, n := d.used(virtioNetRx); idx != 2 || n != 0 {
+		t.Errorf("oversized frame: used idx %d, len %d", idx, n)
+	}
+}
@@ -0,0 +1,34 @@
+package sim
+
+import "io"
+
+// virtio-rng (virtio 1.x, section 5.4).
+const (
+	virtioRNGID = 4
+
+	// virtioRNGMaxRequest caps the bytes produced for one buffer.
+	virtioRNGMaxRequest = 64 * 1024
+)
+
+// VirtioRNG is a virtio entropy device: it fills every buffer the driver
+// places on its single request queue with bytes from its source.
+type VirtioRNG struct {
+	src io.Reader
+}
+
+func NewVirtioRNG(src io.Reader) *VirtioRNG { return &VirtioRNG{src: src} }
+
+func (r *VirtioRNG) deviceID() uint32 { return virtioRNGID }
+func (r *VirtioRNG) features() uint64 { return 0 }
+func (r *VirtioRNG) numQueues() int   { return 1 }
+func (r *VirtioRNG) config() []byte   { return nil }
+func (r *VirtioRNG) reset()           {}
+
+func (r *VirtioRNG) notify(q *virtqueue) {
+	q.process(func(c *vqChain) uint32 {
+		p := make([]byte, min(c.writableLen(), virtioRNGMaxRequest))
+		k, _ := io.ReadFull(r.src, p)
+		n, _ := c.writeAt(q.t.bus, 0, p[:k])
+		return n
+	})
+}
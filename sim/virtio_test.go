@@ -0,0 +1,276 @@
+package sim
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// Guest memory layout used by testDriver: queue q's rings start at
+// q*vtQueueStride past the queue 0 addresses.
+const (
+	vtDesc        = 0x1000
+	vtAvail       = 0x1100
+	vtUsed        = 0x1200
+	vtQueueStride = 0x400
+	vtQueues      = 8
+	vtNum         = 8
+)
+
+// testDriver plays the guest driver of one virtio-mmio transport.
+type testDriver struct {
+	t        *testing.T
+	bus      *Bus
+	base     uint32
+	availIdx [vtQueues]uint16
+	nextDesc [vtQueues]uint16
+}
+
+func newTestVirtio(t *testing.T, dev virtioDevice) (*VirtioMMIO, *testDriver) {
+	t.Helper()
+	bus := NewBus(NewRAM(64*1024), NewUART(nil))
+	v := NewVirtioMMIO(bus, dev)
+	if err := bus.Map("virtio", VirtioBase, VirtioSize, v); err != nil {
+		t.Fatal(err)
+	}
+	return v, &testDriver{t: t, bus: bus, base: VirtioBase}
+}
+
+func (d *testDriver) reg(off uint32) uint32 {
+	v, ok := d.bus.Read32(d.base + off)
+	if !ok {
+		d.t.Fatalf("virtio register 0x%x not readable", off)
+	}
+	return v
+}
+
+func (d *testDriver) set(off, v uint32) {
+	if !d.bus.Write32(d.base+off, v) {
+		d.t.Fatalf("virtio register 0x%x not writable", off)
+	}
+}
+
+// init runs the driver initialisation sequence (virtio 1.x, 3.1.1),
+// accepting the given device features, and sets up every queue.
+func (d *testDriver) init(features uint64) {
+	d.t.Helper()
+	d.set(virtioStatus, 0)
+	d.set(virtioStatus, virtioStatusAcknowledge|virtioStatusDriver)
+	d.set(virtioDriverFeaturesSel, 0)
+	d.set(virtioDriverFeatures, uint32(features))
+	d.set(virtioDriverFeaturesSel, 1)
+	d.set(virtioDriverFeatures, uint32((features|virtioFVersion1)>>32))
+	d.set(virtioStatus, virtioStatusAcknowledge|virtioStatusDriver|virtioStatusFeaturesOK)
+	if d.reg(virtioStatus)&virtioStatusFeaturesOK == 0 {
+		d.t.Fatalf("features 0x%x not accepted", features)
+	}
+	for q := range uint32(vtQueues) {
+		d.set(virtioQueueSel, q)
+		if d.reg(virtioQueueNumMax) == 0 {
+			break
+		}
+		d.set(virtioQueueNum, vtNum)
+		d.set(virtioQueueDescLow, vtDesc+q*vtQueueStride)
+		d.set(virtioQueueDriverLow, vtAvail+q*vtQueueStride)
+		d.set(virtioQueueDeviceLow, vtUsed+q*vtQueueStride)
+		d.set(virtioQueueReady, 1)
+	}
+	d.set(virtioStatus, virtioStatusAcknowledge|virtioStatusDriver|virtioStatusFeaturesOK|virtioStatusDriverOK)
+	d.availIdx, d.nextDesc = [vtQueues]uint16{}, [vtQueues]uint16{}
+}
+
+// submit chains bufs through the next free descriptors of queue q, makes
+// the chain available and notifies the device.
+func (d *testDriver) submit(q uint32, bufs ...vqBuf) {
+	head := d.nextDesc[q]
+	for i, b := range bufs {
+		idx := (head + uint16(i)) % vtNum
+		desc := vtDesc + q*vtQueueStride + uint32(idx)*vringDescSize
+		var flags uint16
+		if b.write {
+			flags |= vringDescWrite
+		}
+		if i < len(bufs)-1 {
+			flags |= vringDescNext
+		}
+		d.bus.Write64(desc, uint64(b.addr))
+		d.bus.Write32(desc+8, b.len)
+		d.bus.Write16(desc+12, flags)
+		d.bus.Write16(desc+14, (idx+1)%vtNum)
+	}
+	d.nextDesc[q] = (head + uint16(len(bufs))) % vtNum
+	avail := vtAvail + q*vtQueueStride
+	d.bus.Write16(avail+4+2*uint32(d.availIdx[q]%vtNum), head)
+	d.availIdx[q]++
+	d.bus.Write16(avail+2, d.availIdx[q])
+	d.set(virtioQueueNotify, q)
+}
+
+// used returns queue q's used ring index and the length of its latest
+// entry.
+func (d *testDriver) used(q uint32) (idx uint16, n uint32) {
+	used := vtUsed + q*vtQueueStride
+	idx, _ = d.bus.Read16(used + 2)
+	if idx > 0 {
+		n, _ = d.bus.Read32(used + 4 + 8*uint32((idx-1)%vtNum) + 4)
+	}
+	return idx, n
+}
+
+func (d *testDriver) poke(addr uint32, p []byte) { dmaWrite(d.bus, addr, p) }
+
+func (d *testDriver) peek(addr, n uint32) []byte {
+	p := make([]byte, n)
+	dmaRead(d.bus, addr, p)
+	return p
+}
+
+func TestVirtio_Registers(t *testing.T) {
+	blk := newTestBlk(t, 8, DiskReadOnly)
+	_, d := newTestVirtio(t, blk)
+
+	for _, r := range []struct{ off, want uint32 }{
+		{virtioMagicValue, virtioMagic},
+		{virtioVersion, 2},
+		{virtioDeviceID, virtioBlkID},
+		{virtioVendorID, virtioVendor},
+	} {
+		if v := d.reg(r.off); v != r.want {
+			t.Errorf("register 0x%03x = 0x%x, want 0x%x", r.off, v, r.want)
+		}
+	}
+	d.set(virtioDeviceFeaturesSel, 0)
+	if f := d.reg(virtioDeviceFeatures); f != virtioBlkFRO|virtioBlkFFlush {
+		t.Errorf("features[0] = 0x%x", f)
+	}
+	d.set(virtioDeviceFeaturesSel, 1)
+	if f := d.reg(virtioDeviceFeatures); f != 1 {
+		t.Errorf("features[1] = 0x%x, want VERSION_1", f)
+	}
+	if _, ok := d.bus.Read8(d.base + virtioMagicValue); ok {
+		t.Errorf("byte access to a register succeeded")
+	}
+	if c, ok := d.bus.Read64(d.base + virtioConfig); !ok || c != 8 {
+		t.Errorf("capacity = (%d, %v), want 8 sectors", c, ok)
+	}
+	if c, _ := d.bus.Read32(d.base + virtioConfig + 4); c != 0 {
+		t.Errorf("capacity high word = %d", c)
+	}
+}
+
+func TestVirtio_FeatureNegotiation(t *testing.T) {
+	_, d := newTestVirtio(t, newTestBlk(t, 8, DiskReadWrite))
+	accept := func(lo, hi uint32) bool {
+		d.set(virtioStatus, 0)
+		d.set(virtioStatus, virtioStatusAcknowledge|virtioStatusDriver)
+		d.set(virtioDriverFeaturesSel, 0)
+		d.set(virtioDriverFeatures, lo)
+		d.set(virtioDriverFeaturesSel, 1)
+		d.set(virtioDriverFeatures, hi)
+		d.set(virtioStatus, virtioStatusAcknowledge|virtioStatusDriver|virtioStatusFeaturesOK)
+		return d.reg(virtioStatus)&virtioStatusFeaturesOK != 0
+	}
+	if accept(virtioBlkFFlush, 0) {
+		t.Errorf("FEATURES_OK without VERSION_1")
+	}
+	if accept(virtioBlkFRO, 1) {
+		t.Errorf("FEATURES_OK with a feature the device does not offer")
+	}
+	if !accept(virtioBlkFFlush, 1) {
+		t.Errorf("valid feature set rejected")
+	}
+}
+
+func TestVirtio_BrokenChainNeedsReset(t *testing.T) {
+	v, d := newTestVirtio(t, newTestBlk(t, 8, DiskReadWrite))
+	d.init(0)
+	// A chain that loops back on itself.
+	d.bus.Write64(vtDesc, 0x3000)
+	d.bus.Write32(vtDesc+8, 16)
+	d.bus.Write16(vtDesc+12, vringDescNext)
+	d.bus.Write16(vtDesc+14, 0)
+	d.bus.Write16(vtAvail+2, 1)
+	d.set(virtioQueueNotify, 0)
+	if d.reg(virtioStatus)&virtioStatusNeedsReset == 0 || d.reg(virtioInterruptStatus)&virtioIntConfig == 0 {
+		t.Fatalf("broken chain not reported")
+	}
+	d.set(virtioStatus, 0)
+	if d.reg(virtioStatus) != 0 || d.reg(virtioInterruptStatus) != 0 || d.reg(virtioQueueReady) != 0 {
+		t.Errorf("reset left state behind")
+	}
+	if v.queues[0].lastAvail != 0 {
+		t.Errorf("reset kept the queue position")
+	}
+}
+
+func TestVirtio_UnwritableUsedRing(t *testing.T) {
+	v, d := newTestVirtio(t, newTestBlk(t, 8, DiskReadWrite))
+	d.init(0)
+	d.set(virtioQueueSel, 0)
+	d.set(virtioQueueDeviceLow, 0x2000_0000) // nothing mapped there
+	flush := binary.LittleEndian.AppendUint32(nil, virtioBlkTFlush)
+	d.poke(0x3000, append(flush, make([]byte, 12)...))
+	d.submit(0, vqBuf{0x3000, 16, false}, vqBuf{0x3100, 1, true})
+	if d.reg(virtioStatus)&virtioStatusNeedsReset == 0 {
+		t.Errorf("unwritable used ring not reported")
+	}
+	if v.queues[0].usedIdx != 0 || d.reg(virtioInterruptStatus)&virtioIntUsedBuffer != 0 {
+		t.Errorf("chain reported as used")
+	}
+}
+
+// Buffer lengths come from the guest: oversized ones are refused before
+// the device allocates anything for them.
+func TestVirtio_OversizedDescriptor(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		bufs []vqBuf
+	}{
+		{"unmapped", []vqBuf{{0, 0xFFFF0000, true}}},
+		{"past the end of RAM", []vqBuf{{0xF000, 0x2000, false}, {0x3100, 1, true}}},
+		{"chain too long", []vqBuf{{0x8000_0000, virtioChainMax, false}, {0x3100, 1, true}}},
+	} {
+		_, d := newTestVirtio(t, newTestBlk(t, 8, DiskReadWrite))
+		d.bus.Map("mmio", 0x8000_0000, 2*virtioChainMax, &regDev{})
+		d.init(0)
+		d.submit(0, tc.bufs...)
+		if d.reg(virtioStatus)&virtioStatusNeedsReset == 0 {
+			t.Errorf("%s: not reported", tc.name)
+		}
+		if idx, _ := d.used(0); idx != 0 {
+			t.Errorf("%s: chain was processed", tc.name)
+		}
+	}
+}
+
+func TestVirtio_Interrupts(t *testing.T) {
+	v, d := newTestVirtio(t, newTestBlk(t, 8, DiskReadWrite))
+	cpu := NewCPU(d.bus)
+	plic := NewPLIC(31, cpu)
+	d.bus.Map("plic", PLICBase, PLICSize, plic)
+	v.IRQ = plic.Line(VirtioIRQ)
+	d.bus.Write32(PLICBase+VirtioIRQ*4, 1)
+	d.bus.Write32(PLICBase+plicEnable, 1<<VirtioIRQ)
+	d.init(0)
+
+	flush := binary.LittleEndian.AppendUint32(nil, virtioBlkTFlush)
+	d.poke(0x3000, append(flush, make([]byte, 12)...))
+	d.submit(0, vqBuf{0x3000, 16, false}, vqBuf{0x3100, 1, true})
+	if d.reg(virtioInterruptStatus) != virtioIntUsedBuffer || csr(t, cpu, CSRMip)&mipMEIP == 0 {
+		t.Fatalf("completion interrupt not raised")
+	}
+	d.set(virtioInterruptACK, virtioIntUsedBuffer)
+	if id, _ := d.bus.Read32(plicCtx(0, 4)); id != VirtioIRQ {
+		t.Errorf("claimed source %d", id)
+	}
+	d.bus.Write32(plicCtx(0, 4), VirtioIRQ)
+	if csr(t, cpu, CSRMip)&mipMEIP != 0 {
+		t.Errorf("interrupt still raised after ACK and complete")
+	}
+
+	// VRING_AVAIL_F_NO_INTERRUPT suppresses the interrupt, not the work.
+	d.bus.Write16(vtAvail, vringAvailNoInt)
+	d.submit(0, vqBuf{0x3000, 16, false}, vqBuf{0x3100, 1, true})
+	if idx, _ := d.used(0); idx != 2 || d.reg(virtioInterruptStatus) != 0 {
+		t.Errorf("used idx %d, interrupt status 0x%x", idx, d.reg(virtioInterruptStatus))
+	}
+}